@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"webshell/store"
+
+	"github.com/coder/websocket"
+)
+
+// AdminHandler lets operators see and control every session on the server.
+// It uses its own credential, separate from the token used to reach the shell.
+type AdminHandler struct {
+	token    string
+	basePath string
+	sessions *SessionManager
+	store    *store.Store // Audit events, nil when the store isn't enabled
+}
+
+type adminPageParams struct {
+	BasePath  string
+	SessionId string
+}
+
+func (a AdminHandler) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin", a.dashboard)
+	mux.HandleFunc("GET /admin/sessions/{id}/shadow", a.shadowPage)
+	mux.HandleFunc("GET /admin/api/sessions", a.list)
+	mux.HandleFunc("GET /admin/api/sessions/{id}", a.inspect)
+	mux.HandleFunc("GET /admin/api/sessions/{id}/summary", a.summary)
+	mux.HandleFunc("POST /admin/api/sessions/{id}/terminate", a.terminate)
+	mux.HandleFunc("GET /admin/api/sessions/{id}/shadow", a.shadow)
+	mux.HandleFunc("POST /admin/api/broadcast", a.broadcast)
+	mux.HandleFunc("GET /admin/api/audit/events", a.auditEvents)
+	mux.HandleFunc("GET /admin/api/audit/sessions", a.auditSessions)
+	return a.requireAdmin(mux)
+}
+
+// Accepts the admin token as either a bearer token or the password of basic
+// auth. Browsers send basic auth with any request to the server, including
+// ones another site makes them send, so with it only the dashboard's own
+// pages can make changes.
+func (a AdminHandler) requireAdmin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		_, password, basic := r.BasicAuth()
+		if basic {
+			provided = password
+		}
+
+		if a.token == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(a.token)) != 1 {
+			logger.Warn(fmt.Sprintf("Unauthorized admin request from %s", remoteIP(r)))
+			w.Header().Set("WWW-Authenticate", `Basic realm="webshell admin"`)
+			http.Error(w, "Access Denied", http.StatusUnauthorized)
+			return
+		}
+		if basic && r.Method != http.MethodGet && r.Method != http.MethodHead && !sameOrigin(r) {
+			logger.Warn(fmt.Sprintf("Cross-site admin request from %s", remoteIP(r)))
+			http.Error(w, "Cross-site requests are not allowed", http.StatusForbidden)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Returns whether the request was made by a page of this server, from the
+// Origin browsers send with every request that isn't a GET or HEAD.
+func sameOrigin(r *http.Request) bool {
+	origin, err := url.Parse(r.Header.Get("Origin"))
+	return err == nil && origin.Host != "" && origin.Host == r.Host
+}
+
+// Records an admin action in the audit log.
+func (a AdminHandler) audit(r *http.Request, action string, attrs ...any) {
+	attrs = append(attrs,
+		slog.String("event.action", action),
+		slog.Any("event.category", []string{"iam"}),
+		slog.String("source.ip", remoteIP(r)),
+	)
+	auditLogger.Info("Admin: "+action, attrs...)
+}
+
+func (a AdminHandler) dashboard(w http.ResponseWriter, r *http.Request) {
+	a.audit(r, "view-dashboard")
+	a.render(w, adminTemplate, adminPageParams{BasePath: a.basePath})
+}
+
+func (a AdminHandler) shadowPage(w http.ResponseWriter, r *http.Request) {
+	a.render(w, shadowTemplate, adminPageParams{BasePath: a.basePath, SessionId: r.PathValue("id")})
+}
+
+func (a AdminHandler) render(w http.ResponseWriter, tmpl *template.Template, params adminPageParams) {
+	if err := tmpl.Execute(w, params); err != nil {
+		logger.Error(fmt.Sprintf("%s", err))
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (a AdminHandler) list(w http.ResponseWriter, r *http.Request) {
+	a.audit(r, "list-sessions")
+	infos := []SessionInfo{}
+	for _, s := range a.sessions.List("") {
+		infos = append(infos, s.Info())
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (a AdminHandler) inspect(w http.ResponseWriter, r *http.Request) {
+	session, ok := a.lookup(w, r)
+	if !ok {
+		return
+	}
+	a.audit(r, "inspect-session", slog.String("session.id", session.ID))
+	writeJSON(w, http.StatusOK, session.Info())
+}
+
+func (a AdminHandler) summary(w http.ResponseWriter, r *http.Request) {
+	session, ok := a.lookup(w, r)
+	if !ok {
+		return
+	}
+	a.audit(r, "inspect-session-summary", slog.String("session.id", session.ID))
+	writeJSON(w, http.StatusOK, session.Summary())
+}
+
+func (a AdminHandler) terminate(w http.ResponseWriter, r *http.Request) {
+	session, ok := a.lookup(w, r)
+	if !ok {
+		return
+	}
+
+	a.audit(r, "terminate-session", slog.String("session.id", session.ID))
+	session.Close("Session terminated by an administrator")
+	writeJSON(w, http.StatusOK, session.Info())
+}
+
+// Writes a message into every attached terminal.
+func (a AdminHandler) broadcast(w http.ResponseWriter, r *http.Request) {
+	message := strings.TrimSpace(r.FormValue("message"))
+	if message == "" {
+		http.Error(w, "Message is required", http.StatusBadRequest)
+		return
+	}
+
+	count := 0
+	for _, s := range a.sessions.List("") {
+		if s.State() == StateAttached {
+			s.Notify(message)
+			count++
+		}
+	}
+
+	a.audit(r, "broadcast", slog.String("message", message), slog.Int("sessions", count))
+	writeJSON(w, http.StatusOK, map[string]int{"sessions": count})
+}
+
+// Streams a session's output to an admin's read-only terminal.
+func (a AdminHandler) shadow(w http.ResponseWriter, r *http.Request) {
+	session, ok := a.lookup(w, r)
+	if !ok {
+		return
+	}
+
+	ws, err := websocket.Accept(w, r, &websocket.AcceptOptions{Subprotocols: supportedProtocols})
+	if err != nil {
+		logger.Error(err.Error())
+		return
+	}
+	defer ws.CloseNow()
+	conn := NewTerminalConn(ws)
+
+	a.audit(r, "shadow-session", slog.String("session.id", session.ID))
+	session.Notify("An administrator is viewing this session")
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	if err := session.Shadow(ctx, conn); err != nil {
+		logger.Warn(fmt.Sprintf("Unable to shadow session %s: %s", session.ID, err))
+		conn.Close(websocket.StatusNormalClosure, "Session Ended")
+		return
+	}
+	defer session.Unshadow(conn)
+
+	// Input from shadows is discarded, read until the connection closes.
+	for {
+		_, msg, err := conn.Read(ctx)
+		if errors.Is(err, errInvalidControl) {
+			continue
+		}
+		if err != nil {
+			break
+		}
+		if msg != nil && msg.Type == MsgPing && !conn.legacy {
+			conn.WriteControl(ctx, ControlMessage{Type: MsgPong})
+		}
+	}
+
+	a.audit(r, "unshadow-session", slog.String("session.id", session.ID))
+	session.Notify("An administrator has stopped viewing this session")
+}
+
+// Searches the audit store for events.
+func (a AdminHandler) auditEvents(w http.ResponseWriter, r *http.Request) {
+	q, ok := a.auditQuery(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, a.store.Events(q))
+}
+
+// Searches the audit store for sessions with matching events.
+func (a AdminHandler) auditSessions(w http.ResponseWriter, r *http.Request) {
+	q, ok := a.auditQuery(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, a.store.Sessions(q))
+}
+
+// Reads a query of the audit store from the request's parameters, and audits it.
+func (a AdminHandler) auditQuery(w http.ResponseWriter, r *http.Request) (store.Query, bool) {
+	if a.store == nil {
+		http.Error(w, "Audit store not enabled", http.StatusNotFound)
+		return store.Query{}, false
+	}
+
+	params := r.URL.Query()
+	q := store.Query{
+		Session: params.Get("session"),
+		User:    params.Get("user"),
+		Kind:    params.Get("kind"),
+		Action:  params.Get("action"),
+		Command: params.Get("command"),
+	}
+	var err error
+	if limit := params.Get("limit"); limit != "" {
+		if q.Limit, err = strconv.Atoi(limit); err != nil {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return store.Query{}, false
+		}
+	}
+	if q, err = withTimes(q, params.Get("since"), params.Get("until")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return store.Query{}, false
+	}
+
+	a.audit(r, "query-audit", slog.String("url.query", r.URL.RawQuery))
+	return q, true
+}
+
+func (a AdminHandler) lookup(w http.ResponseWriter, r *http.Request) (*Session, bool) {
+	session, found := a.sessions.Get(r.PathValue("id"))
+	if !found {
+		http.Error(w, "Session Not Found", http.StatusNotFound)
+		return nil, false
+	}
+	return session, true
+}
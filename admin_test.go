@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"webshell/logging"
+)
+
+// Changes made with basic auth, which browsers send for any site, have to
+// come from the dashboard itself. A bearer token can only be sent on purpose.
+func TestAdminCrossSite(t *testing.T) {
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	auditLogger = slog.New(logging.NewHandler(&bytes.Buffer{}, "session", new(slog.LevelVar)))
+	admin := AdminHandler{token: "secret", sessions: NewSessionManager()}.Handler()
+
+	tests := []struct {
+		name   string
+		method string
+		auth   func(r *http.Request)
+		origin string
+		want   int
+	}{
+		{"basic, same origin", "POST", func(r *http.Request) { r.SetBasicAuth("admin", "secret") }, "http://example.com", http.StatusOK},
+		{"basic, cross site", "POST", func(r *http.Request) { r.SetBasicAuth("admin", "secret") }, "https://attacker.example", http.StatusForbidden},
+		{"basic, no origin", "POST", func(r *http.Request) { r.SetBasicAuth("admin", "secret") }, "", http.StatusForbidden},
+		{"basic, read", "GET", func(r *http.Request) { r.SetBasicAuth("admin", "secret") }, "https://attacker.example", http.StatusOK},
+		{"bearer", "POST", func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") }, "", http.StatusOK},
+	}
+	for _, test := range tests {
+		path := "/admin/api/broadcast"
+		if test.method == "GET" {
+			path = "/admin/api/sessions"
+		}
+		r := httptest.NewRequest(test.method, path, strings.NewReader("message=hello"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		test.auth(r)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("%s: want %d got %d", test.name, test.want, w.Code)
+		}
+	}
+}
+
+// Reads of sessions are audited as well as changes.
+func TestAdminAuditsReads(t *testing.T) {
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	audit := &bytes.Buffer{}
+	auditLogger = slog.New(logging.NewHandler(audit, "session", new(slog.LevelVar)))
+	admin := AdminHandler{token: "secret", sessions: NewSessionManager()}.Handler()
+
+	r := httptest.NewRequest("GET", "/admin/api/sessions", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	admin.ServeHTTP(httptest.NewRecorder(), r)
+	if !strings.Contains(audit.String(), `"event.action":"list-sessions"`) {
+		t.Errorf("listing sessions wasn't audited: %s", audit)
+	}
+}
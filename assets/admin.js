@@ -0,0 +1,71 @@
+function formatDuration(seconds) {
+    seconds = Math.floor(seconds)
+    const hours = String(Math.floor(seconds / 3600)).padStart(2, '0')
+    const minutes = String(Math.floor((seconds % 3600) / 60)).padStart(2, '0')
+    const secs = String(seconds % 60).padStart(2, '0')
+    return `${hours}:${minutes}:${secs}`
+}
+
+function cell(row, text) {
+    const td = document.createElement("td")
+    td.textContent = text
+    row.appendChild(td)
+    return td
+}
+
+async function refreshSessions(adminPath) {
+    const res = await fetch(adminPath + "/api/sessions")
+    if (!res.ok) {
+        return
+    }
+    const sessions = await res.json()
+    const body = document.querySelector("#sessions tbody")
+    body.replaceChildren()
+
+    for (const s of sessions) {
+        const row = document.createElement("tr")
+        cell(row, s.id.substring(0, 12))
+        cell(row, s.user)
+        cell(row, s.client_ip)
+        cell(row, s.state + (s.shadowed ? " (shadowed)" : ""))
+        cell(row, formatDuration(s.duration_seconds))
+        cell(row, s.bytes_in)
+        cell(row, s.bytes_out)
+        cell(row, s.command || "")
+
+        const actions = cell(row, "")
+        if (s.state !== "ended") {
+            const shadow = document.createElement("a")
+            shadow.href = adminPath + "/sessions/" + s.id + "/shadow"
+            shadow.target = "_blank"
+            shadow.textContent = "shadow"
+            actions.appendChild(shadow)
+
+            const terminate = document.createElement("button")
+            terminate.textContent = "terminate"
+            terminate.addEventListener("click", async function () {
+                if (confirm("Terminate session " + s.id.substring(0, 12) + "?")) {
+                    await fetch(adminPath + "/api/sessions/" + s.id + "/terminate", {method: "POST"})
+                    refreshSessions(adminPath)
+                }
+            })
+            actions.appendChild(terminate)
+        }
+        body.appendChild(row)
+    }
+}
+
+function initAdmin(adminPath) {
+    refreshSessions(adminPath)
+    setInterval(() => refreshSessions(adminPath), 5000)
+
+    const form = document.getElementById("broadcast")
+    form.addEventListener("submit", async function (event) {
+        event.preventDefault()
+        const res = await fetch(adminPath + "/api/broadcast", {method: "POST", body: new URLSearchParams(new FormData(form))})
+        document.getElementById("error").textContent = res.ok ? "" : await res.text()
+        if (res.ok) {
+            form.reset()
+        }
+    })
+}
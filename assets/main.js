@@ -22,70 +22,377 @@ function debounce(func, timeout = 300) {
 
 function reloadFiles() {
     const frame = document.getElementById("file-frame")
-    frame.src = frame.src
+    if (frame.getAttribute("src")) {
+        frame.src = frame.src
+    }
 }
 
-function init(shellPath) {
-    terminal = new Terminal(terminalConfig)
+const encoder = new TextEncoder()
+
+// Websocket protocol, binary messages are terminal data and text messages are JSON control frames.
+const PROTOCOL = "webshell.v1"
+
+// Close code the server uses when the session has been attached by another connection.
+const ATTACHED_ELSEWHERE = 4001
+
+// A ShellTab is a terminal attached to one session on the server. If the
+// connection drops it reconnects and resumes from the last byte it received.
+class ShellTab {
+    constructor(shellPath, element, sessionId, shellName) {
+        this.shellPath = shellPath
+        this.shellName = shellName || ""
+        this.element = element
+        this.session = {
+            id: sessionId || "",
+            offset: 0,
+            ended: false,
+        }
+        this.retries = 0
+        this.onSession = function () {}
+        this.onTitle = function () {}
+        this.onEnded = function () {}
+
+        this.terminal = new Terminal(terminalConfig)
+        this.fitAddon = new FitAddon.FitAddon()
+        this.terminal.loadAddon(this.fitAddon)
+        this.terminal.open(element)
+        this.terminal._initialized = true
+
+        // make the background match the terminal's background
+        if (terminalConfig.theme?.background) {
+            element.style.background = terminalConfig.theme.background
+        }
+
+        this.terminal.onData((data) => this.send(data))
+        this.terminal.onBinary((data) => {
+            const buffer = new Uint8Array(data.length)
+            for (let i = 0; i < data.length; ++i) {
+                buffer[i] = data.charCodeAt(i) & 255
+            }
+            this.send(buffer)
+        })
+        this.terminal.onResize(debounce(() => this.sendSize()))
 
-    // make the background match the terminal's background
-    if (terminalConfig.theme?.background) {
-        document.getElementById('terminal').style.background = terminalConfig.theme.background
+        this.connect()
     }
 
-    const protocol = (location.protocol === "https:") ? "wss://" : "ws://"
-    const url = protocol + location.host + shellPath
-    ws = new WebSocket(url)
-    const attachAddon = new AttachAddon.AttachAddon(ws)
-    const fitAddon = new FitAddon.FitAddon()
+    url() {
+        const protocol = (location.protocol === "https:") ? "wss://" : "ws://"
+        let url = protocol + location.host + this.shellPath
+        if (this.session.id) {
+            url += "?session=" + encodeURIComponent(this.session.id) + "&offset=" + this.session.offset
+        } else if (this.shellName) {
+            url += "?shell=" + encodeURIComponent(this.shellName)
+        }
+        return url
+    }
+
+    legacy() {
+        return this.ws.protocol !== PROTOCOL
+    }
 
-    terminal.loadAddon(attachAddon)
-    terminal.loadAddon(fitAddon)
-    terminal.open(document.getElementById("terminal"))
-    terminal._initialized = true
+    send(data) {
+        if (this.ws && this.ws.readyState === 1) {
+            this.ws.send(typeof data === "string" ? encoder.encode(data) : data)
+        }
+    }
 
-    function ping() {
+    // Sends a control message, falling back to the legacy format if the server doesn't support the protocol.
+    control(msg) {
+        if (!this.ws || this.ws.readyState !== 1) {
+            return
+        }
+        if (!this.legacy()) {
+            this.ws.send(JSON.stringify(msg))
+        } else if (msg.type === "ping") {
+            this.send("\x01PING")
+        } else if (msg.type === "resize") {
+            this.send("\x01SIZE " + msg.cols + " " + (msg.rows + 1))
+        }
+    }
+
+    sendSize() {
+        console.log(`resizing col:${this.terminal.cols} row:${this.terminal.rows}`)
+        this.control({type: "resize", cols: this.terminal.cols, rows: this.terminal.rows})
+    }
+
+    ping() {
         try {
-            if (ws && ws.readyState === 1) {
-                const msg = new TextEncoder().encode("\x01PING")
-                ws.send(msg);
-            }
+            this.control({type: "ping"})
         } catch (e) {
             console.error("ping failed")
         }
-        setTimeout(ping, 5000);
     }
 
-    ws.onclose = function () {
-        terminal.write('\r\n\nTerminal connection closed\r\n')
+    fit() {
+        this.fitAddon.fit()
+    }
+
+    focus() {
+        this.terminal.focus()
+    }
+
+    // Handles control messages sent by the server.
+    handleControl(msg) {
+        switch (msg.type) {
+            case "session":
+                this.session.id = msg.session
+                this.session.offset = msg.offset || 0
+                this.onSession(this.session.id)
+                break
+            case "title":
+                this.onTitle(msg.title)
+                break
+            case "notification":
+                this.terminal.write(`\r\n\x1b[1m*** ${msg.message} ***\x1b[0m\r\n`)
+                break
+            case "error":
+                console.error("server error: " + msg.message)
+                break
+        }
+    }
+
+    // Handles the special payloads sent by servers using the legacy protocol, these are prefixed with \x01.
+    handleSpecial(payload) {
+        const fields = payload.trim().split(/\s+/)
+        if (fields[0] === "SESSION" && fields.length === 3) {
+            this.handleControl({type: "session", session: fields[1], offset: parseInt(fields[2], 10)})
+        }
+    }
+
+    connect() {
+        const ws = new WebSocket(this.url(), [PROTOCOL])
+        ws.binaryType = "arraybuffer"
+        this.ws = ws
+
+        ws.onmessage = (event) => {
+            if (typeof event.data === "string") {
+                if (!this.legacy()) {
+                    try {
+                        this.handleControl(JSON.parse(event.data))
+                    } catch (e) {
+                        console.error("invalid control message", e)
+                    }
+                } else if (event.data[0] === "\x01") {
+                    this.handleSpecial(event.data.substring(1))
+                } else {
+                    this.terminal.write(event.data)
+                }
+                return
+            }
+            const data = new Uint8Array(event.data)
+            this.session.offset += data.length
+            this.terminal.write(data)
+        }
+
+        ws.onopen = () => {
+            this.retries = 0
+            this.terminal.focus()
+            setTimeout(() => {
+                this.fit()
+                this.sendSize()
+            })
+        }
+
+        ws.onclose = (event) => {
+            if (this.closed) {
+                return
+            }
+
+            // A normal closure means the shell has ended, anything else we try to reattach.
+            if (event.code === 1000 || !this.session.id) {
+                this.session.ended = true
+                this.terminal.write('\r\n\nTerminal connection closed\r\n')
+                this.onEnded()
+                return
+            }
+
+            // Reconnecting would take the session back, so leave it to the user.
+            if (event.code === ATTACHED_ELSEWHERE) {
+                this.terminal.write('\r\n\nSession attached in another window\r\n')
+                this.showReattach()
+                return
+            }
+
+            const delay = Math.min(30000, 1000 * 2 ** this.retries)
+            this.retries++
+            this.terminal.write(`\r\n\nConnection lost, reconnecting in ${delay / 1000}s...\r\n`)
+            setTimeout(() => this.connect(), delay)
+        }
     }
 
-    ws.onopen = function () {
-        terminal.focus()
-        setTimeout(function () {
-            fitAddon.fit()
+    // Shows a button to take the session back from wherever it was attached.
+    showReattach() {
+        const button = document.createElement("button")
+        button.className = "reattach"
+        button.textContent = "Reattach"
+        button.addEventListener("click", () => {
+            button.remove()
+            this.retries = 0
+            this.connect()
         })
+        this.element.appendChild(button)
+    }
+
+    close() {
+        this.closed = true
+        this.ws.close()
+        this.terminal.dispose()
+        this.element.remove()
+    }
+}
 
-        terminal.onResize(debounce(function (event) {
-            const rows = event.rows
-            const cols = event.cols
+let tabs = []
+let activeTab
 
-            console.log(`resizing col:${cols} row:${rows}`)
-            const msg = new TextEncoder().encode("\x01SIZE " + cols + " " + (rows + 1))
-            ws.send(msg)
-        }))
+// Set when each session has its own home, the files tab then follows the active shell.
+let sessionFilesPath = ""
 
-        ping()
+function showSessionFiles(tab) {
+    if (!sessionFilesPath || !tab.session.id) {
+        return
+    }
+    const frame = document.getElementById("file-frame")
+    const src = sessionFilesPath + "/" + encodeURIComponent(tab.session.id) + "/home"
+    if (frame.getAttribute("src") !== src) {
+        frame.src = src
+    }
+}
 
-        window.onresize = debounce(function () {
-            fitAddon.fit()
+function activateTab(tab) {
+    activeTab = tab
+    terminal = tab.terminal
+    ws = tab.ws
+    for (const t of tabs) {
+        t.element.classList.toggle("active", t === tab)
+        t.label.classList.toggle("active", t === tab)
+    }
+    tab.fit()
+    tab.focus()
+    showSessionFiles(tab)
+}
+
+// Opens a new terminal tab, either attaching to an existing session or starting a new one.
+function openTab(shellPath, sessionsPath, sessionId, shellName) {
+    const element = document.createElement("div")
+    element.className = "terminal"
+    document.getElementById("terminals").appendChild(element)
+
+    const label = document.createElement("span")
+    label.className = "shell-tab"
+    label.textContent = (shellName || "Shell") + " " + (tabs.length + 1)
+
+    const closeButton = document.createElement("button")
+    closeButton.className = "shell-tab-close"
+    closeButton.textContent = "×"
+    closeButton.title = "Close shell"
+    label.appendChild(closeButton)
+
+    const newButton = document.getElementById("new-shell")
+    newButton.parentNode.insertBefore(label, newButton)
+
+    const tab = new ShellTab(shellPath, element, sessionId, shellName)
+    tab.label = label
+    tabs.push(tab)
+
+    tab.onSession = function () {
+        if (tab === activeTab) {
+            ws = tab.ws
+            showSessionFiles(tab)
+        }
+    }
+
+    tab.onTitle = function (title) {
+        label.firstChild.textContent = title + " " + (tabs.indexOf(tab) + 1)
+    }
+
+    label.addEventListener("click", function () {
+        activateTab(tab)
+    })
+
+    closeButton.addEventListener("click", function (event) {
+        event.stopPropagation()
+        if (tab.session.id && !tab.session.ended) {
+            fetch(sessionsPath + "/" + encodeURIComponent(tab.session.id), {method: "DELETE"})
+        }
+        tab.close()
+        label.remove()
+        tabs = tabs.filter((t) => t !== tab)
+        if (tabs.length === 0) {
+            openTab(shellPath, sessionsPath)
+        } else if (tab === activeTab) {
+            activateTab(tabs[tabs.length - 1])
+        }
+    })
+
+    activateTab(tab)
+    return tab
+}
+
+// Sets up the tabbed terminal page. Any sessions this browser still has running are reopened.
+async function initTabs(shellPath, sessionsPath, sessionHomes) {
+    if (sessionHomes) {
+        sessionFilesPath = sessionsPath
+    }
+
+    document.getElementById("new-shell").addEventListener("click", function () {
+        const choice = document.getElementById("shell-choice")
+        openTab(shellPath, sessionsPath, "", choice ? choice.value : "")
+    })
+
+    // Signals are sent to whatever is running in the foreground of the active shell.
+    document.querySelectorAll("[data-signal]").forEach(function (button) {
+        button.addEventListener("click", function () {
+            activeTab?.control({type: "signal", signal: button.dataset.signal})
+            activeTab?.focus()
         })
+    })
+
+    let existing = []
+    try {
+        const res = await fetch(sessionsPath)
+        if (res.ok) {
+            existing = (await res.json()).filter((s) => s.state !== "ended")
+        }
+    } catch (e) {
+        console.error("failed to list sessions", e)
+    }
 
+    for (const s of existing) {
+        openTab(shellPath, sessionsPath, s.id)
+    }
+    if (tabs.length === 0) {
+        openTab(shellPath, sessionsPath)
     }
 
+    setInterval(function () {
+        tabs.forEach((t) => t.ping())
+    }, 5000)
+
+    window.onresize = debounce(function () {
+        activeTab?.fit()
+    })
+
     const fileTab = document.getElementById('tab-2')
     if(fileTab) {
         fileTab.addEventListener('change', reloadFiles)
     }
+
+    const termTab = document.getElementById('tab-1')
+    if(termTab) {
+        termTab.addEventListener('change', () => activeTab?.fit())
+    }
 }
 
+// Sets up a page with a single terminal.
+function init(shellPath) {
+    const tab = new ShellTab(shellPath, document.getElementById("terminal"))
+    terminal = tab.terminal
+    ws = tab.ws
+
+    setInterval(() => tab.ping(), 5000)
+
+    window.onresize = debounce(function () {
+        tab.fit()
+    })
+}
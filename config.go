@@ -1,30 +1,87 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"flag"
 	"log/slog"
+	"net/netip"
 	"os"
 	"os/user"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
+
+	"webshell/logging"
+	"webshell/policy"
+	"webshell/strace"
 )
 
 type Config struct {
-	HomeDir    string
-	Port       int
-	Once       bool
-	Token      string
-	LogLevel   *slog.LevelVar
-	User       *user.User
-	AuditTTY   bool
-	AuditPath  string
-	AuditExec  bool
-	Replay     bool
-	ReplayFile string
-	Grace      time.Duration
-	Theme      string
-	Title      string
-	GlobalTTL  int
+	HomeDir     string
+	Port        int
+	Once        bool
+	Token       string
+	LogLevel    *slog.LevelVar
+	User        *user.User
+	AuditTTY    bool
+	AuditPath   string
+	AuditExec   bool
+	AuditTracer string
+	FailClosed  bool
+	Syscalls    strace.Options
+	Replay      bool
+	ReplayFile  string
+	Grace       time.Duration
+	DetachGrace time.Duration
+	Scrollback  int
+	KillGrace   time.Duration
+	Theme       string
+	Title       string
+	GlobalTTL   int
+	AdminToken  string
+	Shells      []ShellSpec
+	Env         EnvPolicy
+	Limits      ResourceLimits
+	Sandbox     Sandbox
+	Homes       SessionHomes
+	Integration ShellIntegration
+	Alerting    Alerting
+	LogSinks    []string
+	AuditSinks  []string
+	LogQueueDir string
+	AuditSync   bool // Sync each audit record to disk, rather than once a second
+	LogQueueMax int64
+
+	AuditChainKey   ed25519.PrivateKey // Chains the audit log when set, and signs its checkpoints
+	AuditCheckpoint time.Duration
+	AuditStore      string // Directory of the audit event store, disabled when empty
+	AuditRetention  time.Duration
+
+	TrustedProxies []netip.Prefix // Trusted to set X-Forwarded-For and X-Real-IP
+}
+
+// stringsFlag collects the values of a repeatable flag.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// Splits a comma separated flag, ignoring empty values.
+func splitList(s string) []string {
+	list := []string{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
 }
 
 func LoadConfig() Config {
@@ -36,8 +93,23 @@ func LoadConfig() Config {
 	flag.IntVar(&cfg.Port, "port", 8080, "Port to listen on")
 	flag.StringVar(&cfg.HomeDir, "home", homeDir, "Home directory for file access")
 	flag.StringVar(&cfg.Token, "token", "no-token", "Token to access service")
+	trustedProxies := flag.String("trusted-proxies", "", "Comma separated IPs or CIDRs of proxies whose X-Forwarded-For and X-Real-IP give the client's IP")
 	username := flag.String("user", "", "User to run shell as")
 
+	// The default shell, and any others users can pick from on the terminal page.
+	shellCmd := flag.String("shell", "/bin/bash", "Shell to run")
+	shellArgs := flag.String("shell-args", "", "Arguments passed to the shell")
+	login := flag.Bool("login", false, "Start the shell as a login shell")
+	var shellChoices shellFlag
+	flag.Var(&shellChoices, "shell-choice", "Additional shell users can pick, as name=command [args]. Prefix the command with - for a login shell. Can be repeated.")
+
+	// Controls which of the server's environment variables the shell sees.
+	envAllow := flag.String("env-allow", "", "Comma separated glob patterns of env vars passed to the shell. Everything is passed if unset.")
+	envDeny := flag.String("env-deny", "", "Comma separated glob patterns of env vars never passed to the shell")
+	var envSet, shellEnv stringsFlag
+	flag.Var(&envSet, "env", "KEY=VALUE to set in every shell. Can be repeated.")
+	flag.Var(&shellEnv, "shell-env", "name:KEY=VALUE to set in the named shell only. Can be repeated.")
+
 	// Only allows the first unique user to connect to the shell. When they disconnect the server will exit.
 	flag.BoolVar(&cfg.Once, "once", false, "Single use service, only accepts one connection")
 
@@ -46,16 +118,75 @@ func LoadConfig() Config {
 	// mode where js timeout calls only run every 5 minutes.
 	graceSecs := flag.Int("grace", 600, "Seconds to wait after disconnecting before stopping server. Used with -once.")
 
+	// How long a shell is kept running after its websocket drops, so the user can reattach to it.
+	detachSecs := flag.Int("detach-grace", 300, "Seconds to keep a disconnected shell running. 0 kills the shell on disconnect.")
+	killGraceSecs := flag.Int("kill-grace", 3, "Seconds to wait between SIGHUP, SIGTERM and SIGKILL when ending a session")
+	flag.IntVar(&cfg.Scrollback, "scrollback", 256*1024, "Bytes of shell output to keep for replay when reattaching")
+
+	// Per-session resource limits, so one user can't starve the server and other sessions.
+	flag.Uint64Var(&cfg.Limits.NProc, "limit-nproc", 0, "Max processes for the shell user (RLIMIT_NPROC). 0 is unlimited.")
+	flag.Uint64Var(&cfg.Limits.NoFile, "limit-nofile", 0, "Max open files per process (RLIMIT_NOFILE). 0 is unlimited.")
+	flag.Uint64Var(&cfg.Limits.CPU, "limit-cpu", 0, "Max CPU seconds per process (RLIMIT_CPU). 0 is unlimited.")
+	flag.Uint64Var(&cfg.Limits.FSize, "limit-fsize", 0, "Max bytes per file written (RLIMIT_FSIZE). 0 is unlimited.")
+	flag.StringVar(&cfg.Limits.CgroupParent, "cgroup", "", "cgroup v2 directory to create a child cgroup in for each session")
+	flag.StringVar(&cfg.Limits.Memory, "cgroup-memory", "", "Memory limit per session, e.g. 512M. Requires -cgroup.")
+	flag.IntVar(&cfg.Limits.Pids, "cgroup-pids", 0, "Max processes per session. Requires -cgroup.")
+	flag.Float64Var(&cfg.Limits.CPUs, "cgroup-cpus", 0, "CPUs available to each session, e.g. 0.5. Requires -cgroup.")
+
+	// Gives every session its own home directory instead of sharing -home.
+	flag.StringVar(&cfg.Homes.Root, "session-homes", "", "Directory to create a fresh home directory in for each session")
+	flag.StringVar(&cfg.Homes.Template, "home-template", "", "Directory copied into each new session home. Used with -session-homes.")
+	flag.StringVar(&cfg.Homes.Archive, "home-archive", "", "Directory to archive session homes to when the session ends, otherwise they're deleted. Used with -session-homes.")
+
+	// Isolates the shell from the server and the rest of the host.
+	flag.BoolVar(&cfg.Sandbox.Enabled, "sandbox", false, "Run the shell in its own PID, mount, UTS and IPC namespaces")
+	flag.BoolVar(&cfg.Sandbox.Network, "sandbox-net", false, "Give sandboxed shells their own network namespace, with no network access")
+	sandboxWritable := flag.String("sandbox-writable", "", "Comma separated paths sandboxed shells can write to, as well as the home directory")
+
 	// Turns on various auditing capabilities.
 	flag.BoolVar(&cfg.AuditTTY, "audit-tty", false, "Record users tty session for auditing")
 	flag.BoolVar(&cfg.AuditExec, "audit-exec", false, "Record all commands executed by user")
 	flag.StringVar(&cfg.AuditPath, "audit-path", "/tmp", "Directory to write audit logs to")
+	flag.StringVar(&cfg.AuditTracer, "audit-tracer", "auto", "How commands are audited: ptrace, strace, proc to poll /proc, or auto to try each in turn")
+	flag.BoolVar(&cfg.FailClosed, "audit-fail-closed", false, "Refuse to start shells that can't be audited, and end sessions whose auditor stops")
+	auditSyscalls := flag.String("audit-syscalls", "", "Comma separated syscalls to audit as well as commands: open, unlink, rename, connect, bind")
+	flag.IntVar(&cfg.Syscalls.RateLimit, "audit-syscall-rate", 100, "Max audited syscalls per second of each kind per session, the rest are dropped. 0 is unlimited.")
 	audit := flag.Bool("audit", false, "Enabled all auditing")
 
+	// Blocks commands as well as auditing them.
+	policyFile := flag.String("policy", "", "JSON file of rules for the commands shells can run, enforced by the ptrace tracer. Enables -audit-exec.")
+
+	// Alerts on risky commands and file transfers.
+	detectRules := flag.String("detect-rules", "", "JSON file of detection rules for risky commands and file transfers, each match is logged as an alert")
+	flag.StringVar(&cfg.Alerting.Webhook, "detect-webhook", "", "URL to POST alerts to as JSON")
+	flag.StringVar(&cfg.Alerting.WebhookSeverity, "detect-webhook-severity", "high", "Least severe alert posted to the webhook: low, medium, high or critical")
+	flag.StringVar(&cfg.Alerting.EndSession, "detect-end-session", "", "Least severe alert that ends the session. Sessions aren't ended if unset.")
+
+	// Where the application and audit logs are sent, each can go to several sinks.
+	var logSinks, auditSinks stringsFlag
+	flag.Var(&logSinks, "log-sink", "Where application logs are sent: stdout, file://, syslog+tcp://, syslog+udp://, syslog+unix:// or http(s)://. Can be repeated.")
+	flag.Var(&auditSinks, "audit-sink", "Where audit logs are sent, as -log-sink. Can be repeated.")
+	flag.StringVar(&cfg.LogQueueDir, "log-queue-dir", "", "Directory to queue logs in until their sinks accept them. Defaults to log-queue in -audit-path.")
+	flag.Int64Var(&cfg.LogQueueMax, "log-queue-max", 1<<30, "Max bytes queued on disk for each sink. Past it the oldest records are dropped. 0 is unlimited.")
+	flag.BoolVar(&cfg.AuditSync, "audit-sync", false, "Sync each audit record to disk before carrying on, so none are lost if the machine crashes. Otherwise logs are synced once a second.")
+
+	// Makes edits to the audit log detectable.
+	auditChainKey := flag.String("audit-chain-key", "", "Ed25519 private key, as a PKCS #8 PEM file, to sign audit log checkpoints with. Chains audit records together so edits can be detected.")
+	flag.DurationVar(&cfg.AuditCheckpoint, "audit-checkpoint", time.Minute, "How often to write a signed checkpoint to the audit log. Used with -audit-chain-key.")
+	flag.StringVar(&cfg.AuditStore, "audit-store", "", "Directory to keep a searchable store of exec, file transfer, session and alert events in. Queried with the admin API or the audit-query subcommand.")
+	retentionDays := flag.Int("audit-store-retention", 0, "Days to keep events in the audit store for. 0 keeps them forever.")
+
+	// Marks where each command starts and ends in the shell's output.
+	flag.BoolVar(&cfg.Integration.Enabled, "shell-integration", false, "Have bash and zsh mark prompts and commands with OSC 133, so each command is audited with its exit status")
+	flag.BoolVar(&cfg.Integration.Strip, "shell-integration-strip", false, "Remove the OSC 133 markers from the output sent to the browser. Used with -shell-integration.")
+
 	// Replayer is still work-in-progress
 	flag.BoolVar(&cfg.Replay, "replay", false, "Enabled replay of audit files")
 	flag.StringVar(&cfg.ReplayFile, "replay-file", "", "Path to audit file to replay")
 
+	// Admin dashboard, disabled unless a token is set.
+	flag.StringVar(&cfg.AdminToken, "admin-token", "", "Token required to access the admin dashboard and API")
+
 	// UI customization
 	flag.StringVar(&cfg.Theme, "theme", "", "Path to custom theme.js file")
 	flag.StringVar(&cfg.Title, "title", "", "Custom title")
@@ -73,6 +204,129 @@ func LoadConfig() Config {
 		}
 	}
 
+	// Validate trusted proxies
+	proxies, err := parseProxies(splitList(*trustedProxies))
+	if err != nil {
+		println("Invalid trusted proxies: " + err.Error())
+		os.Exit(1)
+	}
+	cfg.TrustedProxies = proxies
+
+	// Validate shells
+	cfg.Shells = append([]ShellSpec{{
+		Name:    filepath.Base(*shellCmd),
+		Command: *shellCmd,
+		Args:    strings.Fields(*shellArgs),
+		Login:   *login,
+	}}, shellChoices...)
+
+	if err := validateShells(cfg.Shells); err != nil {
+		println("Invalid shell: " + err.Error())
+		os.Exit(1)
+	}
+
+	if err := applyShellEnv(cfg.Shells, shellEnv); err != nil {
+		println("Invalid shell env: " + err.Error())
+		os.Exit(1)
+	}
+
+	// Validate env policy
+	envPolicy, err := NewEnvPolicy(splitList(*envAllow), splitList(*envDeny), envSet)
+	if err != nil {
+		println("Invalid env policy: " + err.Error())
+		os.Exit(1)
+	}
+	cfg.Env = envPolicy
+
+	// Validate resource limits
+	if err := validateLimits(cfg.Limits); err != nil {
+		println("Invalid resource limits: " + err.Error())
+		os.Exit(1)
+	}
+
+	cfg.Sandbox.Writable = splitList(*sandboxWritable)
+
+	// Validate session homes
+	if err := validateSessionHomes(cfg.Homes); err != nil {
+		println("Invalid session homes: " + err.Error())
+		os.Exit(1)
+	}
+
+	// Validate tracer
+	switch cfg.AuditTracer {
+	case "auto", "ptrace", "strace", "proc":
+	default:
+		println("Invalid audit tracer: " + cfg.AuditTracer)
+		os.Exit(1)
+	}
+
+	// Validate audited syscalls
+	cfg.Syscalls.Classes = splitList(*auditSyscalls)
+	if err := strace.ValidateClasses(cfg.Syscalls.Classes); err != nil {
+		println("Invalid audit syscalls: " + err.Error())
+		os.Exit(1)
+	}
+
+	// Validate command policy
+	if *policyFile != "" {
+		p, err := policy.Load(*policyFile)
+		if err != nil {
+			println("Invalid policy: " + err.Error())
+			os.Exit(1)
+		}
+		if cfg.AuditTracer != "auto" && cfg.AuditTracer != "ptrace" {
+			println("Invalid audit tracer: policies can only be enforced by ptrace")
+			os.Exit(1)
+		}
+		cfg.Syscalls.Policy = p
+		cfg.AuditExec = true
+	}
+
+	// Validate detection rules
+	if *detectRules != "" {
+		rules, err := policy.LoadDetections(*detectRules)
+		if err != nil {
+			println("Invalid detection rules: " + err.Error())
+			os.Exit(1)
+		}
+		cfg.Alerting.Rules = rules
+	}
+	if err := validateAlerting(cfg.Alerting); err != nil {
+		println("Invalid alerting: " + err.Error())
+		os.Exit(1)
+	}
+
+	// Validate log sinks
+	for _, spec := range append(logSinks, auditSinks...) {
+		if err := logging.ParseSink(spec); err != nil {
+			println("Invalid log sink: " + err.Error())
+			os.Exit(1)
+		}
+	}
+	cfg.LogSinks = logSinks
+	cfg.AuditSinks = auditSinks
+	if cfg.LogQueueDir == "" {
+		cfg.LogQueueDir = filepath.Join(cfg.AuditPath, "log-queue")
+	}
+	if cfg.LogQueueMax < 0 {
+		println("Invalid log queue max: " + strconv.FormatInt(cfg.LogQueueMax, 10))
+		os.Exit(1)
+	}
+
+	// Validate audit chain key
+	if *auditChainKey != "" {
+		key, err := logging.LoadSigningKey(*auditChainKey)
+		if err != nil {
+			println("Invalid audit chain key: " + err.Error())
+			os.Exit(1)
+		}
+		if cfg.AuditCheckpoint <= 0 {
+			println("Invalid audit checkpoint: must be positive")
+			os.Exit(1)
+		}
+		cfg.AuditChainKey = key
+	}
+
 	// Audit shortcut
 	if *audit {
 		cfg.AuditTTY = true
@@ -86,6 +340,9 @@ func LoadConfig() Config {
 	}
 
 	cfg.Grace = time.Duration(*graceSecs) * time.Second
+	cfg.DetachGrace = time.Duration(*detachSecs) * time.Second
+	cfg.AuditRetention = time.Duration(*retentionDays) * 24 * time.Hour
+	cfg.KillGrace = time.Duration(*killGraceSecs) * time.Second
 
 	return cfg
 }
@@ -103,6 +360,10 @@ func LoadConfigFromEnv() Config {
 		cfg.Token = token
 	}
 
+	if adminToken, ok := os.LookupEnv("ADMIN_TOKEN"); ok {
+		cfg.AdminToken = adminToken
+	}
+
 	if home, ok := os.LookupEnv("HOMEDIR"); ok {
 		cfg.HomeDir = home
 	}
@@ -113,5 +374,17 @@ func LoadConfigFromEnv() Config {
 		}
 	}
 
+	// Validated once the home directory is known, the shell always needs to write to it.
+	if cfg.Sandbox.Enabled {
+		home := cfg.HomeDir
+		if cfg.Homes.Enabled() {
+			home = cfg.Homes.Root
+		}
+		if err := validateSandbox(cfg.Sandbox, home); err != nil {
+			println("Invalid sandbox: " + err.Error())
+			os.Exit(1)
+		}
+	}
+
 	return cfg
 }
@@ -7,7 +7,7 @@ import (
 )
 
 func debugHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Printf("!!  CONN COUNT %d !!\n", connCount)
+	fmt.Printf("!!  SESSION COUNT %d !!\n", sessions.Count())
 	buf := make([]byte, 1<<16) // 64 KB buffer
 	l := runtime.Stack(buf, true)
 
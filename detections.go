@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"webshell/policy"
+	"webshell/strace"
+)
+
+// Alerting raises alerts when commands or file transfers match a detection rule.
+type Alerting struct {
+	Rules           *policy.Detections
+	Webhook         string // URL alerts are posted to
+	WebhookSeverity string // Least severe alert posted to the webhook
+	EndSession      string // Least severe alert that ends the session, never if empty
+}
+
+// NewDetector returns a detector for the rules, or nil if there aren't any.
+func (a Alerting) NewDetector() *policy.Detector {
+	if a.Rules == nil {
+		return nil
+	}
+	return a.Rules.NewDetector()
+}
+
+func validateAlerting(a Alerting) error {
+	if a.Webhook != "" && a.Rules == nil {
+		return fmt.Errorf("a webhook needs detection rules")
+	}
+	if err := policy.ValidSeverity(a.WebhookSeverity); err != nil {
+		return err
+	}
+	if a.EndSession != "" {
+		return policy.ValidSeverity(a.EndSession)
+	}
+	return nil
+}
+
+// The exec as the detection rules see it.
+func execEvent(e strace.ExecEvent) policy.Event {
+	return policy.Event{
+		Kind:       policy.EventExec,
+		Timestamp:  e.Timestamp,
+		Pid:        e.Pid,
+		PPid:       e.PPid,
+		Executable: e.Executable,
+		Argv:       e.Argv,
+	}
+}
+
+// Checks an event against the detection rules, raising an alert for each
+// that matches. session is nil for files transferred from the shared home.
+func detect(detector *policy.Detector, session *Session, e policy.Event) {
+	if detector == nil {
+		return
+	}
+	for _, a := range detector.Check(e) {
+		raiseAlert(session, a)
+	}
+}
+
+func raiseAlert(session *Session, a policy.Alert) {
+	logAlert(session, a)
+	if session != nil {
+		session.recordAlert(a)
+	}
+
+	if config.Alerting.Webhook != "" && policy.AtLeast(a.Rule.Severity, config.Alerting.WebhookSeverity) {
+		go postAlert(config.Alerting.Webhook, session, a)
+	}
+
+	if session != nil && config.Alerting.EndSession != "" && policy.AtLeast(a.Rule.Severity, config.Alerting.EndSession) {
+		session.Close(fmt.Sprintf("Session ended by rule %s: %s", a.Rule.ID, a.Rule.Description))
+	}
+}
+
+func logAlert(session *Session, a policy.Alert) {
+	attrs := []any{
+		slog.String("event.kind", "alert"),
+		slog.Any("event.type", []string{"info"}),
+		slog.String("event.action", "detection"),
+		slog.Int("event.severity", policy.SeverityScore[a.Rule.Severity]),
+		slog.String("rule.id", a.Rule.ID),
+		slog.String("rule.description", a.Rule.Description),
+		slog.String("rule.ruleset", "webshell-detections"),
+		slog.String("webshell.detection.severity", a.Rule.Severity),
+	}
+	if session != nil {
+		attrs = append(attrs, slog.String("session.id", session.ID))
+	}
+	if len(a.Rule.Tags) > 0 {
+		attrs = append(attrs, slog.Any("tags", a.Rule.Tags))
+	}
+
+	if a.Event.Kind == policy.EventExec {
+		attrs = append(attrs,
+			slog.Any("event.category", []string{"process"}),
+			slog.Int("process.pid", a.Event.Pid),
+			slog.Int("process.parent.pid", a.Event.PPid),
+			slog.String("process.executable", a.Event.Executable),
+			slog.Any("process.args", a.Event.Argv),
+			slog.String("process.command_line", strings.Join(a.Event.Argv, " ")),
+		)
+	} else {
+		attrs = append(attrs,
+			slog.Any("event.category", []string{"file"}),
+			slog.String("file.path", a.Event.Path),
+		)
+	}
+	if a.Related != nil {
+		attrs = append(attrs,
+			slog.Int("webshell.detection.related.pid", a.Related.Pid),
+			slog.String("webshell.detection.related.command_line", strings.Join(a.Related.Argv, " ")),
+		)
+	}
+
+	auditLogger.Warn(fmt.Sprintf("Alert: %s [%s]", a.Rule.Description, a.Rule.Severity), attrs...)
+}
+
+// What's posted to the webhook for each alert.
+type alertPayload struct {
+	Timestamp   time.Time     `json:"timestamp"`
+	SessionID   string        `json:"session_id,omitempty"`
+	Rule        string        `json:"rule"`
+	Description string        `json:"description"`
+	Severity    string        `json:"severity"`
+	Tags        []string      `json:"tags,omitempty"`
+	Event       policy.Event  `json:"event"`
+	Related     *policy.Event `json:"related,omitempty"`
+}
+
+// How long the webhook has to respond to each alert.
+const webhookTimeout = 10 * time.Second
+
+func postAlert(url string, session *Session, a policy.Alert) {
+	payload := alertPayload{
+		Timestamp:   time.Now(),
+		Rule:        a.Rule.ID,
+		Description: a.Rule.Description,
+		Severity:    a.Rule.Severity,
+		Tags:        a.Rule.Tags,
+		Event:       a.Event,
+		Related:     a.Related,
+	}
+	if session != nil {
+		payload.SessionID = session.ID
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to encode alert: %s", err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failed to post alert: %s", err))
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		logger.Warn(fmt.Sprintf("Failed to post alert %s: %s", a.Rule.ID, err))
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		logger.Warn(fmt.Sprintf("Alert webhook returned %s for %s", resp.Status, a.Rule.ID))
+	}
+}
+
+// DetectTest is the argv[1] that runs detection rules against a recorded
+// audit log instead of starting the server.
+const DetectTest = "detect-test"
+
+// Reads an audit log, as JSON lines, and prints the alerts the rules raise.
+// Each session is checked with its own detector.
+func runDetectTest(args []string) int {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Fprintf(os.Stderr, "usage: %s %s RULES [AUDIT_LOG]\n", filepath.Base(os.Args[0]), DetectTest)
+		return 2
+	}
+	rules, err := policy.LoadDetections(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid detection rules: %s\n", err)
+		return 1
+	}
+
+	in := os.Stdin
+	if len(args) == 2 {
+		if in, err = os.Open(args[1]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer in.Close()
+	}
+
+	alerts, err := detectLog(rules, in, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "%d alerts\n", alerts)
+	return 0
+}
+
+// Writes a line to out for each alert raised by the events in log.
+func detectLog(rules *policy.Detections, log io.Reader, out io.Writer) (int, error) {
+	detectors := map[string]*policy.Detector{}
+	count := 0
+
+	lines := bufio.NewScanner(log)
+	lines.Buffer(nil, 1024*1024)
+	for lines.Scan() {
+		session, e, ok := parseAuditEvent(lines.Bytes())
+		if !ok {
+			continue
+		}
+		if detectors[session] == nil {
+			detectors[session] = rules.NewDetector()
+		}
+		for _, a := range detectors[session].Check(e) {
+			count++
+			what := e.Path
+			if a.Event.Kind == policy.EventExec {
+				what = strings.Join(a.Event.Argv, " ")
+			}
+			fmt.Fprintf(out, "%s %s %s %s: %s\n", a.Event.Timestamp.Format(time.RFC3339), a.Rule.Severity, a.Rule.ID, a.Rule.Description, what)
+		}
+	}
+	return count, lines.Err()
+}
+
+// Audit log entries that detections are checked against.
+type auditEntry struct {
+	Timestamp  time.Time `json:"@timestamp"`
+	Action     string    `json:"event.action"`
+	Session    string    `json:"session.id"`
+	Pid        int       `json:"process.pid"`
+	PPid       int       `json:"process.parent.pid"`
+	Executable string    `json:"process.executable"`
+	Args       []string  `json:"process.args"`
+	Failure    string    `json:"error.message"`
+	Path       string    `json:"file.path"`
+}
+
+// Turns a line of the audit log into an event, if it's an exec or file transfer.
+func parseAuditEvent(line []byte) (string, policy.Event, bool) {
+	entry := auditEntry{}
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return "", policy.Event{}, false
+	}
+
+	e := policy.Event{Timestamp: entry.Timestamp}
+	switch entry.Action {
+	case "exec", "exec-blocked":
+		// As in a live session, execs that failed, other than being blocked, aren't checked.
+		if entry.Action == "exec" && entry.Failure != "" {
+			return "", e, false
+		}
+		e.Kind, e.Pid, e.PPid, e.Executable, e.Argv = policy.EventExec, entry.Pid, entry.PPid, entry.Executable, entry.Args
+	case "file-upload":
+		e.Kind, e.Path = policy.EventUpload, entry.Path
+	case "file-download":
+		e.Kind, e.Path = policy.EventDownload, entry.Path
+	default:
+		return "", e, false
+	}
+	return entry.Session, e, true
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"webshell/policy"
+)
+
+const testRules = `{
+	"rules": [
+		{"id": "curl-sh", "description": "Download piped to a shell", "severity": "high", "executable": "*sh", "with": {"executable": "curl"}},
+		{"id": "sudoers", "description": "sudoers edited", "severity": "critical", "command": "/etc/sudoers"},
+		{"id": "foo", "description": "foo downloaded", "severity": "low", "events": ["download"], "path": "foo\\.txt$"}
+	]
+}`
+
+func TestDetectLog(t *testing.T) {
+	rules, err := policy.ParseDetections([]byte(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Execs by the same parent in two sessions, which aren't matched with each other.
+	log := strings.Join([]string{
+		`{"@timestamp":"2024-01-01T00:00:00Z","event.action":"exec","session.id":"a","process.pid":10,"process.parent.pid":1,"process.executable":"/usr/bin/curl","process.args":["curl","x"]}`,
+		`{"@timestamp":"2024-01-01T00:00:00.1Z","event.action":"exec","session.id":"b","process.pid":11,"process.parent.pid":1,"process.executable":"/bin/sh","process.args":["sh"]}`,
+		`{"@timestamp":"2024-01-01T00:00:00.2Z","event.action":"exec","session.id":"a","process.pid":12,"process.parent.pid":1,"process.executable":"/bin/bash","process.args":["bash"]}`,
+		`not json`,
+		`{"@timestamp":"2024-01-01T00:00:01Z","event.action":"exec","session.id":"a","process.pid":13,"process.parent.pid":1,"process.executable":"/usr/local/bin/vi","process.args":["vi","/etc/sudoers"],"error.message":"no such file or directory"}`,
+		`{"@timestamp":"2024-01-01T00:00:02Z","event.action":"exec-blocked","session.id":"a","process.pid":13,"process.parent.pid":1,"process.executable":"/usr/bin/vi","process.args":["vi","/etc/sudoers"],"error.message":"operation not permitted"}`,
+		`{"@timestamp":"2024-01-01T00:00:03Z","event.action":"file-download","file.path":"/home/foo.txt"}`,
+	}, "\n")
+
+	out := &strings.Builder{}
+	count, err := detectLog(rules, strings.NewReader(log), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "2024-01-01T00:00:00Z high curl-sh Download piped to a shell: bash\n" +
+		"2024-01-01T00:00:02Z critical sudoers sudoers edited: vi /etc/sudoers\n" +
+		"2024-01-01T00:00:03Z low foo foo downloaded: /home/foo.txt\n"
+	if count != 3 || out.String() != want {
+		t.Errorf("got %d alerts:\n%s", count, out)
+	}
+}
+
+func TestAlertWebhook(t *testing.T) {
+	rules, err := policy.ParseDetections([]byte(testRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	posted := make(chan alertPayload, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload := alertPayload{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Error(err)
+		}
+		posted <- payload
+	}))
+	defer webhook.Close()
+
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	config.Alerting = Alerting{Rules: rules, Webhook: webhook.URL, WebhookSeverity: "low"}
+	defer func() { config.Alerting = Alerting{} }()
+
+	h, err := setup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown(h)
+	h.detector = config.Alerting.NewDetector()
+
+	req := httptest.NewRequest(http.MethodGet, "/1234/home/foo.txt", nil)
+	req.SetPathValue("filename", "foo.txt")
+	h.Handler().ServeHTTP(httptest.NewRecorder(), req)
+
+	select {
+	case p := <-posted:
+		if p.Rule != "foo" || p.Severity != "low" || p.Event.Kind != policy.EventDownload || !strings.HasSuffix(p.Event.Path, "/foo.txt") {
+			t.Errorf("unexpected alert %+v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("alert wasn't posted")
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Variables that are never passed on to the shell, whatever the policy says.
+var restrictedEnvVars = []string{
+	"AUDIT_UPLOAD_URL",
+	"ADMIN_TOKEN",
+	"TOKEN",
+}
+
+// Set in the shell's environment if they're not already.
+var defaultEnvVars = []string{
+	"TERM=xterm-256color",
+	"LANG=C.UTF-8",
+}
+
+// EnvPolicy decides which of the server's environment variables are passed to
+// the shell, and what extra variables are set.
+type EnvPolicy struct {
+	// Glob patterns, if any are set only matching variables are passed through.
+	Allow []string
+	// Glob patterns, matching variables are always removed.
+	Deny []string
+	// KEY=VALUE pairs set in every shell.
+	Set []string
+}
+
+func NewEnvPolicy(allow []string, deny []string, set []string) (EnvPolicy, error) {
+	policy := EnvPolicy{
+		Allow: allow,
+		Deny:  deny,
+		Set:   set,
+	}
+
+	for _, pattern := range append(policy.Allow, policy.Deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return EnvPolicy{}, fmt.Errorf("invalid env pattern %q: %w", pattern, err)
+		}
+	}
+
+	if err := validateEnvVars(set); err != nil {
+		return EnvPolicy{}, err
+	}
+
+	return policy, nil
+}
+
+// Checks a list of variables are all in the form KEY=VALUE.
+func validateEnvVars(vars []string) error {
+	for _, v := range vars {
+		if key, _, found := strings.Cut(v, "="); !found || key == "" {
+			return fmt.Errorf("invalid env var %q, expected KEY=VALUE", v)
+		}
+	}
+	return nil
+}
+
+func matchesAny(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter returns the variables from the parent environment the shell is allowed to see.
+func (p EnvPolicy) Filter(parent []string) []string {
+	environ := []string{}
+	for _, e := range parent {
+		key, _, _ := strings.Cut(e, "=")
+		if len(p.Allow) > 0 && !matchesAny(p.Allow, key) {
+			continue
+		}
+		if matchesAny(restrictedEnvVars, key) || matchesAny(p.Deny, key) {
+			continue
+		}
+		environ = append(environ, e)
+	}
+	return environ
+}
+
+// Inject defaults TERM and LANG if they're missing, then adds the policy's
+// fixed variables followed by any extra ones, replacing existing values.
+func (p EnvPolicy) Inject(environ []string, extra ...string) []string {
+	for _, e := range defaultEnvVars {
+		key, value, _ := strings.Cut(e, "=")
+		if lookupEnv(environ, key) == "" {
+			environ = setEnv(environ, key, value)
+		}
+	}
+
+	for _, e := range append(append([]string{}, p.Set...), extra...) {
+		key, value, _ := strings.Cut(e, "=")
+		environ = setEnv(environ, key, value)
+	}
+	return environ
+}
+
+// Sets key in environ, replacing any existing value.
+func setEnv(environ []string, key string, value string) []string {
+	result := []string{}
+	for _, e := range environ {
+		if k, _, _ := strings.Cut(e, "="); k != key {
+			result = append(result, e)
+		}
+	}
+	return append(result, key+"="+value)
+}
+
+func lookupEnv(environ []string, key string) string {
+	for _, e := range environ {
+		if k, v, _ := strings.Cut(e, "="); k == key {
+			return v
+		}
+	}
+	return ""
+}
+
+// Removes any restricted keys from the parent environment
+func filterEnv(o []string) []string {
+	return config.Env.Filter(o)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestEnvPolicyAllow(t *testing.T) {
+	policy, err := NewEnvPolicy([]string{"LC_*", "PATH", "TOKEN"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := policy.Filter([]string{"PATH=/bin", "LC_ALL=C", "SECRET=1", "TOKEN=abc"})
+	if !slices.Equal(res, []string{"PATH=/bin", "LC_ALL=C"}) {
+		t.Errorf("unexpected env %v", res)
+	}
+}
+
+func TestEnvPolicyDeny(t *testing.T) {
+	policy, err := NewEnvPolicy(nil, []string{"AWS_*"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := policy.Filter([]string{"PATH=/bin", "AWS_SECRET_ACCESS_KEY=x", "ADMIN_TOKEN=y"})
+	if !slices.Equal(res, []string{"PATH=/bin"}) {
+		t.Errorf("unexpected env %v", res)
+	}
+}
+
+func TestEnvPolicyInject(t *testing.T) {
+	policy, err := NewEnvPolicy(nil, nil, []string{"FOO=bar", "LANG=en_GB.UTF-8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := policy.Inject([]string{"FOO=old", "PATH=/bin"}, "EXTRA=1")
+
+	want := map[string]string{
+		"FOO":   "bar",
+		"PATH":  "/bin",
+		"TERM":  "xterm-256color",
+		"LANG":  "en_GB.UTF-8",
+		"EXTRA": "1",
+	}
+	if len(res) != len(want) {
+		t.Errorf("unexpected env %v", res)
+	}
+	for k, v := range want {
+		if lookupEnv(res, k) != v {
+			t.Errorf("%s: want %s got %s", k, v, lookupEnv(res, k))
+		}
+	}
+}
+
+func TestEnvPolicyInvalid(t *testing.T) {
+	if _, err := NewEnvPolicy([]string{"[A-"}, nil, nil); err == nil {
+		t.Error("invalid allow pattern should be rejected")
+	}
+	if _, err := NewEnvPolicy(nil, []string{"\\"}, nil); err == nil {
+		t.Error("invalid deny pattern should be rejected")
+	}
+	if _, err := NewEnvPolicy(nil, nil, []string{"NOVALUE"}); err == nil {
+		t.Error("invalid env var should be rejected")
+	}
+}
+
+func TestApplyShellEnv(t *testing.T) {
+	shells := []ShellSpec{{Name: "bash"}, {Name: "python"}}
+	if err := applyShellEnv(shells, []string{"python:PYTHONSTARTUP=/etc/startup.py"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(shells[0].Env) != 0 || !slices.Equal(shells[1].Env, []string{"PYTHONSTARTUP=/etc/startup.py"}) {
+		t.Errorf("unexpected shell env %v", shells)
+	}
+
+	if err := applyShellEnv(shells, []string{"zsh:FOO=bar"}); err == nil {
+		t.Error("unknown shells should be rejected")
+	}
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log/slog"
 	"net/http"
@@ -12,6 +15,9 @@ import (
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
+
+	"webshell/policy"
 )
 
 type FileLink struct {
@@ -35,15 +41,30 @@ type errorParams struct {
 }
 
 type FilesHandler struct {
-	baseDir string
-	baseUrl string
-	user    *user.User
-	logger  *slog.Logger
+	baseDir   string
+	baseUrl   string
+	assetsUrl string
+	user      *user.User
+	logger    *slog.Logger
+	session   *Session         // Set when serving a session's own home
+	sessions  *SessionManager  // Set when serving the shared home, to find the browser's session
+	detector  *policy.Detector // Checks transfers against the detection rules
 }
 
 func (fh FilesHandler) Handler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
+		// Transfers in the shared home are tied to the session the browser is using.
+		if fh.session == nil && fh.sessions != nil {
+			if session := fh.sessions.Latest(clientId(r)); session != nil {
+				fh.session = session
+				fh.detector = session.detector
+			}
+		}
+		if fh.session != nil {
+			fh.logger = fh.logger.With(slog.String("session.id", fh.session.ID))
+		}
+
 		if r.Method == "POST" {
 			fh.uploadFileHandler(w, r)
 			return
@@ -85,9 +106,13 @@ func (fh FilesHandler) downloadFile(w http.ResponseWriter, filename string) {
 	defer f.Close()
 
 	w.Header().Set("Content-Type", "application/octet-stream")
-	if _, err := io.Copy(w, f); err != nil {
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, hash), f)
+	if err != nil {
 		http.Error(w, "Error reading file "+f.Name(), http.StatusInternalServerError)
+		return
 	}
+	fh.transferred(policy.EventDownload, filename, n, hash)
 }
 
 func (fh FilesHandler) listFiles(w http.ResponseWriter, dirname string, error string) {
@@ -95,7 +120,7 @@ func (fh FilesHandler) listFiles(w http.ResponseWriter, dirname string, error st
 	fh.logger.Info(fmt.Sprintf("listing files in %s", dirname))
 
 	params := fileParams{
-		AssetsPath: path.Join(fh.baseUrl, "../assets"),
+		AssetsPath: fh.assetsPath(),
 		UploadPath: path.Join(fh.baseUrl, "/upload"),
 		CurrentDir: dirname,
 		Files:      []FileLink{},
@@ -206,16 +231,41 @@ func (fh FilesHandler) upload(file io.Reader, filename string) error {
 		}
 	}
 
-	if _, err := io.Copy(dst, file); err != nil {
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(dst, hash), file)
+	if err != nil {
 		return errors.New("upload failed, failed to write file")
 	}
 
+	fh.transferred(policy.EventUpload, filePath, n, hash)
 	return nil
 }
 
+// Audits a file being uploaded or downloaded, and checks it against the
+// detection rules. digest has been given the file's contents.
+func (fh FilesHandler) transferred(kind string, filename string, size int64, digest hash.Hash) {
+	sum := hex.EncodeToString(digest.Sum(nil))
+	attrs := []any{
+		slog.String("event.kind", "event"),
+		slog.Any("event.category", []string{"file"}),
+		slog.String("event.action", "file-"+kind),
+		slog.String("file.path", filename),
+		slog.Int64("file.size", size),
+		slog.String("file.hash.sha256", sum),
+	}
+	if fh.session != nil {
+		attrs = append(attrs, slog.String("session.id", fh.session.ID))
+		fh.session.recordTransfer(FileTransfer{Time: time.Now(), Direction: kind, Path: filename, Size: size, SHA256: sum})
+	}
+	verb := map[string]string{policy.EventUpload: "uploaded", policy.EventDownload: "downloaded"}[kind]
+	auditLogger.Info(fmt.Sprintf("File %s: %s", verb, filename), attrs...)
+
+	detect(fh.detector, fh.session, policy.Event{Kind: kind, Timestamp: time.Now(), Path: filename})
+}
+
 func (fh FilesHandler) fileError(w http.ResponseWriter, error string) {
 	params := errorParams{
-		AssetsPath: path.Join(fh.baseUrl, "../assets"),
+		AssetsPath: fh.assetsPath(),
 		Home:       fh.baseUrl,
 		Error:      error,
 	}
@@ -226,6 +276,14 @@ func (fh FilesHandler) fileError(w http.ResponseWriter, error string) {
 	}
 }
 
+// URL of the static assets, relative to the files page unless set.
+func (fh FilesHandler) assetsPath() string {
+	if fh.assetsUrl != "" {
+		return fh.assetsUrl
+	}
+	return path.Join(fh.baseUrl, "../assets")
+}
+
 func (fh FilesHandler) isPathSafe(filename string) bool {
 	return strings.HasPrefix(filepath.Clean(filename), filepath.Clean(fh.baseDir))
 }
@@ -31,6 +31,7 @@ func setup() (*FilesHandler, error) {
 		return nil, err
 	}
 
+	auditLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
 	h := &FilesHandler{
 		baseDir: dir,
 		baseUrl: "/1234/home",
@@ -1,12 +1,10 @@
 package main
 
 import (
-	"fmt"
 	"os"
 	"os/exec"
 	"os/user"
 	"strconv"
-	"strings"
 	"syscall"
 )
 
@@ -21,27 +19,31 @@ func chown(f *os.File, user *user.User) error {
 	return f.Chown(uid, gid)
 }
 
+// Like chown, but changes a symlink rather than what it points to.
+func lchown(path string, user *user.User) error {
+	uid, _ := strconv.Atoi(user.Uid)
+	gid, _ := strconv.Atoi(user.Gid)
+	return os.Lchown(path, uid, gid)
+}
+
 func runAs(cmd *exec.Cmd, user *user.User) {
 	uid, _ := strconv.ParseInt(user.Uid, 10, 32)
 	gid, _ := strconv.ParseInt(user.Gid, 10, 32)
 
 	cmd.SysProcAttr = &syscall.SysProcAttr{}
 	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
-	cmd.Env = append(cmd.Env, fmt.Sprintf("HOME=%s", user.HomeDir))
+	cmd.Env = setEnv(cmd.Env, "HOME", user.HomeDir)
+	cmd.Env = setEnv(cmd.Env, "USER", user.Username)
+	cmd.Env = setEnv(cmd.Env, "LOGNAME", user.Username)
 }
 
-var restrictedEnvVars = map[string]bool{
-	"AUDIT_UPLOAD_URL": true,
-}
-
-// Removes any restricted keys from the parent environment
-func filterEnv(o []string) []string {
-	environ := []string{}
-	for _, e := range o {
-		key, _, _ := strings.Cut(e, "=")
-		if _, found := restrictedEnvVars[key]; !found {
-			environ = append(environ, e)
-		}
+// Returns the name of the user the shell runs as.
+func shellUser(u *user.User) string {
+	if u != nil {
+		return u.Username
+	}
+	if current, err := user.Current(); err == nil {
+		return current.Username
 	}
-	return environ
+	return ""
 }
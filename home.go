@@ -0,0 +1,243 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+)
+
+// SessionHomes configures a fresh home directory for every session, so
+// nothing one user leaves behind is visible to the next.
+type SessionHomes struct {
+	Root     string // Where session homes are created, enables the mode.
+	Template string // Copied into each new home.
+	Archive  string // Homes are archived here when the session ends, otherwise they're deleted.
+}
+
+func (sh SessionHomes) Enabled() bool {
+	return sh.Root != ""
+}
+
+func validateSessionHomes(sh SessionHomes) error {
+	for _, dir := range []string{sh.Root, sh.Template, sh.Archive} {
+		if dir == "" {
+			continue
+		}
+		stat, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !stat.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+	}
+	return nil
+}
+
+// SessionHome is the home directory of a single session.
+type SessionHome struct {
+	Path string
+	user *user.User
+}
+
+// NewSessionHome creates a new home directory, seeded from the template and owned by the shell user.
+func NewSessionHome(sh SessionHomes, user *user.User) (*SessionHome, error) {
+	path, err := os.MkdirTemp(sh.Root, "home-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create session home: %w", err)
+	}
+	home := &SessionHome{Path: path, user: user}
+
+	if sh.Template != "" {
+		if err := home.copyTemplate(sh.Template); err != nil {
+			home.Remove()
+			return nil, fmt.Errorf("failed to copy home template: %w", err)
+		}
+	}
+
+	if err := home.chown(path); err != nil {
+		home.Remove()
+		return nil, err
+	}
+
+	return home, nil
+}
+
+// Copies the template into the home, keeping file modes.
+func (h *SessionHome) copyTemplate(template string) error {
+	return filepath.WalkDir(template, func(src string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(template, src)
+		if err != nil || rel == "." {
+			return err
+		}
+		dst := filepath.Join(h.Path, rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.IsDir():
+			if err := os.Mkdir(dst, info.Mode().Perm()); err != nil {
+				return err
+			}
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(src)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(target, dst); err != nil {
+				return err
+			}
+			if h.user != nil {
+				return lchown(dst, h.user)
+			}
+			return nil
+		case d.Type().IsRegular():
+			if err := copyFile(src, dst, info.Mode().Perm()); err != nil {
+				return err
+			}
+		default:
+			// Devices, sockets and pipes aren't copied.
+			return nil
+		}
+
+		return h.chown(dst)
+	})
+}
+
+func copyFile(src string, dst string, mode fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Gives the shell user ownership of a file or directory in the home.
+func (h *SessionHome) chown(path string) error {
+	if h.user == nil {
+		return nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := chown(f, h.user); err != nil {
+		return fmt.Errorf("failed to chown %s: %w", path, err)
+	}
+	return nil
+}
+
+// Close archives the home, if configured, then deletes it. Returns the path of the archive.
+func (h *SessionHome) Close(archiveDir string, sessionID string) (string, error) {
+	archive := ""
+	if archiveDir != "" {
+		name := fmt.Sprintf("%s_%s.home.tar.gz", time.Now().Format(time.RFC3339), sessionID)
+		archive = filepath.Join(archiveDir, name)
+		if err := archiveDirectory(h.Path, archive); err != nil {
+			// Keep the home around so nothing is lost.
+			return "", fmt.Errorf("failed to archive %s: %w", h.Path, err)
+		}
+	}
+
+	return archive, h.Remove()
+}
+
+// Remove deletes the home and everything in it.
+func (h *SessionHome) Remove() error {
+	if err := os.RemoveAll(h.Path); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", h.Path, err)
+	}
+	return nil
+}
+
+// Writes the contents of dir to a gzipped tar file.
+func archiveDirectory(dir string, dst string) error {
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		link := ""
+		if d.Type()&fs.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		} else if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		src, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+
+	return errors.Join(tw.Close(), gz.Close())
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestSessionHomeFromTemplate(t *testing.T) {
+	template := t.TempDir()
+	os.Mkdir(filepath.Join(template, ".config"), 0755)
+	os.WriteFile(filepath.Join(template, ".config", "settings"), []byte("x"), 0600)
+	os.Symlink(".config/settings", filepath.Join(template, "link"))
+
+	home, err := NewSessionHome(SessionHomes{Root: t.TempDir(), Template: template}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stat, err := os.Stat(filepath.Join(home.Path, ".config", "settings"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Mode().Perm() != 0600 {
+		t.Errorf("file mode not kept, got %s", stat.Mode())
+	}
+
+	if target, _ := os.Readlink(filepath.Join(home.Path, "link")); target != ".config/settings" {
+		t.Errorf("symlink not copied, got %q", target)
+	}
+
+	if _, err := home.Close("", "id"); err != nil {
+		t.Fatal(err)
+	}
+	if checkFileExists(home.Path) {
+		t.Error("home was not deleted")
+	}
+}
+
+func TestSessionHomeArchive(t *testing.T) {
+	archiveDir := t.TempDir()
+	home, err := NewSessionHome(SessionHomes{Root: t.TempDir()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(home.Path, ".bash_history"), []byte("ls\n"), 0600)
+
+	archive, err := home.Close(archiveDir, "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkFileExists(home.Path) {
+		t.Error("home was not deleted")
+	}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, header.Name)
+	}
+	if !slices.Equal(names, []string{".bash_history"}) {
+		t.Errorf("unexpected archive contents %v", names)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Not defined by the syscall package.
+const rlimitNproc = 0x6
+
+var rlimitNames = map[int]string{
+	syscall.RLIMIT_CPU:    "RLIMIT_CPU",
+	syscall.RLIMIT_FSIZE:  "RLIMIT_FSIZE",
+	syscall.RLIMIT_NOFILE: "RLIMIT_NOFILE",
+	rlimitNproc:           "RLIMIT_NPROC",
+}
+
+// ResourceLimits are applied to every shell. Zero values are unlimited.
+type ResourceLimits struct {
+	NProc  uint64
+	NoFile uint64
+	CPU    uint64 // seconds
+	FSize  uint64 // bytes
+
+	// Optional cgroup v2 limits, each session gets a child of CgroupParent.
+	CgroupParent string
+	Memory       string // memory.max, e.g. 512M
+	Pids         int
+	CPUs         float64
+}
+
+// Rlimits returns the rlimits to set on the shell, keyed by resource.
+func (l ResourceLimits) Rlimits() map[int]uint64 {
+	rlimits := map[int]uint64{}
+	for resource, limit := range map[int]uint64{
+		rlimitNproc:           l.NProc,
+		syscall.RLIMIT_NOFILE: l.NoFile,
+		syscall.RLIMIT_CPU:    l.CPU,
+		syscall.RLIMIT_FSIZE:  l.FSize,
+	} {
+		if limit > 0 {
+			rlimits[resource] = limit
+		}
+	}
+	return rlimits
+}
+
+var cgroupMemoryPattern = regexp.MustCompile(`^(max|[0-9]+[KMGkmg]?)$`)
+
+// Checks the limits can be applied, and enables the cgroup controllers they need on the parent.
+func validateLimits(l ResourceLimits) error {
+	if l.CgroupParent == "" {
+		if l.Memory != "" || l.Pids > 0 || l.CPUs > 0 {
+			return errors.New("cgroup limits need -cgroup to be set")
+		}
+		return nil
+	}
+
+	if l.Memory != "" && !cgroupMemoryPattern.MatchString(l.Memory) {
+		return fmt.Errorf("invalid memory limit %q", l.Memory)
+	}
+	if l.Pids < 0 || l.CPUs < 0 {
+		return errors.New("cgroup limits can't be negative")
+	}
+
+	if !checkFileExists(filepath.Join(l.CgroupParent, "cgroup.controllers")) {
+		return fmt.Errorf("%s is not a cgroup v2 directory", l.CgroupParent)
+	}
+
+	controllers := []string{}
+	if l.Memory != "" {
+		controllers = append(controllers, "+memory")
+	}
+	if l.Pids > 0 {
+		controllers = append(controllers, "+pids")
+	}
+	if l.CPUs > 0 {
+		controllers = append(controllers, "+cpu")
+	}
+	if len(controllers) == 0 {
+		return nil
+	}
+
+	subtree := filepath.Join(l.CgroupParent, "cgroup.subtree_control")
+	if err := os.WriteFile(subtree, []byte(strings.Join(controllers, " ")), 0644); err != nil {
+		return fmt.Errorf("failed to enable %s controllers: %w", strings.Join(controllers, " "), err)
+	}
+	return nil
+}
+
+// Cgroup is the cgroup v2 group a session's processes run in.
+type Cgroup struct {
+	path string
+	dir  *os.File
+}
+
+// Period used for cpu.max.
+const cgroupCPUPeriod = 100000
+
+// NewCgroup creates a cgroup for a session under the configured parent and sets its limits.
+func NewCgroup(limits ResourceLimits, name string) (*Cgroup, error) {
+	path := filepath.Join(limits.CgroupParent, name)
+	if err := os.Mkdir(path, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cgroup: %w", err)
+	}
+
+	cg := &Cgroup{path: path}
+
+	settings := map[string]string{}
+	if limits.Memory != "" {
+		settings["memory.max"] = limits.Memory
+	}
+	if limits.Pids > 0 {
+		settings["pids.max"] = strconv.Itoa(limits.Pids)
+	}
+	if limits.CPUs > 0 {
+		settings["cpu.max"] = fmt.Sprintf("%d %d", int(limits.CPUs*cgroupCPUPeriod), cgroupCPUPeriod)
+	}
+
+	for file, value := range settings {
+		if err := os.WriteFile(filepath.Join(path, file), []byte(value), 0644); err != nil {
+			cg.Remove()
+			return nil, fmt.Errorf("failed to set %s: %w", file, err)
+		}
+	}
+
+	dir, err := os.Open(path)
+	if err != nil {
+		cg.Remove()
+		return nil, err
+	}
+	cg.dir = dir
+
+	return cg, nil
+}
+
+// FD is passed to SysProcAttr.CgroupFD so the shell starts inside the cgroup.
+func (cg *Cgroup) FD() int {
+	return int(cg.dir.Fd())
+}
+
+// Kill sends SIGKILL to every process in the cgroup.
+func (cg *Cgroup) Kill() error {
+	return os.WriteFile(filepath.Join(cg.path, "cgroup.kill"), []byte("1"), 0644)
+}
+
+// Remove deletes the cgroup, it must have no processes left in it.
+func (cg *Cgroup) Remove() error {
+	if cg.dir != nil {
+		cg.dir.Close()
+	}
+
+	// The kernel can take a moment to notice the last process has gone.
+	var err error
+	for i := 0; i < 10; i++ {
+		if err = os.Remove(cg.path); err == nil || errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return err
+}
+
+// Reads a counter from one of the cgroup's flat keyed files, such as memory.events.
+func (cg *Cgroup) counter(file string, key string) int {
+	b, err := os.ReadFile(filepath.Join(cg.path, file))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		k, v, _ := strings.Cut(line, " ")
+		if k == key {
+			n, _ := strconv.Atoi(v)
+			return n
+		}
+	}
+	return 0
+}
+
+// LimitEvent is reported when one of the cgroup's limits is hit.
+type LimitEvent struct {
+	Limit   string
+	Count   int
+	Message string
+}
+
+// Counters that increase when a limit is hit.
+var cgroupLimitEvents = []struct {
+	file    string
+	key     string
+	limit   string
+	message string
+}{
+	{"memory.events", "oom_kill", "memory.max", "Out of memory, a process was killed"},
+	{"pids.events", "max", "pids.max", "Process limit reached, a process could not be started"},
+}
+
+// Watch polls the cgroup's event counters until done is closed, calling report whenever one increases.
+func (cg *Cgroup) Watch(done <-chan struct{}, interval time.Duration, report func(LimitEvent)) {
+	last := make([]int, len(cgroupLimitEvents))
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			for i, e := range cgroupLimitEvents {
+				count := cg.counter(e.file, e.key)
+				if count > last[i] {
+					report(LimitEvent{Limit: e.limit, Count: count - last[i], Message: e.message})
+				}
+				last[i] = count
+			}
+		}
+	}
+}
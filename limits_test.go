@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRlimits(t *testing.T) {
+	limits := ResourceLimits{NProc: 100, FSize: 1024}
+
+	rlimits := limits.Rlimits()
+	if len(rlimits) != 2 || rlimits[rlimitNproc] != 100 || rlimits[syscall.RLIMIT_FSIZE] != 1024 {
+		t.Errorf("unexpected rlimits %v", rlimits)
+	}
+}
+
+func TestValidateLimits(t *testing.T) {
+	tests := map[string]ResourceLimits{
+		"no cgroup":        {Pids: 10},
+		"bad memory":       {CgroupParent: t.TempDir(), Memory: "lots"},
+		"negative pids":    {CgroupParent: t.TempDir(), Pids: -1},
+		"not a cgroup dir": {CgroupParent: t.TempDir(), Pids: 10},
+	}
+
+	for name, limits := range tests {
+		if err := validateLimits(limits); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	if err := validateLimits(ResourceLimits{NoFile: 64}); err != nil {
+		t.Errorf("rlimits only: %s", err)
+	}
+}
+
+func TestCgroupWatch(t *testing.T) {
+	cg := &Cgroup{path: t.TempDir()}
+	events := filepath.Join(cg.path, "memory.events")
+	os.WriteFile(events, []byte("low 0\nhigh 0\nmax 3\noom 1\noom_kill 0\n"), 0644)
+
+	done := make(chan struct{})
+	reports := make(chan LimitEvent, 1)
+	go cg.Watch(done, 10*time.Millisecond, func(e LimitEvent) { reports <- e })
+	defer close(done)
+
+	time.Sleep(50 * time.Millisecond)
+	os.WriteFile(events, []byte("low 0\nhigh 0\nmax 5\noom 2\noom_kill 2\n"), 0644)
+
+	select {
+	case e := <-reports:
+		if e.Limit != "memory.max" || e.Count != 2 {
+			t.Errorf("unexpected event %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Error("oom kill was not reported")
+	}
+}
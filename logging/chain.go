@@ -0,0 +1,257 @@
+package logging
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Fields added to every record of a chain.
+const (
+	chainIDKey       = "webshell.chain.id"
+	chainSeqKey      = "webshell.chain.seq"
+	chainPrevKey     = "webshell.chain.prev"
+	chainLinkIDKey   = "webshell.chain.link.id"
+	chainLinkSeqKey  = "webshell.chain.link.seq"
+	chainLinkHashKey = "webshell.chain.link.hash"
+	signatureKey     = "webshell.checkpoint.signature"
+	checkpointAction = "audit-checkpoint"
+)
+
+// Chain makes a log tamper-evident. Each record it writes is numbered and
+// has the hash of the record before it, so a record that's edited, removed or
+// moved breaks the chain. Checkpoints signed with the key are written
+// periodically, and on Close, so the chain can't be rewritten either.
+// Every time the server starts a new chain is started, with a new id, whose
+// first record links to the last checkpoint of the chain before it, so a
+// chain that's removed, or cut short at a checkpoint, is noticed too.
+type Chain struct {
+	w     io.Writer
+	key   ed25519.PrivateKey
+	id    string
+	state string     // File the end of the chain is kept in, at each checkpoint
+	link  *chainLink // The end of the chain before, if there was one
+
+	mu      sync.Mutex
+	seq     uint64
+	prev    string // Hash of the last record written
+	signed  uint64 // The last record covered by a checkpoint
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// The end of a chain, as of its last checkpoint.
+type chainLink struct {
+	ID   string `json:"id"`
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"` // Of the checkpoint
+}
+
+// NewChain starts a chain of the records written to w, with a checkpoint
+// signed by key every interval there's been something new written. The end
+// of the chain is kept in the state file, and the next chain is linked to it.
+func NewChain(w io.Writer, key ed25519.PrivateKey, interval time.Duration, state string) (*Chain, error) {
+	id := make([]byte, 8)
+	rand.Read(id)
+	c := &Chain{
+		w:       w,
+		key:     key,
+		id:      hex.EncodeToString(id),
+		state:   state,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if state != "" {
+		if err := os.MkdirAll(filepath.Dir(state), 0700); err != nil {
+			return nil, err
+		}
+		data, err := os.ReadFile(state)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		if err == nil {
+			c.link = &chainLink{}
+			if err := json.Unmarshal(data, c.link); err != nil {
+				return nil, fmt.Errorf("invalid chain state %s: %w", state, err)
+			}
+		}
+	}
+	go c.checkpoints(interval)
+	return c, nil
+}
+
+// Write adds a record, a line of JSON, to the chain.
+func (c *Chain) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.write(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close writes a final checkpoint, so the end of the chain is signed too.
+func (c *Chain) Close() error {
+	close(c.stop)
+	<-c.stopped
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.checkpoint()
+}
+
+// Adds the chain's fields to the end of a record and writes it. Called with c.mu held.
+func (c *Chain) write(p []byte) error {
+	record := bytes.TrimRight(p, "\n")
+	if !bytes.HasSuffix(record, []byte("}")) {
+		return errors.New("log record isn't a JSON object")
+	}
+
+	seq := c.seq + 1
+	fields := fmt.Sprintf(`"%s":"%s","%s":%d,"%s":"%s"}`, chainIDKey, c.id, chainSeqKey, seq, chainPrevKey, c.prev)
+	if seq == 1 && c.link != nil {
+		fields = fmt.Sprintf(`"%s":"%s","%s":%d,"%s":"%s",`, chainLinkIDKey, c.link.ID, chainLinkSeqKey, c.link.Seq, chainLinkHashKey, c.link.Hash) + fields
+	}
+	line := append(bytes.Clone(record[:len(record)-1]), ',')
+	if len(record) == 2 {
+		line = line[:1]
+	}
+	line = append(line, fields...)
+
+	// Some sinks may have it even if others failed, so it's part of the chain either way.
+	_, err := c.w.Write(append(line, '\n'))
+	c.seq = seq
+	c.prev = hashRecord(line)
+	return err
+}
+
+// Writes a checkpoint, if anything has been written since the last one. Called with c.mu held.
+func (c *Chain) checkpoint() error {
+	if c.seq == c.signed {
+		return nil
+	}
+
+	seq := c.seq + 1
+	signature := ed25519.Sign(c.key, checkpointMessage(c.id, seq, c.prev))
+	record, err := json.Marshal(map[string]any{
+		"@timestamp":   time.Now(),
+		"message":      fmt.Sprintf("Audit checkpoint of %d records", c.seq),
+		"log.level":    "info",
+		"ecs.version":  ecsVersion,
+		"event.kind":   "event",
+		"event.action": checkpointAction,
+		signatureKey:   base64.StdEncoding.EncodeToString(signature),
+	})
+	if err != nil {
+		return err
+	}
+	if err := c.write(record); err != nil {
+		return err
+	}
+	c.signed = c.seq
+	return c.saveState()
+}
+
+// Keeps the end of the chain, as of the checkpoint just written, for the
+// next chain to link to. Called with c.mu held.
+func (c *Chain) saveState() error {
+	if c.state == "" {
+		return nil
+	}
+	data, _ := json.Marshal(chainLink{ID: c.id, Seq: c.seq, Hash: c.prev})
+	return replaceFile(c.state, data)
+}
+
+func (c *Chain) checkpoints(interval time.Duration) {
+	defer close(c.stopped)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.mu.Lock()
+			if err := c.checkpoint(); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to write audit checkpoint: %s\n", err)
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// The hash of a record as written, without its newline.
+func hashRecord(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// What a checkpoint signs: its place in the chain, and the hash of the record
+// before it, which covers every record before that.
+func checkpointMessage(id string, seq uint64, prev string) []byte {
+	return fmt.Appendf(nil, "webshell-chain %s %d %s", id, seq, prev)
+}
+
+// LoadSigningKey reads an Ed25519 private key from a PKCS #8 PEM file, as
+// written by `openssl genpkey -algorithm ed25519`.
+func LoadSigningKey(file string) (ed25519.PrivateKey, error) {
+	key, err := loadKey(file)
+	if err != nil {
+		return nil, err
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an Ed25519 private key")
+	}
+	return private, nil
+}
+
+// LoadVerifyingKey reads an Ed25519 public key from a PEM file, or the public
+// half of a private key.
+func LoadVerifyingKey(file string) (ed25519.PublicKey, error) {
+	key, err := loadKey(file)
+	if err != nil {
+		return nil, err
+	}
+	if signer, ok := key.(crypto.Signer); ok {
+		key = signer.Public()
+	}
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("not an Ed25519 key")
+	}
+	return public, nil
+}
+
+func loadKey(file string) (any, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM key found")
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	return nil, fmt.Errorf("unsupported key type %s", block.Type)
+}
@@ -0,0 +1,177 @@
+package logging
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Writes n chained records and a final checkpoint, returning the lines written.
+func chainedLog(t *testing.T, key ed25519.PrivateKey, n int) []string {
+	t.Helper()
+	return linkedLog(t, key, "", n)
+}
+
+// Writes a chain, with a checkpoint after every batch of records, that links
+// to the chain before it kept in the state file.
+func linkedLog(t *testing.T, key ed25519.PrivateKey, state string, batches ...int) []string {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	c, err := NewChain(buf, key, time.Hour, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range batches {
+		for i := range n {
+			fmt.Fprintf(c, `{"message":"record %d"}`+"\n", i)
+		}
+		c.mu.Lock()
+		c.checkpoint()
+		c.mu.Unlock()
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(buf.String()), "\n")
+}
+
+// The id of the chain a record is in.
+func chainID(line string) string {
+	return line[strings.Index(line, `"webshell.chain.id":"`)+21:][:16]
+}
+
+func verify(t *testing.T, lines []string, key ed25519.PublicKey) []string {
+	t.Helper()
+	return verifyStrict(t, lines, key, false)
+}
+
+func verifyStrict(t *testing.T, lines []string, key ed25519.PublicKey, strict bool) []string {
+	t.Helper()
+	v, err := VerifyChain(strings.NewReader(strings.Join(lines, "\n")+"\n"), key, strict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems := []string{}
+	for _, p := range v.Problems {
+		problems = append(problems, fmt.Sprintf("%d: %s", p.Line, p.Message))
+	}
+	return problems
+}
+
+func TestVerifyChain(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(nil)
+	lines := chainedLog(t, private, 5)
+	if len(lines) != 6 {
+		t.Fatalf("expected 5 records and a checkpoint, got %q", lines)
+	}
+
+	// Application logs mixed into the same file are ignored.
+	withApp := append([]string{`{"message":"app"}`}, lines...)
+	v, _ := VerifyChain(strings.NewReader(strings.Join(withApp, "\n")), public, false)
+	if len(v.Problems) != 0 || v.Records != 6 || v.Unchained != 1 || v.Checkpoints != 1 || v.Chains != 1 {
+		t.Errorf("got %+v", v)
+	}
+	// Unless they're strict, when they could be forged records.
+	if problems := verifyStrict(t, withApp, public, true); !slices.Equal(problems, []string{"1: record isn't part of a chain"}) {
+		t.Errorf("strict: got %q", problems)
+	}
+
+	tamper := func(f func([]string) []string) []string {
+		return f(slices.Clone(lines))
+	}
+	tests := []struct {
+		name     string
+		lines    []string
+		key      ed25519.PublicKey
+		problems []string
+	}{
+		{"modified", tamper(func(l []string) []string {
+			l[1] = strings.Replace(l[1], "record 1", "record X", 1)
+			return l
+		}), public, []string{"2: record 2 has been modified, it doesn't match the hash in record 3"}},
+		{"removed", tamper(func(l []string) []string {
+			return slices.Delete(l, 2, 3)
+		}), public, []string{"3: record 3 is missing"}},
+		{"reordered", tamper(func(l []string) []string {
+			l[1], l[2] = l[2], l[1]
+			return l
+		}), public, []string{"3: record 2 is out of order, it's after record 3"}},
+		{"duplicated", tamper(func(l []string) []string {
+			return slices.Insert(l, 3, l[0])
+		}), public, []string{"4: record 1 is duplicated, it's also on line 1"}},
+		{"truncated", tamper(func(l []string) []string {
+			return l[:4]
+		}), public, []string{"4: records 1-4 at the end of the chain are not covered by a signed checkpoint"}},
+		{"wrong key", lines, func() ed25519.PublicKey { k, _, _ := ed25519.GenerateKey(nil); return k }(), []string{
+			"6: checkpoint 6 has an invalid signature",
+			"6: records 1-6 at the end of the chain are not covered by a signed checkpoint",
+		}},
+	}
+	for _, test := range tests {
+		if problems := verify(t, test.lines, test.key); !slices.Equal(problems, test.problems) {
+			t.Errorf("%s: got %q, expected %q", test.name, problems, test.problems)
+		}
+	}
+}
+
+// A chain rewritten after a record was removed fails its checkpoint.
+func TestVerifyChainRewritten(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(nil)
+	lines := chainedLog(t, private, 3)
+
+	// Rebuilds the chain without record 2, keeping the original checkpoint.
+	buf := &bytes.Buffer{}
+	c := &Chain{w: buf, id: chainID(lines[0])}
+	for _, line := range []string{lines[0], lines[2], lines[3]} {
+		record := line[:strings.Index(line, `,"webshell.chain.id"`)] + "}"
+		c.write([]byte(record))
+	}
+
+	problems := verify(t, strings.Split(strings.TrimSpace(buf.String()), "\n"), public)
+	if len(problems) == 0 || !strings.Contains(problems[0], "invalid signature") {
+		t.Errorf("got %q", problems)
+	}
+}
+
+// Each chain links to the end of the one before, so a chain that's removed,
+// or cut short at a checkpoint, is found.
+func TestVerifyChainLinked(t *testing.T) {
+	public, private, _ := ed25519.GenerateKey(nil)
+	state := filepath.Join(t.TempDir(), "chain.json")
+	first := linkedLog(t, private, state, 2, 2)
+	second := linkedLog(t, private, state, 2)
+	third := linkedLog(t, private, state, 2)
+	if !strings.Contains(second[0], `"webshell.chain.link.seq":6`) {
+		t.Fatalf("the second chain doesn't link to the end of the first: %s", second[0])
+	}
+
+	join := func(logs ...[]string) []string {
+		return slices.Concat(logs...)
+	}
+	tests := []struct {
+		name     string
+		lines    []string
+		problems []string
+	}{
+		{"whole", join(first, second, third), []string{}},
+		// Older logs may have been rotated away.
+		{"from the second", join(second, third), []string{}},
+		{"removed", join(first, third), []string{
+			"7: the chain before it, " + chainID(second[0]) + ", is missing",
+		}},
+		{"cut short", join(first[:3], second, third), []string{
+			"4: records 4-6 at the end of the chain are missing, chain " + chainID(second[0]) + " follows record 6",
+		}},
+		{"unlinked", join(first, chainedLog(t, private, 1)), []string{"7: the chain doesn't link to the chain before it"}},
+	}
+	for _, test := range tests {
+		if problems := verify(t, test.lines, public); !slices.Equal(problems, test.problems) {
+			t.Errorf("%s: got %q, expected %q", test.name, problems, test.problems)
+		}
+	}
+}
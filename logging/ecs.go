@@ -11,7 +11,11 @@ const (
 	ecsVersion = "8.10.0"
 )
 
+// Drops slog's own fields, which are replaced by their ECS equivalents.
 func replacer(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) > 0 {
+		return a
+	}
 	switch a.Key {
 	case "time", "msg", "source", "level":
 		return slog.Attr{}
@@ -20,9 +24,26 @@ func replacer(groups []string, a slog.Attr) slog.Attr {
 	}
 }
 
+type sessionKey struct{}
+
+// WithSessionID returns a context whose log records are tagged with the session's id.
+func WithSessionID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, sessionKey{}, id)
+}
+
+// SessionID returns the id of the session ctx belongs to, or an empty string.
+func SessionID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(sessionKey{}).(string)
+	return id
+}
+
 type Handler struct {
 	source      string
 	jsonHandler slog.Handler
+	hasSession  bool // Whether session.id has been added with WithAttrs
 }
 
 func NewHandler(w io.Writer, source string, logLevel *slog.LevelVar) *Handler {
@@ -50,6 +71,11 @@ func (h *Handler) Handle(ctx context.Context, record slog.Record) error {
 		level = "error"
 	}
 
+	// Records logged with a session's context are tagged with it, unless they already are.
+	if id := SessionID(ctx); id != "" && !h.hasSession && !hasAttr(record, "session.id") {
+		record.AddAttrs(slog.String("session.id", id))
+	}
+
 	record.AddAttrs(
 		slog.String("ecs.version", ecsVersion),
 		slog.Time("@timestamp", record.Time),
@@ -70,11 +96,24 @@ func (h *Handler) Handle(ctx context.Context, record slog.Record) error {
 }
 
 func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
-	return &Handler{jsonHandler: h.jsonHandler.WithAttrs(attrs)}
+	hasSession := h.hasSession
+	for _, a := range attrs {
+		hasSession = hasSession || a.Key == "session.id"
+	}
+	return &Handler{source: h.source, jsonHandler: h.jsonHandler.WithAttrs(attrs), hasSession: hasSession}
 }
 
 func (h *Handler) WithGroup(name string) slog.Handler {
-	return &Handler{jsonHandler: h.jsonHandler.WithGroup(name)}
+	return &Handler{source: h.source, jsonHandler: h.jsonHandler.WithGroup(name), hasSession: h.hasSession}
+}
+
+func hasAttr(record slog.Record, key string) bool {
+	found := false
+	record.Attrs(func(a slog.Attr) bool {
+		found = a.Key == key
+		return !found
+	})
+	return found
 }
 
 func NewEcsLogger(source string, logLevel *slog.LevelVar) *slog.Logger {
@@ -0,0 +1,58 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// Logs a record with log, returning it decoded.
+func logRecord(t *testing.T, log func(*slog.Logger)) map[string]any {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	log(slog.New(NewHandler(buf, "session", new(slog.LevelVar))))
+
+	record := map[string]any{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("%s: %q", err, buf)
+	}
+	return record
+}
+
+func TestHandlerSessionID(t *testing.T) {
+	ctx := WithSessionID(context.Background(), "ABC")
+
+	record := logRecord(t, func(l *slog.Logger) { l.InfoContext(ctx, "hi") })
+	if record["session.id"] != "ABC" {
+		t.Errorf("got session.id %v", record["session.id"])
+	}
+	if webshell, _ := record["webshell"].(map[string]any); webshell["source"] != "session" {
+		t.Errorf("got webshell %v", record["webshell"])
+	}
+
+	record = logRecord(t, func(l *slog.Logger) { l.Info("hi") })
+	if _, ok := record["session.id"]; ok {
+		t.Error("session.id set without a session")
+	}
+
+	// Not duplicated when it's already set.
+	for _, log := range []func(*slog.Logger){
+		func(l *slog.Logger) { l.InfoContext(ctx, "hi", slog.String("session.id", "ABC")) },
+		func(l *slog.Logger) { l.With(slog.String("session.id", "ABC")).InfoContext(ctx, "hi") },
+	} {
+		buf := &bytes.Buffer{}
+		log(slog.New(NewHandler(buf, "session", new(slog.LevelVar))))
+		if n := strings.Count(buf.String(), `"session.id"`); n != 1 {
+			t.Errorf("session.id logged %d times: %s", n, buf)
+		}
+	}
+
+	// The source is kept by loggers with attributes.
+	record = logRecord(t, func(l *slog.Logger) { l.With(slog.Int("process.pid", 1)).Info("hi") })
+	if webshell, _ := record["webshell"].(map[string]any); webshell["source"] != "session" {
+		t.Errorf("got webshell %v", record["webshell"])
+	}
+}
@@ -0,0 +1,167 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// FileSink appends records to a local file, rotating it once it reaches
+// MaxSize or has been open for MaxAge. Rotated files have the time they were
+// rotated appended to their name, and only the newest Keep are kept.
+type FileSink struct {
+	Path     string
+	MaxSize  int64         // 0 is unlimited
+	MaxAge   time.Duration // 0 is forever
+	Keep     int           // 0 keeps every rotated file
+	SyncEach bool          // Sync each batch before Send returns, rather than every syncInterval
+
+	mu        sync.Mutex
+	file      *os.File
+	size      int64
+	opened    time.Time
+	syncTimer *time.Timer
+}
+
+// Format of the time appended to rotated files, it sorts in time order.
+const rotatedTimeFormat = "20060102T150405.000"
+
+func (s *FileSink) Send(records [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+
+	for _, record := range records {
+		length := int64(len(record) + 1)
+		full := s.MaxSize > 0 && s.size > 0 && s.size+length > s.MaxSize
+		old := s.MaxAge > 0 && time.Since(s.opened) >= s.MaxAge
+		if full || old {
+			if err := s.rotate(); err != nil {
+				return err
+			}
+		}
+
+		if _, err := s.file.Write(append(record, '\n')); err != nil {
+			return err
+		}
+		s.size += length
+	}
+	if s.SyncEach {
+		return s.file.Sync()
+	}
+	if s.syncTimer == nil {
+		s.syncTimer = time.AfterFunc(syncInterval, s.sync)
+	}
+	return nil
+}
+
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.syncTimer != nil {
+		s.syncTimer.Stop()
+		s.syncTimer = nil
+	}
+	if s.file == nil {
+		return nil
+	}
+	s.file.Sync()
+	return s.file.Close()
+}
+
+// Syncs the records sent since the last sync to disk.
+func (s *FileSink) sync() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.syncTimer == nil || s.file == nil {
+		return
+	}
+	s.syncTimer = nil
+	if err := s.file.Sync(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to sync log file %s: %s\n", s.Path, err)
+	}
+}
+
+func (s *FileSink) open() error {
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file, s.size, s.opened = f, stat.Size(), time.Now()
+	return nil
+}
+
+// Moves the current file aside, removes the oldest rotated files over Keep, and starts a new file.
+func (s *FileSink) rotate() error {
+	s.file.Sync()
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+	rotated := s.Path + "." + time.Now().Format(rotatedTimeFormat)
+	for i := 1; exists(rotated); i++ {
+		// Rotated more than once in the same millisecond.
+		rotated = fmt.Sprintf("%s.%s-%d", s.Path, time.Now().Format(rotatedTimeFormat), i)
+	}
+	if err := os.Rename(s.Path, rotated); err != nil {
+		return err
+	}
+
+	if s.Keep > 0 {
+		backups, _ := filepath.Glob(s.Path + ".*")
+		slices.Sort(backups)
+		for len(backups) > s.Keep {
+			os.Remove(backups[0])
+			backups = backups[1:]
+		}
+	}
+	return s.open()
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// Replaces a small file atomically, and durably, so after a crash it's
+// either the old contents or the new.
+func replaceFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
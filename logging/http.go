@@ -0,0 +1,46 @@
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// How long the HTTP sink waits for each batch to be accepted.
+const httpTimeout = 30 * time.Second
+
+// HTTPSink POSTs batches of records as newline delimited JSON. Credentials
+// in the URL are sent with basic auth.
+type HTTPSink struct {
+	URL string
+}
+
+func (s *HTTPSink) Send(records [][]byte) error {
+	body := bytes.Join(records, []byte("\n"))
+	body = append(body, '\n')
+
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	client := http.Client{Timeout: httpTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s", req.URL.Redacted(), resp.Status)
+	}
+	return nil
+}
+
+func (s *HTTPSink) Close() error {
+	return nil
+}
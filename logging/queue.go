@@ -0,0 +1,388 @@
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits on the batches sent from the queue.
+const (
+	maxBatchSize  = 1 << 20
+	maxBatchCount = 500
+)
+
+// The size segment files are filled up to before starting another.
+var maxSegmentSize int64 = 16 << 20
+
+// How long to wait between failed sends, doubling up to the max.
+var (
+	minRetryDelay = time.Second
+	maxRetryDelay = time.Minute
+)
+
+// How long Close waits for the queue to be sent before giving up.
+var drainTimeout = 5 * time.Second
+
+// How long records can be written before they're synced to disk, unless each
+// one is synced. Records written in between are lost if the machine crashes.
+var syncInterval = time.Second
+
+// Queue is a disk-backed queue in front of a sink. Records are written to
+// segment files before Write returns, and only removed once the sink has
+// accepted them, so nothing is lost while the sink is down or across restarts.
+// Records sent just before a crash may be sent again.
+//
+// A sink that's down for long enough could fill the disk, so with a max size
+// the oldest unsent segments are dropped when a new one is started, leaving
+// the most recent records.
+type Queue struct {
+	dir      string
+	sink     Sink
+	syncEach bool  // Sync each record before Write returns, rather than every syncInterval
+	maxSize  int64 // Bytes kept on disk before the oldest records are dropped, 0 is unlimited
+
+	mu        sync.Mutex
+	file      *os.File // The segment being appended to
+	seg       uint64
+	size      int64
+	syncTimer *time.Timer   // Syncs the records written since the last sync
+	wrote     chan struct{} // Wakes the sender when records are written
+
+	closing chan struct{} // Send what's queued, then stop
+	stop    chan struct{} // Stop now
+	done    chan struct{}
+	once    sync.Once
+}
+
+// The position of the next record to send, saved in the cursor file.
+type cursor struct {
+	seg    uint64
+	offset int64
+}
+
+// NewQueue opens the queue in dir, creating it if needed, and starts sending
+// anything already in it to sink. With syncEach every record is synced to
+// disk before Write returns, which is slower but survives the machine crashing.
+// Past maxSize bytes, unless it's 0, the oldest records are dropped.
+func NewQueue(dir string, sink Sink, syncEach bool, maxSize int64) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	q := &Queue{
+		dir:      dir,
+		sink:     sink,
+		syncEach: syncEach,
+		maxSize:  maxSize,
+		wrote:    make(chan struct{}, 1),
+		closing:  make(chan struct{}),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	segs, err := q.segments()
+	if err != nil {
+		return nil, err
+	}
+	q.seg = 1
+	if len(segs) > 0 {
+		q.seg = segs[len(segs)-1]
+	}
+	if err := q.openSegment(); err != nil {
+		return nil, err
+	}
+
+	go q.send()
+	return q, nil
+}
+
+// Write appends a record to the queue, it's on disk once Write returns, and
+// synced to it then or within syncInterval.
+func (q *Queue) Write(p []byte) (int, error) {
+	record := p
+	if !bytes.HasSuffix(record, []byte("\n")) {
+		record = append(bytes.Clone(p), '\n')
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.size > 0 && q.size+int64(len(record)) > maxSegmentSize {
+		q.file.Sync()
+		q.file.Close()
+		q.seg++
+		if err := q.openSegment(); err != nil {
+			return 0, err
+		}
+		q.trim()
+	}
+	if _, err := q.file.Write(record); err != nil {
+		return 0, err
+	}
+	if q.syncEach {
+		if err := q.file.Sync(); err != nil {
+			return 0, err
+		}
+	} else if q.syncTimer == nil {
+		q.syncTimer = time.AfterFunc(syncInterval, q.sync)
+	}
+	q.size += int64(len(record))
+
+	select {
+	case q.wrote <- struct{}{}:
+	default:
+	}
+	return len(p), nil
+}
+
+// Close tries to send what's queued, for up to drainTimeout, then closes the sink.
+func (q *Queue) Close() error {
+	q.once.Do(func() {
+		close(q.closing)
+		select {
+		case <-q.done:
+		case <-time.After(drainTimeout):
+			close(q.stop)
+			<-q.done
+		}
+	})
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.syncTimer != nil {
+		q.syncTimer.Stop()
+		q.syncTimer = nil
+	}
+	q.file.Sync()
+	q.file.Close()
+	return q.sink.Close()
+}
+
+// Syncs the records written since the last sync to disk.
+func (q *Queue) sync() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.syncTimer == nil {
+		// Closed since the timer fired.
+		return
+	}
+	q.syncTimer = nil
+	if err := q.file.Sync(); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to sync log queue %s: %s\n", q.dir, err)
+	}
+}
+
+// Drops the oldest segments, sent or not, until the queue is within maxSize.
+// The segment being written to is always kept. Called with q.mu held.
+func (q *Queue) trim() {
+	if q.maxSize <= 0 {
+		return
+	}
+	segs, err := q.segments()
+	if err != nil {
+		return
+	}
+	sizes := map[uint64]int64{}
+	var total int64
+	for _, seg := range segs {
+		if stat, err := os.Stat(q.segmentPath(seg)); err == nil {
+			sizes[seg] = stat.Size()
+			total += stat.Size()
+		}
+	}
+	var dropped int64
+	for _, seg := range segs {
+		if total <= q.maxSize || seg >= q.seg {
+			break
+		}
+		if err := os.Remove(q.segmentPath(seg)); err == nil {
+			total -= sizes[seg]
+			dropped += sizes[seg]
+		}
+	}
+	if dropped > 0 {
+		fmt.Fprintf(os.Stderr, "Log queue %s is over %d bytes, dropped the oldest %d bytes of records\n", q.dir, q.maxSize, dropped)
+	}
+}
+
+// Opens the current segment for appending. Called with q.mu held, or before the sender starts.
+func (q *Queue) openSegment() error {
+	f, err := os.OpenFile(q.segmentPath(q.seg), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	q.file, q.size = f, stat.Size()
+	return nil
+}
+
+func (q *Queue) segmentPath(seg uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d.log", seg))
+}
+
+// Returns the numbers of the segment files, oldest first.
+func (q *Queue) segments() ([]uint64, error) {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	segs := []uint64{}
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".log")
+		if !ok {
+			continue
+		}
+		if seg, err := strconv.ParseUint(name, 10, 64); err == nil {
+			segs = append(segs, seg)
+		}
+	}
+	slices.Sort(segs)
+	return segs, nil
+}
+
+// Sends batches of records to the sink until the queue is closed, retrying
+// each until it's accepted.
+func (q *Queue) send() {
+	defer close(q.done)
+
+	pos := q.readCursor()
+	delay := minRetryDelay
+	for {
+		batch, next, err := q.read(pos)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read log queue %s: %s\n", q.dir, err)
+		}
+
+		if len(batch) == 0 {
+			if next != pos {
+				pos = next
+				q.writeCursor(pos)
+				continue
+			}
+			select {
+			case <-q.wrote:
+				continue
+			case <-q.closing:
+				return
+			case <-q.stop:
+				return
+			}
+		}
+
+		if err := q.sink.Send(batch); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to send logs, retrying in %s: %s\n", delay, err)
+			select {
+			case <-q.closing:
+				// Left on disk to be sent after a restart.
+				return
+			case <-q.stop:
+				return
+			case <-time.After(delay):
+			}
+			delay = min(delay*2, maxRetryDelay)
+			continue
+		}
+
+		delay = minRetryDelay
+		pos = next
+		q.writeCursor(pos)
+	}
+}
+
+// Reads the next batch of records from pos. Segments that have been sent, and
+// aren't being written to, are removed. Returns the position after the batch.
+func (q *Queue) read(pos cursor) ([][]byte, cursor, error) {
+	f, err := os.Open(q.segmentPath(pos.seg))
+	if os.IsNotExist(err) {
+		return nil, q.nextSegment(pos), nil
+	}
+	if err != nil {
+		return nil, pos, err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(pos.offset, io.SeekStart); err != nil {
+		return nil, pos, err
+	}
+
+	batch := [][]byte{}
+	size := 0
+	r := bufio.NewReader(f)
+	for len(batch) < maxBatchCount && size < maxBatchSize {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			// A record without its newline is still being written.
+			break
+		}
+		batch = append(batch, bytes.TrimSuffix(line, []byte("\n")))
+		size += len(line)
+		pos.offset += int64(len(line))
+	}
+
+	if len(batch) == 0 {
+		return nil, q.nextSegment(pos), nil
+	}
+	return batch, pos, nil
+}
+
+// Moves on from a segment that's been sent, if it's no longer being written to.
+func (q *Queue) nextSegment(pos cursor) cursor {
+	q.mu.Lock()
+	current := q.seg
+	q.mu.Unlock()
+	if pos.seg >= current {
+		return pos
+	}
+	// It may have been read before the last records were finished.
+	if stat, err := os.Stat(q.segmentPath(pos.seg)); err == nil && stat.Size() > pos.offset {
+		return pos
+	}
+	os.Remove(q.segmentPath(pos.seg))
+
+	// Skip any gap in the numbering, e.g. segments removed by hand.
+	segs, err := q.segments()
+	if err == nil {
+		if i := slices.IndexFunc(segs, func(s uint64) bool { return s > pos.seg }); i >= 0 {
+			return cursor{seg: segs[i]}
+		}
+	}
+	return cursor{seg: pos.seg + 1}
+}
+
+func (q *Queue) readCursor() cursor {
+	pos := cursor{seg: 1}
+	if segs, err := q.segments(); err == nil && len(segs) > 0 {
+		pos.seg = segs[0]
+	}
+
+	data, err := os.ReadFile(filepath.Join(q.dir, "cursor"))
+	if err != nil {
+		return pos
+	}
+	saved := cursor{}
+	if _, err := fmt.Sscanf(string(data), "%d %d", &saved.seg, &saved.offset); err != nil || saved.seg < pos.seg {
+		return pos
+	}
+	return saved
+}
+
+// Saves the position, replacing the cursor file atomically so it's never half
+// written, and syncing it so records aren't sent again after a crash.
+func (q *Queue) writeCursor(pos cursor) {
+	data := fmt.Sprintf("%d %d\n", pos.seg, pos.offset)
+	if err := replaceFile(filepath.Join(q.dir, "cursor"), []byte(data)); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to save log queue position: %s\n", err)
+	}
+}
@@ -0,0 +1,251 @@
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Records what it's sent, failing while down is set.
+type fakeSink struct {
+	mu      sync.Mutex
+	down    bool
+	records []string
+	closed  bool
+}
+
+func (s *fakeSink) Send(records [][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down {
+		return errors.New("sink down")
+	}
+	for _, r := range records {
+		s.records = append(s.records, string(r))
+	}
+	return nil
+}
+
+func (s *fakeSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *fakeSink) setDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+// Waits for the sink to have been sent n records, returning them.
+func (s *fakeSink) wait(t *testing.T, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		records := slices.Clone(s.records)
+		s.mu.Unlock()
+		if len(records) >= n {
+			return records
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d records", n)
+	return nil
+}
+
+func init() {
+	minRetryDelay = 10 * time.Millisecond
+	maxRetryDelay = 50 * time.Millisecond
+}
+
+func TestQueue(t *testing.T) {
+	dir := t.TempDir()
+	sink := &fakeSink{}
+	q, err := NewQueue(dir, sink, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q.Write([]byte(`{"n":1}` + "\n"))
+	q.Write([]byte(`{"n":2}`))
+	if records := sink.wait(t, 2); !slices.Equal(records, []string{`{"n":1}`, `{"n":2}`}) {
+		t.Errorf("got %q", records)
+	}
+
+	// Retried until the sink comes back.
+	sink.setDown(true)
+	q.Write([]byte(`{"n":3}`))
+	time.Sleep(50 * time.Millisecond)
+	sink.setDown(false)
+	if records := sink.wait(t, 3); records[2] != `{"n":3}` {
+		t.Errorf("got %q", records)
+	}
+
+	q.Close()
+	if !sink.closed {
+		t.Error("sink not closed")
+	}
+}
+
+func TestQueueRestart(t *testing.T) {
+	dir := t.TempDir()
+	drainTimeout = 100 * time.Millisecond
+	defer func() { drainTimeout = 5 * time.Second }()
+
+	// Nothing can be sent before the server stops.
+	sink := &fakeSink{down: true}
+	q, err := NewQueue(dir, sink, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 3 {
+		q.Write([]byte(fmt.Sprintf(`{"n":%d}`, i)))
+	}
+	q.Close()
+
+	// Everything is sent once it restarts, and only once.
+	sink = &fakeSink{}
+	q, err = NewQueue(dir, sink, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Write([]byte(`{"n":3}`))
+	records := sink.wait(t, 4)
+	q.Close()
+	if !slices.Equal(records, []string{`{"n":0}`, `{"n":1}`, `{"n":2}`, `{"n":3}`}) {
+		t.Errorf("got %q", records)
+	}
+
+	sink = &fakeSink{}
+	q, err = NewQueue(dir, sink, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.Write([]byte(`{"n":4}`))
+	records = sink.wait(t, 1)
+	q.Close()
+	if !slices.Equal(records, []string{`{"n":4}`}) {
+		t.Errorf("got %q after restart", records)
+	}
+}
+
+func TestQueueSegments(t *testing.T) {
+	dir := t.TempDir()
+	sink := &fakeSink{}
+	q, err := NewQueue(dir, sink, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	// Fills two segments, the first is removed once it's sent.
+	record := make([]byte, maxSegmentSize/2)
+	for i := range record {
+		record[i] = 'x'
+	}
+	for range 3 {
+		q.Write(record)
+	}
+	sink.wait(t, 3)
+	q.Write([]byte(`{}`))
+	sink.wait(t, 4)
+
+	entries, _ := os.ReadDir(dir)
+	segs := 0
+	for _, e := range entries {
+		if e.Name() != "cursor" {
+			segs++
+		}
+	}
+	if segs != 1 {
+		t.Errorf("got %d segments, expected 1", segs)
+	}
+}
+
+// Without syncEach, records are synced together after syncInterval.
+func TestQueueBatchedSync(t *testing.T) {
+	defer func(interval time.Duration) { syncInterval = interval }(syncInterval)
+	syncInterval = 20 * time.Millisecond
+
+	sink := &fakeSink{}
+	q, err := NewQueue(t.TempDir(), sink, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	q.Write([]byte("one"))
+	q.Write([]byte("two"))
+	q.mu.Lock()
+	pending := q.syncTimer != nil
+	q.mu.Unlock()
+	if !pending {
+		t.Error("the records should be waiting to be synced")
+	}
+	if got := sink.wait(t, 2); !slices.Equal(got, []string{"one", "two"}) {
+		t.Errorf("got %q", got)
+	}
+
+	time.Sleep(5 * syncInterval)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.syncTimer != nil {
+		t.Error("the records weren't synced")
+	}
+}
+
+// Past its max size, the queue drops the oldest records while the sink is down.
+func TestQueueMaxSize(t *testing.T) {
+	defer func(size int64) { maxSegmentSize = size }(maxSegmentSize)
+	maxSegmentSize = 100
+
+	sink := &fakeSink{down: true}
+	q, err := NewQueue(t.TempDir(), sink, true, 250)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	// Ten records a segment, with the newline.
+	for i := range 60 {
+		q.Write([]byte(fmt.Sprintf("record%03d", i)))
+	}
+	sink.setDown(false)
+	records := sink.wait(t, 1)
+	time.Sleep(100 * time.Millisecond)
+	records = sink.wait(t, len(records))
+
+	// The two newest full segments, and the one being written, are kept.
+	if len(records) > 30 || records[len(records)-1] != "record059" {
+		t.Errorf("got %q", records)
+	}
+	if records[0] != "record030" {
+		t.Errorf("the oldest records weren't dropped: %q", records)
+	}
+}
+
+// The cursor is replaced, leaving no temporary file behind.
+func TestQueueCursor(t *testing.T) {
+	dir := t.TempDir()
+	q, err := NewQueue(dir, &fakeSink{}, true, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.writeCursor(cursor{seg: 3, offset: 42})
+	q.Close()
+
+	if pos := q.readCursor(); pos != (cursor{seg: 3, offset: 42}) {
+		t.Errorf("got %+v", pos)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cursor.tmp")); !os.IsNotExist(err) {
+		t.Errorf("cursor.tmp was left behind: %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+package logging
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sink delivers log records, each a line of JSON, somewhere outside the server.
+type Sink interface {
+	// Send delivers a batch of records, it either delivers them all or returns an error.
+	Send(records [][]byte) error
+	Close() error
+}
+
+// ParseSink validates a sink spec without opening it. Specs are URLs:
+//
+//	stdout
+//	file:///var/log/webshell/audit.log?max_size=100M&max_age=24h&keep=7
+//	syslog+tcp://host:514, syslog+udp://host:514 or syslog+unix:///dev/log, with ?facility=local0
+//	http://host/path or https://host/path
+func ParseSink(spec string) error {
+	_, err := openSink(spec, "")
+	return err
+}
+
+// Opens the sink a spec describes. tag names the log stream it's for.
+func openSink(spec string, tag string) (Sink, error) {
+	if spec == "stdout" {
+		return nil, nil
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+
+	switch u.Scheme {
+	case "file":
+		if u.Path == "" {
+			return nil, errors.New("file sink needs a path")
+		}
+		sink := &FileSink{Path: u.Path}
+		if sink.MaxSize, err = parseSize(query.Get("max_size")); err != nil {
+			return nil, err
+		}
+		if v := query.Get("max_age"); v != "" {
+			if sink.MaxAge, err = time.ParseDuration(v); err != nil {
+				return nil, err
+			}
+		}
+		if v := query.Get("keep"); v != "" {
+			if sink.Keep, err = strconv.Atoi(v); err != nil {
+				return nil, fmt.Errorf("invalid keep %q", v)
+			}
+		}
+		return sink, nil
+
+	case "syslog+tcp", "syslog+udp", "syslog+unix":
+		network := strings.TrimPrefix(u.Scheme, "syslog+")
+		address := u.Host
+		if network == "unix" {
+			address = u.Path
+		}
+		if address == "" {
+			return nil, errors.New("syslog sink needs an address")
+		}
+		facility := query.Get("facility")
+		if facility == "" {
+			facility = "user"
+		}
+		if _, ok := syslogFacilities[facility]; !ok {
+			return nil, fmt.Errorf("unknown syslog facility %q", facility)
+		}
+		return &SyslogSink{Network: network, Address: address, Facility: facility, Tag: tag}, nil
+
+	case "http", "https":
+		if u.Host == "" {
+			return nil, errors.New("http sink needs a host")
+		}
+		return &HTTPSink{URL: spec}, nil
+	}
+	return nil, fmt.Errorf("unknown log sink %q", spec)
+}
+
+// Parses a size such as 100M, in bytes.
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		multiplier = 1 << 10
+	case "M":
+		multiplier = 1 << 20
+	case "G":
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
+
+// Output writes each record to every sink of a log stream. Sinks other than
+// stdout are behind a disk-backed Queue.
+type Output struct {
+	writers []io.Writer
+	queues  []*Queue
+}
+
+// NewOutput opens the sinks for a stream, stdout if there are none. Each
+// sink's queue is kept in queueDir, in a directory named after its spec, so
+// records queued before a restart are delivered to the same sink. With
+// syncEach, the queues and file sinks sync each record to disk, otherwise
+// they're synced every syncInterval. Each queue drops its oldest records
+// past maxQueueSize bytes, unless it's 0.
+func NewOutput(specs []string, queueDir string, tag string, syncEach bool, maxQueueSize int64) (*Output, error) {
+	if len(specs) == 0 {
+		specs = []string{"stdout"}
+	}
+
+	o := &Output{}
+	for _, spec := range specs {
+		sink, err := openSink(spec, tag)
+		if err != nil {
+			o.Close()
+			return nil, err
+		}
+		if sink == nil {
+			o.writers = append(o.writers, os.Stdout)
+			continue
+		}
+
+		if file, ok := sink.(*FileSink); ok {
+			file.SyncEach = syncEach
+		}
+		hash := sha256.Sum256([]byte(spec))
+		q, err := NewQueue(filepath.Join(queueDir, fmt.Sprintf("%x", hash[:8])), sink, syncEach, maxQueueSize)
+		if err != nil {
+			sink.Close()
+			o.Close()
+			return nil, fmt.Errorf("failed to open queue for %s: %w", spec, err)
+		}
+		o.writers = append(o.writers, q)
+		o.queues = append(o.queues, q)
+	}
+	return o, nil
+}
+
+// Write writes a record to every sink, it's written to all of them even if one fails.
+func (o *Output) Write(p []byte) (int, error) {
+	errs := []error{}
+	for _, w := range o.writers {
+		if _, err := w.Write(p); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		// The logger has nowhere else to report it.
+		fmt.Fprintf(os.Stderr, "Failed to write log record: %s\n", err)
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close gives each queue a chance to deliver what it holds, then closes the sinks.
+// Anything left is delivered once the server is restarted.
+func (o *Output) Close() error {
+	errs := make([]error, len(o.queues))
+	wg := sync.WaitGroup{}
+	for i, q := range o.queues {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = q.Close()
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,154 @@
+package logging
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestParseSink(t *testing.T) {
+	valid := []string{
+		"stdout",
+		"file:///var/log/webshell/audit.log?max_size=100M&max_age=24h&keep=7",
+		"syslog+tcp://localhost:514?facility=local0",
+		"syslog+udp://localhost:514",
+		"syslog+unix:///dev/log",
+		"https://logs.example.com/ingest",
+	}
+	for _, spec := range valid {
+		if err := ParseSink(spec); err != nil {
+			t.Errorf("%s: %s", spec, err)
+		}
+	}
+
+	invalid := []string{
+		"stderr",
+		"file://",
+		"file:///tmp/x.log?max_size=big",
+		"file:///tmp/x.log?max_age=1",
+		"syslog+tcp://localhost:514?facility=nope",
+		"syslog+unix://",
+		"ftp://example.com",
+	}
+	for _, spec := range invalid {
+		if err := ParseSink(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink := &FileSink{Path: path, MaxSize: 20, Keep: 2}
+	defer sink.Close()
+
+	for _, record := range []string{`{"n":1}`, `{"n":2}`, `{"n":3}`, `{"n":4}`, `{"n":5}`, `{"n":6}`, `{"n":7}`} {
+		if err := sink.Send([][]byte{[]byte(record)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, _ := os.ReadFile(path)
+	if string(data) != "{\"n\":7}\n" {
+		t.Errorf("got %q", data)
+	}
+	rotated, _ := filepath.Glob(path + ".*")
+	if len(rotated) != 2 {
+		t.Errorf("got %d rotated files, expected 2", len(rotated))
+	}
+}
+
+var syslogPattern = regexp.MustCompile(`^<134>1 2024-05-01T10:00:00.000000Z \S+ webshell \d+ audit - \{.*\}$`)
+
+const syslogRecord = `{"@timestamp":"2024-05-01T10:00:00Z","log.level":"info","message":"hi"}`
+
+func TestSyslogSinkUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sink := &SyslogSink{Network: "udp", Address: conn.LocalAddr().String(), Facility: "local0", Tag: "audit"}
+	defer sink.Close()
+	if err := sink.Send([][]byte{[]byte(syslogRecord)}); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4096)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !syslogPattern.Match(buf[:n]) {
+		t.Errorf("got %q", buf[:n])
+	}
+}
+
+func TestSyslogSinkTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	sink := &SyslogSink{Network: "tcp", Address: l.Addr().String(), Facility: "local0", Tag: "audit"}
+	defer sink.Close()
+	if err := sink.Send([][]byte{[]byte(syslogRecord), []byte(syslogRecord)}); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Each message is prefixed with its length.
+	r := bufio.NewReader(conn)
+	for range 2 {
+		var length int
+		if _, err := fmt.Fscanf(r, "%d ", &length); err != nil {
+			t.Fatal(err)
+		}
+		msg := make([]byte, length)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			t.Fatal(err)
+		}
+		if !syslogPattern.Match(msg) {
+			t.Errorf("got %q", msg)
+		}
+	}
+}
+
+func TestHTTPSink(t *testing.T) {
+	var body, contentType string
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		body, contentType = string(data), r.Header.Get("Content-Type")
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	sink := &HTTPSink{URL: server.URL}
+	if err := sink.Send([][]byte{[]byte(`{"n":1}`), []byte(`{"n":2}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if body != "{\"n\":1}\n{\"n\":2}\n" || contentType != "application/x-ndjson" {
+		t.Errorf("got %q as %s", body, contentType)
+	}
+
+	status = http.StatusServiceUnavailable
+	if err := sink.Send([][]byte{[]byte(`{}`)}); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("expected an error for a 503, got %v", err)
+	}
+}
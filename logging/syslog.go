@@ -0,0 +1,113 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "daemon": 3, "auth": 4, "syslog": 5, "authpriv": 10,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// Syslog severities of the ECS log levels.
+var syslogSeverities = map[string]int{"error": 3, "warn": 4, "info": 6, "debug": 7}
+
+// How long to wait connecting to, or writing to, the syslog server.
+const syslogTimeout = 10 * time.Second
+
+// SyslogSink sends records to a syslog server as RFC 5424 messages, with the
+// JSON record as the message. Over TCP messages are framed with their length,
+// as in RFC 6587.
+type SyslogSink struct {
+	Network  string // tcp, udp or unix
+	Address  string
+	Facility string
+	Tag      string // Sent as the MSGID
+
+	conn     net.Conn
+	framed   bool // Whether messages need framing, on stream connections
+	hostname string
+}
+
+func (s *SyslogSink) Send(records [][]byte) error {
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+
+	s.conn.SetWriteDeadline(time.Now().Add(syslogTimeout))
+	for _, record := range records {
+		msg := s.format(record)
+		if s.framed {
+			msg = fmt.Appendf(nil, "%d %s", len(msg), msg)
+		}
+		if _, err := s.conn.Write(msg); err != nil {
+			// Reconnect on the next attempt, the whole batch is sent again.
+			s.conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SyslogSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+func (s *SyslogSink) connect() error {
+	s.hostname, _ = os.Hostname()
+	if s.hostname == "" {
+		s.hostname = "-"
+	}
+
+	network := s.Network
+	if network == "unix" {
+		// The local syslog socket is usually a datagram socket.
+		conn, err := net.DialTimeout("unixgram", s.Address, syslogTimeout)
+		if err == nil {
+			s.conn, s.framed = conn, false
+			return nil
+		}
+	}
+	conn, err := net.DialTimeout(network, s.Address, syslogTimeout)
+	if err != nil {
+		return err
+	}
+	s.conn, s.framed = conn, network != "udp"
+	return nil
+}
+
+// Formats a record as <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID - MSG,
+// taking the severity and timestamp from the record.
+func (s *SyslogSink) format(record []byte) []byte {
+	fields := struct {
+		Timestamp time.Time `json:"@timestamp"`
+		Level     string    `json:"log.level"`
+	}{}
+	json.Unmarshal(record, &fields)
+	if fields.Timestamp.IsZero() {
+		fields.Timestamp = time.Now()
+	}
+	severity, ok := syslogSeverities[fields.Level]
+	if !ok {
+		severity = syslogSeverities["info"]
+	}
+
+	tag := s.Tag
+	if tag == "" {
+		tag = "-"
+	}
+	pri := syslogFacilities[s.Facility]*8 + severity
+	timestamp := fields.Timestamp.UTC().Format("2006-01-02T15:04:05.000000Z07:00")
+	return fmt.Appendf(nil, "<%d>1 %s %s webshell %d %s - %s", pri, timestamp, s.hostname, os.Getpid(), tag, record)
+}
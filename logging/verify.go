@@ -0,0 +1,201 @@
+package logging
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// Problem is something wrong with a chained log, found by VerifyChain.
+type Problem struct {
+	Line    int // Of the input, from 1
+	Chain   string
+	Message string
+}
+
+// Verification is what VerifyChain found.
+type Verification struct {
+	Records     int // Chained records
+	Unchained   int // Records that aren't part of a chain, e.g. application logs, only problems when strict
+	Chains      int
+	Checkpoints int // Checkpoints with a valid signature
+	Problems    []Problem
+}
+
+// The state of one chain, records may be out of order so they're kept by sequence number.
+type chainState struct {
+	id     string
+	hashes map[uint64]string // Of each record
+	prevs  map[uint64]string // The hash each record has of the one before it
+	lines  map[uint64]int
+	max    uint64
+	signed uint64     // The last record covered by a valid checkpoint
+	link   *chainLink // The end of the chain before, from its first record
+}
+
+// VerifyChain checks the chained records in a log, as written by Chain, and
+// reports records that were modified, removed, duplicated or moved, and any
+// at the end of a chain that aren't covered by a checkpoint signed by key.
+// Each chain after the first has to link to the end of the one before it, so
+// a chain that was removed, or cut short at a checkpoint, is reported too.
+// A log split over several files can be checked by reading them in order.
+// When strict, records that aren't part of a chain are reported as well.
+func VerifyChain(r io.Reader, key ed25519.PublicKey, strict bool) (*Verification, error) {
+	v := &Verification{}
+	chains := map[string]*chainState{}
+	order := []*chainState{}
+	problem := func(line int, c *chainState, format string, args ...any) {
+		v.Problems = append(v.Problems, Problem{Line: line, Chain: c.id, Message: fmt.Sprintf(format, args...)})
+	}
+
+	in := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := in.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) == 0 {
+			if err == io.EOF {
+				break
+			}
+			continue
+		}
+
+		record := struct {
+			ID        string  `json:"webshell.chain.id"`
+			Seq       uint64  `json:"webshell.chain.seq"`
+			Prev      *string `json:"webshell.chain.prev"`
+			Action    string  `json:"event.action"`
+			Signature string  `json:"webshell.checkpoint.signature"`
+			LinkID    string  `json:"webshell.chain.link.id"`
+			LinkSeq   uint64  `json:"webshell.chain.link.seq"`
+			LinkHash  string  `json:"webshell.chain.link.hash"`
+		}{}
+		if json.Unmarshal(line, &record) != nil || record.ID == "" || record.Seq == 0 || record.Prev == nil {
+			v.Unchained++
+			if strict {
+				v.Problems = append(v.Problems, Problem{Line: n, Message: "record isn't part of a chain"})
+			}
+			continue
+		}
+		v.Records++
+
+		c, ok := chains[record.ID]
+		if !ok {
+			c = &chainState{id: record.ID, hashes: map[uint64]string{}, prevs: map[uint64]string{}, lines: map[uint64]int{}}
+			chains[record.ID] = c
+			order = append(order, c)
+		}
+		seq, prev, hash := record.Seq, *record.Prev, hashRecord(line)
+
+		if first, ok := c.lines[seq]; ok {
+			problem(n, c, "record %d is duplicated, it's also on line %d", seq, first)
+			continue
+		}
+		if seq < c.max {
+			problem(n, c, "record %d is out of order, it's after record %d", seq, c.max)
+		}
+		c.hashes[seq], c.prevs[seq], c.lines[seq] = hash, prev, n
+		c.max = max(c.max, seq)
+
+		// Each record is checked against its neighbours, whichever order they're in.
+		if before, ok := c.hashes[seq-1]; ok && before != prev {
+			problem(c.lines[seq-1], c, "record %d has been modified, it doesn't match the hash in record %d", seq-1, seq)
+		}
+		if seq == 1 && prev != "" {
+			problem(n, c, "record 1 has been modified, it should start the chain")
+		}
+		if seq == 1 && record.LinkID != "" {
+			c.link = &chainLink{ID: record.LinkID, Seq: record.LinkSeq, Hash: record.LinkHash}
+		}
+		if after, ok := c.prevs[seq+1]; ok && after != hash {
+			problem(n, c, "record %d has been modified, it doesn't match the hash in record %d", seq, seq+1)
+		}
+
+		if record.Action == checkpointAction && key != nil {
+			signature, _ := base64.StdEncoding.DecodeString(record.Signature)
+			if !ed25519.Verify(key, checkpointMessage(c.id, seq, prev), signature) {
+				problem(n, c, "checkpoint %d has an invalid signature", seq)
+			} else {
+				v.Checkpoints++
+				c.signed = max(c.signed, seq)
+			}
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	for i, c := range order {
+		v.Chains++
+		// The first chain read may follow one in an older file that wasn't given.
+		if first, ok := c.lines[1]; ok && i > 0 {
+			checkLink(c, chains, first, problem)
+		}
+		for _, missing := range missingRanges(c) {
+			problem(c.lines[missing[1]+1], c, "%s %s missing", describeRange(missing), isAre(missing))
+		}
+		if unsigned := [2]uint64{c.signed + 1, c.max}; key != nil && c.signed < c.max {
+			problem(c.lines[c.max], c, "%s at the end of the chain %s not covered by a signed checkpoint", describeRange(unsigned), isAre(unsigned))
+		}
+	}
+
+	slices.SortStableFunc(v.Problems, func(a, b Problem) int { return a.Line - b.Line })
+	return v, nil
+}
+
+// Checks a chain follows on from the end of the chain before it.
+func checkLink(c *chainState, chains map[string]*chainState, line int, problem func(int, *chainState, string, ...any)) {
+	if c.link == nil {
+		problem(line, c, "the chain doesn't link to the chain before it")
+		return
+	}
+	before, ok := chains[c.link.ID]
+	if !ok {
+		problem(line, c, "the chain before it, %s, is missing", c.link.ID)
+		return
+	}
+	if hash, ok := before.hashes[c.link.Seq]; ok && hash != c.link.Hash {
+		problem(before.lines[c.link.Seq], before, "record %d has been modified, it doesn't match the hash in chain %s", c.link.Seq, c.id)
+	} else if missing := [2]uint64{before.max + 1, c.link.Seq}; before.max < c.link.Seq {
+		problem(line, before, "%s at the end of the chain %s missing, chain %s follows record %d", describeRange(missing), isAre(missing), c.id, c.link.Seq)
+	}
+}
+
+// Returns the ranges of sequence numbers that are missing before the last record of a chain.
+func missingRanges(c *chainState) [][2]uint64 {
+	ranges := [][2]uint64{}
+	for seq := uint64(1); seq < c.max; seq++ {
+		if _, ok := c.hashes[seq]; ok {
+			continue
+		}
+		if len(ranges) > 0 && ranges[len(ranges)-1][1] == seq-1 {
+			ranges[len(ranges)-1][1] = seq
+		} else {
+			ranges = append(ranges, [2]uint64{seq, seq})
+		}
+	}
+	return ranges
+}
+
+func describeRange(r [2]uint64) string {
+	if r[0] == r[1] {
+		return fmt.Sprintf("record %d", r[0])
+	}
+	return fmt.Sprintf("records %d-%d", r[0], r[1])
+}
+
+// The verb for a range, "is" for one record and "are" for more.
+func isAre(r [2]uint64) string {
+	if r[0] == r[1] {
+		return "is"
+	}
+	return "are"
+}
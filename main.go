@@ -4,15 +4,19 @@ import (
 	"context"
 	"embed"
 	"fmt"
+	"io"
 	"log"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"sync"
 	"syscall"
 	"time"
 	"webshell/logging"
+	"webshell/store"
+	"webshell/strace"
 )
 
 //go:embed assets/*
@@ -22,6 +26,9 @@ var (
 	config      Config
 	logger      *slog.Logger
 	auditLogger *slog.Logger
+	sessions    *SessionManager
+	closeLogs   func() // Flushes and closes the log sinks
+	auditStore  *store.Store
 
 	globalCtx         context.Context
 	cancelFunc        context.CancelFunc
@@ -30,11 +37,28 @@ var (
 
 func main() {
 
+	// When re-executed as one of the helpers, run that instead of the server.
+	switch filepath.Base(os.Args[0]) {
+	case execHelperName:
+		runHelper(os.Args[1:])
+	case strace.PtraceHelper:
+		strace.RunPtraceHelper(os.Args[1:])
+	}
+	if len(os.Args) > 1 && os.Args[1] == DetectTest {
+		os.Exit(runDetectTest(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == AuditVerify {
+		os.Exit(runAuditVerify(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == AuditQuery {
+		os.Exit(runAuditQuery(os.Args[2:]))
+	}
+
 	globalCtx, cancelFunc = context.WithCancel(context.Background())
 
 	config = LoadConfigFromEnv()
-	logger = logging.NewEcsLogger("terminal", config.LogLevel)
-	auditLogger = logging.NewEcsLogger("session", config.LogLevel)
+	closeLogs = openLogs()
+	sessions = NewSessionManager()
 
 	routes := buildRoutes()
 
@@ -76,6 +100,55 @@ func main() {
 	cancelFunc()
 	activeConnections.Wait()
 	logger.Info("All connections closed")
+
+	closeLogs()
+}
+
+// Opens the application and audit log sinks, returning a func that closes them.
+func openLogs() func() {
+	logOutput, err := logging.NewOutput(config.LogSinks, filepath.Join(config.LogQueueDir, "app"), "app", false, config.LogQueueMax)
+	if err != nil {
+		log.Fatalf("Failed to open log sinks: %v", err)
+	}
+	auditOutput, err := logging.NewOutput(config.AuditSinks, filepath.Join(config.LogQueueDir, "audit"), "audit", config.AuditSync, config.LogQueueMax)
+	if err != nil {
+		log.Fatalf("Failed to open audit sinks: %v", err)
+	}
+
+	var audit io.Writer = auditOutput
+	var chain *logging.Chain
+	if config.AuditChainKey != nil {
+		// The end of the chain is kept with the queues, which have to persist too.
+		chain, err = logging.NewChain(auditOutput, config.AuditChainKey, config.AuditCheckpoint, filepath.Join(config.LogQueueDir, "audit-chain.json"))
+		if err != nil {
+			log.Fatalf("Failed to start audit chain: %v", err)
+		}
+		audit = chain
+	}
+	if config.AuditStore != "" {
+		auditStore, err = store.Open(config.AuditStore, config.AuditRetention)
+		if err != nil {
+			log.Fatalf("Failed to open audit store: %v", err)
+		}
+		// The store never fails a write, so it can't stop the record reaching the sinks.
+		audit = io.MultiWriter(auditStore, audit)
+	}
+
+	logger = slog.New(logging.NewHandler(logOutput, "terminal", config.LogLevel))
+	auditLogger = slog.New(logging.NewHandler(audit, "session", config.LogLevel))
+
+	return func() {
+		// Signs the end of the audit log, then gives the sinks a chance to
+		// deliver what's queued, the rest is sent after a restart.
+		if chain != nil {
+			chain.Close()
+		}
+		auditOutput.Close()
+		logOutput.Close()
+		if auditStore != nil {
+			auditStore.Close()
+		}
+	}
 }
 
 // Minimal healthcheck endpoint.
@@ -93,13 +166,24 @@ func buildRoutes() http.Handler {
 	}
 
 	var (
-		wsHandler       http.Handler = Shell{config, timeout}
-		termPageHandler http.Handler = termPageHandler(config.Token, config.Title, time.Now(), config.GlobalTTL)
+		wsHandler       http.Handler = Shell{config, timeout, sessions}
+		termPageHandler http.Handler = termPageHandler(config.Token, config.Title, time.Now(), config.GlobalTTL, config.ShellNames(), config.Homes.Enabled())
 		filesHandler    http.Handler = FilesHandler{
-			baseDir: config.HomeDir,
-			baseUrl: rootPath + "home",
-			user:    config.User,
-			logger:  logger,
+			baseDir:  config.HomeDir,
+			baseUrl:  rootPath + "home",
+			user:     config.User,
+			logger:   logger,
+			sessions: sessions,
+			detector: config.Alerting.NewDetector(),
+		}.Handler()
+		sessionsHandler http.Handler = SessionsAPI{
+			sessions: sessions,
+			files: FilesHandler{
+				baseUrl:   rootPath + "sessions",
+				assetsUrl: rootPath + "assets",
+				user:      config.User,
+				logger:    logger,
+			},
 		}.Handler()
 		themeHandler = ThemeHandler{
 			themeFile: config.Theme,
@@ -113,23 +197,47 @@ func buildRoutes() http.Handler {
 		wsHandler = o.once(wsHandler)
 		termPageHandler = o.setCookie(termPageHandler)
 		filesHandler = o.requireCookie(filesHandler)
+		sessionsHandler = o.requireCookie(sessionsHandler)
 		logger.Info("Server will EXIT after the first connection closes")
 	}
 
 	// Webshell routes.
 	webshellMux := http.NewServeMux()
-	webshellMux.Handle("/{$}", termPageHandler)
+	webshellMux.Handle("/{$}", withClientId(rootPrefix, termPageHandler))
 	webshellMux.Handle("/shell", wsHandler)
-	webshellMux.Handle("/home", filesHandler)
-	webshellMux.Handle("/upload", filesHandler)
-	webshellMux.Handle("/home/{filename...}", filesHandler)
+
+	// With session homes there's no shared home, files are served per session.
+	if !config.Homes.Enabled() {
+		webshellMux.Handle("/home", filesHandler)
+		webshellMux.Handle("/upload", filesHandler)
+		webshellMux.Handle("/home/{filename...}", filesHandler)
+	}
+
+	webshellMux.Handle("/sessions", sessionsHandler)
+	webshellMux.Handle("/sessions/", sessionsHandler)
 	webshellMux.Handle("/theme", themeHandler)
 	webshellMux.Handle("/assets/", http.FileServer(http.FS(assetsFS)))
 
+	// Admin dashboard and API.
+	if config.AdminToken != "" {
+		adminHandler := AdminHandler{
+			token:    config.AdminToken,
+			basePath: rootPath,
+			sessions: sessions,
+			store:    auditStore,
+		}.Handler()
+		webshellMux.Handle("/admin", adminHandler)
+		webshellMux.Handle("/admin/", adminHandler)
+		logger.Info("Admin dashboard enabled")
+	}
+
 	// Playback of audit files. Still a work in progress
 	if config.Replay {
 		webshellMux.Handle("/replay/ws", &Replayer{})
 		webshellMux.Handle("/replay", replayPageHandler(config.Token))
+		libraryHandler := ReplayLibrary{dir: config.AuditPath, basePath: rootPath, adminToken: config.AdminToken}.Handler()
+		webshellMux.Handle("/replay/library", libraryHandler)
+		webshellMux.Handle("/replay/library/", libraryHandler)
 	}
 
 	// Combined routes.
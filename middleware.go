@@ -2,14 +2,20 @@ package main
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"net"
 	"net/http"
+	"net/netip"
+	"strings"
 	"time"
 )
 
-const sessionCookie = "cdpwebshell"
-
-var connCount int
+const (
+	sessionCookie = "cdpwebshell"
+	clientCookie  = "cdpwebshell_client"
+)
 
 // Middleware to log inbound requests.
 func requestLogger(h http.Handler) http.Handler {
@@ -19,6 +25,102 @@ func requestLogger(h http.Handler) http.Handler {
 	})
 }
 
+// Gives each browser a random client id, used to identify which sessions belong to it.
+func withClientId(cookiePath string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if clientId(r) == "" {
+			cookie := &http.Cookie{
+				Name:     clientCookie,
+				Value:    generateId(),
+				Path:     cookiePath,
+				HttpOnly: true,
+				SameSite: http.SameSiteStrictMode,
+			}
+			http.SetCookie(w, cookie)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Returns the id of the client set by withClientId, or an empty string if there isn't one.
+// The cookie itself is never exposed, only a hash of it.
+func clientId(r *http.Request) string {
+	cookie, err := r.Cookie(clientCookie)
+	if err != nil || cookie.Value == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(cookie.Value))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Returns the IP of the client. X-Forwarded-For and X-Real-IP are only used
+// when the request comes from a trusted proxy, anyone else could set them.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !trustedProxy(host) {
+		return host
+	}
+
+	// Each proxy appends the address it got the request from, so the client
+	// is the last one that isn't a trusted proxy. Anything before that could
+	// have been sent by the client.
+	if fwd := r.Header.Values("X-Forwarded-For"); len(fwd) > 0 {
+		addrs := strings.Split(strings.Join(fwd, ","), ",")
+		client := host
+		for i := len(addrs) - 1; i >= 0; i-- {
+			addr, err := netip.ParseAddr(strings.TrimSpace(addrs[i]))
+			if err != nil {
+				break
+			}
+			client = addr.Unmap().String()
+			if !trustedProxy(client) {
+				break
+			}
+		}
+		return client
+	}
+	if addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return addr.Unmap().String()
+	}
+	return host
+}
+
+// Returns whether ip is one of the -trusted-proxies.
+func trustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range config.TrustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parses -trusted-proxies, each an IP or a CIDR.
+func parseProxies(list []string) ([]netip.Prefix, error) {
+	proxies := []netip.Prefix{}
+	for _, s := range list {
+		if addr, err := netip.ParseAddr(s); err == nil {
+			addr = addr.Unmap()
+			proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q isn't an IP or CIDR", s)
+		}
+		proxies = append(proxies, p.Masked())
+	}
+	return proxies, nil
+}
+
 type Once struct {
 	keyUsed    bool
 	secretId   string
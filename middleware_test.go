@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// Forwarded addresses are only used from a trusted proxy, and only as far
+// back as the proxies are trusted.
+func TestRemoteIP(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	proxies, err := parseProxies([]string{"10.0.0.1", "192.168.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.TrustedProxies = proxies
+
+	tests := []struct {
+		remote    string
+		forwarded string
+		realIP    string
+		want      string
+	}{
+		{"203.0.113.5:1234", "", "", "203.0.113.5"},
+		{"203.0.113.5:1234", "1.2.3.4", "", "203.0.113.5"},
+		{"203.0.113.5:1234", "", "1.2.3.4", "203.0.113.5"},
+		{"10.0.0.1:1234", "1.2.3.4", "", "1.2.3.4"},
+		{"10.0.0.1:1234", "", "1.2.3.4", "1.2.3.4"},
+		// The client can put anything at the start.
+		{"10.0.0.1:1234", "6.6.6.6, 1.2.3.4", "", "1.2.3.4"},
+		{"10.0.0.1:1234", "6.6.6.6, 1.2.3.4, 192.168.1.1", "", "1.2.3.4"},
+		{"10.0.0.1:1234", "192.168.1.2, 192.168.1.1", "", "192.168.1.2"},
+		{"10.0.0.1:1234", "1.2.3.4, not-an-ip", "", "10.0.0.1"},
+		{"[::ffff:10.0.0.1]:1234", "1.2.3.4", "", "1.2.3.4"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remote
+		if test.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if test.realIP != "" {
+			r.Header.Set("X-Real-IP", test.realIP)
+		}
+		if got := remoteIP(r); got != test.want {
+			t.Errorf("%s forwarding %q %q: got %s, want %s", test.remote, test.forwarded, test.realIP, got, test.want)
+		}
+	}
+}
+
+func TestParseProxiesInvalid(t *testing.T) {
+	for _, s := range []string{"proxy", "10.0.0.0/33", "10.0.0"} {
+		if _, err := parseProxies([]string{s}); err == nil {
+			t.Errorf("expected %q to be invalid", s)
+		}
+	}
+}
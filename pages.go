@@ -11,9 +11,13 @@ type termPageParams struct {
 	Title   string
 	Start   int64
 	Timeout int
+	Shells  []string
+
+	// Files are served from each session's home rather than a shared one.
+	SessionHomes bool
 }
 
-func termPageHandler(token string, title string, start time.Time, timeout int) http.Handler {
+func termPageHandler(token string, title string, start time.Time, timeout int, shells []string, sessionHomes bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -24,6 +28,9 @@ func termPageHandler(token string, title string, start time.Time, timeout int) h
 			Token: token,
 			Title: title, Start: start.Unix() * 1000,
 			Timeout: timeout,
+			Shells:  shells,
+
+			SessionHomes: sessionHomes,
 		}
 		if err := termTemplate.Execute(w, params); err != nil {
 			logger.Error(fmt.Sprintf("%s", err))
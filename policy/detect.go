@@ -0,0 +1,256 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Kinds of events detections are checked against.
+const (
+	EventExec     = "exec"
+	EventUpload   = "upload"
+	EventDownload = "download"
+)
+
+// Severities of detections, from least to most severe.
+var Severities = []string{"low", "medium", "high", "critical"}
+
+// SeverityScore is the ECS event.severity of each severity, as used by Elastic's detection rules.
+var SeverityScore = map[string]int{"low": 21, "medium": 47, "high": 73, "critical": 99}
+
+// AtLeast reports whether severity is as severe as min.
+func AtLeast(severity string, min string) bool {
+	return slices.Index(Severities, severity) >= slices.Index(Severities, min)
+}
+
+// ValidSeverity checks severity is one of Severities.
+func ValidSeverity(severity string) error {
+	if !slices.Contains(Severities, severity) {
+		return fmt.Errorf("unknown severity %q", severity)
+	}
+	return nil
+}
+
+// How long apart the execs of a With detection can be, if Within isn't set.
+const defaultWithin = 2 * time.Second
+
+// Detection is a rule for something risky, it's alerted on rather than blocked.
+type Detection struct {
+	ID          string   `json:"id"`
+	Description string   `json:"description"`
+	Severity    string   `json:"severity"`
+	Tags        []string `json:"tags,omitempty"`
+	Events      []string `json:"events,omitempty"` // The kinds of event it's checked against, exec if unset
+
+	// The executable and arguments of an exec.
+	Match
+	// Regular expression matched against the path of an uploaded or downloaded file.
+	Path string `json:"path,omitempty"`
+	// Another exec by the same parent, started Within either side of the
+	// matching one, such as the other end of a pipeline.
+	With   *Match `json:"with,omitempty"`
+	Within string `json:"within,omitempty"`
+
+	path   *regexp.Regexp
+	within time.Duration
+}
+
+// Detections is a set of rules, every one that matches an event is alerted on.
+type Detections struct {
+	Rules []Detection `json:"rules"`
+}
+
+// LoadDetections reads detection rules from a JSON file.
+func LoadDetections(file string) (*Detections, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseDetections(data)
+}
+
+// ParseDetections decodes and validates JSON detection rules.
+func ParseDetections(data []byte) (*Detections, error) {
+	d := &Detections{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(d); err != nil {
+		return nil, err
+	}
+
+	ids := map[string]bool{}
+	for i := range d.Rules {
+		r := &d.Rules[i]
+		if r.ID == "" {
+			return nil, fmt.Errorf("rule %d has no id", i+1)
+		}
+		if ids[r.ID] {
+			return nil, fmt.Errorf("duplicate rule id %q", r.ID)
+		}
+		ids[r.ID] = true
+
+		if err := r.compile(); err != nil {
+			return nil, fmt.Errorf("rule %s: %w", r.ID, err)
+		}
+		if len(r.Events) == 0 {
+			r.Events = []string{EventExec}
+		}
+		for _, kind := range r.Events {
+			switch {
+			case kind != EventExec && kind != EventUpload && kind != EventDownload:
+				return nil, fmt.Errorf("rule %s: unknown event %q", r.ID, kind)
+			case kind == EventExec && r.Empty():
+				return nil, fmt.Errorf("rule %s matches every command", r.ID)
+			case kind != EventExec && r.Path == "":
+				return nil, fmt.Errorf("rule %s: %s needs a path", r.ID, kind)
+			}
+		}
+	}
+	return d, nil
+}
+
+func (r *Detection) compile() error {
+	if err := ValidSeverity(r.Severity); err != nil {
+		return err
+	}
+	if err := r.Match.compile(); err != nil {
+		return err
+	}
+	if r.Path != "" {
+		rx, err := regexp.Compile(r.Path)
+		if err != nil {
+			return err
+		}
+		r.path = rx
+	}
+
+	r.within = defaultWithin
+	if r.Within != "" {
+		within, err := time.ParseDuration(r.Within)
+		if err != nil {
+			return err
+		}
+		r.within = within
+	}
+	if r.With != nil {
+		if r.With.Empty() {
+			return fmt.Errorf("with matches every command")
+		}
+		return r.With.compile()
+	}
+	return nil
+}
+
+// Event is something a detection is checked against, an exec or a file transfer.
+type Event struct {
+	Kind       string    `json:"kind"`
+	Timestamp  time.Time `json:"timestamp"`
+	Pid        int       `json:"pid,omitempty"`
+	PPid       int       `json:"ppid,omitempty"`
+	Executable string    `json:"executable,omitempty"`
+	Argv       []string  `json:"argv,omitempty"`
+	Path       string    `json:"path,omitempty"` // Of the file transferred
+}
+
+// Alert is a detection matching an event.
+type Alert struct {
+	Rule    Detection `json:"rule"`
+	Event   Event     `json:"event"`
+	Related *Event    `json:"related,omitempty"` // The exec matched by With
+}
+
+// How many execs a Detector remembers to match With against.
+const recentExecs = 64
+
+// Detector checks the events of one session against the rules. It remembers
+// recent execs, so it can match those that run together.
+type Detector struct {
+	rules []Detection
+
+	mu      sync.Mutex
+	recent  []Event
+	alerted map[string]int // The pid each rule last alerted on
+}
+
+func (d *Detections) NewDetector() *Detector {
+	return &Detector{rules: d.Rules, alerted: map[string]int{}}
+}
+
+// Check returns an alert for every rule e matches. Each rule alerts once for
+// a process, however many times it execs the same thing, e.g. while its
+// shell searches PATH.
+func (d *Detector) Check(e Event) []Alert {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	alerts := []Alert{}
+	for _, r := range d.rules {
+		if !slices.Contains(r.Events, e.Kind) {
+			continue
+		}
+		if e.Kind != EventExec {
+			if r.matchesFile(e) {
+				alerts = append(alerts, Alert{Rule: r, Event: e})
+			}
+			continue
+		}
+
+		if r.With == nil {
+			if r.Matches(e.Executable, e.Argv) {
+				alerts = d.alert(alerts, r, e, nil)
+			}
+			continue
+		}
+
+		// Either side of a pipeline can exec first.
+		if r.Matches(e.Executable, e.Argv) {
+			if related, ok := d.find(r, e, r.With); ok {
+				alerts = d.alert(alerts, r, e, &related)
+			}
+		}
+		if r.With.Matches(e.Executable, e.Argv) {
+			if primary, ok := d.find(r, e, &r.Match); ok {
+				alerts = d.alert(alerts, r, primary, &e)
+			}
+		}
+	}
+
+	if e.Kind == EventExec {
+		d.recent = append(d.recent, e)
+		if len(d.recent) > recentExecs {
+			d.recent = d.recent[1:]
+		}
+	}
+	return alerts
+}
+
+// Adds an alert for e, unless the rule has already alerted on its process.
+func (d *Detector) alert(alerts []Alert, r Detection, e Event, related *Event) []Alert {
+	if d.alerted[r.ID] == e.Pid && e.Pid != 0 {
+		return alerts
+	}
+	d.alerted[r.ID] = e.Pid
+	return append(alerts, Alert{Rule: r, Event: e, Related: related})
+}
+
+// Finds a recent exec by the same parent as e, close enough in time, that m matches.
+func (d *Detector) find(r Detection, e Event, m *Match) (Event, bool) {
+	for i := len(d.recent) - 1; i >= 0; i-- {
+		other := d.recent[i]
+		gap := e.Timestamp.Sub(other.Timestamp).Abs()
+		if other.PPid == e.PPid && other.Pid != e.Pid && gap <= r.within && m.Matches(other.Executable, other.Argv) {
+			return other, true
+		}
+	}
+	return Event{}, false
+}
+
+func (r Detection) matchesFile(e Event) bool {
+	return r.path != nil && r.path.MatchString(e.Path)
+}
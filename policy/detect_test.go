@@ -0,0 +1,80 @@
+package policy
+
+import (
+	"testing"
+	"time"
+)
+
+const testDetections = `{
+	"rules": [
+		{"id": "curl-sh", "description": "Download piped to a shell", "severity": "high", "executable": "*sh", "with": {"executable": "curl"}},
+		{"id": "aws-creds", "description": "AWS credentials read", "severity": "medium", "command": "\\.aws/credentials", "tags": ["credentials"]},
+		{"id": "aws-creds-download", "description": "AWS credentials downloaded", "severity": "high", "events": ["download"], "path": "/\\.aws/credentials$"},
+		{"id": "chmod-777", "description": "World writable", "severity": "low", "executable": "chmod", "args": ["777"]}
+	]
+}`
+
+func TestDetector(t *testing.T) {
+	d, err := ParseDetections([]byte(testDetections))
+	if err != nil {
+		t.Fatal(err)
+	}
+	detector := d.NewDetector()
+
+	start := time.Now()
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	check := func(e Event) []string {
+		ids := []string{}
+		for _, a := range detector.Check(e) {
+			ids = append(ids, a.Rule.ID)
+		}
+		return ids
+	}
+
+	tests := []struct {
+		event Event
+		rules []string
+	}{
+		// The shell at the end of the pipeline execs first.
+		{Event{Kind: EventExec, Timestamp: at(0), Pid: 10, PPid: 1, Executable: "/bin/bash", Argv: []string{"bash"}}, []string{}},
+		{Event{Kind: EventExec, Timestamp: at(1), Pid: 11, PPid: 1, Executable: "/usr/bin/curl", Argv: []string{"curl", "-s", "x.sh"}}, []string{"curl-sh"}},
+		// Too long after the curl to be part of the same pipeline.
+		{Event{Kind: EventExec, Timestamp: at(5000), Pid: 12, PPid: 1, Executable: "/bin/sh", Argv: []string{"sh"}}, []string{}},
+		{Event{Kind: EventExec, Timestamp: at(5001), Pid: 13, PPid: 1, Executable: "/bin/cat", Argv: []string{"cat", "/root/.aws/credentials"}}, []string{"aws-creds"}},
+		// Only alerted on once when the same process retries.
+		{Event{Kind: EventExec, Timestamp: at(5002), Pid: 13, PPid: 1, Executable: "/usr/bin/cat", Argv: []string{"cat", "/root/.aws/credentials"}}, []string{}},
+		{Event{Kind: EventExec, Timestamp: at(5003), Pid: 14, PPid: 1, Executable: "/bin/chmod", Argv: []string{"chmod", "777", "/srv"}}, []string{"chmod-777"}},
+		{Event{Kind: EventDownload, Timestamp: at(5004), Path: "/home/u/.aws/credentials"}, []string{"aws-creds-download"}},
+		{Event{Kind: EventUpload, Timestamp: at(5005), Path: "/home/u/.aws/credentials"}, []string{}},
+	}
+	for i, test := range tests {
+		rules := check(test.event)
+		if len(rules) != len(test.rules) || (len(rules) > 0 && rules[0] != test.rules[0]) {
+			t.Errorf("event %d: got %q, expected %q", i, rules, test.rules)
+		}
+	}
+
+	// The alert is for the shell, with the curl as the related exec.
+	detector = d.NewDetector()
+	detector.Check(Event{Kind: EventExec, Timestamp: at(0), Pid: 11, PPid: 1, Executable: "/usr/bin/curl"})
+	alerts := detector.Check(Event{Kind: EventExec, Timestamp: at(1), Pid: 10, PPid: 1, Executable: "/bin/sh"})
+	if len(alerts) != 1 || alerts[0].Event.Pid != 10 || alerts[0].Related == nil || alerts[0].Related.Pid != 11 {
+		t.Errorf("unexpected alerts %+v", alerts)
+	}
+}
+
+func TestParseDetectionsInvalid(t *testing.T) {
+	for _, rules := range []string{
+		`{"rules": [{"id": "a", "severity": "severe", "executable": "rm"}]}`,
+		`{"rules": [{"id": "a", "severity": "low"}]}`,
+		`{"rules": [{"id": "a", "severity": "low", "events": ["upload"], "executable": "rm"}]}`,
+		`{"rules": [{"id": "a", "severity": "low", "events": ["open"], "path": "x"}]}`,
+		`{"rules": [{"id": "a", "severity": "low", "executable": "sh", "with": {}}]}`,
+		`{"rules": [{"id": "a", "severity": "low", "executable": "sh", "within": "soon"}]}`,
+		`{"rules": [{"severity": "low", "executable": "sh"}]}`,
+	} {
+		if _, err := ParseDetections([]byte(rules)); err == nil {
+			t.Errorf("expected %s to be invalid", rules)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+// Package policy decides which commands a shell is allowed to run, and which
+// are risky enough to alert on.
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// What happens to a command that matches a rule.
+const (
+	Allow = "allow"
+	Deny  = "deny"
+)
+
+// DefaultRule is the ID reported for commands no rule matched.
+const DefaultRule = "default"
+
+// UnsupportedRule is the ID reported for execs made with syscalls, like
+// x32's, that can't be checked, which are always denied.
+const UnsupportedRule = "unsupported-abi"
+
+// Match matches commands on their executable and arguments. Every pattern
+// that is set has to match.
+type Match struct {
+	// Glob of the executable's path. Without a / it's matched against the
+	// file name, so rm matches /bin/rm and /usr/bin/rm.
+	Executable string `json:"executable,omitempty"`
+	// Globs that each have to match one of the arguments, in any order.
+	Args []string `json:"args,omitempty"`
+	// Regular expression matched against the arguments joined with spaces.
+	Command string `json:"command,omitempty"`
+
+	command *regexp.Regexp
+}
+
+// Rule allows or denies the commands it matches.
+type Rule struct {
+	ID     string `json:"id"`
+	Action string `json:"action"`
+	Match
+	// Shown to the user when the rule blocks a command.
+	Message string `json:"message,omitempty"`
+}
+
+// Policy is an ordered list of rules, the first one that matches a command
+// decides whether it can run.
+type Policy struct {
+	Default string `json:"default"` // Action for commands no rule matches, allow if unset
+	Rules   []Rule `json:"rules"`
+}
+
+// Load reads a policy from a JSON file.
+func Load(file string) (*Policy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse decodes and validates a JSON policy.
+func Parse(data []byte) (*Policy, error) {
+	p := &Policy{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(p); err != nil {
+		return nil, err
+	}
+
+	if p.Default == "" {
+		p.Default = Allow
+	}
+	if p.Default != Allow && p.Default != Deny {
+		return nil, fmt.Errorf("invalid default action %q", p.Default)
+	}
+
+	ids := map[string]bool{DefaultRule: true, UnsupportedRule: true}
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		if r.ID == "" {
+			return nil, fmt.Errorf("rule %d has no id", i+1)
+		}
+		if ids[r.ID] {
+			return nil, fmt.Errorf("duplicate rule id %q", r.ID)
+		}
+		ids[r.ID] = true
+
+		if r.Action != Allow && r.Action != Deny {
+			return nil, fmt.Errorf("rule %s: invalid action %q", r.ID, r.Action)
+		}
+		if err := r.compile(); err != nil {
+			return nil, fmt.Errorf("rule %s: %w", r.ID, err)
+		}
+		if r.Empty() {
+			return nil, fmt.Errorf("rule %s matches every command, set the default instead", r.ID)
+		}
+	}
+	return p, nil
+}
+
+// Checks the patterns are valid, and compiles the regular expression.
+func (m *Match) compile() error {
+	for _, glob := range append([]string{m.Executable}, m.Args...) {
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", glob)
+		}
+	}
+	if m.Command != "" {
+		rx, err := regexp.Compile(m.Command)
+		if err != nil {
+			return err
+		}
+		m.command = rx
+	}
+	return nil
+}
+
+// Empty reports whether no patterns are set, so it matches every command.
+func (m Match) Empty() bool {
+	return m.Executable == "" && len(m.Args) == 0 && m.Command == ""
+}
+
+// Check returns the rule that decides whether executable can be run with
+// argv, and whether it's allowed. When no rule matches it's the default rule.
+func (p *Policy) Check(executable string, argv []string) (Rule, bool) {
+	for _, r := range p.Rules {
+		if r.Matches(executable, argv) {
+			return r, r.Action == Allow
+		}
+	}
+	return p.defaultRule(), p.Default == Allow
+}
+
+func (p *Policy) defaultRule() Rule {
+	return Rule{ID: DefaultRule, Action: p.Default, Message: "Only allowed commands can be run"}
+}
+
+// Rule returns the rule with the given ID.
+func (p *Policy) Rule(id string) (Rule, bool) {
+	switch id {
+	case DefaultRule:
+		return p.defaultRule(), true
+	case UnsupportedRule:
+		return Rule{ID: UnsupportedRule, Action: Deny, Message: "Commands run with unsupported syscalls can't be checked"}, true
+	}
+	i := slices.IndexFunc(p.Rules, func(r Rule) bool { return r.ID == id })
+	if i < 0 {
+		return Rule{}, false
+	}
+	return p.Rules[i], true
+}
+
+// Matches reports whether executable, run with argv, matches every pattern.
+func (m Match) Matches(executable string, argv []string) bool {
+	if m.Executable != "" {
+		name := executable
+		if !strings.Contains(m.Executable, "/") {
+			name = path.Base(executable)
+		}
+		if ok, _ := path.Match(m.Executable, name); !ok {
+			return false
+		}
+	}
+
+	args := []string{}
+	if len(argv) > 1 {
+		args = argv[1:]
+	}
+	for _, glob := range m.Args {
+		if !slices.ContainsFunc(args, func(arg string) bool {
+			ok, _ := path.Match(glob, arg)
+			return ok
+		}) {
+			return false
+		}
+	}
+
+	if m.command != nil && !m.command.MatchString(strings.Join(args, " ")) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package policy
+
+import "testing"
+
+const testPolicy = `{
+	"rules": [
+		{"id": "rm-root", "action": "deny", "executable": "rm", "args": ["-*r*", "/"], "message": "Don't remove /"},
+		{"id": "halt", "action": "deny", "executable": "/sbin/shutdown"},
+		{"id": "kubectl-get", "action": "allow", "executable": "kubectl", "args": ["get"]},
+		{"id": "kubectl-prod", "action": "deny", "executable": "kubectl", "command": "--context[= ]prod"}
+	]
+}`
+
+func TestCheck(t *testing.T) {
+	p, err := Parse([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		executable string
+		argv       []string
+		rule       string
+		allowed    bool
+	}{
+		{"/usr/bin/rm", []string{"rm", "-rf", "/"}, "rm-root", false},
+		{"/bin/rm", []string{"rm", "/", "-r", "-f"}, "rm-root", false},
+		{"/bin/rm", []string{"rm", "-rf", "/tmp/x"}, DefaultRule, true},
+		{"/sbin/shutdown", []string{"shutdown", "now"}, "halt", false},
+		{"/usr/sbin/shutdown", []string{"shutdown", "now"}, DefaultRule, true},
+		{"/usr/bin/kubectl", []string{"kubectl", "get", "pods", "--context=prod"}, "kubectl-get", true},
+		{"/usr/bin/kubectl", []string{"kubectl", "delete", "pod", "x", "--context", "prod-eu"}, "kubectl-prod", false},
+		{"/usr/bin/kubectl", []string{"kubectl", "delete", "pod", "x", "--context=staging"}, DefaultRule, true},
+		// The program name is ignored, it's whatever the caller says it is.
+		{"/usr/bin/ls", []string{"rm", "-rf", "/"}, DefaultRule, true},
+	}
+	for _, test := range tests {
+		rule, allowed := p.Check(test.executable, test.argv)
+		if rule.ID != test.rule || allowed != test.allowed {
+			t.Errorf("%s %q: got %s %v, expected %s %v", test.executable, test.argv, rule.ID, allowed, test.rule, test.allowed)
+		}
+	}
+
+	if r, ok := p.Rule("rm-root"); !ok || r.Message != "Don't remove /" {
+		t.Errorf("unexpected rule %+v", r)
+	}
+}
+
+func TestDefaultDeny(t *testing.T) {
+	p, err := Parse([]byte(`{"default": "deny", "rules": [{"id": "ls", "action": "allow", "executable": "ls"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, allowed := p.Check("/bin/ls", []string{"ls"}); !allowed {
+		t.Error("ls should be allowed")
+	}
+	if rule, allowed := p.Check("/bin/cat", []string{"cat"}); allowed || rule.ID != DefaultRule || rule.Message == "" {
+		t.Errorf("cat should be denied by default, got %+v", rule)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, policy := range []string{
+		`{"default": "maybe"}`,
+		`{"rules": [{"action": "deny", "executable": "rm"}]}`,
+		`{"rules": [{"id": "a", "action": "deny", "executable": "rm"}, {"id": "a", "action": "deny", "executable": "ls"}]}`,
+		`{"rules": [{"id": "default", "action": "deny", "executable": "rm"}]}`,
+		`{"rules": [{"id": "unsupported-abi", "action": "deny", "executable": "rm"}]}`,
+		`{"rules": [{"id": "a", "action": "block", "executable": "rm"}]}`,
+		`{"rules": [{"id": "a", "action": "deny", "executable": "[rm"}]}`,
+		`{"rules": [{"id": "a", "action": "deny", "command": "("}]}`,
+		`{"rules": [{"id": "a", "action": "deny"}]}`,
+		`{"rules": [{"id": "a", "action": "deny", "exe": "rm"}]}`,
+	} {
+		if _, err := Parse([]byte(policy)); err == nil {
+			t.Errorf("expected %s to be invalid", policy)
+		}
+	}
+}
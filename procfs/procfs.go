@@ -0,0 +1,192 @@
+// Package procfs reads process information from the /proc filesystem.
+package procfs
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errInvalidStat = errors.New("invalid stat")
+
+// ClockTicks is the unit of times in /proc, USER_HZ, which is always 100 on Linux.
+const ClockTicks = 100
+
+// Stat holds the fields we care about from /proc/[pid]/stat.
+type Stat struct {
+	Pid       int
+	Comm      string
+	State     byte
+	PPid      int
+	Pgrp      int
+	Session   int
+	StartTime uint64 // clock ticks after boot
+}
+
+// Zombie reports whether the process has exited but not been reaped.
+func (s Stat) Zombie() bool {
+	return s.State == 'Z' || s.State == 'X'
+}
+
+// Started returns when the process started, given the time the system booted.
+func (s Stat) Started(boot time.Time) time.Time {
+	return boot.Add(time.Duration(s.StartTime) * time.Second / ClockTicks)
+}
+
+func ReadStat(pid int) (Stat, error) {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return Stat{}, err
+	}
+	return parseStat(string(b))
+}
+
+func parseStat(s string) (Stat, error) {
+	// The command name is in brackets and may contain spaces or brackets itself.
+	open := strings.IndexByte(s, '(')
+	closing := strings.LastIndexByte(s, ')')
+	if open < 0 || closing < open {
+		return Stat{}, errInvalidStat
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(s[:open]))
+	if err != nil {
+		return Stat{}, errInvalidStat
+	}
+
+	// Fields after the command name, starting with state (field 3).
+	fields := strings.Fields(s[closing+1:])
+	if len(fields) < 20 || len(fields[0]) != 1 {
+		return Stat{}, errInvalidStat
+	}
+
+	stat := Stat{
+		Pid:   pid,
+		Comm:  s[open+1 : closing],
+		State: fields[0][0],
+	}
+
+	var errs [4]error
+	stat.PPid, errs[0] = strconv.Atoi(fields[1])
+	stat.Pgrp, errs[1] = strconv.Atoi(fields[2])
+	stat.Session, errs[2] = strconv.Atoi(fields[3])
+	stat.StartTime, errs[3] = strconv.ParseUint(fields[19], 10, 64)
+	if err := errors.Join(errs[:]...); err != nil {
+		return Stat{}, errInvalidStat
+	}
+
+	return stat, nil
+}
+
+// List returns the stat of every process currently running.
+func List() ([]Stat, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	stats := []Stat{}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		// Processes can exit while we're listing them.
+		if stat, err := ReadStat(pid); err == nil {
+			stats = append(stats, stat)
+		}
+	}
+	return stats, nil
+}
+
+// Descendants returns every live process that is either a descendant of pid
+// or in the same session as it, including pid itself. Processes that have been
+// orphaned and re-parented are still found as long as they stay in the session.
+func Descendants(pid int) ([]Stat, error) {
+	procs, err := List()
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := ReadStat(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	children := map[int][]Stat{}
+	for _, p := range procs {
+		children[p.PPid] = append(children[p.PPid], p)
+	}
+
+	found := map[int]Stat{}
+	queue := []Stat{root}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		if _, seen := found[p.Pid]; seen {
+			continue
+		}
+		found[p.Pid] = p
+		queue = append(queue, children[p.Pid]...)
+	}
+
+	for _, p := range procs {
+		if p.Session == root.Session && root.Session == root.Pid {
+			found[p.Pid] = p
+		}
+	}
+
+	result := []Stat{}
+	for _, p := range found {
+		if !p.Zombie() {
+			result = append(result, p)
+		}
+	}
+	return result, nil
+}
+
+// Cmdline returns the command line of a process with its arguments separated by spaces.
+func Cmdline(pid int) (string, error) {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(strings.ReplaceAll(string(b), "\x00", " ")), nil
+}
+
+// Argv returns the arguments of a process, as it last exec'd them.
+func Argv(pid int) ([]string, error) {
+	b, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return []string{}, nil
+	}
+	return strings.Split(strings.TrimSuffix(string(b), "\x00"), "\x00"), nil
+}
+
+// BootTime returns when the system booted, from /proc/stat.
+func BootTime() (time.Time, error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "btime "); ok {
+			secs, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return time.Unix(secs, 0), nil
+		}
+	}
+	return time.Time{}, errors.New("btime not found in /proc/stat")
+}
@@ -0,0 +1,67 @@
+package procfs
+
+import (
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseStat(t *testing.T) {
+	stat, err := parseStat("1234 (my (odd) cmd) S 1 1234 1234 34816 1234 4194304 1 0 0 0 0 0 0 0 20 0 1 0 5678 0 0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stat.Pid != 1234 || stat.Comm != "my (odd) cmd" || stat.State != 'S' {
+		t.Errorf("unexpected stat %+v", stat)
+	}
+	if stat.PPid != 1 || stat.Pgrp != 1234 || stat.Session != 1234 || stat.StartTime != 5678 {
+		t.Errorf("unexpected stat %+v", stat)
+	}
+}
+
+func TestParseStatInvalid(t *testing.T) {
+	for _, s := range []string{"", "1234 (cmd", "abc (cmd) S 1 2 3", "1 (cmd) S 1 2 3"} {
+		if _, err := parseStat(s); err == nil {
+			t.Errorf("expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestReadStatSelf(t *testing.T) {
+	stat, err := ReadStat(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Pid != os.Getpid() || stat.PPid != os.Getppid() {
+		t.Errorf("unexpected stat for self %+v", stat)
+	}
+}
+
+func TestArgvSelf(t *testing.T) {
+	argv, err := Argv(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(argv, os.Args) {
+		t.Errorf("want %q got %q", os.Args, argv)
+	}
+}
+
+func TestStartedSelf(t *testing.T) {
+	boot, err := BootTime()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := ReadStat(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Start times only have a resolution of one clock tick.
+	started := stat.Started(boot)
+	if started.After(time.Now()) || time.Since(started) > time.Minute {
+		t.Errorf("unexpected start time %s", started)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/coder/websocket"
+)
+
+// Websocket protocol used between the terminal and the server.
+//
+// Version 1 is negotiated with the "webshell.v1" subprotocol. Binary messages
+// carry raw terminal data in both directions and are never modified. Text
+// messages carry JSON control frames, see ControlMessage.
+//
+// Clients that don't ask for a subprotocol get the legacy protocol, where
+// control messages are binary payloads prefixed with 0x01 (PING, SIZE c r).
+const protocolV1 = "webshell.v1"
+
+var supportedProtocols = []string{protocolV1}
+
+// Control frame types.
+const (
+	MsgPing         = "ping"
+	MsgPong         = "pong"
+	MsgResize       = "resize"
+	MsgSignal       = "signal"
+	MsgSession      = "session"
+	MsgTitle        = "title"
+	MsgNotification = "notification"
+	MsgError        = "error"
+	MsgPlay         = "play"
+)
+
+var errInvalidControl = errors.New("invalid control message")
+
+type ControlMessage struct {
+	Type    string `json:"type"`
+	Cols    int    `json:"cols,omitempty"`
+	Rows    int    `json:"rows,omitempty"`
+	Signal  string `json:"signal,omitempty"`
+	Session string `json:"session,omitempty"`
+	Offset  int64  `json:"offset,omitempty"`
+	Title   string `json:"title,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// TerminalConn wraps a websocket, separating terminal data from control messages.
+type TerminalConn struct {
+	*websocket.Conn
+	legacy bool
+}
+
+func NewTerminalConn(ws *websocket.Conn) *TerminalConn {
+	return &TerminalConn{
+		Conn:   ws,
+		legacy: ws.Subprotocol() != protocolV1,
+	}
+}
+
+// Read returns the next message from the client, either terminal data or a control message.
+func (c *TerminalConn) Read(ctx context.Context) ([]byte, *ControlMessage, error) {
+	typ, b, err := c.Conn.Read(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if c.legacy {
+		return parseLegacyMessage(b)
+	}
+
+	if typ == websocket.MessageBinary {
+		return b, nil, nil
+	}
+
+	msg := &ControlMessage{}
+	if err := json.Unmarshal(b, msg); err != nil || msg.Type == "" {
+		return nil, nil, fmt.Errorf("%w: %s", errInvalidControl, b)
+	}
+	return nil, msg, nil
+}
+
+// WriteData sends terminal output to the client.
+func (c *TerminalConn) WriteData(ctx context.Context, b []byte) error {
+	return c.Conn.Write(ctx, websocket.MessageBinary, b)
+}
+
+// WriteControl sends a control message to the client. Legacy clients only
+// understand a subset of messages, anything they can't display is dropped.
+func (c *TerminalConn) WriteControl(ctx context.Context, msg ControlMessage) error {
+	if c.legacy {
+		switch msg.Type {
+		case MsgSession:
+			hello := fmt.Sprintf("\x01SESSION %s %d", msg.Session, msg.Offset)
+			return c.Conn.Write(ctx, websocket.MessageText, []byte(hello))
+		case MsgNotification, MsgError:
+			// Sent as text, which legacy clients show but don't count towards
+			// the offset they resume from, as it isn't in the scrollback.
+			line := fmt.Sprintf("\r\n\x1b[1m*** %s ***\x1b[0m\r\n", msg.Message)
+			return c.Conn.Write(ctx, websocket.MessageText, []byte(line))
+		default:
+			return nil
+		}
+	}
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.Conn.Write(ctx, websocket.MessageText, b)
+}
+
+// Parses the legacy protocol, where control messages are prefixed with 0x01.
+func parseLegacyMessage(b []byte) ([]byte, *ControlMessage, error) {
+	b = bytes.Trim(b, "\x00")
+
+	if len(b) == 0 || b[0] != 1 {
+		return b, nil, nil
+	}
+
+	payload := string(bytes.Trim(b[1:], " \n\r\t\x00\x01"))
+	fields := strings.Fields(payload)
+	if len(fields) == 0 {
+		return nil, nil, fmt.Errorf("%w: %q", errInvalidControl, payload)
+	}
+
+	switch fields[0] {
+	case "PING":
+		return nil, &ControlMessage{Type: MsgPing}, nil
+	case "PLAY":
+		return nil, &ControlMessage{Type: MsgPlay}, nil
+	case "SIZE":
+		if len(fields) != 3 {
+			return nil, nil, fmt.Errorf("%w: %q", errInvalidControl, payload)
+		}
+
+		cols, errCol := strconv.ParseInt(fields[1], 10, 16)
+		rows, errRow := strconv.ParseInt(fields[2], 10, 16)
+		if errCol != nil || errRow != nil {
+			return nil, nil, fmt.Errorf("%w: %q", errInvalidControl, payload)
+		}
+		return nil, &ControlMessage{Type: MsgResize, Cols: int(cols), Rows: int(rows)}, nil
+	}
+
+	return nil, nil, fmt.Errorf("%w: unknown payload %q", errInvalidControl, payload)
+}
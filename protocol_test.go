@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+func TestParseLegacyMessage(t *testing.T) {
+	_, msg, err := parseLegacyMessage([]byte("\x01PING"))
+	if err != nil || msg == nil || msg.Type != MsgPing {
+		t.Errorf("want ping got %v %v", msg, err)
+	}
+
+	_, msg, err = parseLegacyMessage([]byte("\x01SIZE 80 24\x00"))
+	if err != nil || msg == nil || msg.Type != MsgResize || msg.Cols != 80 || msg.Rows != 24 {
+		t.Errorf("want resize 80x24 got %v %v", msg, err)
+	}
+
+	data, msg, err := parseLegacyMessage([]byte("ls\r"))
+	if err != nil || msg != nil || string(data) != "ls\r" {
+		t.Errorf("want data got %q %v %v", data, msg, err)
+	}
+}
+
+func TestParseLegacyMessageInvalid(t *testing.T) {
+	invalid := []string{
+		"\x01SIZE 80",
+		"\x01SIZE a b",
+		"\x01SIZE 80 99999999",
+		"\x01FOO",
+		"\x01",
+	}
+
+	for _, s := range invalid {
+		if _, _, err := parseLegacyMessage([]byte(s)); err == nil {
+			t.Errorf("expected %q to be rejected", s)
+		}
+	}
+}
+
+// Starts a websocket server that echos back everything read from a TerminalConn.
+func echoServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, &websocket.AcceptOptions{Subprotocols: supportedProtocols})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn := NewTerminalConn(ws)
+		defer conn.CloseNow()
+
+		for {
+			data, msg, err := conn.Read(r.Context())
+			if err != nil {
+				if strings.Contains(err.Error(), errInvalidControl.Error()) {
+					conn.WriteControl(r.Context(), ControlMessage{Type: MsgError, Message: "invalid"})
+					continue
+				}
+				return
+			}
+			if msg != nil {
+				conn.WriteControl(r.Context(), *msg)
+			} else {
+				conn.WriteData(r.Context(), data)
+			}
+		}
+	}))
+}
+
+// With the v1 protocol terminal data is passed through untouched, including NUL bytes.
+func TestProtocolV1(t *testing.T) {
+	srv := echoServer(t)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ws, _, err := websocket.Dial(ctx, srv.URL, &websocket.DialOptions{Subprotocols: []string{protocolV1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.CloseNow()
+
+	if ws.Subprotocol() != protocolV1 {
+		t.Fatalf("subprotocol: want %s got %q", protocolV1, ws.Subprotocol())
+	}
+
+	input := []byte("\x00\x01SIZE 1 1\x00")
+	ws.Write(ctx, websocket.MessageBinary, input)
+	typ, b, err := ws.Read(ctx)
+	if err != nil || typ != websocket.MessageBinary || !bytes.Equal(b, input) {
+		t.Errorf("want binary %q got %v %q %v", input, typ, b, err)
+	}
+
+	ws.Write(ctx, websocket.MessageText, []byte(`{"type":"resize","cols":80,"rows":24}`))
+	typ, b, err = ws.Read(ctx)
+	if err != nil || typ != websocket.MessageText || string(b) != `{"type":"resize","cols":80,"rows":24}` {
+		t.Errorf("want resize control got %v %s %v", typ, b, err)
+	}
+
+	ws.Write(ctx, websocket.MessageText, []byte(`not json`))
+	_, b, err = ws.Read(ctx)
+	if err != nil || string(b) != `{"type":"error","message":"invalid"}` {
+		t.Errorf("want error control got %s %v", b, err)
+	}
+}
+
+// Clients that don't negotiate a protocol get the legacy format.
+func TestProtocolLegacy(t *testing.T) {
+	srv := echoServer(t)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ws, _, err := websocket.Dial(ctx, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.CloseNow()
+
+	ws.Write(ctx, websocket.MessageBinary, []byte("\x00ls\x00"))
+	_, b, err := ws.Read(ctx)
+	if err != nil || string(b) != "ls" {
+		t.Errorf("want ls got %q %v", b, err)
+	}
+
+	// Legacy clients have no way to receive a resize, so the echoed control message is dropped.
+	ws.Write(ctx, websocket.MessageBinary, []byte("\x01SIZE 80 24"))
+	ws.Write(ctx, websocket.MessageBinary, []byte("pwd"))
+	_, b, err = ws.Read(ctx)
+	if err != nil || string(b) != "pwd" {
+		t.Errorf("want pwd got %q %v", b, err)
+	}
+}
+
+// A legacy client resumes from the terminal data it received, so notifications
+// mustn't be sent as data or it would skip output when it reattaches.
+func TestProtocolLegacyReattachAfterNotify(t *testing.T) {
+	scrollback := NewScrollback(1024)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn := NewTerminalConn(ws)
+		defer conn.Close(websocket.StatusGoingAway, "")
+
+		scrollback.Write([]byte("before"))
+		conn.WriteData(r.Context(), []byte("before"))
+		conn.WriteControl(r.Context(), ControlMessage{Type: MsgNotification, Message: "Session ends in 5m"})
+		scrollback.Write([]byte("after"))
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ws, _, err := websocket.Dial(ctx, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.CloseNow()
+
+	// Counted as the legacy client does, only binary messages are terminal data.
+	offset := int64(0)
+	shown := ""
+	for {
+		typ, b, err := ws.Read(ctx)
+		if err != nil {
+			break
+		}
+		if typ == websocket.MessageBinary {
+			offset += int64(len(b))
+		}
+		shown += string(b)
+	}
+	if !strings.Contains(shown, "Session ends in 5m") {
+		t.Errorf("the notification wasn't shown: %q", shown)
+	}
+
+	missed, from := scrollback.Since(offset)
+	if from != offset || string(missed) != "after" {
+		t.Errorf("reattaching at %d should replay %q, got %q from %d", offset, "after", missed, from)
+	}
+}
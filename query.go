@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"webshell/store"
+)
+
+// AuditQuery is the subcommand that searches the audit event store.
+const AuditQuery = "audit-query"
+
+// Runs the audit-query subcommand, returning the exit code.
+func runAuditQuery(args []string) int {
+	flags := flag.NewFlagSet(AuditQuery, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s %s -store DIR [options]\n", filepath.Base(os.Args[0]), AuditQuery)
+		flags.PrintDefaults()
+	}
+	dir := flags.String("store", "", "Directory of the audit store, as given to -audit-store")
+	q := store.Query{}
+	flags.StringVar(&q.Session, "session", "", "Only events of this session")
+	flags.StringVar(&q.User, "user", "", "Only events of this user")
+	flags.StringVar(&q.Kind, "kind", "", "Only events of this kind: exec, file, session or alert")
+	flags.StringVar(&q.Action, "action", "", "Only events with this action, e.g. exec-blocked or session-end")
+	flags.StringVar(&q.Command, "command", "", "Only commands matching this glob, e.g. psql or 'git push*'")
+	since := flags.String("since", "", "Only events since this time, RFC 3339 or how long ago, e.g. 2h or 7d")
+	until := flags.String("until", "", "Only events before this time, as -since")
+	flags.IntVar(&q.Limit, "limit", 0, "Only the most recent events or sessions. 0 is unlimited.")
+	sessions := flags.Bool("sessions", false, "List the sessions with matching events instead of the events")
+	asJSON := flags.Bool("json", false, "Write JSON instead of a table")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *dir == "" || flags.NArg() > 0 {
+		flags.Usage()
+		return 2
+	}
+
+	q, err := withTimes(q, *since, *until)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if _, err := os.Stat(*dir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	// Without a retention, so only the server removes events.
+	s, err := store.Open(*dir, 0)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer s.Close()
+
+	var result any
+	if *sessions {
+		result = s.Sessions(q)
+	} else {
+		result = s.Events(q)
+	}
+	if *asJSON {
+		out := json.NewEncoder(os.Stdout)
+		out.SetIndent("", "  ")
+		out.Encode(result)
+		return 0
+	}
+	writeTable(os.Stdout, result)
+	return 0
+}
+
+// Sets the times of a query from the values of its since and until parameters, and validates it.
+func withTimes(q store.Query, since string, until string) (store.Query, error) {
+	now := time.Now()
+	var err error
+	if since != "" {
+		if q.Since, err = store.ParseTime(since, now); err != nil {
+			return q, fmt.Errorf("invalid since: %w", err)
+		}
+	}
+	if until != "" {
+		if q.Until, err = store.ParseTime(until, now); err != nil {
+			return q, fmt.Errorf("invalid until: %w", err)
+		}
+	}
+	return q, q.Validate()
+}
+
+// Writes the events or sessions found by a query as a table.
+func writeTable(w io.Writer, result any) {
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	defer table.Flush()
+
+	switch result := result.(type) {
+	case []store.SessionMatch:
+		fmt.Fprintln(table, "SESSION\tUSER\tFIRST\tLAST\tEVENTS")
+		for _, m := range result {
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%d\n", m.Session, m.User, m.First.Local().Format(time.DateTime), m.Last.Local().Format(time.DateTime), m.Events)
+		}
+	case []store.Event:
+		fmt.Fprintln(table, "TIME\tSESSION\tUSER\tACTION\tDETAIL")
+		for _, e := range result {
+			fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\n", e.Time.Local().Format(time.DateTime), e.Session, e.User, e.Action, eventDetail(e))
+		}
+	}
+}
+
+// What an event was about, for its row of the table.
+func eventDetail(e store.Event) string {
+	switch e.Kind {
+	case store.KindExec:
+		return e.CommandLine()
+	case store.KindFile:
+		return fmt.Sprintf("%s (%d bytes)", e.Path, e.Size)
+	}
+	return strings.TrimSpace(e.Message)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
+)
+
+// Some setup has to happen inside the shell's process, after it's been forked
+// but before the shell itself runs. Go can't run code at that point, so the
+// server re-executes itself as a small helper which does the setup and then
+// execs the real shell.
+const execHelperName = "webshell-exec"
+
+// The file descriptor the helper waits on, when it's asked to, until the
+// server closes the other end.
+const execHelperWaitFd = 3
+
+func init() {
+	// A tracer attaches to the helper's main thread, and only an exec from
+	// that thread keeps the shell traced, so the helper has to stay on it.
+	if filepath.Base(os.Args[0]) == execHelperName {
+		runtime.LockOSThread()
+	}
+}
+
+// Passed to the helper as its first argument.
+type execHelperConfig struct {
+	Rlimits     map[int]uint64    `json:"rlimits,omitempty"`
+	Sandbox     *sandboxSetup     `json:"sandbox,omitempty"`
+	Integration *integrationSetup `json:"integration,omitempty"`
+	Wait        bool              `json:"wait,omitempty"` // Wait for execHelperWaitFd to be closed before exec'ing
+	Path        string            `json:"path"`
+	Args        []string          `json:"args"`
+}
+
+// Runs the exec helper, called by main when the process was started as one.
+// It never returns, either the shell replaces it or it exits.
+func runHelper(args []string) {
+	err := execHelper(args)
+
+	// Stderr is the shell's terminal, so the user sees why the shell didn't start.
+	fmt.Fprintf(os.Stderr, "webshell: failed to start shell: %s\r\n", err)
+	os.Exit(1)
+}
+
+func execHelper(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("%s expects 1 argument got %d", execHelperName, len(args))
+	}
+
+	cfg := execHelperConfig{}
+	if err := json.Unmarshal([]byte(args[0]), &cfg); err != nil {
+		return err
+	}
+
+	for resource, limit := range cfg.Rlimits {
+		rlimit := &syscall.Rlimit{Cur: limit, Max: limit}
+		if err := syscall.Setrlimit(resource, rlimit); err != nil {
+			return fmt.Errorf("failed to set %s: %w", rlimitNames[resource], err)
+		}
+	}
+
+	if cfg.Sandbox != nil {
+		if err := cfg.Sandbox.enter(); err != nil {
+			return fmt.Errorf("sandbox setup failed: %w", err)
+		}
+	}
+
+	// Without its rc files the shell still starts, just unmarked.
+	if cfg.Integration != nil {
+		if err := cfg.Integration.write(); err != nil {
+			fmt.Fprintf(os.Stderr, "webshell: shell integration is disabled: %s\r\n", err)
+		}
+	}
+
+	// Command auditing attaches while it waits, so it sees the shell's exec
+	// and everything the shell runs from the start. It can't stop itself
+	// instead, as the first process in a PID namespace ignores SIGSTOP.
+	if cfg.Wait {
+		wait := os.NewFile(execHelperWaitFd, "wait")
+		io.Copy(io.Discard, wait)
+		wait.Close()
+	}
+	return syscall.Exec(cfg.Path, cfg.Args, os.Environ())
+}
+
+// Rewrites cmd to run via the exec helper.
+func wrapWithHelper(cmd *exec.Cmd, cfg execHelperConfig) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	cfg.Path = cmd.Path
+	cfg.Args = cmd.Args
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+
+	cmd.Path = self
+	cmd.Args = []string{execHelperName, string(b)}
+	return nil
+}
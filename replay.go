@@ -1,11 +1,19 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
-	"sync"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
 	"webshell/ttyrec"
 
 	"github.com/coder/websocket"
@@ -15,16 +23,29 @@ type Replayer struct{}
 
 func (rp Replayer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Accept the WS connection
-	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{})
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{Subprotocols: supportedProtocols})
 	if err != nil {
 		logger.Error(err.Error())
 		return
 	}
 
-	replayHandler(conn)
+	replayHandler(NewTerminalConn(conn))
 }
 
-func replayHandler(ws *websocket.Conn) {
+// Adapts a TerminalConn to an io.Writer, each write is sent as terminal data.
+type terminalWriter struct {
+	ctx  context.Context
+	conn *TerminalConn
+}
+
+func (tw terminalWriter) Write(b []byte) (int, error) {
+	if err := tw.conn.WriteData(tw.ctx, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func replayHandler(ws *TerminalConn) {
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -35,6 +56,8 @@ func replayHandler(ws *websocket.Conn) {
 	replayer, err := ttyrec.NewReplayer(config.ReplayFile)
 	if err != nil {
 		logger.Error(fmt.Sprintf("failed to load audit file: %v", err))
+		ws.WriteControl(ctx, ControlMessage{Type: MsgError, Message: "Failed to load recording"})
+		ws.Close(websocket.StatusInternalError, "failed to load audit file")
 		return
 	}
 
@@ -43,55 +66,166 @@ func replayHandler(ws *websocket.Conn) {
 		replayer.Close()
 	}()
 
-	var wg sync.WaitGroup
-	wg.Add(1)
+	wsWriter := terminalWriter{ctx: ctx, conn: ws}
 
-	wsWriter, err := ws.Writer(ctx, websocket.MessageBinary)
-	if err != nil {
-		logger.Error(err.Error())
-		return
-	}
-
-	// temp
 	go func() {
 		replayer.Play(wsWriter)
 	}()
 
-	go func() {
+	for {
+		_, msg, err := ws.Read(ctx)
+		if errors.Is(err, errInvalidControl) {
+			logger.Debug(err.Error())
+			continue
+		}
+		if err != nil {
+			logger.Warn(fmt.Sprintf("Websocket closed: %s", err))
+			break
+		}
 
-		for {
-			_, b, err := ws.Read(ctx)
-			if err != nil {
-				logger.Warn(fmt.Sprintf("Websocket closed: %s", err))
-				break
+		// Input is ignored, only control messages do anything.
+		if msg == nil {
+			continue
+		}
+
+		switch msg.Type {
+		case MsgPing:
+			logger.Debug("PING")
+			if !ws.legacy {
+				ws.WriteControl(ctx, ControlMessage{Type: MsgPong})
 			}
+		case MsgPlay:
+			go func() {
+				replayer.Play(wsWriter)
+			}()
+		}
+	}
+}
 
-			b = bytes.Trim(b, "\x00")
+// ReplayLibrary lists the TTY recordings in the audit directory, and lets
+// them be downloaded along with their session reports. With an admin token
+// only admins can use it, otherwise each browser only sees its own sessions.
+type ReplayLibrary struct {
+	dir        string
+	basePath   string
+	adminToken string
+}
 
-			// Handle resize message from the terminal.
-			if b[0] == 1 {
+// A recording in the library.
+type libraryEntry struct {
+	Link    string
+	Session string
+	Started time.Time
+	Size    int64
+	Report  string // Link to the reports without their extension, empty if there aren't any
+}
 
-				specialPayload := bytes.Trim(b[1:], " \n\r\t\x00\x01")
-				logger.Info(string(specialPayload))
-				if len(specialPayload) == 0 {
-					continue
-				}
+type libraryPageParams struct {
+	AssetsPath string
+	Entries    []libraryEntry
+}
 
-				if string(specialPayload) == "PING" {
-					logger.Debug("PING")
-					continue
-				}
+// Suffixes of the files that can be downloaded from the library.
+var libraryFiles = []string{".tty.audit", ".report.json", ".report.html"}
 
-				if string(specialPayload) == "PLAY" {
-					go func() {
-						replayer.Play(wsWriter)
-					}()
-					continue
-				}
-			}
+func (l ReplayLibrary) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /replay/library", l.list)
+	mux.HandleFunc("GET /replay/library/{file}", l.download)
+	if l.adminToken != "" {
+		return AdminHandler{token: l.adminToken}.requireAdmin(mux)
+	}
+	return mux
+}
+
+// Returns whether the client making r can see the recording, and reports,
+// named stem. Without an admin token, only the browser that owned the session
+// can, which is only known from its report.
+func (l ReplayLibrary) visible(r *http.Request, stem string) bool {
+	if l.adminToken != "" {
+		return true
+	}
+	data, err := os.ReadFile(filepath.Join(l.dir, stem+".report.json"))
+	if err != nil {
+		return false
+	}
+	report := SessionReport{}
+	owner := clientId(r)
+	return json.Unmarshal(data, &report) == nil && owner != "" && report.Owner == owner
+}
+
+func (l ReplayLibrary) list(w http.ResponseWriter, r *http.Request) {
+	recordings, err := filepath.Glob(filepath.Join(l.dir, "*.tty.audit"))
+	if err != nil {
+		logger.Error(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	entries := []libraryEntry{}
+	for _, recording := range recordings {
+		stat, err := os.Stat(recording)
+		if err != nil {
+			continue
+		}
+		name := filepath.Base(recording)
+		files := l.basePath + "replay/library/"
+		entry := libraryEntry{Link: files + url.PathEscape(name), Started: stat.ModTime(), Size: stat.Size()}
+
+		// Recordings are named TIMESTAMP_TOKEN_SESSION.tty.audit
+		stem := strings.TrimSuffix(name, ".tty.audit")
+		if !l.visible(r, stem) {
+			continue
+		}
+		if i := strings.LastIndex(stem, "_"); i >= 0 {
+			entry.Session = stem[i+1:]
+		}
+		if started, err := time.Parse(time.RFC3339, strings.SplitN(stem, "_", 2)[0]); err == nil {
+			entry.Started = started
+		}
+		if _, err := os.Stat(reportBase(recording) + ".report.json"); err == nil {
+			entry.Report = files + url.PathEscape(stem)
 		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Started.After(entries[j].Started) })
 
-	}()
+	params := libraryPageParams{AssetsPath: l.basePath + "assets", Entries: entries}
+	if err := libraryTemplate.Execute(w, params); err != nil {
+		logger.Error(fmt.Sprintf("%s", err))
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// Sends a recording or report, which is audited as they show what was done in a session.
+func (l ReplayLibrary) download(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("file")
+	allowed := slices.ContainsFunc(libraryFiles, func(suffix string) bool { return strings.HasSuffix(name, suffix) })
+	if !allowed || name != filepath.Base(name) {
+		http.Error(w, "File Not Found", http.StatusNotFound)
+		return
+	}
+
+	file := filepath.Join(l.dir, name)
+	stem := name
+	for _, suffix := range libraryFiles {
+		stem = strings.TrimSuffix(stem, suffix)
+	}
+	if _, err := os.Stat(file); err != nil || !l.visible(r, stem) {
+		http.Error(w, "File Not Found", http.StatusNotFound)
+		return
+	}
 
-	wg.Wait()
+	auditLogger.Info("Downloaded from replay library: "+name,
+		slog.String("event.kind", "event"),
+		slog.Any("event.category", []string{"file"}),
+		slog.String("event.action", "replay-download"),
+		slog.String("file.path", file),
+		slog.String("source.ip", remoteIP(r)),
+	)
+	// Reports can be viewed in the browser, the rest are saved.
+	if !strings.HasSuffix(name, ".html") {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	}
+	http.ServeFile(w, r, file)
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"webshell/logging"
+)
+
+// Writes a recording, and its report, of a session owned by the browser with the cookie.
+func writeRecording(t *testing.T, dir string, stem string, cookie string) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: clientCookie, Value: cookie})
+	data, _ := json.Marshal(SessionReport{Owner: clientId(r)})
+	os.WriteFile(filepath.Join(dir, stem+".tty.audit"), []byte("recording"), 0600)
+	os.WriteFile(filepath.Join(dir, stem+".report.json"), data, 0600)
+}
+
+// Without an admin token, each browser only sees its own sessions.
+func TestReplayLibraryOwner(t *testing.T) {
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	auditLogger = slog.New(logging.NewHandler(&bytes.Buffer{}, "session", new(slog.LevelVar)))
+
+	dir := t.TempDir()
+	writeRecording(t, dir, "2026-01-05T09:00:00Z_token_mine", "me")
+	writeRecording(t, dir, "2026-01-05T10:00:00Z_token_theirs", "them")
+	library := ReplayLibrary{dir: dir, basePath: "/token/"}.Handler()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.AddCookie(&http.Cookie{Name: clientCookie, Value: "me"})
+		w := httptest.NewRecorder()
+		library.ServeHTTP(w, r)
+		return w
+	}
+
+	list := get("/replay/library").Body.String()
+	if !strings.Contains(list, "mine") || strings.Contains(list, "theirs") {
+		t.Errorf("the library should only list the browser's own session:\n%s", list)
+	}
+	if w := get("/replay/library/2026-01-05T09:00:00Z_token_mine.tty.audit"); w.Code != http.StatusOK {
+		t.Errorf("own recording: want 200 got %d", w.Code)
+	}
+	for _, name := range []string{"2026-01-05T10:00:00Z_token_theirs.tty.audit", "2026-01-05T10:00:00Z_token_theirs.report.json"} {
+		if w := get("/replay/library/" + name); w.Code != http.StatusNotFound {
+			t.Errorf("%s: want 404 got %d", name, w.Code)
+		}
+	}
+}
+
+// With an admin token, only admins can use the library, and see every session.
+func TestReplayLibraryAdmin(t *testing.T) {
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	auditLogger = slog.New(logging.NewHandler(&bytes.Buffer{}, "session", new(slog.LevelVar)))
+
+	dir := t.TempDir()
+	writeRecording(t, dir, "2026-01-05T10:00:00Z_token_theirs", "them")
+	library := ReplayLibrary{dir: dir, basePath: "/token/", adminToken: "secret"}.Handler()
+
+	r := httptest.NewRequest("GET", "/replay/library/2026-01-05T10:00:00Z_token_theirs.tty.audit", nil)
+	w := httptest.NewRecorder()
+	library.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("without the admin token: want 401 got %d", w.Code)
+	}
+
+	r.Header.Set("Authorization", "Bearer secret")
+	w = httptest.NewRecorder()
+	library.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("with the admin token: want 200 got %d", w.Code)
+	}
+}
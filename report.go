@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"webshell/policy"
+	"webshell/strace"
+)
+
+// Identity is who the user signed in as, the same as the user.* fields of
+// the audit log.
+type Identity struct {
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+// The user the server was started for, by whatever authenticated them.
+func signedInUser() Identity {
+	return Identity{ID: os.Getenv("USER_ID"), Name: os.Getenv("USER_NAME")}
+}
+
+// Connection is a client attached to a session, until it detached.
+type Connection struct {
+	ClientIP  string     `json:"client_ip"`
+	UserAgent string     `json:"user_agent,omitempty"`
+	User      Identity   `json:"user"`
+	Attached  time.Time  `json:"attached"`
+	Detached  *time.Time `json:"detached,omitempty"`
+}
+
+// FileTransfer is a file uploaded to, or downloaded from, the session's home.
+type FileTransfer struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"direction"` // upload or download
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+}
+
+// BlockedCommand is a command the command policy stopped from running.
+type BlockedCommand struct {
+	Time        time.Time `json:"time"`
+	CommandLine string    `json:"command_line"`
+	Rule        string    `json:"rule"`
+}
+
+// ReportAlert is an alert raised by a detection rule during the session.
+type ReportAlert struct {
+	Time        time.Time `json:"time"`
+	Rule        string    `json:"rule"`
+	Description string    `json:"description"`
+	Severity    string    `json:"severity"`
+	CommandLine string    `json:"command_line,omitempty"`
+	Path        string    `json:"path,omitempty"`
+}
+
+// What happened in a session that's only kept for its report. Guarded by the session's mu.
+type sessionHistory struct {
+	connections []Connection
+	transfers   []FileTransfer
+	alerts      []ReportAlert
+	blocked     []BlockedCommand
+}
+
+// Marks the current connection as having detached at t.
+func (h *sessionHistory) detached(t time.Time) {
+	if n := len(h.connections); n > 0 && h.connections[n-1].Detached == nil {
+		h.connections[n-1].Detached = &t
+	}
+}
+
+func (s *Session) recordTransfer(t FileTransfer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history.transfers = append(s.history.transfers, t)
+}
+
+func (s *Session) recordAlert(a policy.Alert) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history.alerts = append(s.history.alerts, ReportAlert{
+		Time:        a.Event.Timestamp,
+		Rule:        a.Rule.ID,
+		Description: a.Rule.Description,
+		Severity:    a.Rule.Severity,
+		CommandLine: strings.Join(a.Event.Argv, " "),
+		Path:        a.Event.Path,
+	})
+}
+
+func (s *Session) recordBlocked(e strace.ExecEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history.blocked = append(s.history.blocked, BlockedCommand{Time: e.Timestamp, CommandLine: strings.Join(e.Argv, " "), Rule: e.Rule})
+}
+
+// SessionReport is a summary of a session for reviewing it once it's ended:
+// who connected and for how long, what they ran and transferred, and what
+// the policy and detection rules caught.
+type SessionReport struct {
+	Session       string           `json:"session"`
+	Identity      Identity         `json:"identity"` // Who signed in
+	Owner         string           `json:"owner"`    // The browser's cookie
+	User          string           `json:"user"`     // The shell's user
+	Shell         string           `json:"shell"`
+	Started       time.Time        `json:"started"`
+	Ended         time.Time        `json:"ended"`
+	Duration      float64          `json:"duration_seconds"`
+	EndReason     string           `json:"end_reason"`
+	ExitCode      *int             `json:"exit_code,omitempty"`
+	Connections   []Connection     `json:"connections"`
+	Commands      []strace.Command `json:"commands"`       // From the exec audit
+	ShellCommands []ShellCommand   `json:"shell_commands"` // From the shell integration
+	Transfers     []FileTransfer   `json:"transfers"`
+	Alerts        []ReportAlert    `json:"alerts"`
+	Blocked       []BlockedCommand `json:"blocked"`
+	Recording     string           `json:"recording,omitempty"` // File name, in the same directory as the report
+	Generated     time.Time        `json:"generated"`
+}
+
+// Report describes the session, which ended at ended because of reason.
+func (s *Session) Report(reason string, ended time.Time) SessionReport {
+	summary := s.Summary()
+	report := SessionReport{
+		Session:       s.ID,
+		Identity:      signedInUser(),
+		Owner:         s.Owner,
+		User:          s.User,
+		Shell:         summary.Shell,
+		Started:       s.Started,
+		Ended:         ended,
+		Duration:      ended.Sub(s.Started).Seconds(),
+		EndReason:     reason,
+		Commands:      summary.Commands,
+		ShellCommands: summary.ShellCommands,
+		Generated:     time.Now(),
+	}
+	if s.Recording != "" {
+		report.Recording = filepath.Base(s.Recording)
+	}
+	if state := s.shell.ExitState(); state != nil {
+		code := state.ExitCode()
+		report.ExitCode = &code
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	report.Connections = append([]Connection{}, s.history.connections...)
+	report.Transfers = append([]FileTransfer{}, s.history.transfers...)
+	report.Alerts = append([]ReportAlert{}, s.history.alerts...)
+	report.Blocked = append([]BlockedCommand{}, s.history.blocked...)
+
+	// A client still attached was disconnected by the session ending.
+	for i, c := range report.Connections {
+		if c.Detached == nil {
+			report.Connections[i].Detached = &ended
+		}
+	}
+	return report
+}
+
+// Writes the session's report as JSON and HTML, next to its recording.
+func (s *Session) writeReport(reason string, ended time.Time) {
+	report := s.Report(reason, ended)
+	base := reportBase(s.Recording)
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err == nil {
+		err = os.WriteFile(base+".report.json", data, 0600)
+	}
+	if err != nil {
+		logger.ErrorContext(s.ctx, fmt.Sprintf("Failed to write session report: %s", err))
+		return
+	}
+
+	f, err := os.OpenFile(base+".report.html", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		logger.ErrorContext(s.ctx, fmt.Sprintf("Failed to write session report: %s", err))
+		return
+	}
+	defer f.Close()
+	if err := reportTemplate.Execute(f, report); err != nil {
+		logger.ErrorContext(s.ctx, fmt.Sprintf("Failed to write session report: %s", err))
+		return
+	}
+	logger.InfoContext(s.ctx, fmt.Sprintf("Session report written to %s.report.{json,html}", base))
+}
+
+// The path of a recording's reports, without their extensions.
+func reportBase(recording string) string {
+	return strings.TrimSuffix(recording, ".tty.audit")
+}
+
+// Functions used by the report's template.
+var reportFuncs = map[string]any{
+	"datetime": func(t time.Time) string {
+		return t.Local().Format(time.DateTime)
+	},
+	"duration": func(seconds float64) string {
+		return time.Duration(seconds * float64(time.Second)).Round(time.Second).String()
+	},
+	"since": func(from time.Time, to *time.Time) string {
+		if to == nil {
+			return ""
+		}
+		return to.Sub(from).Round(time.Second).String()
+	},
+	"exitCode": func(code *int) string {
+		if code == nil {
+			return ""
+		}
+		return fmt.Sprint(*code)
+	},
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"webshell/logging"
+	"webshell/policy"
+)
+
+// The report is written next to the recording when the session ends.
+func TestSessionReport(t *testing.T) {
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	auditLogger = slog.New(logging.NewHandler(&bytes.Buffer{}, "session", new(slog.LevelVar)))
+	config.KillGrace = 500 * time.Millisecond
+	t.Setenv("USER_ID", "u-123")
+	t.Setenv("USER_NAME", "alice@example.com")
+
+	sp := &ShellProcess{}
+	if err := sp.Start(ShellSpec{Name: "sh", Command: "/bin/sh", Args: []string{"-c", "exit 2"}}); err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(sp)
+
+	dir := t.TempDir()
+	s := NewSession("abc", "owner", "alice", sp, 1024, 0)
+	s.Recording = filepath.Join(dir, "2026-01-05T09:00:00Z_token_abc.tty.audit")
+	s.history.connections = []Connection{{ClientIP: "10.0.0.1", UserAgent: "Firefox/140.0", User: signedInUser(), Attached: s.Started}}
+	s.recordTransfer(FileTransfer{Time: time.Now(), Direction: policy.EventDownload, Path: "/home/alice/<dump>.sql", Size: 42, SHA256: "abcd"})
+	s.recordAlert(policy.Alert{
+		Rule:  policy.Detection{ID: "exfil", Description: "Database dumped", Severity: "high"},
+		Event: policy.Event{Kind: policy.EventExec, Timestamp: time.Now(), Argv: []string{"pg_dump", "prod"}},
+	})
+	s.Close("Shell exited")
+
+	data, err := os.ReadFile(filepath.Join(dir, "2026-01-05T09:00:00Z_token_abc.report.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := SessionReport{}
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Session != "abc" || report.User != "alice" || report.EndReason != "Shell exited" || report.Identity != (Identity{ID: "u-123", Name: "alice@example.com"}) {
+		t.Errorf("unexpected session details: %+v", report)
+	}
+	if report.ExitCode == nil || *report.ExitCode != 2 {
+		t.Errorf("exit code: want 2 got %v", report.ExitCode)
+	}
+	if len(report.Connections) != 1 || report.Connections[0].Detached == nil || !report.Connections[0].Detached.Equal(report.Ended) {
+		t.Errorf("the connection should end with the session: %+v", report.Connections)
+	}
+	if len(report.Transfers) != 1 || report.Transfers[0].SHA256 != "abcd" {
+		t.Errorf("unexpected transfers: %+v", report.Transfers)
+	}
+	if len(report.Alerts) != 1 || report.Alerts[0].Rule != "exfil" || report.Alerts[0].CommandLine != "pg_dump prod" {
+		t.Errorf("unexpected alerts: %+v", report.Alerts)
+	}
+	if report.Recording != "2026-01-05T09:00:00Z_token_abc.tty.audit" {
+		t.Errorf("recording: got %s", report.Recording)
+	}
+
+	html, err := os.ReadFile(filepath.Join(dir, "2026-01-05T09:00:00Z_token_abc.report.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"alice@example.com (u-123)", "Firefox/140.0", "Database dumped", "/home/alice/&lt;dump&gt;.sql", `href="./2026-01-05T09:00:00Z_token_abc.tty.audit"`} {
+		if !strings.Contains(string(html), want) {
+			t.Errorf("HTML report is missing %s", want)
+		}
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Sandbox starts the shell in its own PID, mount, UTS and IPC namespaces, so
+// it can't see or signal anything outside of its session.
+type Sandbox struct {
+	Enabled  bool
+	Network  bool // Also give the shell its own network namespace, with only loopback.
+	Writable []string
+}
+
+// Files in these directories are private to each sandbox.
+var sandboxPrivateDirs = []string{"/tmp", "/dev/shm"}
+
+const sandboxHostname = "webshell"
+
+// Not defined by the syscall package.
+const (
+	capSysAdmin          = 21
+	prCapAmbient         = 47
+	prCapAmbientClearAll = 4
+	linuxCapVersion3     = 0x20080522
+)
+
+// Passed to the exec helper, which sets up the sandbox from inside the new namespaces.
+type sandboxSetup struct {
+	Writable []string `json:"writable"`
+	Network  bool     `json:"network"`
+
+	// Set when the server runs as root, the helper switches user once the
+	// sandbox is set up. Otherwise the helper is running in a user namespace.
+	Credential *syscall.Credential `json:"credential,omitempty"`
+}
+
+// Apply configures cmd to start in the sandbox via the exec helper. The shell can write to home as well as the writable paths.
+func (sb Sandbox) Apply(cmd *exec.Cmd, helper *execHelperConfig, home string) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	attr := cmd.SysProcAttr
+
+	attr.Cloneflags = syscall.CLONE_NEWPID | syscall.CLONE_NEWNS | syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC
+	if sb.Network {
+		attr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+
+	writable := append([]string{home}, sb.Writable...)
+	setup := &sandboxSetup{Writable: writable, Network: sb.Network}
+
+	// The helper needs CAP_SYS_ADMIN to mount, so it has to switch user itself afterwards.
+	setup.Credential = attr.Credential
+	attr.Credential = nil
+
+	// Without root a user namespace is needed to create the others. The
+	// server's user is mapped to itself, and keeps CAP_SYS_ADMIN across the
+	// exec of the helper so it can set up mounts.
+	if os.Geteuid() != 0 {
+		uid, gid := os.Geteuid(), os.Getegid()
+		attr.Cloneflags |= syscall.CLONE_NEWUSER
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: uid, HostID: uid, Size: 1}}
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: gid, HostID: gid, Size: 1}}
+		attr.GidMappingsEnableSetgroups = false
+		attr.AmbientCaps = []uintptr{capSysAdmin}
+	}
+
+	helper.Sandbox = setup
+}
+
+// Checks the sandbox can be used, by starting a process in one.
+func validateSandbox(sb Sandbox, home string) error {
+	for _, path := range append([]string{home}, sb.Writable...) {
+		if !filepath.IsAbs(path) {
+			return fmt.Errorf("writable path %s must be absolute", path)
+		}
+		for _, private := range sandboxPrivateDirs {
+			if isSubPath(path, private) {
+				return fmt.Errorf("writable path %s is inside %s, which is private to each sandbox", path, private)
+			}
+		}
+	}
+
+	truePath, err := exec.LookPath("true")
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(truePath)
+	helper := execHelperConfig{}
+	sb.Apply(cmd, &helper, home)
+	if err := wrapWithHelper(cmd, helper); err != nil {
+		return err
+	}
+
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		return nil
+	}
+
+	if os.Geteuid() != 0 && (errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.ENOSPC)) {
+		return fmt.Errorf("unprivileged user namespaces are not allowed on this host (%w), "+
+			"check the user.max_user_namespaces, kernel.unprivileged_userns_clone and "+
+			"kernel.apparmor_restrict_unprivileged_userns sysctls, or run as root", err)
+	}
+	if len(out) > 0 {
+		return fmt.Errorf("%s", strings.TrimSpace(string(out)))
+	}
+	return err
+}
+
+// Reports whether path is dir, or inside it.
+func isSubPath(path string, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, "../")
+}
+
+// Sets up the sandbox, called by the exec helper as the first process in the new namespaces.
+func (s sandboxSetup) enter() error {
+	if err := syscall.Sethostname([]byte(sandboxHostname)); err != nil {
+		return fmt.Errorf("failed to set hostname: %w", err)
+	}
+
+	if err := s.setupMounts(); err != nil {
+		return err
+	}
+
+	if s.Network {
+		if err := loopbackUp(); err != nil {
+			return fmt.Errorf("failed to bring up loopback: %w", err)
+		}
+	}
+
+	return s.dropPrivileges()
+}
+
+func (s sandboxSetup) setupMounts() error {
+	// Keep mount changes inside the namespace.
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("failed to make mounts private: %w", err)
+	}
+
+	// Writable paths become mounts of their own, so they stay writable when
+	// everything else is remounted read-only.
+	for _, path := range s.Writable {
+		if err := syscall.Mount(path, path, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("failed to bind mount %s: %w", path, err)
+		}
+	}
+
+	mounts, err := readMounts()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range mounts {
+		if m.readOnly() || isSubPath(m.Path, "/proc") || s.isWritable(m.Path) {
+			continue
+		}
+		flags := syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY | m.lockedFlags()
+		if err := syscall.Mount("", m.Path, "", uintptr(flags), ""); err != nil {
+			return fmt.Errorf("failed to make %s read-only: %w", m.Path, err)
+		}
+	}
+
+	for _, dir := range sandboxPrivateDirs {
+		if !checkFileExists(dir) {
+			continue
+		}
+		if err := syscall.Mount("tmpfs", dir, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+			return fmt.Errorf("failed to mount private %s: %w", dir, err)
+		}
+	}
+
+	// A fresh /proc only shows processes in the sandbox's PID namespace.
+	if err := syscall.Mount("proc", "/proc", "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("failed to mount /proc: %w", err)
+	}
+
+	return nil
+}
+
+func (s sandboxSetup) isWritable(path string) bool {
+	for _, w := range s.Writable {
+		if isSubPath(path, w) {
+			return true
+		}
+	}
+	return false
+}
+
+// Makes sure the shell can't undo the sandbox.
+func (s sandboxSetup) dropPrivileges() error {
+	// Ambient capabilities would otherwise be passed on to the shell.
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientClearAll, 0, 0, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to clear ambient capabilities: %w", errno)
+	}
+
+	// CAP_SYS_ADMIN was made inheritable to get it into the ambient set.
+	if err := clearInheritableCaps(); err != nil {
+		return fmt.Errorf("failed to clear inheritable capabilities: %w", err)
+	}
+
+	// A shell still running as root keeps its other capabilities, but can't mount.
+	if os.Geteuid() == 0 {
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_CAPBSET_DROP, capSysAdmin, 0); errno != 0 {
+			return fmt.Errorf("failed to drop CAP_SYS_ADMIN: %w", errno)
+		}
+	}
+
+	c := s.Credential
+	if c == nil {
+		return nil
+	}
+
+	if !c.NoSetGroups {
+		groups := make([]int, len(c.Groups))
+		for i, g := range c.Groups {
+			groups[i] = int(g)
+		}
+		if err := syscall.Setgroups(groups); err != nil {
+			return fmt.Errorf("failed to set groups: %w", err)
+		}
+	}
+	if err := syscall.Setgid(int(c.Gid)); err != nil {
+		return fmt.Errorf("failed to set gid: %w", err)
+	}
+	if err := syscall.Setuid(int(c.Uid)); err != nil {
+		return fmt.Errorf("failed to set uid: %w", err)
+	}
+	return nil
+}
+
+func clearInheritableCaps() error {
+	header := struct {
+		version uint32
+		pid     int32
+	}{version: linuxCapVersion3}
+	var data [2]struct {
+		effective   uint32
+		permitted   uint32
+		inheritable uint32
+	}
+
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPGET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return errno
+	}
+	data[0].inheritable = 0
+	data[1].inheritable = 0
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+type mountInfo struct {
+	Path    string
+	Options []string
+}
+
+func (m mountInfo) readOnly() bool {
+	return m.Options[0] == "ro"
+}
+
+// Flags that can't be cleared when remounting in a user namespace, so have to be kept.
+var mountFlags = map[string]int{
+	"nosuid":     syscall.MS_NOSUID,
+	"nodev":      syscall.MS_NODEV,
+	"noexec":     syscall.MS_NOEXEC,
+	"noatime":    syscall.MS_NOATIME,
+	"nodiratime": syscall.MS_NODIRATIME,
+	"relatime":   syscall.MS_RELATIME,
+}
+
+func (m mountInfo) lockedFlags() int {
+	flags := 0
+	for _, opt := range m.Options {
+		flags |= mountFlags[opt]
+	}
+	return flags
+}
+
+// Reads the mount points visible to this process from /proc/self/mountinfo.
+func readMounts() ([]mountInfo, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mounts := []mountInfo{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		path, err := unescapeMountPath(fields[4])
+		if err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, mountInfo{Path: path, Options: strings.Split(fields[5], ",")})
+	}
+	return mounts, scanner.Err()
+}
+
+// Mount points escape spaces, tabs, newlines and backslashes as octal.
+func unescapeMountPath(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			n, err := strconv.ParseUint(s[i+1:i+4], 8, 8)
+			if err != nil {
+				return "", fmt.Errorf("invalid mount path %q", s)
+			}
+			b.WriteByte(byte(n))
+			i += 3
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String(), nil
+}
+
+// Brings up the loopback interface in a new network namespace.
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	var ifr struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifr.name[:], "lo")
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return errno
+	}
+	ifr.flags |= syscall.IFF_UP | syscall.IFF_RUNNING
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return errno
+	}
+	return nil
+}
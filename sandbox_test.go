@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"webshell/logging"
+	"webshell/policy"
+	"webshell/strace"
+)
+
+func TestUnescapeMountPath(t *testing.T) {
+	path, err := unescapeMountPath(`/mnt/my\040disk\134x`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != `/mnt/my disk\x` {
+		t.Errorf("unexpected path %q", path)
+	}
+}
+
+func TestIsSubPath(t *testing.T) {
+	tests := map[string]bool{
+		"/tmp":        true,
+		"/tmp/a/b":    true,
+		"/tmpfoo":     false,
+		"/":           false,
+		"/var/../tmp": true,
+	}
+	for path, want := range tests {
+		if isSubPath(path, "/tmp") != want {
+			t.Errorf("isSubPath(%q) should be %v", path, want)
+		}
+	}
+}
+
+func TestMountLockedFlags(t *testing.T) {
+	m := mountInfo{Path: "/data", Options: []string{"rw", "nosuid", "nodev", "relatime"}}
+	if m.readOnly() {
+		t.Error("mount should be read-write")
+	}
+	if m.lockedFlags() != syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_RELATIME {
+		t.Errorf("unexpected flags %x", m.lockedFlags())
+	}
+}
+
+func TestValidateSandboxPaths(t *testing.T) {
+	for _, path := range []string{"relative", "/tmp/home", "/dev/shm"} {
+		if err := validateSandbox(Sandbox{Enabled: true}, path); err == nil {
+			t.Errorf("%s should not be allowed", path)
+		}
+	}
+}
+
+// The tests' binary is re-executed as the helpers, as the server's is.
+func TestMain(m *testing.M) {
+	switch filepath.Base(os.Args[0]) {
+	case execHelperName:
+		runHelper(os.Args[1:])
+	case strace.PtraceHelper:
+		strace.RunPtraceHelper(os.Args[1:])
+	}
+	os.Exit(m.Run())
+}
+
+// A sandboxed shell, the first process in its PID namespace, still waits for
+// the tracer, so the policy applies to it from the start.
+func TestSandboxWithAuditing(t *testing.T) {
+	// /tmp is private to the sandbox, so the home can't be in it.
+	home, err := os.MkdirTemp("/var/tmp", "webshell-test")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer os.RemoveAll(home)
+	if err := validateSandbox(Sandbox{Enabled: true}, home); err != nil {
+		t.Skipf("sandbox not available: %s", err)
+	}
+	p, err := policy.Parse([]byte(`{"rules": [{"id": "no-id", "action": "deny", "executable": "id"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	audit := &bytes.Buffer{}
+	auditLogger = slog.New(logging.NewHandler(audit, "session", new(slog.LevelVar)))
+	saved := config
+	defer func() { config = saved }()
+	config.Sandbox = Sandbox{Enabled: true}
+	config.AuditExec = true
+	config.AuditTracer = "ptrace"
+	config.Syscalls = strace.Options{Policy: p}
+	config.KillGrace = 500 * time.Millisecond
+
+	sp := &ShellProcess{ctx: context.Background(), home: home}
+	if err := sp.Start(ShellSpec{Name: "sh", Command: "/bin/sh", Args: []string{"-c", "id; echo status=$?"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer sp.Kill()
+	if err := sp.WithAuditing(); err != nil {
+		t.Fatal(err)
+	}
+
+	output, _ := io.ReadAll(sp)
+	if !strings.Contains(string(output), "status=126") {
+		t.Errorf("id should have been blocked, got %q", output)
+	}
+}
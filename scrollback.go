@@ -0,0 +1,75 @@
+package main
+
+import "sync"
+
+// Scrollback is a bounded ring buffer holding the most recent output of a shell.
+// Offsets are absolute positions in the shell's output stream, this lets a
+// reconnecting client resume from the last byte it received.
+type Scrollback struct {
+	mu    sync.Mutex
+	data  []byte
+	total int64
+}
+
+func NewScrollback(size int) *Scrollback {
+	return &Scrollback{
+		data: make([]byte, size),
+	}
+}
+
+func (sb *Scrollback) Write(p []byte) (int, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	n := len(p)
+	size := len(sb.data)
+	if size == 0 {
+		sb.total += int64(n)
+		return n, nil
+	}
+
+	// Only the tail of an oversized write will fit.
+	if len(p) > size {
+		sb.total += int64(len(p) - size)
+		p = p[len(p)-size:]
+	}
+
+	pos := int(sb.total % int64(size))
+	c := copy(sb.data[pos:], p)
+	copy(sb.data, p[c:])
+	sb.total += int64(len(p))
+
+	return n, nil
+}
+
+// Offset returns the total number of bytes written to the buffer.
+func (sb *Scrollback) Offset() int64 {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.total
+}
+
+// Since returns a copy of the buffered output from offset onwards, along with
+// the offset the returned data actually starts at. If the requested offset has
+// already been overwritten, or is invalid, everything still buffered is returned.
+func (sb *Scrollback) Since(offset int64) ([]byte, int64) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+
+	size := int64(len(sb.data))
+	oldest := sb.total - min(sb.total, size)
+	if offset < oldest || offset > sb.total {
+		offset = oldest
+	}
+
+	out := make([]byte, sb.total-offset)
+	if len(out) == 0 {
+		return out, offset
+	}
+
+	start := int(offset % size)
+	c := copy(out, sb.data[start:])
+	copy(out[c:], sb.data)
+
+	return out, offset
+}
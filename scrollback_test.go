@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestScrollbackSince(t *testing.T) {
+	sb := NewScrollback(8)
+	sb.Write([]byte("abcd"))
+
+	data, from := sb.Since(0)
+	if string(data) != "abcd" || from != 0 {
+		t.Errorf("want abcd from 0 got %s from %d", data, from)
+	}
+
+	data, from = sb.Since(2)
+	if string(data) != "cd" || from != 2 {
+		t.Errorf("want cd from 2 got %s from %d", data, from)
+	}
+
+	data, _ = sb.Since(4)
+	if len(data) != 0 {
+		t.Errorf("want nothing got %s", data)
+	}
+}
+
+// Check the buffer wraps and only keeps the most recent output.
+func TestScrollbackWraps(t *testing.T) {
+	sb := NewScrollback(8)
+	sb.Write([]byte("abcdef"))
+	sb.Write([]byte("ghijk"))
+
+	if sb.Offset() != 11 {
+		t.Errorf("offset: want 11 got %d", sb.Offset())
+	}
+
+	data, from := sb.Since(0)
+	if string(data) != "defghijk" || from != 3 {
+		t.Errorf("want defghijk from 3 got %s from %d", data, from)
+	}
+
+	data, from = sb.Since(9)
+	if string(data) != "jk" || from != 9 {
+		t.Errorf("want jk from 9 got %s from %d", data, from)
+	}
+}
+
+func TestScrollbackLargeWrite(t *testing.T) {
+	sb := NewScrollback(4)
+	n, _ := sb.Write([]byte("0123456789"))
+	if n != 10 {
+		t.Errorf("write: want 10 got %d", n)
+	}
+
+	data, from := sb.Since(0)
+	if string(data) != "6789" || from != 6 {
+		t.Errorf("want 6789 from 6 got %s from %d", data, from)
+	}
+}
+
+// Offsets beyond the end of the stream are treated as a fresh client.
+func TestScrollbackInvalidOffset(t *testing.T) {
+	sb := NewScrollback(8)
+	sb.Write([]byte("abc"))
+
+	data, from := sb.Since(100)
+	if string(data) != "abc" || from != 0 {
+		t.Errorf("want abc from 0 got %s from %d", data, from)
+	}
+}
@@ -0,0 +1,693 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"webshell/logging"
+	"webshell/policy"
+	"webshell/strace"
+
+	"github.com/coder/websocket"
+	"github.com/creack/pty"
+)
+
+var errSessionEnded = errors.New("session has ended")
+
+// Close code for a client whose session was attached by another connection.
+// It mustn't reconnect by itself, or two clients would keep taking the session
+// from each other.
+const statusAttachedElsewhere websocket.StatusCode = 4001
+
+// How long ended sessions are kept around so they can still be inspected.
+const sessionRetention = time.Hour
+
+type SessionState string
+
+const (
+	StateAttached SessionState = "attached"
+	StateDetached SessionState = "detached"
+	StateEnded    SessionState = "ended"
+)
+
+// SessionInfo is the public view of a session returned by the sessions API.
+type SessionInfo struct {
+	ID       string       `json:"id"`
+	Owner    string       `json:"owner"`
+	User     string       `json:"user"`
+	Shell    string       `json:"shell"`
+	ClientIP string       `json:"client_ip"`
+	Pid      int          `json:"pid"`
+	State    SessionState `json:"state"`
+	Started  time.Time    `json:"started"`
+	Ended    *time.Time   `json:"ended,omitempty"`
+	Duration float64      `json:"duration_seconds"`
+	BytesIn  int64        `json:"bytes_in"`
+	BytesOut int64        `json:"bytes_out"`
+	Command  string       `json:"command,omitempty"`
+	Shadowed bool         `json:"shadowed"`
+}
+
+// SessionSummary is a session along with the processes its shell ran, which
+// are only known when commands are audited.
+type SessionSummary struct {
+	SessionInfo
+	Processes     []*strace.ProcessNode `json:"processes"`
+	Commands      []strace.Command      `json:"commands"`
+	ShellCommands []ShellCommand        `json:"shell_commands"`
+}
+
+// A Session owns a running shell. The shell outlives the websocket that
+// started it, if the connection drops the session is detached and kept alive
+// for a grace period so the user can reconnect and pick up where they left off.
+type Session struct {
+	ID         string
+	Owner      string
+	User       string
+	Started    time.Time
+	Home       *SessionHome // Set when the session has its own home directory
+	Recording  string       // Path of the TTY recording, the report is written next to it
+	shell      *ShellProcess
+	scrollback *Scrollback
+	grace      time.Duration
+	bytesIn    atomic.Int64
+	bytesOut   atomic.Int64
+	marks      *markParser   // Set when the shell integration is injected
+	prompt     *ShellCommand // The command being typed or run, from the markers
+	detector   *policy.Detector
+	ctx        context.Context // Tags the session's log records with its id
+
+	mu        sync.Mutex
+	state     SessionState
+	ended     time.Time
+	client    *TerminalConn
+	clientCtx context.Context
+	clientIP  string
+	shadows   map[*TerminalConn]context.Context
+	attaches  int // How many times a client has attached
+	detached  *time.Timer
+	commands  []ShellCommand // Finished commands, from the markers
+	history   sessionHistory // What's needed for the report
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewSession(id string, owner string, user string, shell *ShellProcess, scrollbackSize int, grace time.Duration) *Session {
+	s := &Session{
+		ID:         id,
+		Owner:      owner,
+		User:       user,
+		Started:    time.Now(),
+		shadows:    map[*TerminalConn]context.Context{},
+		state:      StateDetached,
+		shell:      shell,
+		scrollback: NewScrollback(scrollbackSize),
+		grace:      grace,
+		done:       make(chan struct{}),
+		ctx:        logging.WithSessionID(context.Background(), id),
+	}
+	if shell.integration != "" {
+		s.marks = &markParser{strip: config.Integration.Strip, onMark: s.mark}
+	}
+	s.detector = config.Alerting.NewDetector()
+	return s
+}
+
+// Run copies the shell's output to the scrollback buffer and any attached
+// client. It returns once the shell exits.
+func (s *Session) Run() {
+	activeConnections.Add(1)
+	defer activeConnections.Done()
+
+	// Stop the session if the global context is cancelled.
+	go func() {
+		select {
+		case <-globalCtx.Done():
+			logger.DebugContext(s.ctx, "Cancelling session "+s.ID)
+			s.Close("Server shutting down")
+		case <-s.done:
+		}
+	}()
+
+	if s.shell.cgroup != nil {
+		go s.shell.cgroup.Watch(s.done, time.Second, s.limitReached)
+	}
+
+	if s.shell.tracer != nil {
+		go s.superviseAuditor()
+		go s.watchExecs()
+	}
+
+	buffer := make([]byte, maxBufferSizeBytes)
+	for {
+		l, err := s.shell.Read(buffer)
+		if err != nil {
+			logger.ErrorContext(s.ctx, fmt.Sprintf("err from shellProc: %s", err))
+			break
+		}
+
+		s.bytesOut.Add(int64(l))
+
+		data := buffer[:l]
+		if s.marks != nil {
+			if data = s.marks.Parse(data); len(data) == 0 {
+				continue
+			}
+		}
+
+		s.output(data)
+	}
+
+	s.Close("Session Ended")
+}
+
+// Adds data to the scrollback and sends it to the client and any shadows.
+// They're written to without holding s.mu, so a slow connection only holds
+// up the shell's output, not everything else that needs the session. Anyone
+// attaching in between gets the data from the scrollback instead.
+func (s *Session) output(data []byte) {
+	s.mu.Lock()
+	s.scrollback.Write(data)
+	client, clientCtx := s.client, s.clientCtx
+	shadows := maps.Clone(s.shadows)
+	s.mu.Unlock()
+
+	if client != nil {
+		if err := client.WriteData(clientCtx, data); err != nil {
+			logger.ErrorContext(s.ctx, fmt.Sprintf("Failed to forward tty to ws %s", err))
+		}
+	}
+	for shadow, ctx := range shadows {
+		if err := shadow.WriteData(ctx, data); err != nil {
+			logger.WarnContext(s.ctx, fmt.Sprintf("Failed to forward tty to shadow %s", err))
+		}
+	}
+}
+
+// Records a step in the session's lifecycle, from start to end, in the audit log.
+func (s *Session) lifecycle(msg string, action string, eventType string, attrs ...any) {
+	attrs = append([]any{
+		slog.String("event.kind", "event"),
+		slog.Any("event.category", []string{"session"}),
+		slog.Any("event.type", []string{eventType}),
+		slog.String("event.action", action),
+	}, attrs...)
+	auditLogger.InfoContext(s.ctx, msg, attrs...)
+}
+
+// Records the end of the session, with how the shell exited and the resources it used.
+func (s *Session) logEnd(reason string, ended time.Time) {
+	attrs := []any{
+		slog.String("event.reason", reason),
+		slog.Time("event.start", s.Started),
+		slog.Time("event.end", ended),
+		slog.Int64("event.duration", ended.Sub(s.Started).Nanoseconds()),
+		slog.Int("process.pid", s.shell.cmd.Process.Pid),
+		slog.Int64("webshell.session.bytes_in", s.bytesIn.Load()),
+		slog.Int64("webshell.session.bytes_out", s.bytesOut.Load()),
+	}
+
+	if state := s.shell.ExitState(); state != nil {
+		attrs = append(attrs, slog.Int("process.exit_code", state.ExitCode()))
+		if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			attrs = append(attrs, slog.String("webshell.process.signal", status.Signal().String()))
+		}
+		// Includes the children the shell waited for, but not any it abandoned.
+		if usage, ok := state.SysUsage().(*syscall.Rusage); ok {
+			attrs = append(attrs,
+				slog.Float64("webshell.session.cpu.user", time.Duration(usage.Utime.Nano()).Seconds()),
+				slog.Float64("webshell.session.cpu.system", time.Duration(usage.Stime.Nano()).Seconds()),
+				slog.Int64("webshell.session.memory.max_rss", usage.Maxrss*1024),
+			)
+		}
+	}
+
+	s.lifecycle("Session ended: "+reason, "session-end", "end", attrs...)
+}
+
+// Resize changes the size of the shell's terminal.
+func (s *Session) Resize(rows int, cols int) error {
+	if err := pty.Setsize(s.shell.tty, &pty.Winsize{Rows: uint16(rows), Cols: uint16(cols)}); err != nil {
+		return err
+	}
+	s.lifecycle(fmt.Sprintf("Session resized to %dx%d", cols, rows), "session-resize", "change",
+		slog.Int("webshell.terminal.rows", rows),
+		slog.Int("webshell.terminal.cols", cols),
+	)
+	return nil
+}
+
+// IdleTimeout ends the session because nobody has used it for idle.
+func (s *Session) IdleTimeout(idle time.Duration) {
+	if s.State() == StateEnded {
+		return
+	}
+	s.lifecycle("Session idle timeout", "session-idle-timeout", "info",
+		slog.Float64("webshell.session.idle", idle.Seconds()),
+	)
+	s.Close("Idle timeout")
+}
+
+// Reports a resource limit being hit to the audit log and the user's terminal.
+func (s *Session) limitReached(e LimitEvent) {
+	auditLogger.WarnContext(s.ctx, "Resource limit reached",
+		slog.String("event.action", "limit-reached"),
+		slog.String("event.code", e.Limit),
+		slog.String("event.reason", e.Message),
+		slog.Int("event.count", e.Count),
+	)
+	s.Notify(e.Message)
+}
+
+// Follows the execs the tracer sees, they've already been audited. Tells the
+// user why the commands the policy blocked didn't run, and checks the rest
+// against the detection rules.
+func (s *Session) watchExecs() {
+	last := 0
+	for {
+		select {
+		case <-s.done:
+			return
+		case e := <-s.shell.tracer.Execs():
+			if e.Rule != "" {
+				// Shells try each directory in PATH in turn, only the first is reported.
+				if e.Pid != last {
+					s.output([]byte(blockedMessage(e)))
+					s.recordBlocked(e)
+				}
+				last = e.Pid
+			}
+			if e.Result >= 0 || e.Rule != "" {
+				detect(s.detector, s, execEvent(e))
+			}
+		}
+	}
+}
+
+// The explanation written to the terminal, after the shell's own error.
+func blockedMessage(e strace.ExecEvent) string {
+	msg := fmt.Sprintf("%s was blocked by policy rule %s", filepath.Base(e.Executable), e.Rule)
+	if rule, ok := config.Syscalls.Policy.Rule(e.Rule); ok && rule.Message != "" {
+		msg += ": " + rule.Message
+	}
+	return "\r\n\x1b[1;31mwebshell: " + msg + "\x1b[0m\r\n"
+}
+
+// Watches the exec auditor, which should only stop once the shell has exited.
+// If it dies first the commands run from then on aren't audited.
+func (s *Session) superviseAuditor() {
+	select {
+	case <-s.done:
+		return
+	case <-s.shell.tracer.Done():
+	}
+
+	// The tracer exits with the last process it traced, after the shell.
+	if s.shell.Exited() {
+		return
+	}
+
+	err := s.shell.tracer.Err()
+	auditLogger.ErrorContext(s.ctx, "Exec auditing stopped",
+		slog.String("event.action", "auditor-failed"),
+		slog.String("event.outcome", "failure"),
+		slog.String("error.message", err.Error()),
+	)
+
+	// Without the tracer the policy isn't enforced either.
+	if config.FailClosed || config.Syscalls.Policy != nil {
+		s.Close("Command auditing stopped, the session has been ended")
+		return
+	}
+	logger.WarnContext(s.ctx, fmt.Sprintf("Exec auditing of session %s stopped: %s", s.ID, err))
+}
+
+// Attach connects a websocket to the session, replacing any existing client.
+// Output the client missed since offset is replayed from the scrollback buffer.
+func (s *Session) Attach(ctx context.Context, ws *TerminalConn, clientIP string, userAgent string, offset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.done:
+		return errSessionEnded
+	default:
+	}
+
+	if s.detached != nil {
+		s.detached.Stop()
+		s.detached = nil
+	}
+
+	if s.client != nil && s.client != ws {
+		logger.InfoContext(s.ctx, fmt.Sprintf("Session %s taken over by a new connection", s.ID))
+		go s.client.Close(statusAttachedElsewhere, "Session attached elsewhere")
+	}
+
+	s.client = ws
+	s.clientCtx = ctx
+	s.clientIP = clientIP
+	s.state = StateAttached
+	now := time.Now()
+	s.history.detached(now) // By being taken over
+	s.history.connections = append(s.history.connections, Connection{ClientIP: clientIP, UserAgent: userAgent, User: signedInUser(), Attached: now})
+
+	// The first attach is part of the session starting.
+	if s.attaches > 0 {
+		s.lifecycle("Session reconnected", "session-reconnect", "info", slog.String("source.ip", clientIP))
+	}
+	s.attaches++
+
+	missed, from := s.scrollback.Since(offset)
+	if from > offset {
+		logger.DebugContext(s.ctx, fmt.Sprintf("Session %s scrollback truncated, %d bytes lost", s.ID, from-offset))
+	}
+
+	// Let the client know which session it is attached to, and where in the output stream it is.
+	hello := ControlMessage{Type: MsgSession, Session: s.ID, Offset: from}
+	if err := ws.WriteControl(ctx, hello); err != nil {
+		logger.ErrorContext(s.ctx, fmt.Sprintf("Failed to send session id: %s", err))
+	}
+
+	if len(missed) > 0 {
+		if err := ws.WriteData(ctx, missed); err != nil {
+			logger.ErrorContext(s.ctx, fmt.Sprintf("Failed to replay scrollback: %s", err))
+		}
+	}
+
+	return nil
+}
+
+// Input sends user input to the shell.
+func (s *Session) Input(b []byte) (int, error) {
+	n, err := s.shell.Write(b)
+	s.bytesIn.Add(int64(n))
+	return n, err
+}
+
+// Notify writes a message to the attached client's terminal. The message is
+// not part of the shell's output so it isn't kept in the scrollback.
+func (s *Session) Notify(msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client == nil {
+		return
+	}
+	notification := ControlMessage{Type: MsgNotification, Message: msg}
+	if err := s.client.WriteControl(s.clientCtx, notification); err != nil {
+		logger.WarnContext(s.ctx, fmt.Sprintf("Failed to notify session %s: %s", s.ID, err))
+	}
+}
+
+// Shadow adds a read-only viewer to the session. It receives the scrollback
+// followed by all new output until it's removed with Unshadow.
+func (s *Session) Shadow(ctx context.Context, ws *TerminalConn) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.done:
+		return errSessionEnded
+	default:
+	}
+
+	missed, _ := s.scrollback.Since(0)
+	if err := ws.WriteData(ctx, missed); err != nil {
+		return err
+	}
+	s.shadows[ws] = ctx
+	return nil
+}
+
+func (s *Session) Unshadow(ws *TerminalConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.shadows, ws)
+}
+
+// Detach disconnects a websocket from the session. If no other client is
+// attached the shell is killed once the grace period expires.
+func (s *Session) Detach(ws *TerminalConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != ws {
+		return
+	}
+	s.client = nil
+	s.clientCtx = nil
+	s.history.detached(time.Now())
+
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+
+	s.state = StateDetached
+	s.lifecycle("Session disconnected", "session-disconnect", "info",
+		slog.String("source.ip", s.clientIP),
+		slog.Float64("webshell.session.grace", s.grace.Seconds()),
+	)
+
+	if s.grace <= 0 {
+		go s.Close("Client disconnected")
+		return
+	}
+
+	logger.InfoContext(s.ctx, fmt.Sprintf("Session %s detached, keeping shell alive for %s", s.ID, s.grace))
+	s.detached = time.AfterFunc(s.grace, func() {
+		s.Close("Detach grace period expired")
+	})
+}
+
+// Close kills the shell and disconnects any attached client.
+func (s *Session) Close(reason string) {
+	s.closeOnce.Do(func() {
+		logger.InfoContext(s.ctx, fmt.Sprintf("Stopping session %s: %s", s.ID, reason))
+		close(s.done)
+
+		if err := s.shell.Kill(); err != nil {
+			logger.ErrorContext(s.ctx, "Failed to kill shell process")
+		}
+
+		if s.Home != nil {
+			s.closeHome()
+		}
+
+		ended := time.Now()
+		s.logEnd(reason, ended)
+		if s.Recording != "" {
+			s.writeReport(reason, ended)
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.state = StateEnded
+		s.ended = ended
+
+		if s.detached != nil {
+			s.detached.Stop()
+		}
+
+		if s.client != nil {
+			s.client.WriteControl(s.clientCtx, ControlMessage{Type: MsgNotification, Message: reason})
+			if err := s.client.Close(websocket.StatusNormalClosure, reason); err != nil {
+				logger.ErrorContext(s.ctx, fmt.Sprintf("Failed to close websocket: %s", err))
+			}
+		}
+
+		for shadow := range s.shadows {
+			go shadow.Close(websocket.StatusNormalClosure, reason)
+		}
+	})
+}
+
+// Archives or deletes the session's home directory once the shell has gone.
+func (s *Session) closeHome() {
+	archive, err := s.Home.Close(config.Homes.Archive, s.ID)
+	if err != nil {
+		logger.ErrorContext(s.ctx, fmt.Sprintf("Failed to clean up home for session %s: %s", s.ID, err))
+		return
+	}
+
+	action := "home-deleted"
+	if archive != "" {
+		action = "home-archived"
+	}
+	auditLogger.InfoContext(s.ctx, "Session home closed",
+		slog.String("event.action", action),
+		slog.String("file.directory", s.Home.Path),
+		slog.String("file.path", archive),
+	)
+}
+
+func (s *Session) State() SessionState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+func (s *Session) Info() SessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info := SessionInfo{
+		ID:       s.ID,
+		Owner:    s.Owner,
+		User:     s.User,
+		Shell:    s.shell.spec.Name,
+		ClientIP: s.clientIP,
+		Pid:      s.shell.cmd.Process.Pid,
+		State:    s.state,
+		Started:  s.Started,
+		Duration: time.Since(s.Started).Seconds(),
+		BytesIn:  s.bytesIn.Load(),
+		BytesOut: s.bytesOut.Load(),
+		Shadowed: len(s.shadows) > 0,
+	}
+	if s.state == StateEnded {
+		ended := s.ended
+		info.Ended = &ended
+		info.Duration = ended.Sub(s.Started).Seconds()
+	} else {
+		info.Command = s.shell.ForegroundCommand()
+	}
+	return info
+}
+
+// Summary reconstructs the process tree and the commands run from the exec audit.
+func (s *Session) Summary() SessionSummary {
+	summary := SessionSummary{
+		SessionInfo:   s.Info(),
+		Processes:     []*strace.ProcessNode{},
+		Commands:      []strace.Command{},
+		ShellCommands: s.ShellCommands(),
+	}
+	if tree := s.shell.Tree(); tree != nil {
+		summary.Processes = tree.Roots()
+		summary.Commands = tree.Commands()
+	}
+	return summary
+}
+
+// ShellCommands returns the commands marked by the shell integration, empty if it isn't injected.
+func (s *Session) ShellCommands() []ShellCommand {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ShellCommand{}, s.commands...)
+}
+
+// The summary saved with the TTY recording. It's written as the shell is
+// killed, before the session is marked as ended.
+func (s *Session) recordingSummary() any {
+	summary := s.Summary()
+	ended := time.Now()
+	summary.State = StateEnded
+	summary.Ended = &ended
+	summary.Duration = ended.Sub(summary.Started).Seconds()
+	summary.Command = ""
+	return summary
+}
+
+// Done is closed when the session has ended.
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// SessionManager keeps track of running sessions, and recently ended ones.
+type SessionManager struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+func NewSessionManager() *SessionManager {
+	return &SessionManager{
+		sessions: map[string]*Session{},
+	}
+}
+
+func (m *SessionManager) Add(s *Session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prune()
+	m.sessions[s.ID] = s
+}
+
+func (m *SessionManager) Get(id string) (*Session, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	return s, ok
+}
+
+// List returns every session belonging to owner, oldest first. An empty owner lists all sessions.
+func (m *SessionManager) List(owner string) []*Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prune()
+
+	list := []*Session{}
+	for _, s := range m.sessions {
+		if owner == "" || s.Owner == owner {
+			list = append(list, s)
+		}
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Started.Before(list[j].Started)
+	})
+	return list
+}
+
+// Latest returns owner's most recently started session that's still running,
+// preferring one the browser is attached to, or nil if there isn't one.
+func (m *SessionManager) Latest(owner string) *Session {
+	if owner == "" {
+		return nil
+	}
+	var latest *Session
+	for _, s := range m.List(owner) {
+		switch {
+		case s.State() == StateAttached:
+			latest = s
+		case s.State() == StateDetached && (latest == nil || latest.State() != StateAttached):
+			latest = s
+		}
+	}
+	return latest
+}
+
+// Count returns the number of sessions that have not ended.
+func (m *SessionManager) Count() int {
+	count := 0
+	for _, s := range m.List("") {
+		if s.State() != StateEnded {
+			count++
+		}
+	}
+	return count
+}
+
+// Removes ended sessions that are past their retention period. Must be called with the lock held.
+func (m *SessionManager) prune() {
+	for id, s := range m.sessions {
+		s.mu.Lock()
+		expired := s.state == StateEnded && time.Since(s.ended) > sessionRetention
+		s.mu.Unlock()
+		if expired {
+			delete(m.sessions, id)
+		}
+	}
+}
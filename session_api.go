@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+)
+
+// SessionsAPI lets a browser list, inspect and terminate its own sessions.
+// Sessions with their own home directory also serve their files.
+type SessionsAPI struct {
+	sessions *SessionManager
+	files    FilesHandler
+}
+
+func (api SessionsAPI) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /sessions", api.list)
+	mux.HandleFunc("GET /sessions/{id}", api.inspect)
+	mux.HandleFunc("GET /sessions/{id}/summary", api.summary)
+	mux.HandleFunc("DELETE /sessions/{id}", api.terminate)
+	mux.HandleFunc("/sessions/{id}/home", api.home)
+	mux.HandleFunc("/sessions/{id}/home/{filename...}", api.home)
+	return mux
+}
+
+func (api SessionsAPI) list(w http.ResponseWriter, r *http.Request) {
+	owner := clientId(r)
+	infos := []SessionInfo{}
+	if owner != "" {
+		for _, s := range api.sessions.List(owner) {
+			infos = append(infos, s.Info())
+		}
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (api SessionsAPI) inspect(w http.ResponseWriter, r *http.Request) {
+	session, ok := api.lookup(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, session.Info())
+}
+
+func (api SessionsAPI) summary(w http.ResponseWriter, r *http.Request) {
+	session, ok := api.lookup(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, session.Summary())
+}
+
+func (api SessionsAPI) terminate(w http.ResponseWriter, r *http.Request) {
+	session, ok := api.lookup(w, r)
+	if !ok {
+		return
+	}
+
+	logger.Info(fmt.Sprintf("Session %s terminated by its owner", session.ID))
+	session.Close("Session terminated")
+	writeJSON(w, http.StatusOK, session.Info())
+}
+
+// Serves the files in the session's home directory.
+func (api SessionsAPI) home(w http.ResponseWriter, r *http.Request) {
+	session, ok := api.lookup(w, r)
+	if !ok {
+		return
+	}
+	if session.Home == nil || session.State() == StateEnded {
+		http.Error(w, "File Not Found", http.StatusNotFound)
+		return
+	}
+
+	fh := api.files
+	fh.baseDir = session.Home.Path
+	fh.baseUrl = path.Join(api.files.baseUrl, session.ID, "home")
+	fh.session = session
+	fh.detector = session.detector
+	fh.Handler().ServeHTTP(w, r)
+}
+
+// Finds the session requested in the path, writing an error if it doesn't belong to the client.
+func (api SessionsAPI) lookup(w http.ResponseWriter, r *http.Request) (*Session, bool) {
+	owner := clientId(r)
+	session, found := api.sessions.Get(r.PathValue("id"))
+	if !found || owner == "" || session.Owner != owner {
+		http.Error(w, "Session Not Found", http.StatusNotFound)
+		return nil, false
+	}
+	return session, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Error(fmt.Sprintf("Failed to encode response: %s", err))
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"webshell/logging"
+
+	"github.com/coder/websocket"
+)
+
+func TestSessionManagerList(t *testing.T) {
+	m := NewSessionManager()
+	now := time.Now()
+
+	m.Add(&Session{ID: "b", Owner: "alice", Started: now.Add(time.Second), state: StateAttached})
+	m.Add(&Session{ID: "a", Owner: "alice", Started: now, state: StateDetached})
+	m.Add(&Session{ID: "c", Owner: "bob", Started: now, state: StateAttached})
+
+	list := m.List("alice")
+	if len(list) != 2 {
+		t.Fatalf("want 2 sessions got %d", len(list))
+	}
+	if list[0].ID != "a" || list[1].ID != "b" {
+		t.Errorf("sessions not sorted by start time: %s, %s", list[0].ID, list[1].ID)
+	}
+
+	if len(m.List("")) != 3 {
+		t.Errorf("want 3 sessions got %d", len(m.List("")))
+	}
+}
+
+// The browser's latest attached session is preferred over detached and ended ones.
+func TestSessionManagerLatest(t *testing.T) {
+	m := NewSessionManager()
+	now := time.Now()
+
+	m.Add(&Session{ID: "attached", Owner: "alice", Started: now, state: StateAttached})
+	m.Add(&Session{ID: "detached", Owner: "alice", Started: now.Add(time.Second), state: StateDetached})
+	m.Add(&Session{ID: "ended", Owner: "alice", Started: now.Add(2 * time.Second), state: StateEnded, ended: now})
+	m.Add(&Session{ID: "other", Owner: "bob", Started: now, state: StateDetached})
+
+	if s := m.Latest("alice"); s == nil || s.ID != "attached" {
+		t.Errorf("want attached got %v", s)
+	}
+	if s := m.Latest("bob"); s == nil || s.ID != "other" {
+		t.Errorf("want other got %v", s)
+	}
+	if s := m.Latest("carol"); s != nil {
+		t.Errorf("want no session got %s", s.ID)
+	}
+}
+
+// Ended sessions are kept until their retention period expires.
+func TestSessionManagerPrune(t *testing.T) {
+	m := NewSessionManager()
+	m.Add(&Session{ID: "old", state: StateEnded, ended: time.Now().Add(-2 * sessionRetention)})
+	m.Add(&Session{ID: "recent", state: StateEnded, ended: time.Now()})
+	m.Add(&Session{ID: "running", state: StateAttached})
+
+	if _, found := m.Get("old"); found {
+		t.Error("expired session was not pruned")
+	}
+	if _, found := m.Get("recent"); !found {
+		t.Error("recently ended session was pruned")
+	}
+	if m.Count() != 1 {
+		t.Errorf("count: want 1 got %d", m.Count())
+	}
+}
+
+// The end of a session is audited with how the shell exited and what it used.
+func TestSessionEndEvent(t *testing.T) {
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	buf := &bytes.Buffer{}
+	auditLogger = slog.New(logging.NewHandler(buf, "session", new(slog.LevelVar)))
+	config.KillGrace = 500 * time.Millisecond
+
+	sp := &ShellProcess{}
+	if err := sp.Start(ShellSpec{Command: "/bin/sh", Args: []string{"-c", "echo started; exit 3"}}); err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(sp)
+
+	s := NewSession("abc", "owner", "user", sp, 1024, 0)
+	s.Input([]byte("ls\n"))
+	s.Close("Session Ended")
+
+	event := map[string]any{}
+	if err := json.Unmarshal(buf.Bytes(), &event); err != nil {
+		t.Fatalf("%s: %s", err, buf)
+	}
+	expected := map[string]any{
+		"session.id":                "abc",
+		"event.action":              "session-end",
+		"event.reason":              "Session Ended",
+		"process.exit_code":         float64(3),
+		"webshell.session.bytes_in": float64(3),
+	}
+	for k, v := range expected {
+		if event[k] != v {
+			t.Errorf("%s: got %v, expected %v", k, event[k], v)
+		}
+	}
+	for _, k := range []string{"event.duration", "webshell.session.cpu.user", "webshell.session.cpu.system", "webshell.session.memory.max_rss"} {
+		if _, ok := event[k]; !ok {
+			t.Errorf("%s is missing", k)
+		}
+	}
+}
+
+// A client that stops reading only holds up the shell's output, the rest of
+// the session can still be used.
+func TestSessionSlowClient(t *testing.T) {
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	conns := make(chan *TerminalConn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- NewTerminalConn(ws)
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	ws, _, err := websocket.Dial(ctx, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.CloseNow()
+
+	s := &Session{shadows: map[*TerminalConn]context.Context{}, scrollback: NewScrollback(1024), ctx: ctx, state: StateAttached}
+	s.client, s.clientCtx = <-conns, ctx
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		chunk := make([]byte, 64*1024)
+		for range 1024 {
+			s.output(chunk)
+		}
+	}()
+
+	// Once the connection's buffers are full, nothing's written until the
+	// client reads, which it never does.
+	time.Sleep(500 * time.Millisecond)
+	select {
+	case <-written:
+		t.Fatal("the output was all written without the client reading it")
+	default:
+	}
+	state := make(chan SessionState)
+	go func() { state <- s.State() }()
+	select {
+	case <-state:
+	case <-time.After(time.Second):
+		t.Error("the session is locked while output is written to the client")
+	}
+
+	ws.CloseNow()
+	<-written
+}
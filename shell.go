@@ -1,211 +1,267 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"math"
 	"net/http"
+	"path/filepath"
 	"strconv"
-	"strings"
-	"sync"
 	"time"
 
 	"github.com/coder/websocket"
-	"github.com/creack/pty"
 
+	"webshell/logging"
 	"webshell/ttyrec"
 )
 
 const (
-	shell              = "/bin/bash"
 	maxBufferSizeBytes = 1024 * 256
 )
 
 type Shell struct {
-	config  Config
-	timeout Timeout
+	config   Config
+	timeout  Timeout
+	sessions *SessionManager
 }
 
 func (s Shell) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
+	owner := clientId(r)
+
+	// Reattach to a detached session if the client asks for one of theirs that's still running.
+	session, found := s.sessions.Get(r.URL.Query().Get("session"))
+	found = found && session.Owner == owner && session.State() != StateEnded
+	var ctx context.Context
+	if found {
+		ctx = logging.WithSessionID(r.Context(), session.ID)
+		logger.InfoContext(ctx, "Reattaching to session "+session.ID)
+	} else {
+		// Users can pick from the configured shells, anything else is refused.
+		spec, ok := s.config.FindShell(r.URL.Query().Get("shell"))
+		if !ok {
+			http.Error(w, "Unknown shell", http.StatusBadRequest)
+			return
+		}
+
+		// Everything logged about the new session, from here on, is tagged with its id.
+		ctx = logging.WithSessionID(r.Context(), generateId())
+		var err error
+		session, err = s.startSession(ctx, r, spec)
+		if err != nil {
+			logger.ErrorContext(ctx, err.Error())
+			http.Error(w, "Failed to start shell", http.StatusInternalServerError)
+			return
+		}
+	}
+
 	// Accept the WS connection
 	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
 		InsecureSkipVerify: true,
+		Subprotocols:       supportedProtocols,
 	})
 	if err != nil {
-		logger.Error(err.Error())
+		logger.ErrorContext(ctx, err.Error())
+		if !found {
+			session.Close("Websocket upgrade failed")
+		}
 		return
 	}
 
+	offset, _ := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+
+	// Pass to websocket handler
+	s.timeout.Start()
+	s.shellHandler(ctx, NewTerminalConn(conn), session, remoteIP(r), r.UserAgent(), offset)
+}
+
+// Starts a new shell for the client making r, with any auditing that's
+// required, and registers it as a session with the id in ctx.
+func (s Shell) startSession(ctx context.Context, r *http.Request, spec ShellSpec) (*Session, error) {
+	id := logging.SessionID(ctx)
+	owner := clientId(r)
+
+	// Each session gets its own home directory if configured.
+	shellProcess := &ShellProcess{ctx: ctx}
+	var home *SessionHome
+	if s.config.Homes.Enabled() {
+		var err error
+		home, err = NewSessionHome(s.config.Homes, s.config.User)
+		if err != nil {
+			return nil, err
+		}
+		shellProcess.home = home.Path
+	}
+
 	// Start shell process
-	shellProcess := &ShellProcess{}
-	err = shellProcess.Start(shell)
+	err := shellProcess.Start(spec)
 	if err != nil {
-		logger.Error(err.Error())
-		return
+		if home != nil {
+			home.Remove()
+		}
+		return nil, err
+	}
+
+	// Cleans up if auditing can't be set up.
+	abort := func() {
+		shellProcess.Kill()
+		if home != nil {
+			home.Remove()
+		}
 	}
 
 	// Attach auditing if required
+	recording := ""
 	if s.config.AuditTTY {
 		timestamp := time.Now().Format(time.RFC3339)
-		auditFile := fmt.Sprintf("%s_%s.tty.audit", timestamp, s.config.Token)
+		auditFile := fmt.Sprintf("%s_%s_%s.tty.audit", timestamp, s.config.Token, id)
 		recorder, err := ttyrec.NewRecorder(s.config.AuditPath, auditFile)
 		if err != nil {
-			logger.Error(err.Error())
-			http.Error(w, "Audit setup failed", http.StatusInternalServerError)
-			return
+			abort()
+			return nil, fmt.Errorf("audit setup failed: %w", err)
 		}
 		shellProcess.WithTTYRecorder(recorder)
-		logger.Info(fmt.Sprintf("Recording TTY data to %s/%s", s.config.AuditPath, auditFile))
-		defer recorder.Save()
+		recording = filepath.Join(s.config.AuditPath, auditFile)
+		logger.InfoContext(ctx, "Recording TTY data to "+recording)
 	}
 
 	if s.config.AuditExec {
 		if err := shellProcess.WithAuditing(); err != nil {
-			logger.Error(err.Error())
-			http.Error(w, "Audit setup failed", http.StatusInternalServerError)
-			return
+			abort()
+			return nil, err
 		}
 	}
 
-	// Pass to websocket handler
-	s.timeout.Start()
-	s.shellHandler(r.Context(), conn, shellProcess)
-
+	session := NewSession(id, owner, shellUser(s.config.User), shellProcess, s.config.Scrollback, s.config.DetachGrace)
+	session.Home = home
+	session.Recording = recording
+	shellProcess.summary = session.recordingSummary
+
+	logger.InfoContext(ctx, "New webshell session "+session.ID)
+	session.lifecycle("Session started", "session-start", "start",
+		slog.String("process.name", spec.Name),
+		slog.String("process.executable", spec.Command),
+		slog.Any("process.args", append([]string{spec.Argv0()}, spec.Args...)),
+		slog.Int("process.pid", shellProcess.cmd.Process.Pid),
+		slog.String("process.user.name", session.User),
+		slog.String("source.ip", remoteIP(r)),
+		slog.String("user_agent.original", r.UserAgent()),
+	)
+
+	s.sessions.Add(session)
+	go session.Run()
+
+	return session, nil
 }
 
 // WebShell's websocket handler
-func (s Shell) shellHandler(ctxReq context.Context, ws *websocket.Conn, shellProc *ShellProcess) {
-
-	logger.Info("New webshell session")
+func (s Shell) shellHandler(ctxReq context.Context, ws *TerminalConn, session *Session, clientIP string, userAgent string, offset int64) {
 
 	ctxLocal, cancelLocal := context.WithCancel(ctxReq)
 	defer cancelLocal()
 
-	var wg sync.WaitGroup
-	wg.Add(1)
 	activeConnections.Add(1)
 	defer activeConnections.Done()
 
-	// Gracefully stop the session
+	if err := session.Attach(ctxLocal, ws, clientIP, userAgent, offset); err != nil {
+		logger.WarnContext(ctxLocal, fmt.Sprintf("Unable to attach to session %s: %s", session.ID, err))
+		ws.Close(websocket.StatusNormalClosure, "Session Ended")
+		return
+	}
+
+	ws.WriteControl(ctxLocal, ControlMessage{Type: MsgTitle, Title: session.shell.spec.Name})
+
+	// Detach from the session when the websocket closes, the shell keeps running.
 	defer func() {
-		logger.Info("Stopping webshell")
-		if err := shellProc.Kill(); err != nil {
-			logger.Error("Failed to kill shell process")
-		}
-		if err := ws.Close(websocket.StatusNormalClosure, "Connection closed"); err != nil {
-			logger.Error(fmt.Sprintf("Failed to close websocket: %s", err))
-		}
+		logger.InfoContext(ctxLocal, "Detaching from session "+session.ID)
+		session.Detach(ws)
+		ws.CloseNow()
 	}()
 
-	// Shell -> User
+	// Stop the handler if the global context is cancelled
 	go func() {
-		buffer := make([]byte, maxBufferSizeBytes)
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
 		for {
-			l, err := shellProc.Read(buffer)
-			if err != nil {
-				logger.Error(fmt.Sprintf("err from shellProc: %s", err))
-				ws.Write(ctxLocal, websocket.MessageBinary, []byte("Session Ended"))
-				break
-			}
-
-			if err := ws.Write(ctxLocal, websocket.MessageBinary, buffer[:l]); err != nil {
-				logger.Error("Failed to forward tty to ws %s", err)
+			select {
+			case <-globalCtx.Done():
+				logger.DebugContext(ctxLocal, "Cancelling Websocket Handler")
+				if err := ws.CloseNow(); err != nil {
+					logger.ErrorContext(ctxLocal, err.Error())
+				}
+				return
+			case <-ctxLocal.Done():
+				logger.InfoContext(ctxLocal, "Request Cancelled")
+				return
+			case <-ticker.C:
+				s.timeout.Ping()
 			}
 		}
-		wg.Done()
 	}()
 
 	// User -> Shell
-	go func() {
-
-		// Kill the shell when the reader exits. TODO: can do move this outside the go routines?
-		defer shellProc.Kill()
-
-		for {
-			_, b, err := ws.Read(ctxLocal)
-			if err != nil {
-				logger.Warn(fmt.Sprintf("Websocket closed: %s", err))
-				break
-			}
+	for {
+		data, msg, err := ws.Read(ctxLocal)
+		if errors.Is(err, errInvalidControl) {
+			logger.WarnContext(ctxLocal, err.Error())
+			ws.WriteControl(ctxLocal, ControlMessage{Type: MsgError, Message: err.Error()})
+			continue
+		}
+		if err != nil {
+			logger.WarnContext(ctxLocal, fmt.Sprintf("Websocket closed: %s", err))
+			break
+		}
 
-			s.timeout.Ping()
+		s.timeout.Ping()
 
-			b = bytes.Trim(b, "\x00")
+		if msg != nil {
+			s.handleControl(ctxLocal, ws, session, msg)
+			continue
+		}
 
-			if len(b) == 0 {
-				continue
-			}
+		if len(data) == 0 {
+			continue
+		}
 
-			// Special purpose payloads.
-			if b[0] == 1 {
-				specialPayload := string(bytes.Trim(b[1:], " \n\r\t\x00\x01"))
+		// Send user input to shell process
+		_, err = session.Input(data)
+		if err != nil {
+			logger.ErrorContext(ctxLocal, fmt.Sprintf("Failed to write to TTY: %s", err))
+		}
+	}
+}
 
-				if specialPayload == "PING" {
-					continue
-				}
+// Handles a control message sent by the terminal.
+func (s Shell) handleControl(ctx context.Context, ws *TerminalConn, session *Session, msg *ControlMessage) {
+	switch msg.Type {
+	case MsgPing:
+		if !ws.legacy {
+			ws.WriteControl(ctx, ControlMessage{Type: MsgPong})
+		}
 
-				// Resize payload (SIZE COL ROW)
-				if strings.HasPrefix(specialPayload, "SIZE") {
-					fields := strings.Fields(specialPayload)
-					if len(fields) != 3 {
-						logger.Error("Invalid resize payload: " + specialPayload)
-						continue
-					}
-
-					cols, errCol := strconv.ParseInt(fields[1], 10, 16)
-					rows, errRow := strconv.ParseInt(fields[2], 10, 16)
-
-					if errCol != nil || errRow != nil {
-						logger.Error("Invalid resize payload: " + specialPayload)
-						continue
-					}
-
-					logger.Debug(fmt.Sprintf("Resizing tty to use %d rows and %d columns...", rows, cols))
-
-					if err := pty.Setsize(shellProc.tty, &pty.Winsize{
-						Rows: uint16(rows),
-						Cols: uint16(cols),
-					}); err != nil {
-						logger.Warn(fmt.Sprintf("Failed to resize tty, error: %s", err))
-					}
-					continue
-				}
+	case MsgResize:
+		if msg.Cols <= 0 || msg.Rows <= 0 || msg.Cols > math.MaxUint16 || msg.Rows > math.MaxUint16 {
+			logger.ErrorContext(ctx, fmt.Sprintf("Invalid resize payload: %d %d", msg.Cols, msg.Rows))
+			ws.WriteControl(ctx, ControlMessage{Type: MsgError, Message: "invalid terminal size"})
+			return
+		}
 
-				logger.Info("Unknown special payload " + specialPayload)
-			}
+		logger.DebugContext(ctx, fmt.Sprintf("Resizing tty to use %d rows and %d columns...", msg.Rows, msg.Cols))
 
-			// Send user input to shell process
-			_, err = shellProc.Write(b)
-			if err != nil {
-				logger.Error(fmt.Sprintf("Failed to write to TTY: %s", err))
-			}
+		if err := session.Resize(msg.Rows, msg.Cols); err != nil {
+			logger.WarnContext(ctx, fmt.Sprintf("Failed to resize tty, error: %s", err))
 		}
 
-	}()
-
-	// Stop the handler if the global context is cancelled
-	go func() {
-		ticker := time.NewTicker(5 * time.Second)
-		for {
-			select {
-			case <-globalCtx.Done():
-				logger.Debug("Cancelling Websocket Handler")
-				if err := shellProc.Kill(); err != nil {
-					logger.Error(err.Error())
-				}
-				if err := ws.CloseNow(); err != nil {
-					logger.Error(err.Error())
-				}
-				return
-			case <-ctxLocal.Done():
-				logger.Info("Request Cancelled")
-				return
-			case <-ticker.C:
-				s.timeout.Ping()
-			}
+	case MsgSignal:
+		if err := session.shell.Signal(msg.Signal); err != nil {
+			logger.WarnContext(ctx, fmt.Sprintf("Failed to send signal: %s", err))
+			ws.WriteControl(ctx, ControlMessage{Type: MsgError, Message: err.Error()})
 		}
-	}()
 
-	wg.Wait()
+	default:
+		logger.InfoContext(ctx, "Unsupported control message "+msg.Type)
+		ws.WriteControl(ctx, ControlMessage{Type: MsgError, Message: "unsupported control message: " + msg.Type})
+	}
 }
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Shell integration has bash and zsh mark their prompts and the commands run
+// with OSC 133 sequences, so the server knows where each command starts and
+// ends in the output, and how it exited.
+type ShellIntegration struct {
+	Enabled bool
+	Strip   bool // Remove the markers from the output sent to the browser
+}
+
+//go:embed integration/*
+var integrationFS embed.FS
+
+// The rc files for each supported shell, by the name they're written as.
+var integrationFiles = map[string]map[string]string{
+	"bash": {"bashrc": "bashrc"},
+	"zsh":  {".zshenv": "zshenv", ".zprofile": "zprofile", ".zshrc": "zshrc"},
+}
+
+// Passed to the exec helper, which writes the rc files as the shell's user,
+// inside the sandbox if there is one.
+type integrationSetup struct {
+	Dir   string            `json:"dir"`
+	Files map[string]string `json:"files"`
+}
+
+func (s integrationSetup) write() error {
+	if err := os.Mkdir(s.Dir, 0700); err != nil {
+		return err
+	}
+	for name, content := range s.Files {
+		if err := os.WriteFile(filepath.Join(s.Dir, name), []byte(content), 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Arguments that mean the shell won't read the rc files, or isn't interactive.
+var integrationSkipArgs = []string{"-c", "--rcfile", "--init-file", "--norc", "--posix"}
+
+// Sets up the shell to read the integration's rc files. Returns nil if the shell isn't supported.
+func (sp *ShellProcess) injectIntegration(spec ShellSpec) (*integrationSetup, error) {
+	shell := filepath.Base(spec.Command)
+	files, ok := integrationFiles[shell]
+	if !ok || slices.ContainsFunc(spec.Args, func(arg string) bool { return slices.Contains(integrationSkipArgs, arg) }) {
+		logger.Debug(fmt.Sprintf("Shell integration isn't supported for %s %s", spec.Command, strings.Join(spec.Args, " ")))
+		return nil, nil
+	}
+
+	setup := &integrationSetup{
+		Dir:   filepath.Join(os.TempDir(), "webshell-integration-"+generateId()),
+		Files: map[string]string{},
+	}
+	for name, file := range files {
+		content, err := integrationFS.ReadFile("integration/" + file)
+		if err != nil {
+			return nil, err
+		}
+		setup.Files[name] = string(content)
+	}
+
+	switch shell {
+	case "bash":
+		sp.cmd.Args = slices.Insert(sp.cmd.Args, 1, "--rcfile", filepath.Join(setup.Dir, "bashrc"))
+		if spec.Login {
+			sp.cmd.Args[0] = filepath.Base(spec.Command)
+			sp.cmd.Env = setEnv(sp.cmd.Env, "WEBSHELL_LOGIN", "1")
+		}
+	case "zsh":
+		if dir := lookupEnv(sp.cmd.Env, "ZDOTDIR"); dir != "" {
+			sp.cmd.Env = setEnv(sp.cmd.Env, "WEBSHELL_USER_ZDOTDIR", dir)
+		}
+		sp.cmd.Env = setEnv(sp.cmd.Env, "ZDOTDIR", setup.Dir)
+	}
+
+	sp.integration = setup.Dir
+	return setup, nil
+}
+
+// Longest marker looked for, they include the command line.
+const maxMarkLength = 64 * 1024
+
+var markPrefix = []byte("\x1b]133;")
+
+// A commandMark is an OSC 133 sequence found in the shell's output.
+type commandMark struct {
+	kind   byte // A prompt, B input, C output, D finished
+	params []string
+	offset int64 // Of the start of the sequence in the shell's output
+}
+
+// markParser finds OSC 133 sequences in the shell's output, which can be
+// split across reads.
+type markParser struct {
+	strip   bool
+	onMark  func(commandMark)
+	start   int64  // Offset in the output of the start of pending
+	pending []byte // The start of a sequence held back until the rest is read
+}
+
+// Parse finds the markers in the next chunk of output, returning the output
+// to pass on. When stripping, the markers are removed, and the start of any
+// marker split across reads is held back until the rest of it is read.
+func (p *markParser) Parse(b []byte) []byte {
+	data := b
+	if len(p.pending) > 0 {
+		data = append(p.pending, b...)
+	}
+	p.pending = nil
+
+	out := data[:0:0]
+	copied := 0
+	for i := 0; i < len(data); {
+		j := bytes.IndexByte(data[i:], 0x1b)
+		if j < 0 {
+			break
+		}
+		i += j
+
+		rest := data[i:]
+		if len(rest) < len(markPrefix) {
+			if bytes.HasPrefix(markPrefix, rest) {
+				p.pending = rest
+				break
+			}
+			i++
+			continue
+		}
+		if !bytes.HasPrefix(rest, markPrefix) {
+			i++
+			continue
+		}
+
+		end, termLength := markEnd(rest)
+		if end < 0 {
+			if len(rest) <= maxMarkLength {
+				p.pending = rest
+				break
+			}
+			i++
+			continue
+		}
+
+		p.onMark(parseMark(rest[len(markPrefix):end], p.start+int64(i)))
+		if p.strip {
+			out = append(out, data[copied:i]...)
+			copied = i + end + termLength
+		}
+		i += end + termLength
+	}
+
+	held := len(p.pending)
+	p.pending = bytes.Clone(p.pending)
+	p.start += int64(len(data) - held)
+
+	if !p.strip {
+		// Nothing is removed, so nothing needs holding back either.
+		return b
+	}
+	return append(out, data[copied:len(data)-held]...)
+}
+
+// Finds the BEL or ST that ends an OSC sequence, returning its index and length.
+func markEnd(b []byte) (int, int) {
+	for i := len(markPrefix); i < len(b); i++ {
+		switch {
+		case b[i] == '\a':
+			return i, 1
+		case b[i] == 0x1b && i+1 < len(b) && b[i+1] == '\\':
+			return i, 2
+		}
+	}
+	return -1, 0
+}
+
+// Parses the body of a marker, e.g. D;0;cmdline=ls -l. The command line is
+// always last, and can contain semicolons.
+func parseMark(body []byte, offset int64) commandMark {
+	mark := commandMark{offset: offset}
+	s := string(body)
+	if s == "" {
+		return mark
+	}
+	mark.kind = s[0]
+	s = strings.TrimPrefix(s[1:], ";")
+	for s != "" {
+		if strings.HasPrefix(s, "cmdline=") {
+			mark.params = append(mark.params, s)
+			break
+		}
+		param, rest, _ := strings.Cut(s, ";")
+		mark.params = append(mark.params, param)
+		s = rest
+	}
+	return mark
+}
+
+// ShellCommand is a command line the user ran, as marked by the shell
+// integration. Offsets are into the shell's output, as it's recorded.
+type ShellCommand struct {
+	CommandLine  string     `json:"command_line"`
+	ExitCode     *int       `json:"exit_code,omitempty"`
+	Started      time.Time  `json:"started"`
+	Ended        *time.Time `json:"ended,omitempty"`
+	PromptOffset int64      `json:"prompt_offset"`
+	InputOffset  int64      `json:"input_offset"`
+	OutputOffset int64      `json:"output_offset"`
+	EndOffset    int64      `json:"end_offset"`
+}
+
+// Follows the markers through each prompt and command, logging each command once it finishes.
+func (s *Session) mark(m commandMark) {
+	switch m.kind {
+	case 'A':
+		s.prompt = &ShellCommand{PromptOffset: m.offset, InputOffset: m.offset}
+	case 'B':
+		if s.prompt != nil {
+			s.prompt.InputOffset = m.offset
+		}
+	case 'C':
+		if s.prompt == nil {
+			s.prompt = &ShellCommand{PromptOffset: m.offset, InputOffset: m.offset}
+		}
+		s.prompt.OutputOffset = m.offset
+		s.prompt.Started = time.Now()
+	case 'D':
+		// Only commands that were run have an output marker.
+		if s.prompt == nil || s.prompt.Started.IsZero() {
+			return
+		}
+		command := *s.prompt
+		s.prompt = nil
+
+		ended := time.Now()
+		command.Ended = &ended
+		command.EndOffset = m.offset
+		for i, param := range m.params {
+			if cmdline, ok := strings.CutPrefix(param, "cmdline="); ok {
+				command.CommandLine = strings.TrimSpace(cmdline)
+			} else if code, err := strconv.Atoi(param); err == nil && i == 0 {
+				command.ExitCode = &code
+			}
+		}
+
+		s.mu.Lock()
+		s.commands = append(s.commands, command)
+		s.mu.Unlock()
+		s.logCommand(command)
+	}
+}
+
+func (s *Session) logCommand(c ShellCommand) {
+	attrs := []any{
+		slog.String("event.kind", "event"),
+		slog.Any("event.category", []string{"process"}),
+		slog.Any("event.type", []string{"end"}),
+		slog.String("event.action", "shell-command"),
+		slog.String("event.provider", "shell-integration"),
+		slog.Time("event.start", c.Started),
+		slog.Time("event.end", *c.Ended),
+		slog.Int64("event.duration", c.Ended.Sub(c.Started).Nanoseconds()),
+		slog.String("process.command_line", c.CommandLine),
+		slog.Int64("webshell.recording.offset", c.OutputOffset),
+	}
+
+	msg := "Command: " + c.CommandLine
+	if c.ExitCode != nil {
+		outcome := "success"
+		if *c.ExitCode != 0 {
+			outcome = "failure"
+		}
+		attrs = append(attrs,
+			slog.Int("process.exit_code", *c.ExitCode),
+			slog.String("event.outcome", outcome),
+		)
+		msg += fmt.Sprintf(" = %d", *c.ExitCode)
+	}
+	auditLogger.InfoContext(s.ctx, msg, attrs...)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/creack/pty"
+)
+
+func TestMarkParser(t *testing.T) {
+	output := "\x1b]133;A\a$ \x1b]133;B\x1b\\ls\r\n\x1b]133;C\afile\r\n\x1b]133;D;0;cmdline=ls; echo a;b\a\x1b[0m"
+
+	for _, strip := range []bool{false, true} {
+		// Every way of splitting the output across two reads.
+		for split := 0; split <= len(output); split++ {
+			marks := []commandMark{}
+			p := &markParser{strip: strip, onMark: func(m commandMark) { marks = append(marks, m) }}
+
+			out := append(p.Parse([]byte(output[:split])), p.Parse([]byte(output[split:]))...)
+
+			want := output
+			if strip {
+				want = "$ ls\r\nfile\r\n\x1b[0m"
+			}
+			if string(out) != want {
+				t.Fatalf("strip %v split at %d: got %q", strip, split, out)
+			}
+
+			kinds := ""
+			for _, m := range marks {
+				kinds += string(m.kind)
+			}
+			if kinds != "ABCD" {
+				t.Fatalf("strip %v split at %d: got marks %q", strip, split, kinds)
+			}
+			if marks[2].offset != int64(strings.Index(output, "\x1b]133;C")) {
+				t.Errorf("wrong offset %d for %+v", marks[2].offset, marks[2])
+			}
+			if !slices.Equal(marks[3].params, []string{"0", "cmdline=ls; echo a;b"}) {
+				t.Errorf("wrong params %q", marks[3].params)
+			}
+		}
+	}
+}
+
+// Escape sequences that aren't markers are passed through as they are.
+func TestMarkParserOtherSequences(t *testing.T) {
+	p := &markParser{strip: true, onMark: func(m commandMark) { t.Errorf("unexpected mark %+v", m) }}
+
+	output := "\x1b]0;title\a\x1b[1m\x1b]13x"
+	if out := p.Parse([]byte(output)); string(out) != output {
+		t.Errorf("got %q", out)
+	}
+
+	// A lone escape might be the start of a marker.
+	if out := p.Parse([]byte("a\x1b")); string(out) != "a" {
+		t.Errorf("got %q", out)
+	}
+	if out := p.Parse([]byte("[0m")); string(out) != "\x1b[0m" {
+		t.Errorf("got %q", out)
+	}
+}
+
+// Runs bash with the integration's rc file and checks the commands it marks.
+func TestBashIntegration(t *testing.T) {
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash is not installed")
+	}
+	auditLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	home := t.TempDir()
+	rc, err := integrationFS.ReadFile("integration/bashrc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcfile := filepath.Join(home, "bashrc")
+	if err := os.WriteFile(rcfile, rc, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(home, ".bashrc"), []byte("PS1='$ '\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(bash, "--rcfile", rcfile)
+	cmd.Env = []string{"HOME=" + home, "PATH=" + os.Getenv("PATH"), "TERM=xterm"}
+	tty, err := pty.Start(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tty.Close()
+
+	s := &Session{ID: "test"}
+	s.marks = &markParser{strip: true, onMark: s.mark}
+
+	output := &bytes.Buffer{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 1024)
+		for {
+			n, err := tty.Read(buf)
+			if err != nil {
+				return
+			}
+			output.Write(s.marks.Parse(buf[:n]))
+		}
+	}()
+
+	for _, line := range []string{"true", "", "(exit 3)", "echo 'a;b'", "exit"} {
+		time.Sleep(100 * time.Millisecond)
+		tty.Write([]byte(line + "\n"))
+	}
+	cmd.Wait()
+	tty.Close()
+	<-done
+
+	results := []string{}
+	for _, c := range s.ShellCommands() {
+		results = append(results, c.CommandLine+" = "+strconv.Itoa(*c.ExitCode))
+		if c.OutputOffset <= c.InputOffset || c.EndOffset < c.OutputOffset {
+			t.Errorf("offsets out of order %+v", c)
+		}
+	}
+	if !slices.Equal(results, []string{"true = 0", "(exit 3) = 3", "echo 'a;b' = 0"}) {
+		t.Errorf("unexpected commands %q", results)
+	}
+	if bytes.Contains(output.Bytes(), []byte("\x1b]133")) {
+		t.Errorf("markers weren't stripped %q", output)
+	}
+}
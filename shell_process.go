@@ -1,25 +1,46 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"os/exec"
 	"sync"
+	"syscall"
+	"time"
+	"unsafe"
 
 	"github.com/creack/pty"
 
+	"webshell/logging"
+	"webshell/procfs"
 	"webshell/strace"
 	"webshell/ttyrec"
 )
 
 type ShellProcess struct {
+	home   string // Overrides config.HomeDir as the shell's cwd and HOME
+	spec   ShellSpec
 	cmd    *exec.Cmd
 	tty    *os.File
 	reader io.Reader
 	once   sync.Once
 	rec    *ttyrec.Recorder
+	cgroup *Cgroup
+	tracer strace.Tracer
+	resume *os.File         // Closed to let the exec helper run the shell, once auditing has started
+	ctx    context.Context  // Tags the shell's log records with its session
+	state  *os.ProcessState // Set once the shell has been killed and waited for
+
+	// Directory of the shell integration's rc files, set when it's injected.
+	integration string
+
+	// Saved with the TTY recording as its metadata.
+	summary func() any
 }
 
 func (sp *ShellProcess) Read(b []byte) (int, error) {
@@ -30,23 +51,82 @@ func (sp *ShellProcess) Write(b []byte) (int, error) {
 	return sp.tty.Write(b)
 }
 
-func (sp *ShellProcess) Start(command string, args ...string) error {
+func (sp *ShellProcess) Start(spec ShellSpec) error {
 	var err error
 
 	// Start the shell
-	sp.cmd = exec.Command(command, args...)
+	sp.spec = spec
+	sp.cmd = exec.Command(spec.Command, spec.Args...)
+	sp.cmd.Args[0] = spec.Argv0()
 	sp.cmd.Env = filterEnv(os.Environ())
 	sp.cmd.Dir = config.HomeDir
+	if sp.home != "" {
+		sp.cmd.Dir = sp.home
+	}
 
 	// TODO: move to params
 	if config.User != nil {
-		logger.Info(fmt.Sprintf("Running %s as %s", shell, config.User.Username))
+		logger.InfoContext(sp.ctx, fmt.Sprintf("Running %s as %s", spec.Command, config.User.Username))
 		runAs(sp.cmd, config.User)
 	}
 
+	sp.cmd.Env = config.Env.Inject(sp.cmd.Env, spec.Env...)
+	if sp.home != "" {
+		sp.cmd.Env = setEnv(sp.cmd.Env, "HOME", sp.home)
+	}
+
+	// The shell runs in its own session, and so its own process group, so we
+	// can find and signal everything it starts. pty.Start sets Setsid as well,
+	// this makes sure it's never lost.
+	if sp.cmd.SysProcAttr == nil {
+		sp.cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	sp.cmd.SysProcAttr.Setsid = true
+
+	// rlimits, the sandbox and the shell integration have to be set up by the
+	// new process itself, so it's started via the exec helper.
+	helper := execHelperConfig{Rlimits: config.Limits.Rlimits(), Wait: config.AuditExec}
+	if config.Sandbox.Enabled {
+		config.Sandbox.Apply(sp.cmd, &helper, sp.cmd.Dir)
+	}
+	if config.Integration.Enabled {
+		if helper.Integration, err = sp.injectIntegration(spec); err != nil {
+			return fmt.Errorf("failed to set up shell integration: %w", err)
+		}
+	}
+	if len(helper.Rlimits) > 0 || helper.Sandbox != nil || helper.Integration != nil || helper.Wait {
+		if err := wrapWithHelper(sp.cmd, helper); err != nil {
+			return fmt.Errorf("failed to start exec helper: %w", err)
+		}
+	}
+	if helper.Wait {
+		wait, resume, err := os.Pipe()
+		if err != nil {
+			return err
+		}
+		defer wait.Close()
+		sp.cmd.ExtraFiles = []*os.File{wait} // execHelperWaitFd
+		sp.resume = resume
+	}
+
+	// The shell is started directly in the session's cgroup, everything it forks stays there.
+	if config.Limits.CgroupParent != "" {
+		sp.cgroup, err = NewCgroup(config.Limits, "webshell-"+generateId())
+		if err != nil {
+			return err
+		}
+		sp.cmd.SysProcAttr.UseCgroupFD = true
+		sp.cmd.SysProcAttr.CgroupFD = sp.cgroup.FD()
+	}
+
 	tty, err := pty.Start(sp.cmd)
 	if err != nil {
-		logger.Error(fmt.Sprintf("Failed to start %s: %s", shell, err))
+		logger.ErrorContext(sp.ctx, fmt.Sprintf("Failed to start %s: %s", spec.Command, err))
+		if sp.cgroup != nil {
+			sp.cgroup.Remove()
+		}
+		sp.release()
+		return err
 	}
 	sp.tty = tty
 	sp.reader = tty
@@ -54,45 +134,235 @@ func (sp *ShellProcess) Start(command string, args ...string) error {
 	return err
 }
 
+// Returns the process group currently in the foreground of the shell's terminal.
+func (sp *ShellProcess) foregroundPgrp() (int, error) {
+	var pgid int32
+	var errno syscall.Errno
+
+	// Use the raw conn, calling Fd() would put the tty into blocking mode.
+	rawConn, err := sp.tty.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	err = rawConn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCGPGRP, uintptr(unsafe.Pointer(&pgid)))
+	})
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(pgid), nil
+}
+
+// ForegroundCommand returns the command line of the process group currently
+// in the foreground of the shell's terminal.
+func (sp *ShellProcess) ForegroundCommand() string {
+	pgid, err := sp.foregroundPgrp()
+	if err != nil {
+		return ""
+	}
+
+	cmdline, _ := procfs.Cmdline(pgid)
+	return cmdline
+}
+
+// Signals the UI is allowed to send to the foreground process group.
+var userSignals = map[string]syscall.Signal{
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGTSTP": syscall.SIGTSTP,
+}
+
+// Signal sends a signal to the foreground process group of the shell's terminal.
+func (sp *ShellProcess) Signal(name string) error {
+	sig, ok := userSignals[name]
+	if !ok {
+		return fmt.Errorf("signal %s is not allowed", name)
+	}
+
+	pgid, err := sp.foregroundPgrp()
+	if err != nil {
+		return err
+	}
+
+	logger.DebugContext(sp.ctx, fmt.Sprintf("Sending %s to process group %d", name, pgid))
+	return syscall.Kill(-pgid, sig)
+}
+
 func (sp *ShellProcess) WithAuditing() error {
-	// TODO: check shell is running
-	straceAudit := strace.NewStraceLogger(auditLogger)
-	if err := straceAudit.Attach(sp.cmd.Process.Pid); err != nil {
-		logger.Error(fmt.Sprintf("Syscall auditing failed to start: %v", err))
+	pid := sp.cmd.Process.Pid
+
+	// The exec helper waits to run the shell until the tracer has attached,
+	// or failed to, so nothing the shell runs is missed.
+	defer sp.release()
+
+	// In auto mode each tracer is tried in turn, the /proc poller works
+	// everywhere but may miss short lived processes so it's the last resort.
+	modes := []string{config.AuditTracer}
+	if config.AuditTracer == "auto" {
+		modes = []string{"ptrace", "strace", "proc"}
+		// Only ptrace can enforce a policy, so there's nothing to fall back to.
+		if config.Syscalls.Policy != nil {
+			modes = modes[:1]
+		}
+	}
+
+	var tracer strace.Tracer
+	var err error
+	for i, mode := range modes {
+		tracer = sp.newTracer(mode)
+		if err = tracer.Attach(pid); err == nil {
+			break
+		}
+		if i < len(modes)-1 {
+			logger.WarnContext(sp.ctx, fmt.Sprintf("%s auditing failed to start, falling back to %s: %v", mode, modes[i+1], err))
+		}
+	}
+
+	// Without fail-closed a missing strace only disables auditing, as it always has.
+	if errors.Is(err, strace.ErrStraceNotInstalled) && !config.FailClosed {
+		logger.WarnContext(sp.ctx, "strace is not installed. Command auditing will be is disabled!")
+		return nil
+	}
+	if err != nil {
+		logger.ErrorContext(sp.ctx, fmt.Sprintf("Syscall auditing failed to start: %v", err))
 		return errors.New("syscall auditing failed to start")
 	}
 
-	logger.Info("Syscall auditing is enabled")
+	sp.tracer = tracer
+	logger.InfoContext(sp.ctx, "Syscall auditing is enabled")
 	return nil
 }
 
+// Lets the exec helper run the shell, if it's waiting to.
+func (sp *ShellProcess) release() {
+	if sp.resume != nil {
+		sp.resume.Close()
+	}
+}
+
+// How often the /proc poller looks for new processes.
+const procPollInterval = 100 * time.Millisecond
+
+func (sp *ShellProcess) newTracer(mode string) strace.Tracer {
+	// Tracers log without a context, so they're given the session's id up front.
+	audit := auditLogger.With(slog.String("session.id", logging.SessionID(sp.ctx)))
+	switch mode {
+	case "strace":
+		return strace.NewStraceLogger(audit, config.Syscalls)
+	case "proc":
+		if len(config.Syscalls.Classes) > 0 {
+			logger.WarnContext(sp.ctx, "Syscalls can't be audited by polling /proc, only commands will be audited")
+		}
+		return strace.NewProcPoller(audit, procPollInterval)
+	default:
+		return strace.NewPtraceTracer(audit, config.Syscalls)
+	}
+}
+
+// Tree returns the processes the shell has run, or nil if commands aren't audited.
+func (sp *ShellProcess) Tree() *strace.ProcessTree {
+	if sp.tracer == nil {
+		return nil
+	}
+	return sp.tracer.Tree()
+}
+
+// Exited reports whether the shell itself has exited, it may not have been reaped yet.
+func (sp *ShellProcess) Exited() bool {
+	stat, err := procfs.ReadStat(sp.cmd.Process.Pid)
+	return err != nil || stat.Zombie()
+}
+
+// ExitState returns how the shell exited and the resources it used, or nil
+// until it's been killed.
+func (sp *ShellProcess) ExitState() *os.ProcessState {
+	return sp.state
+}
+
 func (sp *ShellProcess) WithTTYRecorder(recorder *ttyrec.Recorder) error {
 	// TODO: check shell is running
 	sp.reader = io.TeeReader(sp.tty, recorder)
+	sp.rec = recorder
 	return nil
 }
 
+// Signals sent to the shell and everything it started when the session ends.
+// Each one is given the kill grace period to work before moving on to the next.
+var killSequence = []syscall.Signal{syscall.SIGHUP, syscall.SIGTERM, syscall.SIGKILL}
+
 func (sp *ShellProcess) Kill() error {
 
 	sp.once.Do(func() {
-		logger.Info(fmt.Sprintf("Killing process %d", sp.cmd.Process.Pid))
-		// TODO: should we send SIGTERM instead? The go docs say kill will not kill
-		// any processes this proc has started...
-		if err := sp.cmd.Process.Kill(); err != nil {
-			logger.Error(fmt.Sprintf("Failed to stop process: %s", err))
+		sp.release()
+		pid := sp.cmd.Process.Pid
+		logger.InfoContext(sp.ctx, fmt.Sprintf("Killing process %d and its children", pid))
+
+		for _, sig := range killSequence {
+			procs, err := procfs.Descendants(pid)
+			if err != nil || len(procs) == 0 {
+				break
+			}
+
+			for _, p := range procs {
+				if err := syscall.Kill(p.Pid, sig); err != nil && !errors.Is(err, syscall.ESRCH) {
+					logger.ErrorContext(sp.ctx, fmt.Sprintf("Failed to send %s to %d: %s", sig, p.Pid, err))
+				}
+			}
+
+			if waitForExit(pid, config.KillGrace) {
+				break
+			}
+			logger.WarnContext(sp.ctx, fmt.Sprintf("Processes still running after %s", sig))
 		}
 
-		if _, err := sp.cmd.Process.Wait(); err != nil {
-			logger.Error(fmt.Sprintf("Failed to wait process: %s", err))
+		// Anything that escaped the shell's session is still in its cgroup.
+		if sp.cgroup != nil {
+			if err := sp.cgroup.Kill(); err != nil {
+				logger.ErrorContext(sp.ctx, fmt.Sprintf("Failed to kill cgroup: %s", err))
+			}
+		}
+
+		state, err := sp.cmd.Process.Wait()
+		if err != nil {
+			logger.ErrorContext(sp.ctx, fmt.Sprintf("Failed to wait process: %s", err))
 		}
+		sp.state = state
 
 		if err := sp.tty.Close(); err != nil {
-			logger.Error(fmt.Sprintf("Failed to close tty: %s", err))
+			logger.ErrorContext(sp.ctx, fmt.Sprintf("Failed to close tty: %s", err))
+		}
+
+		// Usually the tracer has already exited along with everything it traced.
+		if sp.tracer != nil {
+			if err := sp.tracer.Close(); err != nil {
+				logger.ErrorContext(sp.ctx, fmt.Sprintf("Failed to stop auditing: %s", err))
+			}
+		}
+
+		if sp.cgroup != nil {
+			if err := sp.cgroup.Remove(); err != nil {
+				logger.ErrorContext(sp.ctx, fmt.Sprintf("Failed to remove cgroup: %s", err))
+			}
+		}
+
+		// Sandboxed shells wrote these in their own /tmp, which has already gone.
+		if sp.integration != "" {
+			os.RemoveAll(sp.integration)
 		}
 
 		if sp.rec != nil {
+			if sp.summary != nil {
+				metadata, err := json.Marshal(sp.summary())
+				if err != nil {
+					logger.ErrorContext(sp.ctx, fmt.Sprintf("Failed to encode audit metadata: %s", err))
+				}
+				sp.rec.SetMetadata(metadata)
+			}
 			if err := sp.rec.Save(); err != nil {
-				logger.Error(fmt.Sprintf("Failed to save audit: %s", err))
+				logger.ErrorContext(sp.ctx, fmt.Sprintf("Failed to save audit: %s", err))
 			}
 			sp.rec.Close()
 		}
@@ -100,3 +370,18 @@ func (sp *ShellProcess) Kill() error {
 
 	return nil
 }
+
+// Polls until pid and everything it started has exited, returns false if they're still running after timeout.
+func waitForExit(pid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		procs, err := procfs.Descendants(pid)
+		if err != nil || len(procs) == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
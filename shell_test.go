@@ -1,7 +1,13 @@
 package main
 
 import (
+	"io"
+	"log/slog"
+	"syscall"
 	"testing"
+	"time"
+
+	"webshell/procfs"
 )
 
 func TestFilterEnv(t *testing.T) {
@@ -17,3 +23,39 @@ func TestFilterEnv(t *testing.T) {
 		t.Error("environments were not filtered")
 	}
 }
+
+// Killing the shell should take down everything it started, including background jobs that ignore SIGHUP.
+func TestKillProcessTree(t *testing.T) {
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	config.KillGrace = 500 * time.Millisecond
+
+	sp := &ShellProcess{}
+	script := "trap '' HUP; nohup sleep 100 >/dev/null 2>&1 & sleep 100 & echo started; wait"
+	if err := sp.Start(ShellSpec{Command: "/bin/sh", Args: []string{"-c", script}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the children to start.
+	buf := make([]byte, 1024)
+	if _, err := sp.Read(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	procs, err := procfs.Descendants(sp.cmd.Process.Pid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(procs) < 3 {
+		t.Fatalf("expected the shell and 2 children, got %d processes", len(procs))
+	}
+
+	sp.Kill()
+
+	for _, p := range procs {
+		if err := syscall.Kill(p.Pid, 0); err == nil {
+			if stat, err := procfs.ReadStat(p.Pid); err == nil && !stat.Zombie() {
+				t.Errorf("process %d (%s) is still running", p.Pid, p.Comm)
+			}
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ShellSpec describes a shell, or any other interactive program, users can start.
+type ShellSpec struct {
+	Name    string
+	Command string
+	Args    []string
+	Login   bool
+	Env     []string
+}
+
+// Argv0 is the name the program is started with. Login shells are started
+// with a leading dash, the same convention login(1) uses.
+func (s ShellSpec) Argv0() string {
+	name := filepath.Base(s.Command)
+	if s.Login {
+		return "-" + name
+	}
+	return name
+}
+
+// Parses a named shell in the form name=command [args...]. A leading dash on
+// the command starts it as a login shell, e.g. zsh=-/bin/zsh.
+func parseShellSpec(s string) (ShellSpec, error) {
+	name, cmdline, found := strings.Cut(s, "=")
+	name = strings.TrimSpace(name)
+	fields := strings.Fields(cmdline)
+	if !found || name == "" || len(fields) == 0 {
+		return ShellSpec{}, fmt.Errorf("invalid shell %q, expected name=command [args...]", s)
+	}
+
+	spec := ShellSpec{
+		Name:    name,
+		Command: fields[0],
+		Args:    fields[1:],
+	}
+
+	if strings.HasPrefix(spec.Command, "-") {
+		spec.Login = true
+		spec.Command = spec.Command[1:]
+	}
+
+	return spec, nil
+}
+
+// Checks the shells are usable, the names are unique and the commands exist.
+func validateShells(shells []ShellSpec) error {
+	names := map[string]bool{}
+	for _, s := range shells {
+		if names[s.Name] {
+			return fmt.Errorf("shell %q is defined more than once", s.Name)
+		}
+		names[s.Name] = true
+
+		if _, err := exec.LookPath(s.Command); err != nil {
+			return fmt.Errorf("shell %q: %w", s.Name, err)
+		}
+	}
+	return nil
+}
+
+// shellFlag collects the repeatable -shell-choice flag.
+type shellFlag []ShellSpec
+
+func (f *shellFlag) String() string {
+	names := []string{}
+	for _, s := range *f {
+		names = append(names, s.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (f *shellFlag) Set(value string) error {
+	spec, err := parseShellSpec(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, spec)
+	return nil
+}
+
+// FindShell returns the shell with the given name, an empty name is the default shell.
+func (c Config) FindShell(name string) (ShellSpec, bool) {
+	if name == "" && len(c.Shells) > 0 {
+		return c.Shells[0], true
+	}
+	for _, s := range c.Shells {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return ShellSpec{}, false
+}
+
+// ShellNames lists the shells users can choose from, the default first.
+func (c Config) ShellNames() []string {
+	names := []string{}
+	for _, s := range c.Shells {
+		names = append(names, s.Name)
+	}
+	return names
+}
+
+// Adds variables from the repeatable -shell-env flag, in the form name:KEY=VALUE, to the named shells.
+func applyShellEnv(shells []ShellSpec, vars []string) error {
+	for _, v := range vars {
+		name, env, found := strings.Cut(v, ":")
+		if !found {
+			return fmt.Errorf("invalid shell env %q, expected name:KEY=VALUE", v)
+		}
+		if err := validateEnvVars([]string{env}); err != nil {
+			return err
+		}
+
+		i := slices.IndexFunc(shells, func(s ShellSpec) bool { return s.Name == name })
+		if i < 0 {
+			return fmt.Errorf("invalid shell env %q, there is no shell called %s", v, name)
+		}
+		shells[i].Env = append(shells[i].Env, env)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseShellSpec(t *testing.T) {
+	spec, err := parseShellSpec("python=/usr/bin/python3 -q -i")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if spec.Name != "python" || spec.Command != "/usr/bin/python3" || spec.Login {
+		t.Errorf("unexpected spec %+v", spec)
+	}
+	if len(spec.Args) != 2 || spec.Args[0] != "-q" || spec.Args[1] != "-i" {
+		t.Errorf("unexpected args %v", spec.Args)
+	}
+	if spec.Argv0() != "python3" {
+		t.Errorf("argv0: want python3 got %s", spec.Argv0())
+	}
+}
+
+func TestParseShellSpecLogin(t *testing.T) {
+	spec, err := parseShellSpec("zsh=-/bin/zsh")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !spec.Login || spec.Command != "/bin/zsh" || spec.Argv0() != "-zsh" {
+		t.Errorf("unexpected spec %+v", spec)
+	}
+}
+
+func TestParseShellSpecInvalid(t *testing.T) {
+	for _, s := range []string{"", "zsh", "zsh=", "=/bin/zsh", " = "} {
+		if _, err := parseShellSpec(s); err == nil {
+			t.Errorf("expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestFindShell(t *testing.T) {
+	cfg := Config{Shells: []ShellSpec{
+		{Name: "bash", Command: "/bin/bash"},
+		{Name: "sh", Command: "/bin/sh"},
+	}}
+
+	if s, ok := cfg.FindShell(""); !ok || s.Name != "bash" {
+		t.Errorf("empty name should return the default shell, got %v", s)
+	}
+	if s, ok := cfg.FindShell("sh"); !ok || s.Name != "sh" {
+		t.Errorf("want sh got %v", s)
+	}
+	if _, ok := cfg.FindShell("/bin/zsh"); ok {
+		t.Error("unknown shells should not be found")
+	}
+}
+
+func TestValidateShells(t *testing.T) {
+	if err := validateShells([]ShellSpec{{Name: "sh", Command: "/bin/sh"}, {Name: "sh", Command: "/bin/sh"}}); err == nil {
+		t.Error("duplicate names should be rejected")
+	}
+	if err := validateShells([]ShellSpec{{Name: "missing", Command: "/does/not/exist"}}); err == nil {
+		t.Error("missing commands should be rejected")
+	}
+}
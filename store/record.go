@@ -0,0 +1,102 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// The fields of an ECS audit record that are kept.
+type record struct {
+	Timestamp   time.Time `json:"@timestamp"`
+	Message     string    `json:"message"`
+	Kind        string    `json:"event.kind"`
+	Action      string    `json:"event.action"`
+	Outcome     string    `json:"event.outcome"`
+	Reason      string    `json:"event.reason"`
+	Session     string    `json:"session.id"`
+	User        ecsUser   `json:"user"` // The authenticated user
+	ProcessUser string    `json:"process.user.name"`
+	Pid         int       `json:"process.pid"`
+	PPid        int       `json:"process.parent.pid"`
+	Executable  string    `json:"process.executable"`
+	Args        []string  `json:"process.args"`
+	ExitCode    *int      `json:"process.exit_code"`
+	Path        string    `json:"file.path"`
+	Size        int64     `json:"file.size"`
+	Hash        string    `json:"file.hash.sha256"`
+	SourceIP    string    `json:"source.ip"`
+	Rule        string    `json:"rule.id"`
+	Severity    string    `json:"webshell.detection.severity"`
+}
+
+// The log handler writes the user as an object rather than dotted keys.
+type ecsUser struct {
+	Name string `json:"name"`
+}
+
+// Returns the kind of event a record is, or "" if it isn't kept.
+func (r record) kind() string {
+	switch {
+	case r.Action == "exec" && r.Outcome != "failure", r.Action == "exec-blocked":
+		// Failed execs are mostly the shell searching the PATH.
+		return KindExec
+	case r.Action == "file-upload", r.Action == "file-download":
+		return KindFile
+	case strings.HasPrefix(r.Action, "session-"):
+		return KindSession
+	case r.Kind == "alert":
+		return KindAlert
+	}
+	return ""
+}
+
+func (r record) event() Event {
+	e := Event{
+		Time:     r.Timestamp,
+		Session:  r.Session,
+		User:     r.User.Name,
+		Kind:     r.kind(),
+		Action:   r.Action,
+		Message:  r.Message,
+		Pid:      r.Pid,
+		Path:     r.Path,
+		Size:     r.Size,
+		Hash:     r.Hash,
+		ExitCode: r.ExitCode,
+		SourceIP: r.SourceIP,
+		Reason:   r.Reason,
+		Rule:     r.Rule,
+		Severity: r.Severity,
+	}
+	if e.User == "" {
+		e.User = r.ProcessUser
+	}
+	// A session's process is the shell, it's only a command when it was run in the shell.
+	if e.Kind != KindSession {
+		e.PPid, e.Executable, e.Args = r.PPid, r.Executable, r.Args
+	}
+	return e
+}
+
+// Write adds the audit events in records of JSON, one per line, that are kept
+// in the store. It's the audit log's writer, so it never fails, a record that
+// can't be stored is reported instead.
+func (s *Store) Write(p []byte) (int, error) {
+	for _, line := range bytes.Split(p, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		r := record{}
+		if err := json.Unmarshal(line, &r); err != nil || r.kind() == "" {
+			continue
+		}
+		if err := s.Add(r.event()); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to add audit event to the store: %s\n", err)
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,435 @@
+// Package store keeps the audit events needed for an investigation on the
+// local disk, so they can be searched without the log aggregator. Events are
+// appended to segment files that are never rewritten, a new one each day, and
+// indexed in memory by session, user, command and time when the store is
+// opened. Every event kept is held in memory, and read again each time the
+// store is opened, so a retention should be set to bound them.
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of event kept in the store.
+const (
+	KindExec    = "exec"
+	KindFile    = "file"
+	KindSession = "session"
+	KindAlert   = "alert"
+)
+
+// Size a segment file can grow to before a new one is started.
+const maxSegmentSize = 64 << 20
+
+// Event is an audit event, flattened from its ECS record.
+type Event struct {
+	Time       time.Time `json:"time"`
+	Session    string    `json:"session,omitempty"`
+	User       string    `json:"user,omitempty"`
+	Kind       string    `json:"kind"`
+	Action     string    `json:"action"`
+	Message    string    `json:"message,omitempty"`
+	Pid        int       `json:"pid,omitempty"`
+	PPid       int       `json:"ppid,omitempty"`
+	Executable string    `json:"executable,omitempty"`
+	Args       []string  `json:"args,omitempty"`
+	Path       string    `json:"path,omitempty"`
+	Size       int64     `json:"size,omitempty"`
+	Hash       string    `json:"sha256,omitempty"`
+	ExitCode   *int      `json:"exit_code,omitempty"`
+	SourceIP   string    `json:"source_ip,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	Rule       string    `json:"rule,omitempty"`
+	Severity   string    `json:"severity,omitempty"`
+}
+
+// CommandLine is the event's arguments joined by spaces.
+func (e Event) CommandLine() string {
+	return strings.Join(e.Args, " ")
+}
+
+// Store is an append-only store of audit events in a directory.
+type Store struct {
+	dir       string
+	retention time.Duration // How long events are kept for, 0 is forever
+
+	mu        sync.RWMutex
+	events    []Event
+	byTime    []int // Indexes of events, oldest first
+	bySession map[string][]int
+	byUser    map[string][]int
+	byCommand map[string][]int  // By the base name of the executable
+	users     map[string]string // The user of each session, from its start event
+
+	file    *os.File // The segment being appended to, opened on the first write
+	seg     int
+	size    int64
+	started time.Time // When the segment was started
+}
+
+// Open loads the events stored in dir. With a retention, the segments and
+// events older than it are removed first, and then each day as events are
+// added. Without one nothing is written, and dir isn't created, until events
+// are added, so the store can be read while a server writes to it.
+func Open(dir string, retention time.Duration) (*Store, error) {
+	s := &Store{
+		dir:       dir,
+		retention: retention,
+	}
+	s.reset()
+
+	now := time.Now()
+	if err := s.removeSegments(now); err != nil {
+		return nil, err
+	}
+	segs, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, seg := range segs {
+		if err := s.load(seg, s.cutoff(now)); err != nil {
+			return nil, fmt.Errorf("failed to load %s: %w", seg, err)
+		}
+		fmt.Sscanf(filepath.Base(seg), "events-%d.jsonl", &s.seg)
+	}
+	return s, nil
+}
+
+// Empties the indexes.
+func (s *Store) reset() {
+	s.events, s.byTime = nil, nil
+	s.bySession = map[string][]int{}
+	s.byUser = map[string][]int{}
+	s.byCommand = map[string][]int{}
+	s.users = map[string]string{}
+}
+
+// The segment files, oldest first.
+func (s *Store) segments() ([]string, error) {
+	segs, err := filepath.Glob(filepath.Join(s.dir, "events-*.jsonl"))
+	slices.Sort(segs)
+	return segs, err
+}
+
+// The time events before are no longer kept, zero if they're kept forever.
+func (s *Store) cutoff(now time.Time) time.Time {
+	if s.retention <= 0 {
+		return time.Time{}
+	}
+	return now.Add(-s.retention)
+}
+
+// Removes the segments last written to before the retention.
+func (s *Store) removeSegments(now time.Time) error {
+	cutoff := s.cutoff(now)
+	if cutoff.IsZero() {
+		return nil
+	}
+	segs, err := s.segments()
+	if err != nil {
+		return err
+	}
+	for _, seg := range segs {
+		if s.file != nil && seg == s.file.Name() {
+			continue
+		}
+		if info, err := os.Stat(seg); err == nil && info.ModTime().Before(cutoff) {
+			if err := os.Remove(seg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Removes the segments and events older than the retention. Called with s.mu held.
+func (s *Store) prune(now time.Time) error {
+	cutoff := s.cutoff(now)
+	if cutoff.IsZero() || len(s.byTime) == 0 || !s.events[s.byTime[0]].Time.Before(cutoff) {
+		return nil
+	}
+
+	events, byTime, users := s.events, s.byTime, s.users
+	s.reset()
+	for _, i := range byTime {
+		if e := events[i]; !e.Time.Before(cutoff) {
+			s.index(e)
+		}
+	}
+	// Sessions that started before the cutoff still have a user.
+	for session := range s.bySession {
+		if user, ok := users[session]; ok {
+			s.users[session] = user
+		}
+	}
+	return s.removeSegments(now)
+}
+
+// Reads the events in a segment from since. A partly written last line is skipped.
+func (s *Store) load(seg string, since time.Time) error {
+	f, err := os.Open(seg)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	lines := bufio.NewScanner(f)
+	lines.Buffer(nil, 4<<20)
+	for lines.Scan() {
+		e := Event{}
+		if json.Unmarshal(lines.Bytes(), &e) == nil && !e.Time.Before(since) {
+			s.index(e)
+		}
+	}
+	return lines.Err()
+}
+
+// Add appends an event to the store.
+func (s *Store) Add(e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.file == nil || s.size+int64(len(data)) > maxSegmentSize || s.started.Format(time.DateOnly) != now.Format(time.DateOnly) {
+		if err := s.nextSegment(now); err != nil {
+			return err
+		}
+		if err := s.prune(now); err != nil {
+			return err
+		}
+	}
+	if _, err := s.file.Write(data); err != nil {
+		return err
+	}
+	s.size += int64(len(data))
+	s.index(e)
+	return nil
+}
+
+// Starts appending to a new segment, never one a previous run wrote to.
+func (s *Store) nextSegment(now time.Time) error {
+	if s.file != nil {
+		s.file.Close()
+	}
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+	s.seg++
+	f, err := os.OpenFile(filepath.Join(s.dir, fmt.Sprintf("events-%06d.jsonl", s.seg)), os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	s.file, s.size, s.started = f, 0, now
+	return nil
+}
+
+// Adds an event to the indexes. Called with s.mu held, or before the store is shared.
+func (s *Store) index(e Event) {
+	if e.Action == "session-start" && e.User != "" {
+		s.users[e.Session] = e.User
+	}
+	if e.User == "" {
+		e.User = s.users[e.Session]
+	}
+
+	i := len(s.events)
+	s.events = append(s.events, e)
+
+	// Events mostly arrive in order, so this is usually an append.
+	at := sort.Search(len(s.byTime), func(j int) bool { return s.events[s.byTime[j]].Time.After(e.Time) })
+	s.byTime = slices.Insert(s.byTime, at, i)
+
+	if e.Session != "" {
+		s.bySession[e.Session] = append(s.bySession[e.Session], i)
+	}
+	if e.User != "" {
+		s.byUser[e.User] = append(s.byUser[e.User], i)
+	}
+	if e.Executable != "" {
+		name := path.Base(e.Executable)
+		s.byCommand[name] = append(s.byCommand[name], i)
+	}
+}
+
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
+
+// Query selects events. Empty fields match everything.
+type Query struct {
+	Session string
+	User    string
+	Kind    string
+	Action  string
+	// Command is a glob matched against the executable, or its base name when
+	// it has no /, or against the whole command line.
+	Command string
+	Since   time.Time
+	Until   time.Time
+	Limit   int // Of the most recent events, 0 is unlimited
+}
+
+func (q Query) Validate() error {
+	if _, err := path.Match(q.Command, ""); err != nil {
+		return fmt.Errorf("invalid command %q: %w", q.Command, err)
+	}
+	if q.Limit < 0 {
+		return errors.New("limit can't be negative")
+	}
+	return nil
+}
+
+func (q Query) matches(e Event) bool {
+	if q.Session != "" && e.Session != q.Session {
+		return false
+	}
+	if q.User != "" && e.User != q.User {
+		return false
+	}
+	if q.Kind != "" && e.Kind != q.Kind {
+		return false
+	}
+	if q.Action != "" && e.Action != q.Action {
+		return false
+	}
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !e.Time.Before(q.Until) {
+		return false
+	}
+	if q.Command != "" {
+		target := e.Executable
+		if !strings.Contains(q.Command, "/") {
+			target = path.Base(e.Executable)
+		}
+		exe, _ := path.Match(q.Command, target)
+		line, _ := path.Match(q.Command, e.CommandLine())
+		if e.Executable == "" || (!exe && !line) {
+			return false
+		}
+	}
+	return true
+}
+
+// Events returns the events matching q, oldest first.
+func (s *Store) Events(q Query) []Event {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	matched := []Event{}
+	for _, i := range s.candidates(q) {
+		if e := s.events[i]; q.matches(e) {
+			matched = append(matched, e)
+		}
+	}
+	if q.Limit > 0 && len(matched) > q.Limit {
+		matched = matched[len(matched)-q.Limit:]
+	}
+	return matched
+}
+
+// Returns the indexes of the events that might match q, in time order, using
+// the smallest index that applies.
+func (s *Store) candidates(q Query) []int {
+	var smallest []int
+	narrow := func(index []int) {
+		if smallest == nil || len(index) < len(smallest) {
+			smallest = index
+		}
+	}
+	if q.Session != "" {
+		narrow(s.bySession[q.Session])
+	}
+	if q.User != "" {
+		narrow(s.byUser[q.User])
+	}
+	// Only a plain name can be looked up, a pattern has to be checked against every event.
+	if q.Command != "" && !strings.ContainsAny(q.Command, "/*?[\\ ") {
+		narrow(s.byCommand[q.Command])
+	}
+
+	if smallest == nil {
+		from := sort.Search(len(s.byTime), func(j int) bool { return !s.events[s.byTime[j]].Time.Before(q.Since) })
+		return s.byTime[from:]
+	}
+	sorted := slices.Clone(smallest)
+	slices.SortStableFunc(sorted, func(a, b int) int { return s.events[a].Time.Compare(s.events[b].Time) })
+	return sorted
+}
+
+// SessionMatch is a session with events matching a query.
+type SessionMatch struct {
+	Session string    `json:"session"`
+	User    string    `json:"user,omitempty"`
+	First   time.Time `json:"first"`
+	Last    time.Time `json:"last"`
+	Events  int       `json:"events"` // That matched
+}
+
+// Sessions returns the sessions with events matching q, such as every session
+// that ran psql last week, oldest first.
+func (s *Store) Sessions(q Query) []SessionMatch {
+	limit := q.Limit
+	q.Limit = 0
+
+	matches := []SessionMatch{}
+	found := map[string]int{}
+	for _, e := range s.Events(q) {
+		if e.Session == "" {
+			continue
+		}
+		i, ok := found[e.Session]
+		if !ok {
+			i = len(matches)
+			found[e.Session] = i
+			matches = append(matches, SessionMatch{Session: e.Session, User: e.User, First: e.Time})
+		}
+		matches[i].Last = e.Time
+		matches[i].Events++
+	}
+	if limit > 0 && len(matches) > limit {
+		matches = matches[len(matches)-limit:]
+	}
+	return matches
+}
+
+// ParseTime reads a time for a query, either RFC 3339 or how long before now,
+// as a duration like 90m or a number of days like 7d.
+func ParseTime(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		var n int
+		if _, err := fmt.Sscanf(days, "%d", &n); err == nil && n >= 0 && fmt.Sprint(n) == days {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if ago, err := time.ParseDuration(value); err == nil && ago >= 0 {
+		return now.Add(-ago), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected RFC 3339, a duration or a number of days", value)
+}
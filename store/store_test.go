@@ -0,0 +1,189 @@
+package store
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"webshell/logging"
+)
+
+var start = time.Date(2026, 1, 5, 9, 0, 0, 0, time.UTC)
+
+// Writes audit records for two sessions, one of which ran psql, as the audit
+// log does. alice signed in to s1, s2 only has the shell's user.
+func writeRecords(t *testing.T, s *Store) {
+	t.Helper()
+	records := []struct {
+		user  string // USER_NAME, the authenticated user
+		attrs []slog.Attr
+	}{
+		{"alice", []slog.Attr{slog.String("event.action", "session-start"), slog.String("session.id", "s1"), slog.String("process.user.name", "shell"), slog.String("process.executable", "/bin/bash")}},
+		{"alice", []slog.Attr{slog.String("event.action", "exec"), slog.String("event.outcome", "failure"), slog.String("session.id", "s1"), slog.String("process.executable", "/usr/local/bin/psql"), slog.Any("process.args", []string{"psql"})}},
+		{"alice", []slog.Attr{slog.String("event.action", "exec"), slog.String("event.outcome", "success"), slog.String("session.id", "s1"), slog.String("process.executable", "/usr/bin/psql"), slog.Any("process.args", []string{"psql", "-h", "db"})}},
+		{"alice", []slog.Attr{slog.String("event.action", "file-download"), slog.String("session.id", "s1"), slog.String("file.path", "/home/alice/dump.sql"), slog.Int64("file.size", 42)}},
+		{"alice", []slog.Attr{slog.String("event.action", "shadow-session"), slog.String("session.id", "s1")}},
+		{"", []slog.Attr{slog.String("event.action", "session-start"), slog.String("session.id", "s2"), slog.String("process.user.name", "bob"), slog.String("process.executable", "/bin/bash")}},
+		{"", []slog.Attr{slog.String("event.action", "exec"), slog.String("event.outcome", "success"), slog.String("session.id", "s2"), slog.String("process.executable", "/usr/bin/git"), slog.Any("process.args", []string{"git", "push", "origin"})}},
+		{"", []slog.Attr{slog.String("event.kind", "alert"), slog.String("event.action", "detection"), slog.String("session.id", "s2"), slog.String("rule.id", "push"), slog.String("webshell.detection.severity", "low")}},
+		{"alice", []slog.Attr{slog.String("event.action", "session-end"), slog.String("session.id", "s1"), slog.String("event.reason", "Shell exited"), slog.Int("process.exit_code", 0)}},
+	}
+	handler := logging.NewHandler(s, "audit", new(slog.LevelVar))
+	for i, r := range records {
+		t.Setenv("USER_NAME", r.user)
+		record := slog.NewRecord(start.Add(time.Duration(i)*time.Hour), slog.LevelInfo, "", 0)
+		record.AddAttrs(r.attrs...)
+		if err := handler.Handle(context.Background(), record); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func actions(events []Event) []string {
+	result := []string{}
+	for _, e := range events {
+		result = append(result, e.Session+" "+e.Action)
+	}
+	return result
+}
+
+func TestStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeRecords(t, s)
+	s.Close()
+
+	// The events are found again after a restart.
+	s, err = Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	tests := []struct {
+		name  string
+		query Query
+		want  []string
+	}{
+		{"all", Query{}, []string{"s1 session-start", "s1 exec", "s1 file-download", "s2 session-start", "s2 exec", "s2 detection", "s1 session-end"}},
+		{"session", Query{Session: "s2"}, []string{"s2 session-start", "s2 exec", "s2 detection"}},
+		{"user from session start", Query{User: "alice", Kind: KindFile}, []string{"s1 file-download"}},
+		{"command name", Query{Command: "psql"}, []string{"s1 exec"}},
+		{"command path", Query{Command: "/usr/bin/*"}, []string{"s1 exec", "s2 exec"}},
+		{"command line", Query{Command: "git push *"}, []string{"s2 exec"}},
+		{"shell isn't a command", Query{Command: "bash"}, []string{}},
+		{"time", Query{Since: start.Add(3 * time.Hour), Until: start.Add(6 * time.Hour)}, []string{"s1 file-download", "s2 session-start"}},
+		{"limit", Query{Kind: KindSession, Limit: 2}, []string{"s2 session-start", "s1 session-end"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := actions(s.Events(test.query)); !slices.Equal(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+
+	if code := s.Events(Query{Action: "session-end"}); len(code) != 1 || code[0].ExitCode == nil || *code[0].ExitCode != 0 {
+		t.Errorf("session end event = %+v, want exit code 0", code)
+	}
+}
+
+func TestStoreSessions(t *testing.T) {
+	s, err := Open(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	writeRecords(t, s)
+
+	got := s.Sessions(Query{Command: "psql", Since: start})
+	want := []SessionMatch{{Session: "s1", User: "alice", First: start.Add(2 * time.Hour), Last: start.Add(2 * time.Hour), Events: 1}}
+	if !slices.EqualFunc(got, want, func(a, b SessionMatch) bool {
+		return a.Session == b.Session && a.User == b.User && a.First.Equal(b.First) && a.Last.Equal(b.Last) && a.Events == b.Events
+	}) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+// Segments and events older than the retention are removed when the store is
+// opened, and each day after.
+func TestStoreRetention(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	session := func(id string, at time.Time) Event {
+		return Event{Time: at, Session: id, Kind: KindSession, Action: "session-start"}
+	}
+	sessions := func(s *Store) []string {
+		ids := []string{}
+		for _, m := range s.Sessions(Query{}) {
+			ids = append(ids, m.Session)
+		}
+		return ids
+	}
+
+	s, err := Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add(session("expired", now.Add(-72*time.Hour)))
+	s.Close()
+	expired := filepath.Join(dir, "events-000001.jsonl")
+	os.Chtimes(expired, now.Add(-72*time.Hour), now.Add(-72*time.Hour))
+
+	s, err = Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add(session("old", now.Add(-50*time.Hour)))
+	s.Add(session("recent", now))
+	s.Close()
+
+	s, err = Open(dir, 48*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := os.Stat(expired); !os.IsNotExist(err) {
+		t.Errorf("the expired segment wasn't removed: %v", err)
+	}
+	if got := sessions(s); !slices.Equal(got, []string{"recent"}) {
+		t.Errorf("got %q, want only the recent session", got)
+	}
+
+	// The next day's first event drops what has expired since.
+	s.Add(session("late", now.Add(-49*time.Hour)))
+	s.started = s.started.AddDate(0, 0, -1)
+	s.Add(session("next", now))
+	if got := sessions(s); !slices.Equal(got, []string{"recent", "next"}) {
+		t.Errorf("got %q, want the recent and next sessions", got)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{"2026-01-02T03:04:05Z", time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{"90m", now.Add(-90 * time.Minute)},
+		{"7d", now.AddDate(0, 0, -7)},
+	}
+	for _, test := range tests {
+		if got, err := ParseTime(test.value, now); err != nil || !got.Equal(test.want) {
+			t.Errorf("ParseTime(%q) = %v, %v, want %v", test.value, got, err, test.want)
+		}
+	}
+	for _, invalid := range []string{"", "yesterday", "-1d", "1.5d", "-2h"} {
+		if _, err := ParseTime(invalid, now); err == nil {
+			t.Errorf("ParseTime(%q) succeeded, want an error", invalid)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package strace
+
+import "syscall"
+
+// The errnos strace prints by name, with their numbers on this architecture.
+var errnoNames = map[string]syscall.Errno{
+	"E2BIG":           syscall.E2BIG,
+	"EACCES":          syscall.EACCES,
+	"EADDRINUSE":      syscall.EADDRINUSE,
+	"EADDRNOTAVAIL":   syscall.EADDRNOTAVAIL,
+	"EADV":            syscall.EADV,
+	"EAFNOSUPPORT":    syscall.EAFNOSUPPORT,
+	"EAGAIN":          syscall.EAGAIN,
+	"EALREADY":        syscall.EALREADY,
+	"EBADE":           syscall.EBADE,
+	"EBADF":           syscall.EBADF,
+	"EBADFD":          syscall.EBADFD,
+	"EBADMSG":         syscall.EBADMSG,
+	"EBADR":           syscall.EBADR,
+	"EBADRQC":         syscall.EBADRQC,
+	"EBADSLT":         syscall.EBADSLT,
+	"EBFONT":          syscall.EBFONT,
+	"EBUSY":           syscall.EBUSY,
+	"ECANCELED":       syscall.ECANCELED,
+	"ECHILD":          syscall.ECHILD,
+	"ECHRNG":          syscall.ECHRNG,
+	"ECOMM":           syscall.ECOMM,
+	"ECONNABORTED":    syscall.ECONNABORTED,
+	"ECONNREFUSED":    syscall.ECONNREFUSED,
+	"ECONNRESET":      syscall.ECONNRESET,
+	"EDEADLK":         syscall.EDEADLK,
+	"EDEADLOCK":       syscall.EDEADLOCK,
+	"EDESTADDRREQ":    syscall.EDESTADDRREQ,
+	"EDOM":            syscall.EDOM,
+	"EDOTDOT":         syscall.EDOTDOT,
+	"EDQUOT":          syscall.EDQUOT,
+	"EEXIST":          syscall.EEXIST,
+	"EFAULT":          syscall.EFAULT,
+	"EFBIG":           syscall.EFBIG,
+	"EHOSTDOWN":       syscall.EHOSTDOWN,
+	"EHOSTUNREACH":    syscall.EHOSTUNREACH,
+	"EIDRM":           syscall.EIDRM,
+	"EILSEQ":          syscall.EILSEQ,
+	"EINPROGRESS":     syscall.EINPROGRESS,
+	"EINTR":           syscall.EINTR,
+	"EINVAL":          syscall.EINVAL,
+	"EIO":             syscall.EIO,
+	"EISCONN":         syscall.EISCONN,
+	"EISDIR":          syscall.EISDIR,
+	"EISNAM":          syscall.EISNAM,
+	"EKEYEXPIRED":     syscall.EKEYEXPIRED,
+	"EKEYREJECTED":    syscall.EKEYREJECTED,
+	"EKEYREVOKED":     syscall.EKEYREVOKED,
+	"EL2HLT":          syscall.EL2HLT,
+	"EL2NSYNC":        syscall.EL2NSYNC,
+	"EL3HLT":          syscall.EL3HLT,
+	"EL3RST":          syscall.EL3RST,
+	"ELIBACC":         syscall.ELIBACC,
+	"ELIBBAD":         syscall.ELIBBAD,
+	"ELIBEXEC":        syscall.ELIBEXEC,
+	"ELIBMAX":         syscall.ELIBMAX,
+	"ELIBSCN":         syscall.ELIBSCN,
+	"ELNRNG":          syscall.ELNRNG,
+	"ELOOP":           syscall.ELOOP,
+	"EMEDIUMTYPE":     syscall.EMEDIUMTYPE,
+	"EMFILE":          syscall.EMFILE,
+	"EMLINK":          syscall.EMLINK,
+	"EMSGSIZE":        syscall.EMSGSIZE,
+	"EMULTIHOP":       syscall.EMULTIHOP,
+	"ENAMETOOLONG":    syscall.ENAMETOOLONG,
+	"ENAVAIL":         syscall.ENAVAIL,
+	"ENETDOWN":        syscall.ENETDOWN,
+	"ENETRESET":       syscall.ENETRESET,
+	"ENETUNREACH":     syscall.ENETUNREACH,
+	"ENFILE":          syscall.ENFILE,
+	"ENOANO":          syscall.ENOANO,
+	"ENOBUFS":         syscall.ENOBUFS,
+	"ENOCSI":          syscall.ENOCSI,
+	"ENODATA":         syscall.ENODATA,
+	"ENODEV":          syscall.ENODEV,
+	"ENOENT":          syscall.ENOENT,
+	"ENOEXEC":         syscall.ENOEXEC,
+	"ENOKEY":          syscall.ENOKEY,
+	"ENOLCK":          syscall.ENOLCK,
+	"ENOLINK":         syscall.ENOLINK,
+	"ENOMEDIUM":       syscall.ENOMEDIUM,
+	"ENOMEM":          syscall.ENOMEM,
+	"ENOMSG":          syscall.ENOMSG,
+	"ENONET":          syscall.ENONET,
+	"ENOPKG":          syscall.ENOPKG,
+	"ENOPROTOOPT":     syscall.ENOPROTOOPT,
+	"ENOSPC":          syscall.ENOSPC,
+	"ENOSR":           syscall.ENOSR,
+	"ENOSTR":          syscall.ENOSTR,
+	"ENOSYS":          syscall.ENOSYS,
+	"ENOTBLK":         syscall.ENOTBLK,
+	"ENOTCONN":        syscall.ENOTCONN,
+	"ENOTDIR":         syscall.ENOTDIR,
+	"ENOTEMPTY":       syscall.ENOTEMPTY,
+	"ENOTNAM":         syscall.ENOTNAM,
+	"ENOTRECOVERABLE": syscall.ENOTRECOVERABLE,
+	"ENOTSOCK":        syscall.ENOTSOCK,
+	"ENOTSUP":         syscall.ENOTSUP,
+	"ENOTTY":          syscall.ENOTTY,
+	"ENOTUNIQ":        syscall.ENOTUNIQ,
+	"ENXIO":           syscall.ENXIO,
+	"EOPNOTSUPP":      syscall.EOPNOTSUPP,
+	"EOVERFLOW":       syscall.EOVERFLOW,
+	"EOWNERDEAD":      syscall.EOWNERDEAD,
+	"EPERM":           syscall.EPERM,
+	"EPFNOSUPPORT":    syscall.EPFNOSUPPORT,
+	"EPIPE":           syscall.EPIPE,
+	"EPROTO":          syscall.EPROTO,
+	"EPROTONOSUPPORT": syscall.EPROTONOSUPPORT,
+	"EPROTOTYPE":      syscall.EPROTOTYPE,
+	"ERANGE":          syscall.ERANGE,
+	"EREMCHG":         syscall.EREMCHG,
+	"EREMOTE":         syscall.EREMOTE,
+	"EREMOTEIO":       syscall.EREMOTEIO,
+	"ERESTART":        syscall.ERESTART,
+	"ERFKILL":         syscall.ERFKILL,
+	"EROFS":           syscall.EROFS,
+	"ESHUTDOWN":       syscall.ESHUTDOWN,
+	"ESOCKTNOSUPPORT": syscall.ESOCKTNOSUPPORT,
+	"ESPIPE":          syscall.ESPIPE,
+	"ESRCH":           syscall.ESRCH,
+	"ESRMNT":          syscall.ESRMNT,
+	"ESTALE":          syscall.ESTALE,
+	"ESTRPIPE":        syscall.ESTRPIPE,
+	"ETIME":           syscall.ETIME,
+	"ETIMEDOUT":       syscall.ETIMEDOUT,
+	"ETOOMANYREFS":    syscall.ETOOMANYREFS,
+	"ETXTBSY":         syscall.ETXTBSY,
+	"EUCLEAN":         syscall.EUCLEAN,
+	"EUNATCH":         syscall.EUNATCH,
+	"EUSERS":          syscall.EUSERS,
+	"EWOULDBLOCK":     syscall.EWOULDBLOCK,
+	"EXDEV":           syscall.EXDEV,
+	"EXFULL":          syscall.EXFULL,
+
+	// Only seen by tracers, the kernel restarts the syscall or returns another errno.
+	"ERESTARTSYS":           512,
+	"ERESTARTNOINTR":        513,
+	"ERESTARTNOHAND":        514,
+	"ENOIOCTLCMD":           515,
+	"ERESTART_RESTARTBLOCK": 516,
+	"ENOTSUPP":              524,
+}
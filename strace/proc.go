@@ -0,0 +1,202 @@
+package strace
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"webshell/procfs"
+)
+
+// ProcPoller audits commands by polling /proc for the processes a shell has
+// started. It needs no privileges beyond reading /proc, so works where ptrace
+// is blocked, but it is only sampling: anything that starts and exits between
+// polls is never seen, and exits are recorded when they are noticed.
+type ProcPoller struct {
+	execQueue
+	logger   *slog.Logger
+	interval time.Duration
+	pid      int
+	boot     time.Time
+	seen     map[procKey]ExecEvent // processes running at the last poll
+	tree     *ProcessTree
+	stop     chan struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+// Processes are identified by their start time as well, pids are reused.
+type procKey struct {
+	pid   int
+	start uint64
+}
+
+// Events from the poller are marked with this, as processes can be missed.
+var sampledAttr = slog.Bool("webshell.audit.sampled", true)
+
+func NewProcPoller(logger *slog.Logger, interval time.Duration) *ProcPoller {
+	return &ProcPoller{
+		logger:   logger,
+		interval: interval,
+		seen:     map[procKey]ExecEvent{},
+		tree:     NewProcessTree(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+
+		execQueue: newExecQueue(),
+	}
+}
+
+// Attach records the processes already running under pid, then polls for new ones.
+func (p *ProcPoller) Attach(pid int) error {
+	boot, err := procfs.BootTime()
+	if err != nil {
+		return fmt.Errorf("failed to read boot time: %w", err)
+	}
+	if _, err := procfs.ReadStat(pid); err != nil {
+		return err
+	}
+	p.pid = pid
+	p.boot = boot
+	p.tree.SetRoot(pid)
+
+	p.poll()
+	go p.run()
+
+	p.logger.Info(fmt.Sprintf("Polling /proc for processes started by PID %d", pid))
+	return nil
+}
+
+func (p *ProcPoller) run() {
+	defer close(p.done)
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			if !p.poll() {
+				return
+			}
+		}
+	}
+}
+
+// Compares the processes running now with the last poll, logging any that
+// started or exited in between. Returns false once the shell has gone.
+func (p *ProcPoller) poll() bool {
+	procs, err := procfs.Descendants(p.pid)
+	if err != nil {
+		for key, e := range p.seen {
+			p.logExit(e)
+			delete(p.seen, key)
+		}
+		return false
+	}
+
+	// Parents are handled before their children.
+	slices.SortFunc(procs, func(a, b procfs.Stat) int {
+		return cmp.Or(cmp.Compare(a.StartTime, b.StartTime), cmp.Compare(a.Pid, b.Pid))
+	})
+
+	running := map[procKey]bool{}
+	for _, proc := range procs {
+		key := procKey{pid: proc.Pid, start: proc.StartTime}
+		running[key] = true
+
+		argv, err := procfs.Argv(proc.Pid)
+		if err != nil {
+			continue
+		}
+
+		// A process already seen with different args has exec'd since the last poll.
+		timestamp := proc.Started(p.boot)
+		if previous, ok := p.seen[key]; ok {
+			if slices.Equal(previous.Argv, argv) {
+				continue
+			}
+			timestamp = time.Now()
+		}
+
+		e := ExecEvent{
+			Pid:       proc.Pid,
+			Timestamp: timestamp,
+			Argv:      argv,
+		}
+		e.readProcess()
+		e.Executable, _ = os.Readlink(fmt.Sprintf("/proc/%d/exe", proc.Pid))
+		if e.Executable == "" && len(argv) > 0 {
+			e.Executable = argv[0]
+		}
+
+		p.seen[key] = e
+		logExec(p.logger, e, "proc", sampledAttr)
+		p.tree.Exec(e)
+		p.send(e)
+	}
+
+	for key, e := range p.seen {
+		if !running[key] {
+			p.logExit(e)
+			delete(p.seen, key)
+		}
+	}
+	return true
+}
+
+// Logs a process that's no longer running. The exit code isn't known, only
+// the parent gets that, and the time is when it was noticed.
+func (p *ProcPoller) logExit(e ExecEvent) {
+	ended := time.Now()
+	p.tree.Exit(ExitEvent{Pid: e.Pid, Timestamp: ended})
+	p.logger.Info(fmt.Sprintf("Audit: [PID %d] exited: %s", e.Pid, strings.Join(e.Argv, " ")),
+		slog.String("event.kind", "event"),
+		slog.Any("event.category", []string{"process"}),
+		slog.Any("event.type", []string{"end"}),
+		slog.String("event.action", "exit"),
+		slog.String("event.provider", "proc"),
+		slog.Int("process.pid", e.Pid),
+		slog.Int("process.parent.pid", e.PPid),
+		slog.String("process.executable", e.Executable),
+		slog.Any("process.args", e.Argv),
+		slog.Time("process.start", e.Timestamp),
+		slog.Time("process.end", ended),
+		sampledAttr,
+	)
+}
+
+func (p *ProcPoller) Tree() *ProcessTree {
+	return p.tree
+}
+
+func (p *ProcPoller) Done() <-chan struct{} {
+	return p.done
+}
+
+func (p *ProcPoller) Err() error {
+	select {
+	case <-p.done:
+		return errTracerExited
+	default:
+		return nil
+	}
+}
+
+// Close stops polling, after a last poll so the exits of processes that
+// ended with the shell are logged.
+func (p *ProcPoller) Close() error {
+	p.once.Do(func() {
+		close(p.stop)
+		<-p.done
+		p.poll()
+	})
+	<-p.done
+	return nil
+}
@@ -0,0 +1,85 @@
+package strace
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A buffer that's safe to log to from the poller's goroutine.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) records(t *testing.T) []map[string]any {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	records := []map[string]any{}
+	dec := json.NewDecoder(&b.buf)
+	for dec.More() {
+		var r map[string]any
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestProcPoller(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "sleep 0.3; sleep 0.3")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+
+	var buf syncBuffer
+	poller := NewProcPoller(slog.New(slog.NewJSONHandler(&buf, nil)), 20*time.Millisecond)
+	if err := poller.Attach(cmd.Process.Pid); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Second)
+	poller.Close()
+
+	execs, exits := 0, 0
+	for _, r := range buf.records(t) {
+		if r["event.action"] == nil {
+			continue
+		}
+		if r["event.provider"] != "proc" || r["webshell.audit.sampled"] != true {
+			t.Errorf("poller events should be marked as sampled %v", r)
+		}
+		switch r["event.action"] {
+		case "exec":
+			execs++
+			if r["process.pid"] == float64(cmd.Process.Pid) && r["process.command_line"] != "sh -c sleep 0.3; sleep 0.3" {
+				t.Errorf("unexpected shell exec %v", r)
+			}
+		case "exit":
+			exits++
+		}
+	}
+
+	// The shell, both sleeps, and their exits.
+	if execs < 3 || exits < 2 {
+		t.Errorf("want at least 3 execs and 2 exits, got %d and %d", execs, exits)
+	}
+
+	commands := poller.Tree().Commands()
+	if len(commands) != 2 || commands[0].CommandLine != "sleep 0.3" || commands[0].Ended == nil {
+		t.Errorf("unexpected commands %+v", commands)
+	}
+}
@@ -0,0 +1,205 @@
+package strace
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"webshell/policy"
+)
+
+// PtraceHelper is the argv[0] the server is re-executed with to run the ptrace tracer.
+//
+// Waiting on traced processes means calling wait4(-1), which would also reap
+// the server's own children, so the tracer runs in a separate process and
+// reports what it sees back to the server as JSON lines.
+const PtraceHelper = "webshell-trace"
+
+// Messages written by the tracer helper, one JSON object per line.
+type tracerMessage struct {
+	Type    string        `json:"type"`
+	Exec    *ExecEvent    `json:"exec,omitempty"`
+	Syscall *SyscallEvent `json:"syscall,omitempty"`
+	Fork    *ForkEvent    `json:"fork,omitempty"`
+	Exit    *ExitEvent    `json:"exit,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+const (
+	msgAttached = "attached"
+	msgExec     = "exec"
+	msgSyscall  = "syscall"
+	msgFork     = "fork"
+	msgExit     = "exit"
+)
+
+// PtraceTracer audits commands using ptrace, without needing strace installed.
+type PtraceTracer struct {
+	*tracerProcess
+	execQueue
+	logger   *slog.Logger
+	opts     Options
+	syscalls *syscallLogger
+	tree     *ProcessTree
+	pid      int
+}
+
+func NewPtraceTracer(logger *slog.Logger, opts Options) *PtraceTracer {
+	return &PtraceTracer{
+		logger:   logger,
+		opts:     opts,
+		syscalls: newSyscallLogger(logger, "ptrace", opts.RateLimit),
+		tree:     NewProcessTree(),
+
+		execQueue: newExecQueue(),
+	}
+}
+
+func (t *PtraceTracer) Tree() *ProcessTree {
+	return t.tree
+}
+
+// Attach starts tracing pid and everything it starts, it returns once the tracer has attached.
+func (t *PtraceTracer) Attach(pid int) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	args := []string{strconv.Itoa(pid), strings.Join(t.opts.Classes, ",")}
+	if t.opts.Policy != nil {
+		p, err := json.Marshal(t.opts.Policy)
+		if err != nil {
+			return err
+		}
+		args = append(args, string(p))
+	}
+
+	cmd := exec.Command(self, args...)
+	cmd.Args[0] = PtraceHelper
+	stderr := &strings.Builder{}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	t.pid = pid
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	t.tracerProcess = newTracerProcess(cmd)
+
+	// The first message says whether the tracer managed to attach.
+	lines := bufio.NewScanner(stdout)
+	lines.Buffer(nil, 1024*1024)
+	msg, err := readMessage(lines)
+	if err != nil || msg.Type != msgAttached {
+		t.wait(nil)
+		if msg.Error != "" {
+			return errors.New(msg.Error)
+		}
+		return fmt.Errorf("ptrace tracer failed to start: %s", strings.TrimSpace(stderr.String()))
+	}
+
+	t.logger.Info(fmt.Sprintf("Attached to PID %d", pid))
+	t.tree.SetRoot(pid)
+
+	go func() {
+		for {
+			msg, err := readMessage(lines)
+			if err != nil {
+				break
+			}
+			switch {
+			case msg.Type == msgExec && msg.Exec != nil:
+				logExec(t.logger, *msg.Exec, "ptrace", t.ruleAttrs(msg.Exec.Rule)...)
+				t.tree.Exec(*msg.Exec)
+				t.send(*msg.Exec)
+			case msg.Type == msgSyscall && msg.Syscall != nil:
+				t.syscalls.log(*msg.Syscall)
+			case msg.Type == msgFork && msg.Fork != nil:
+				t.tree.Fork(*msg.Fork)
+			case msg.Type == msgExit && msg.Exit != nil:
+				t.tree.Exit(*msg.Exit)
+			}
+		}
+		t.wait(t.syscalls.flush)
+	}()
+
+	return nil
+}
+
+// Describes the policy rule that blocked an exec.
+func (t *PtraceTracer) ruleAttrs(id string) []slog.Attr {
+	if id == "" || t.opts.Policy == nil {
+		return nil
+	}
+	attrs := []slog.Attr{slog.String("rule.id", id), slog.String("rule.ruleset", "webshell-policy")}
+	if rule, ok := t.opts.Policy.Rule(id); ok && rule.Message != "" {
+		attrs = append(attrs, slog.String("rule.description", rule.Message))
+	}
+	return attrs
+}
+
+func readMessage(lines *bufio.Scanner) (tracerMessage, error) {
+	msg := tracerMessage{}
+	if !lines.Scan() {
+		if err := lines.Err(); err != nil {
+			return msg, err
+		}
+		return msg, io.EOF
+	}
+	err := json.Unmarshal(lines.Bytes(), &msg)
+	return msg, err
+}
+
+// RunPtraceHelper is the entry point of the tracer helper process. It traces
+// the pid given in args until it exits, then exits itself. The optional second
+// argument is a comma separated list of syscall classes to audit, and the
+// third a JSON policy to enforce.
+func RunPtraceHelper(args []string) {
+	out := json.NewEncoder(os.Stdout)
+
+	if len(args) < 1 || len(args) > 3 {
+		fmt.Fprintf(os.Stderr, "%s expects a pid, syscall classes and a policy\n", PtraceHelper)
+		os.Exit(1)
+	}
+	pid, err := strconv.Atoi(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid pid %q\n", args[0])
+		os.Exit(1)
+	}
+
+	opts := Options{}
+	if len(args) >= 2 && args[1] != "" {
+		opts.Classes = strings.Split(args[1], ",")
+	}
+	if len(args) == 3 {
+		if opts.Policy, err = policy.Parse([]byte(args[2])); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid policy: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	err = trace(pid, opts, traceHandlers{
+		attached: func() { out.Encode(tracerMessage{Type: msgAttached}) },
+		exec:     func(e ExecEvent) { out.Encode(tracerMessage{Type: msgExec, Exec: &e}) },
+		syscall:  func(e SyscallEvent) { out.Encode(tracerMessage{Type: msgSyscall, Syscall: &e}) },
+		fork:     func(e ForkEvent) { out.Encode(tracerMessage{Type: msgFork, Fork: &e}) },
+		exit:     func(e ExitEvent) { out.Encode(tracerMessage{Type: msgExit, Exit: &e}) },
+	})
+
+	if err != nil {
+		out.Encode(tracerMessage{Type: "error", Error: err.Error()})
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,287 @@
+package strace
+
+import (
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"webshell/policy"
+	"webshell/procfs"
+)
+
+// Starts a shell script and traces it, returning the exec events seen.
+func traceScript(t *testing.T, script string, whileTracing func(pid int)) []ExecEvent {
+	events, _ := traceScriptSyscalls(t, script, Options{}, NewProcessTree(), whileTracing)
+	return events
+}
+
+// Starts a shell script and traces it with opts, adding the processes seen to tree.
+func traceScriptSyscalls(t *testing.T, script string, opts Options, tree *ProcessTree, whileTracing func(pid int)) ([]ExecEvent, []SyscallEvent) {
+	cmd := exec.Command("/bin/sh", "-c", "sleep 0.2; "+script)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	pid := cmd.Process.Pid
+
+	attached := make(chan struct{})
+	done := make(chan error)
+	events := []ExecEvent{}
+	syscalls := []SyscallEvent{}
+	go func() {
+		done <- trace(pid, opts, traceHandlers{
+			attached: func() { tree.SetRoot(pid); close(attached) },
+			exec:     func(e ExecEvent) { events = append(events, e); tree.Exec(e) },
+			syscall:  func(e SyscallEvent) { syscalls = append(syscalls, e) },
+			fork:     tree.Fork,
+			exit:     tree.Exit,
+		})
+	}()
+
+	select {
+	case <-attached:
+	case err := <-done:
+		t.Skipf("ptrace not permitted: %s", err)
+	}
+
+	if whileTracing != nil {
+		whileTracing(pid)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("tracer did not exit")
+	}
+	return events, syscalls
+}
+
+func TestPtraceExec(t *testing.T) {
+	events := traceScript(t, "cd /; /bin/true a 'b c'; /nonexistent", nil)
+
+	found := map[string]ExecEvent{}
+	for _, e := range events {
+		found[e.Executable] = e
+	}
+
+	e, ok := found["/bin/true"]
+	if !ok {
+		t.Fatalf("exec of /bin/true not seen in %+v", events)
+	}
+	if !slices.Equal(e.Argv, []string{"/bin/true", "a", "b c"}) {
+		t.Errorf("unexpected argv %q", e.Argv)
+	}
+	if e.Cwd != "/" || e.Result != 0 || e.EnvCount == 0 {
+		t.Errorf("unexpected event %+v", e)
+	}
+
+	if e, ok := found["/nonexistent"]; !ok || e.Result != -int(syscall.ENOENT) {
+		t.Errorf("failed exec not reported correctly %+v", e)
+	}
+}
+
+// A process stopped by job control has to stay stopped while traced.
+func TestPtraceGroupStop(t *testing.T) {
+	events := traceScript(t, "kill -STOP $$; /bin/true resumed", func(pid int) {
+		time.Sleep(500 * time.Millisecond)
+		stat, err := procfs.ReadStat(pid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.State != 'T' && stat.State != 't' {
+			t.Errorf("process should be stopped, state is %c", stat.State)
+		}
+		syscall.Kill(pid, syscall.SIGCONT)
+	})
+
+	if len(events) == 0 || events[len(events)-1].Argv[1] != "resumed" {
+		t.Errorf("process did not resume, events %+v", events)
+	}
+}
+
+func TestPtraceSyscalls(t *testing.T) {
+	dir := t.TempDir()
+	script := "cd " + dir + "; echo x > a; cat a > /dev/null; mv a b; rm b; mkdir d; rm -r d"
+	_, events := traceScriptSyscalls(t, script, Options{Classes: []string{ClassOpen, ClassUnlink, ClassRename}}, NewProcessTree(), nil)
+
+	seen := []string{}
+	for _, e := range events {
+		if ignoredDevice(e.Path) {
+			continue
+		}
+		// mv uses renameat or renameat2 depending on the platform.
+		desc := strings.TrimSuffix(e.Syscall, "2") + " " + e.Path
+		if e.TargetPath != "" {
+			desc += " " + e.TargetPath
+		}
+		if e.Syscall == "unlinkat" && e.Flags != "" {
+			desc += " " + e.Flags
+		}
+		seen = append(seen, desc)
+	}
+
+	// Opening a to read it isn't audited.
+	want := []string{
+		"openat " + dir + "/a",
+		"renameat " + dir + "/a " + dir + "/b",
+		"unlinkat " + dir + "/b",
+		"unlinkat " + dir + "/d AT_REMOVEDIR",
+	}
+	if !slices.Equal(seen, want) {
+		t.Errorf("want %q got %q", want, seen)
+	}
+}
+
+func TestPtraceTree(t *testing.T) {
+	tree := NewProcessTree()
+	traceScriptSyscalls(t, "/bin/true | /bin/cat; (/bin/sh -c 'exit 3'); /bin/sh -c 'kill -9 $$'; exit 2", Options{}, tree, nil)
+
+	roots := tree.Roots()
+	if len(roots) != 1 || roots[0].ExitCode == nil || *roots[0].ExitCode != 2 {
+		t.Fatalf("unexpected tree %+v", roots)
+	}
+
+	results := map[string]string{}
+	for _, c := range tree.Commands() {
+		switch {
+		case c.ExitCode != nil:
+			results[c.CommandLine] = strconv.Itoa(*c.ExitCode)
+		case c.Signal != "":
+			results[c.CommandLine] = c.Signal
+		}
+	}
+	expected := map[string]string{
+		"/bin/true":             "0",
+		"/bin/cat":              "0",
+		"/bin/sh -c exit 3":     "3",
+		"/bin/sh -c kill -9 $$": "SIGKILL",
+	}
+	// Whether the sleep before the script is seen depends on when the tracer attaches.
+	delete(results, "sleep 0.2")
+	if !maps.Equal(results, expected) {
+		t.Errorf("unexpected commands %v", results)
+	}
+}
+
+func TestPtracePolicy(t *testing.T) {
+	p, err := policy.Parse([]byte(`{"rules": [{"id": "no-echo", "action": "deny", "executable": "echo", "args": ["blocked"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "out")
+	script := "/bin/echo blocked > " + out + "; echo $? >> " + out + "; /bin/echo allowed >> " + out
+	events, _ := traceScriptSyscalls(t, script, Options{Policy: p}, NewProcessTree(), nil)
+
+	blocked := slices.IndexFunc(events, func(e ExecEvent) bool { return e.Rule != "" })
+	if blocked < 0 {
+		t.Fatalf("no blocked exec in %+v", events)
+	}
+	if e := events[blocked]; e.Rule != "no-echo" || e.Result != -int(syscall.EPERM) || e.Argv[1] != "blocked" {
+		t.Errorf("unexpected blocked exec %+v", e)
+	}
+
+	// The shell sees the exec fail and carries on.
+	output, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != "126\nallowed\n" {
+		t.Errorf("unexpected output %q", output)
+	}
+}
+
+// The arguments are checked again once they've been copied, in full, so what
+// the exec was checked with can't differ from what the command runs with.
+func TestPtracePolicyExecutedArgs(t *testing.T) {
+	p, err := policy.Parse([]byte(`{"rules": [{"id": "no-secret", "action": "deny", "args": ["*secret"]}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Longer than is read as the exec is entered.
+	arg := strings.Repeat("a", 2*maxArgLength) + "secret"
+	out := filepath.Join(t.TempDir(), "out")
+	script := "/bin/echo " + arg + " > /dev/null; echo $? > " + out
+	events, _ := traceScriptSyscalls(t, script, Options{Policy: p}, NewProcessTree(), nil)
+
+	blocked := slices.IndexFunc(events, func(e ExecEvent) bool { return e.Rule != "" })
+	if blocked < 0 {
+		t.Fatalf("no blocked exec in %+v", events)
+	}
+	if e := events[blocked]; e.Rule != "no-secret" || len(e.Argv) != 2 || len(e.Argv[1]) != maxArgLength {
+		t.Errorf("unexpected blocked exec %+v", e)
+	}
+	if output, _ := os.ReadFile(out); string(output) != "137\n" {
+		t.Errorf("unexpected exit code %q", output)
+	}
+}
+
+// A symlink with another name runs the binary it points to, so it's denied too.
+func TestPtracePolicySymlink(t *testing.T) {
+	p, err := policy.Parse([]byte(`{"rules": [{"id": "no-echo", "action": "deny", "executable": "echo"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	echo, err := exec.LookPath("echo")
+	if err != nil {
+		t.Skip("echo not found")
+	}
+	if err := os.Symlink(echo, filepath.Join(dir, "e")); err != nil {
+		t.Fatal(err)
+	}
+	// Relative, and through a link to a directory.
+	if err := os.Symlink(dir, filepath.Join(dir, "d")); err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(dir, "out")
+	script := "cd " + dir + "; ./e hi > " + out + "; echo $? >> " + out + "; d/e hi >> " + out + "; echo $? >> " + out
+	events, _ := traceScriptSyscalls(t, script, Options{Policy: p}, NewProcessTree(), nil)
+
+	blocked := 0
+	for _, e := range events {
+		if e.Rule == "no-echo" {
+			blocked++
+		}
+	}
+	if blocked != 2 {
+		t.Errorf("want 2 blocked execs, got %d in %+v", blocked, events)
+	}
+	output, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(output) != "126\n126\n" {
+		t.Errorf("unexpected output %q", output)
+	}
+}
+
+func TestResolveLinks(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "real"), nil, 0755)
+	os.Symlink("real", filepath.Join(dir, "b"))
+	os.Symlink(filepath.Join(dir, "b"), filepath.Join(dir, "a"))
+	os.Symlink(dir, filepath.Join(dir, "d"))
+
+	pid := os.Getpid()
+	tests := map[string][]string{
+		filepath.Join(dir, "real"):    {},
+		filepath.Join(dir, "a"):       {filepath.Join(dir, "b"), filepath.Join(dir, "real")},
+		filepath.Join(dir, "d", "b"):  {filepath.Join(dir, "real")},
+		filepath.Join(dir, "missing"): {},
+	}
+	for path, want := range tests {
+		if got := resolveLinks(pid, path); !slices.Equal(got, want) {
+			t.Errorf("resolveLinks(%s) = %q, want %q", path, got, want)
+		}
+	}
+}
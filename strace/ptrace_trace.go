@@ -0,0 +1,614 @@
+package strace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"webshell/policy"
+	"webshell/procfs"
+)
+
+// Limits on how much of an execve's arguments are read from the tracee.
+const (
+	maxArgs       = 4096
+	maxArgLength  = 4096
+	maxEnvEntries = 65536
+	pageSize      = 4096
+)
+
+// Longest socket address read, the size of struct sockaddr_storage.
+const maxSockaddrLength = 128
+
+// Per thread tracing state.
+type task struct {
+	inSyscall bool
+	exec      *ExecEvent    // execve waiting for its result, with Rule set if it was blocked
+	call      *SyscallEvent // audited syscall waiting for its result
+}
+
+// What trace reports to, each is called from the tracing thread.
+type traceHandlers struct {
+	attached func()
+	exec     func(ExecEvent)
+	syscall  func(SyscallEvent) // For the syscalls in the audited classes
+	fork     func(ForkEvent)
+	exit     func(ExitEvent)
+}
+
+type tracer struct {
+	tasks    map[int]*task
+	procs    map[int]bool      // Thread group leaders, which report exits
+	syscalls map[uint64]string // audited syscalls besides execve, by number
+	compat   map[uint64]string // the same for the 32-bit ABI
+	sockets  map[uint64]string // audited socketcall calls
+	policy   *policy.Policy
+	handlers traceHandlers
+}
+
+// Traces pid and everything it starts, reporting to handlers and blocking the
+// execs opts.Policy denies. It returns once every traced process has exited.
+func trace(pid int, opts Options, handlers traceHandlers) error {
+	// Every ptrace request for a tracee has to come from the thread that attached to it.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	if !ptraceSupported {
+		return fmt.Errorf("ptrace tracing is not supported on %s", runtime.GOARCH)
+	}
+
+	options := syscall.PTRACE_O_TRACESYSGOOD | syscall.PTRACE_O_TRACEEXEC |
+		syscall.PTRACE_O_TRACEFORK | syscall.PTRACE_O_TRACEVFORK | syscall.PTRACE_O_TRACECLONE
+	if err := ptrace(ptraceSeize, pid, 0, uintptr(options)); err != nil {
+		return fmt.Errorf("failed to attach to %d: %w", pid, err)
+	}
+	if err := ptrace(ptraceInterrupt, pid, 0, 0); err != nil {
+		return fmt.Errorf("failed to stop %d: %w", pid, err)
+	}
+	handlers.attached()
+
+	t := &tracer{
+		tasks:    map[int]*task{},
+		procs:    map[int]bool{pid: true},
+		syscalls: map[uint64]string{},
+		compat:   map[uint64]string{},
+		sockets:  map[uint64]string{},
+		policy:   opts.Policy,
+		handlers: handlers,
+	}
+	for _, name := range opts.syscalls() {
+		if nr, ok := syscallNumbers[name]; ok {
+			t.syscalls[nr] = name
+		}
+	}
+	for _, name := range opts.compatSyscalls() {
+		if nr, ok := compatSyscallNumbers[name]; ok {
+			t.compat[nr] = name
+		}
+	}
+	for call, name := range socketcalls {
+		if slices.Contains(opts.compatSyscalls(), name) {
+			t.sockets[call] = name
+		}
+	}
+	if nr, ok := compatSyscallNumbers["socketcall"]; ok && len(t.sockets) > 0 {
+		t.compat[nr] = "socketcall"
+	}
+	for {
+		var status syscall.WaitStatus
+		tid, err := syscall.Wait4(-1, &status, syscall.WALL, nil)
+		switch {
+		case errors.Is(err, syscall.EINTR):
+			continue
+		case errors.Is(err, syscall.ECHILD):
+			// Nothing left to trace.
+			return nil
+		case err != nil:
+			return err
+		}
+
+		if status.Exited() || status.Signaled() {
+			delete(t.tasks, tid)
+			t.exited(tid, status)
+			continue
+		}
+		if status.Stopped() {
+			t.stopped(tid, status)
+		}
+	}
+}
+
+func (t *tracer) task(tid int) *task {
+	tk, ok := t.tasks[tid]
+	if !ok {
+		tk = &task{}
+		t.tasks[tid] = tk
+	}
+	return tk
+}
+
+// Handles a tracee stopping, then restarts it.
+func (t *tracer) stopped(tid int, status syscall.WaitStatus) {
+	sig := status.StopSignal()
+	event := int(status >> 16)
+
+	switch {
+	case sig == syscall.SIGTRAP|0x80:
+		t.syscallStop(tid)
+
+	case event == syscall.PTRACE_EVENT_EXEC:
+		// If a thread other than the leader calls execve it takes over the leader's pid.
+		if former, err := syscall.PtraceGetEventMsg(tid); err == nil && int(former) != tid {
+			if tk, ok := t.tasks[int(former)]; ok {
+				t.tasks[tid] = tk
+				delete(t.tasks, int(former))
+			}
+		}
+		if tk, ok := t.tasks[tid]; ok && tk.exec != nil && !t.enforceExecuted(tid, tk.exec) {
+			tk.exec = nil
+			return
+		}
+
+	case event == ptraceEventStop:
+		// Job control stops have to stay stopped until the process is continued.
+		switch sig {
+		case syscall.SIGSTOP, syscall.SIGTSTP, syscall.SIGTTIN, syscall.SIGTTOU:
+			ptrace(ptraceListen, tid, 0, 0)
+			return
+		}
+
+	case event == syscall.PTRACE_EVENT_FORK || event == syscall.PTRACE_EVENT_VFORK:
+		// The new process is traced automatically.
+		if child, err := syscall.PtraceGetEventMsg(tid); err == nil {
+			t.procs[int(child)] = true
+			t.handlers.fork(ForkEvent{Pid: int(child), PPid: tid, Timestamp: time.Now()})
+		}
+
+	case event != 0:
+		// clone, usually a new thread, is traced automatically too.
+
+	default:
+		// Pass signals on to the tracee.
+		syscall.PtraceSyscall(tid, int(sig))
+		return
+	}
+
+	syscall.PtraceSyscall(tid, 0)
+}
+
+func (t *tracer) syscallStop(tid int) {
+	tk := t.task(tid)
+
+	var regs syscall.PtraceRegs
+	if err := syscall.PtraceGetRegs(tid, &regs); err != nil {
+		return
+	}
+
+	if !tk.inSyscall {
+		tk.inSyscall = true
+		// Execs with an ABI the tracer doesn't otherwise read, like x32, are
+		// still audited, but denied while there's a policy as their
+		// arguments can't be relied on.
+		if args, at, ok := unsupportedExec(tid, &regs); ok {
+			tk.exec = readExec(tid, args, at, 4)
+			if t.policy != nil && !t.deny(tid, &regs, tk.exec, policy.UnsupportedRule) {
+				tk.exec = nil
+			}
+			return
+		}
+		nr := syscallNo(&regs)
+		name, audited := t.syscalls[nr]
+		compatName, compatAudited := t.compat[compatSyscallNo(&regs)]
+		if nr != sysExecve && nr != sysExecveat && nr != sysExecveCompat && nr != sysExecveatCompat && !audited && !compatAudited {
+			return
+		}
+		// A 64-bit process can still make 32-bit syscalls, with int 0x80, which
+		// have their own numbers. Only execs are read from those, the others
+		// are logged without their paths or addresses.
+		compat := compatSyscall(tid, &regs)
+		switch {
+		case compat && (nr == sysExecveCompat || nr == sysExecveatCompat):
+			tk.exec = readExec(tid, compatArgs(&regs), nr == sysExecveatCompat, 4)
+		case !compat && (nr == sysExecve || nr == sysExecveat):
+			tk.exec = readExec(tid, []uint64{syscallArg(&regs, 0), syscallArg(&regs, 1), syscallArg(&regs, 2), syscallArg(&regs, 3)}, nr == sysExecveat, 8)
+		case compat && compatAudited:
+			tk.call = t.readCompatSyscall(tid, &regs, compatName)
+		case !compat && audited:
+			tk.call = readSyscall(tid, &regs, name)
+		}
+		if tk.exec != nil && !t.enforce(tid, &regs, tk.exec) {
+			tk.exec = nil
+		}
+		return
+	}
+
+	tk.inSyscall = false
+	if tk.exec != nil {
+		e := *tk.exec
+		tk.exec = nil
+		if e.Rule != "" {
+			// The skipped syscall returns ENOSYS, which would be confusing.
+			setSyscallReturn(tid, &regs, -int64(syscall.EPERM))
+		}
+		e.Result = int(syscallReturn(&regs))
+		t.handlers.exec(e)
+	}
+	if tk.call != nil {
+		e := *tk.call
+		tk.call = nil
+		e.Result = int(syscallReturn(&regs))
+		t.handlers.syscall(e)
+	}
+}
+
+// Stops an exec the policy denies from running, by skipping the syscall as
+// the tracee enters it. If that fails the tracee is killed instead, and the
+// exec is reported straight away as it won't return. Returns whether the exec
+// is still waiting for its result.
+func (t *tracer) enforce(tid int, regs *syscall.PtraceRegs, e *ExecEvent) bool {
+	if t.policy == nil {
+		return true
+	}
+	rule, allowed := t.check(tid, e.Executable, e.Argv)
+	if allowed {
+		return true
+	}
+	return t.deny(tid, regs, e, rule.ID)
+}
+
+// Skips the exec the tracee is entering, blocked by the rule, or kills the
+// tracee if it can't. Returns whether the exec is still waiting for its result.
+func (t *tracer) deny(tid int, regs *syscall.PtraceRegs, e *ExecEvent, rule string) bool {
+	e.Rule = rule
+	if err := skipSyscall(tid, regs); err != nil {
+		syscall.Kill(tid, syscall.SIGKILL)
+		e.Result = -int(syscall.EPERM)
+		t.handlers.exec(*e)
+		return false
+	}
+	return true
+}
+
+// Checks an exec against the policy by the path it was run with and by each
+// symlink it resolves through, so a link with another name can't be used to
+// run a denied command. It's denied if any of them is.
+func (t *tracer) check(tid int, executable string, argv []string) (policy.Rule, bool) {
+	for _, path := range resolveLinks(tid, executable) {
+		if rule, allowed := t.policy.Check(path, argv); !allowed {
+			return rule, false
+		}
+	}
+	return t.policy.Check(executable, argv)
+}
+
+// Checks the binary an exec ran, and the arguments the kernel copied, while
+// it's stopped before running any of it, in case a symlink was swapped or
+// another thread changed the arguments after the exec was checked. A denied
+// one is killed and reported as blocked. Returns whether it can carry on.
+func (t *tracer) enforceExecuted(tid int, e *ExecEvent) bool {
+	if t.policy == nil {
+		return true
+	}
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", tid))
+	if err != nil {
+		return true
+	}
+	// The arguments are checked as the kernel copied them, and in full, while
+	// those read as the exec was entered are capped and could have changed.
+	argv := e.Argv
+	if copied, err := procfs.Argv(tid); err == nil {
+		argv = copied
+		e.Argv = make([]string, min(len(copied), maxArgs))
+		for i := range e.Argv {
+			e.Argv[i] = copied[i][:min(len(copied[i]), maxArgLength)]
+		}
+	}
+	rule, allowed := t.policy.Check(exe, argv)
+	if allowed {
+		return true
+	}
+	syscall.Kill(tid, syscall.SIGKILL)
+	e.Rule = rule.ID
+	e.Result = -int(syscall.EPERM)
+	t.handlers.exec(*e)
+	return false
+}
+
+// Most symlinks followed resolving a path, as the kernel's limit.
+const maxSymlinks = 40
+
+// Follows the symlinks in path as the tracee tid sees the filesystem, from
+// its root. Returns each path the executable is found at on the way, and
+// where it really is, but not path itself. A path that can't be resolved,
+// which the exec will fail on, has the links found up to that point.
+func resolveLinks(tid int, path string) []string {
+	root := fmt.Sprintf("/proc/%d/root", tid)
+	found := []string{}
+	resolved := "/"
+	rest := strings.Split(path, "/")
+	for links := 0; len(rest) > 0; {
+		name := rest[0]
+		rest = rest[1:]
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, name)
+		stat, err := os.Lstat(root + next)
+		if err != nil {
+			return found
+		}
+		if stat.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		target, err := os.Readlink(root + next)
+		if links++; err != nil || links > maxSymlinks {
+			return found
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		// Only a link to the executable itself gives it another name.
+		if len(rest) == 0 {
+			found = append(found, filepath.Join(resolved, target))
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+
+	if resolved != filepath.Clean(path) && !slices.Contains(found, resolved) {
+		found = append(found, resolved)
+	}
+	return found
+}
+
+// Reports a process exiting. Threads exiting aren't reported.
+func (t *tracer) exited(tid int, status syscall.WaitStatus) {
+	if !t.procs[tid] {
+		return
+	}
+	delete(t.procs, tid)
+
+	e := ExitEvent{Pid: tid, Timestamp: time.Now()}
+	if status.Exited() {
+		code := status.ExitStatus()
+		e.ExitCode = &code
+	} else {
+		e.Signal = signalName(status.Signal())
+	}
+	t.handlers.exit(e)
+}
+
+// Reads the arguments of an execve, or execveat when at is set, as the tracee
+// enters it. Its pointers are pointerSize bytes, 4 for a 32-bit syscall.
+func readExec(tid int, args []uint64, at bool, pointerSize int) *ExecEvent {
+	e := &ExecEvent{Pid: tid, Timestamp: time.Now()}
+	e.readProcess()
+
+	mem, err := os.Open(fmt.Sprintf("/proc/%d/mem", tid))
+	if err != nil {
+		return e
+	}
+	defer mem.Close()
+
+	pathArg, argvArg, envpArg := args[0], args[1], args[2]
+	dir := e.Cwd
+	if at {
+		pathArg, argvArg, envpArg = args[1], args[2], args[3]
+		if dirfd := int32(args[0]); dirfd != atFdcwd {
+			dir, _ = os.Readlink(fmt.Sprintf("/proc/%d/fd/%d", tid, dirfd))
+		}
+	}
+
+	path, _ := readString(mem, pathArg)
+	if path != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	} else if path == "" {
+		path = dir
+	}
+	e.Executable = path
+	e.Argv, _ = readStrings(mem, argvArg, pointerSize, maxArgs)
+	e.EnvCount, _ = countPointers(mem, envpArg, pointerSize, maxEnvEntries)
+
+	return e
+}
+
+// Reads the arguments of an audited file or network syscall as the tracee
+// enters it. Returns nil for opens that can't change the file.
+func readSyscall(tid int, regs *syscall.PtraceRegs, name string) *SyscallEvent {
+	e := &SyscallEvent{Pid: tid, Timestamp: time.Now(), Syscall: name}
+	if name == "openat" {
+		e.Flags = openFlagNames(int(syscallArg(regs, 2)))
+		if !opensForWrite(e.Flags) {
+			return nil
+		}
+	}
+
+	mem, err := os.Open(fmt.Sprintf("/proc/%d/mem", tid))
+	if err != nil {
+		return e
+	}
+	defer mem.Close()
+
+	switch name {
+	case "openat", "unlinkat":
+		e.Path = readPath(tid, mem, regs, 0, 1)
+		if name == "unlinkat" && syscallArg(regs, 2)&atRemovedir != 0 {
+			e.Flags = "AT_REMOVEDIR"
+		}
+	case "renameat", "renameat2":
+		e.Path = readPath(tid, mem, regs, 0, 1)
+		e.TargetPath = readPath(tid, mem, regs, 2, 3)
+	case "connect", "bind":
+		b := make([]byte, min(syscallArg(regs, 2), maxSockaddrLength))
+		if n, _ := mem.ReadAt(b, int64(syscallArg(regs, 1))); n > 0 {
+			e.Addr = decodeSockaddr(b[:n])
+		}
+	}
+	return e
+}
+
+// Returns the event for a 32-bit file or network syscall, from its flags
+// alone. Its path or address would have to be read with 32-bit pointers and
+// structs, which isn't worth it for the odd program that uses them.
+func (t *tracer) readCompatSyscall(tid int, regs *syscall.PtraceRegs, name string) *SyscallEvent {
+	args := compatArgs(regs)
+	if name == "socketcall" {
+		if name = t.sockets[args[0]]; name == "" {
+			return nil
+		}
+	}
+	e := &SyscallEvent{Pid: tid, Timestamp: time.Now(), Syscall: name, Unparsed: true}
+	switch name {
+	case "open", "openat", "creat":
+		flags := syscall.O_WRONLY | syscall.O_CREAT | syscall.O_TRUNC
+		switch name {
+		case "open":
+			flags = int(args[1])
+		case "openat":
+			flags = int(args[2])
+		}
+		e.Flags = openFlagNames(flags)
+		if !opensForWrite(e.Flags) {
+			return nil
+		}
+	case "unlinkat":
+		if args[2]&atRemovedir != 0 {
+			e.Flags = "AT_REMOVEDIR"
+		}
+	}
+	return e
+}
+
+// Reads a path argument, made absolute with the directory its dirfd argument refers to.
+func readPath(tid int, mem *os.File, regs *syscall.PtraceRegs, dirfdArg int, pathArg int) string {
+	path, _ := readString(mem, syscallArg(regs, pathArg))
+	return resolvePath(tid, int(int32(syscallArg(regs, dirfdArg))), path)
+}
+
+// Not defined by the syscall package on every architecture.
+const (
+	ptraceSeize     = 0x4206
+	ptraceInterrupt = 0x4207
+	ptraceListen    = 0x4208
+	ptraceEventStop = 0x80
+	atFdcwd         = -100
+	atRemovedir     = 0x200
+)
+
+// Reads a NUL terminated string from the tracee's memory.
+func readString(mem *os.File, addr uint64) (string, error) {
+	if addr == 0 {
+		return "", nil
+	}
+
+	buf := []byte{}
+	for len(buf) < maxArgLength {
+		// Only read up to the end of the page, the next one might not be mapped.
+		chunk := make([]byte, pageSize-addr%pageSize)
+		n, err := mem.ReadAt(chunk, int64(addr))
+		if i := bytes.IndexByte(chunk[:n], 0); i >= 0 {
+			return string(append(buf, chunk[:i]...)), nil
+		}
+		if n == 0 {
+			return string(buf), err
+		}
+		buf = append(buf, chunk[:n]...)
+		addr += uint64(n)
+	}
+	return string(buf[:maxArgLength]), nil
+}
+
+// Reads a pointer of size bytes, 4 or 8.
+func readPointer(mem *os.File, addr uint64, size int) (uint64, error) {
+	b := make([]byte, 8)
+	if _, err := mem.ReadAt(b[:size], int64(addr)); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(b), nil
+}
+
+// Reads a NULL terminated array of strings, such as argv.
+func readStrings(mem *os.File, addr uint64, pointerSize int, max int) ([]string, error) {
+	list := []string{}
+	if addr == 0 {
+		return list, nil
+	}
+	for i := 0; i < max; i++ {
+		p, err := readPointer(mem, addr+uint64(i*pointerSize), pointerSize)
+		if err != nil || p == 0 {
+			return list, err
+		}
+		s, err := readString(mem, p)
+		if err != nil {
+			return list, err
+		}
+		list = append(list, s)
+	}
+	return list, nil
+}
+
+// Counts the entries in a NULL terminated array of pointers, such as envp.
+func countPointers(mem *os.File, addr uint64, pointerSize int, max int) (int, error) {
+	if addr == 0 {
+		return 0, nil
+	}
+	for i := 0; i < max; i++ {
+		p, err := readPointer(mem, addr+uint64(i*pointerSize), pointerSize)
+		if err != nil || p == 0 {
+			return i, err
+		}
+	}
+	return max, nil
+}
+
+// Returns the parent pid, real uid and real gid of a process.
+func readStatus(pid int) (ppid int, uid int, gid int) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, -1, -1
+	}
+	defer f.Close()
+
+	uid, gid = -1, -1
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), ":")
+		fields := strings.Fields(value)
+		if len(fields) == 0 {
+			continue
+		}
+		switch key {
+		case "PPid":
+			ppid, _ = strconv.Atoi(fields[0])
+		case "Uid":
+			uid, _ = strconv.Atoi(fields[0])
+		case "Gid":
+			gid, _ = strconv.Atoi(fields[0])
+		}
+	}
+	return ppid, uid, gid
+}
+
+func ptrace(request int, pid int, addr uintptr, data uintptr) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_PTRACE, uintptr(request), uintptr(pid), addr, data, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package strace
+
+import (
+	"encoding/binary"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	ptraceSupported = true
+	sysExecve       = 59
+	sysExecveat     = 322
+
+	// The numbers in the 32-bit ABI, which a 64-bit process can use with int 0x80.
+	sysExecveCompat   = 11
+	sysExecveatCompat = 358
+
+	// x32 syscalls have this bit set, and their own numbers for exec.
+	x32SyscallBit  = 0x40000000
+	sysExecveX32   = 520
+	sysExecveatX32 = 545
+
+	ptraceGetSyscallInfo = 0x420e
+	auditArchX8664       = 0xc000003e
+	userCS32             = 0x23
+)
+
+// Numbers of the syscalls that can be audited besides execve.
+var syscallNumbers = map[string]uint64{
+	"openat":    257,
+	"unlinkat":  263,
+	"renameat":  264,
+	"renameat2": 316,
+	"connect":   42,
+	"bind":      49,
+}
+
+// Numbers of the same syscalls in the 32-bit ABI. Socket calls can also be
+// made with socketcall.
+var compatSyscallNumbers = map[string]uint64{
+	"open":       5,
+	"creat":      8,
+	"unlink":     10,
+	"rename":     38,
+	"openat":     295,
+	"unlinkat":   301,
+	"renameat":   302,
+	"renameat2":  353,
+	"connect":    362,
+	"bind":       361,
+	"socketcall": 102,
+}
+
+func syscallNo(regs *syscall.PtraceRegs) uint64 {
+	return regs.Orig_rax
+}
+
+func compatSyscallNo(regs *syscall.PtraceRegs) uint64 {
+	return regs.Orig_rax
+}
+
+func syscallArg(regs *syscall.PtraceRegs, n int) uint64 {
+	return [6]uint64{regs.Rdi, regs.Rsi, regs.Rdx, regs.R10, regs.R8, regs.R9}[n]
+}
+
+func syscallReturn(regs *syscall.PtraceRegs) int64 {
+	return int64(regs.Rax)
+}
+
+// Makes the kernel skip the syscall the tracee is entering, it returns ENOSYS.
+func skipSyscall(tid int, regs *syscall.PtraceRegs) error {
+	regs.Orig_rax = ^uint64(0)
+	return syscall.PtraceSetRegs(tid, regs)
+}
+
+func setSyscallReturn(tid int, regs *syscall.PtraceRegs, ret int64) error {
+	regs.Rax = uint64(ret)
+	return syscall.PtraceSetRegs(tid, regs)
+}
+
+// Returns whether the syscall the tracee is entering uses the 32-bit ABI,
+// from a 32-bit process or made with int 0x80 by a 64-bit one.
+func compatSyscall(tid int, regs *syscall.PtraceRegs) bool {
+	var info [88]byte // struct ptrace_syscall_info
+	if ptrace(ptraceGetSyscallInfo, tid, uintptr(len(info)), uintptr(unsafe.Pointer(&info))) == nil {
+		return binary.LittleEndian.Uint32(info[4:]) != auditArchX8664
+	}
+	// Before Linux 5.3, look at the code segment, and at the instruction that
+	// made the syscall for int 0x80 or sysenter from 64-bit code.
+	var insn [2]byte
+	syscall.PtracePeekText(tid, uintptr(regs.Rip-2), insn[:])
+	return regs.Cs == userCS32 || insn == [2]byte{0xcd, 0x80} || insn == [2]byte{0x0f, 0x34}
+}
+
+// The arguments of a 32-bit syscall.
+func compatArgs(regs *syscall.PtraceRegs) []uint64 {
+	args := []uint64{regs.Rbx, regs.Rcx, regs.Rdx, regs.Rsi, regs.Rdi, regs.Rbp}
+	for i := range args {
+		args[i] = uint64(uint32(args[i]))
+	}
+	return args
+}
+
+// Returns the arguments of an exec the tracee is entering with an ABI whose
+// execs aren't checked, x32, and whether it's execveat.
+func unsupportedExec(tid int, regs *syscall.PtraceRegs) ([]uint64, bool, bool) {
+	if regs.Orig_rax&x32SyscallBit == 0 {
+		return nil, false, false
+	}
+	var at bool
+	switch regs.Orig_rax &^ x32SyscallBit {
+	case sysExecve, sysExecveX32:
+	case sysExecveat, sysExecveatX32:
+		at = true
+	default:
+		return nil, false, false
+	}
+	args := []uint64{regs.Rdi, regs.Rsi, regs.Rdx, regs.R10}
+	for i := range args {
+		args[i] = uint64(uint32(args[i]))
+	}
+	return args, at, true
+}
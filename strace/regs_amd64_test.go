@@ -0,0 +1,182 @@
+package strace
+
+import (
+	"encoding/binary"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"webshell/policy"
+)
+
+// Writes a static amd64 program that runs path with a 32-bit execve, made
+// with int 0x80, and exits with 3 if that fails.
+func writeCompatExec(t *testing.T, file string, path string) {
+	writeExecProgram(t, file, path, []byte{
+		0xb8, 11, 0, 0, 0, // mov eax, 11 (execve)
+		0xbb, 0, 0, 0, 0, // mov ebx, path
+		0x31, 0xc9, // xor ecx, ecx
+		0x31, 0xd2, // xor edx, edx
+		0xcd, 0x80, // int 0x80
+	}, 6)
+}
+
+// Writes a static amd64 program that runs path with an x32 execve, and exits
+// with 3 if that fails.
+func writeX32Exec(t *testing.T, file string, path string) {
+	writeExecProgram(t, file, path, []byte{
+		0xb8, 0x08, 0x02, 0, 0x40, // mov eax, 0x40000208 (x32 execve)
+		0xbf, 0, 0, 0, 0, // mov edi, path
+		0x31, 0xf6, // xor esi, esi
+		0x31, 0xd2, // xor edx, edx
+		0x0f, 0x05, // syscall
+	}, 6)
+}
+
+// Writes a static amd64 program that creates path with a 32-bit open, made
+// with int 0x80.
+func writeCompatOpen(t *testing.T, file string, path string) {
+	writeExecProgram(t, file, path, []byte{
+		0xb8, 5, 0, 0, 0, // mov eax, 5 (open)
+		0xbb, 0, 0, 0, 0, // mov ebx, path
+		0xb9, 0x41, 0, 0, 0, // mov ecx, O_WRONLY|O_CREAT
+		0xba, 0xa4, 0x01, 0, 0, // mov edx, 0644
+		0xcd, 0x80, // int 0x80
+	}, 6)
+}
+
+// Writes a static amd64 program that makes the syscall in code, with the
+// address of path at offset pathAt, then exits with 3.
+func writeExecProgram(t *testing.T, file string, path string, code []byte, pathAt int) {
+	const base = 0x400000
+	const entry = base + 64 + 56
+	code = append(code,
+		0xbf, 3, 0, 0, 0, // mov edi, 3
+		0xb8, 60, 0, 0, 0, // mov eax, 60 (exit)
+		0x0f, 0x05, // syscall
+	)
+	binary.LittleEndian.PutUint32(code[pathAt:], uint32(entry+len(code)))
+	code = append(append(code, path...), 0)
+
+	le := binary.LittleEndian
+	elf := []byte{0x7f, 'E', 'L', 'F', 2, 1, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	elf = le.AppendUint16(elf, 2)    // ET_EXEC
+	elf = le.AppendUint16(elf, 0x3e) // EM_X86_64
+	elf = le.AppendUint32(elf, 1)
+	elf = le.AppendUint64(elf, entry)
+	elf = le.AppendUint64(elf, 64) // Program headers
+	elf = le.AppendUint64(elf, 0)  // Section headers
+	elf = le.AppendUint32(elf, 0)
+	elf = le.AppendUint16(elf, 64)
+	elf = le.AppendUint16(elf, 56)
+	elf = le.AppendUint16(elf, 1)
+	elf = le.AppendUint16(elf, 0)
+	elf = le.AppendUint16(elf, 0)
+	elf = le.AppendUint16(elf, 0)
+
+	size := uint64(64 + 56 + len(code))
+	elf = le.AppendUint32(elf, 1) // PT_LOAD
+	elf = le.AppendUint32(elf, 5) // Read and execute
+	elf = le.AppendUint64(elf, 0)
+	elf = le.AppendUint64(elf, base)
+	elf = le.AppendUint64(elf, base)
+	elf = le.AppendUint64(elf, size)
+	elf = le.AppendUint64(elf, size)
+	elf = le.AppendUint64(elf, 0x1000)
+	elf = append(elf, code...)
+
+	if err := os.WriteFile(file, elf, 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A 64-bit process can't get around the policy with a 32-bit execve.
+func TestPtracePolicyCompatExec(t *testing.T) {
+	target, err := exec.LookPath("true")
+	if err != nil {
+		t.Skip("true not found")
+	}
+	dir := t.TempDir()
+	program := filepath.Join(dir, "compat")
+	writeCompatExec(t, program, target)
+	if err := exec.Command(program).Run(); err != nil {
+		t.Skipf("32-bit syscalls aren't supported: %s", err)
+	}
+
+	p, err := policy.Parse([]byte(`{"rules": [{"id": "no-true", "action": "deny", "executable": "true"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out")
+	events, _ := traceScriptSyscalls(t, program+"; echo $? > "+out, Options{Policy: p}, NewProcessTree(), nil)
+
+	blocked := false
+	for _, e := range events {
+		if e.Rule == "no-true" && e.Executable == target {
+			blocked = true
+		}
+	}
+	if !blocked {
+		t.Errorf("the 32-bit exec wasn't blocked: %+v", events)
+	}
+	if output, _ := os.ReadFile(out); string(output) != "3\n" {
+		t.Errorf("unexpected exit code %q", output)
+	}
+}
+
+// x32 execs can't be checked, so they're denied while there's a policy.
+func TestPtracePolicyX32Exec(t *testing.T) {
+	target, err := exec.LookPath("true")
+	if err != nil {
+		t.Skip("true not found")
+	}
+	dir := t.TempDir()
+	program := filepath.Join(dir, "x32")
+	writeX32Exec(t, program, target)
+
+	p, err := policy.Parse([]byte(`{"rules": [{"id": "no-rm", "action": "deny", "executable": "rm"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out")
+	events, _ := traceScriptSyscalls(t, program+"; echo $? > "+out, Options{Policy: p}, NewProcessTree(), nil)
+
+	blocked := false
+	for _, e := range events {
+		if e.Rule == policy.UnsupportedRule && e.Executable == target {
+			blocked = true
+		}
+	}
+	if !blocked {
+		t.Errorf("the x32 exec wasn't blocked: %+v", events)
+	}
+	if output, _ := os.ReadFile(out); string(output) != "3\n" {
+		t.Errorf("unexpected exit code %q", output)
+	}
+}
+
+// 32-bit file syscalls are logged, without their paths.
+func TestPtraceCompatOpen(t *testing.T) {
+	dir := t.TempDir()
+	program := filepath.Join(dir, "compat")
+	created := filepath.Join(dir, "created")
+	writeCompatOpen(t, program, created)
+	exec.Command(program).Run()
+	if _, err := os.Stat(created); err != nil {
+		t.Skipf("32-bit syscalls aren't supported: %s", err)
+	}
+	os.Remove(created)
+
+	_, calls := traceScriptSyscalls(t, program, Options{Classes: []string{ClassOpen}}, NewProcessTree(), nil)
+
+	logged := false
+	for _, e := range calls {
+		if e.Syscall == "open" && e.Unparsed && e.Flags == "O_WRONLY|O_CREAT" && e.Result >= 0 {
+			logged = true
+		}
+	}
+	if !logged {
+		t.Errorf("the 32-bit open wasn't logged: %+v", calls)
+	}
+}
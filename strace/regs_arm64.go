@@ -0,0 +1,108 @@
+package strace
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const (
+	ptraceSupported = true
+	sysExecve       = 221
+	sysExecveat     = 281
+
+	// 32-bit arm processes, on kernels that can run them, can't exec while
+	// there's a policy, see unsupportedExec.
+	sysExecveCompat   = ^uint64(0)
+	sysExecveatCompat = ^uint64(0)
+	sysExecveArm      = 11
+	sysExecveatArm    = 387
+
+	ptraceSetRegset = 0x4205
+	ntArmSystemCall = 0x404
+)
+
+// Numbers of the syscalls that can be audited besides execve.
+var syscallNumbers = map[string]uint64{
+	"openat":    56,
+	"unlinkat":  35,
+	"renameat":  38,
+	"renameat2": 276,
+	"connect":   203,
+	"bind":      200,
+}
+
+// Numbers of the same syscalls for 32-bit arm processes.
+var compatSyscallNumbers = map[string]uint64{
+	"open":      5,
+	"creat":     8,
+	"unlink":    10,
+	"rename":    38,
+	"openat":    322,
+	"unlinkat":  328,
+	"renameat":  329,
+	"renameat2": 382,
+	"connect":   283,
+	"bind":      282,
+}
+
+func syscallNo(regs *syscall.PtraceRegs) uint64 {
+	return regs.Regs[8]
+}
+
+// The number of the syscall a 32-bit arm process is entering, from r7.
+func compatSyscallNo(regs *syscall.PtraceRegs) uint64 {
+	return compatReg(regs, 7)
+}
+
+func syscallArg(regs *syscall.PtraceRegs, n int) uint64 {
+	return regs.Regs[n]
+}
+
+func syscallReturn(regs *syscall.PtraceRegs) int64 {
+	return int64(regs.Regs[0])
+}
+
+// Makes the kernel skip the syscall the tracee is entering, it returns ENOSYS.
+// The syscall number isn't in the general registers on arm64, it has its own regset.
+func skipSyscall(tid int, regs *syscall.PtraceRegs) error {
+	nr := int32(-1)
+	iov := syscall.Iovec{Base: (*byte)(unsafe.Pointer(&nr)), Len: 4}
+	return ptrace(ptraceSetRegset, tid, ntArmSystemCall, uintptr(unsafe.Pointer(&iov)))
+}
+
+func setSyscallReturn(tid int, regs *syscall.PtraceRegs, ret int64) error {
+	regs.Regs[0] = uint64(ret)
+	return syscall.PtraceSetRegs(tid, regs)
+}
+
+// Returns whether the tracee is a 32-bit arm process. Its registers are the
+// 32-bit set, which leaves pc and sp unset.
+func compatSyscall(tid int, regs *syscall.PtraceRegs) bool {
+	return regs.Pc == 0 && regs.Sp == 0
+}
+
+func compatArgs(regs *syscall.PtraceRegs) []uint64 {
+	return []uint64{compatReg(regs, 0), compatReg(regs, 1), compatReg(regs, 2), compatReg(regs, 3), compatReg(regs, 4), compatReg(regs, 5)}
+}
+
+// A 32-bit register, which are packed two to each 64-bit one.
+func compatReg(regs *syscall.PtraceRegs, n int) uint64 {
+	return regs.Regs[n/2] >> (32 * (n % 2)) & 0xffffffff
+}
+
+// Returns the arguments of an exec a 32-bit arm process is entering, and
+// whether it's execveat.
+func unsupportedExec(tid int, regs *syscall.PtraceRegs) ([]uint64, bool, bool) {
+	if !compatSyscall(tid, regs) {
+		return nil, false, false
+	}
+	var at bool
+	switch compatSyscallNo(regs) {
+	case sysExecveArm:
+	case sysExecveatArm:
+		at = true
+	default:
+		return nil, false, false
+	}
+	return compatArgs(regs)[:4], at, true
+}
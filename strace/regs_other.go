@@ -0,0 +1,54 @@
+//go:build !amd64 && !arm64
+
+package strace
+
+import "syscall"
+
+// The ptrace tracer only knows the syscall conventions of amd64 and arm64.
+const (
+	ptraceSupported   = false
+	sysExecve         = ^uint64(0)
+	sysExecveat       = ^uint64(0)
+	sysExecveCompat   = ^uint64(0)
+	sysExecveatCompat = ^uint64(0)
+)
+
+var syscallNumbers = map[string]uint64{}
+
+var compatSyscallNumbers = map[string]uint64{}
+
+func syscallNo(regs *syscall.PtraceRegs) uint64 {
+	return 0
+}
+
+func compatSyscallNo(regs *syscall.PtraceRegs) uint64 {
+	return 0
+}
+
+func syscallArg(regs *syscall.PtraceRegs, n int) uint64 {
+	return 0
+}
+
+func syscallReturn(regs *syscall.PtraceRegs) int64 {
+	return 0
+}
+
+func skipSyscall(tid int, regs *syscall.PtraceRegs) error {
+	return syscall.ENOSYS
+}
+
+func setSyscallReturn(tid int, regs *syscall.PtraceRegs, ret int64) error {
+	return syscall.ENOSYS
+}
+
+func compatSyscall(tid int, regs *syscall.PtraceRegs) bool {
+	return false
+}
+
+func compatArgs(regs *syscall.PtraceRegs) []uint64 {
+	return nil
+}
+
+func unsupportedExec(tid int, regs *syscall.PtraceRegs) ([]uint64, bool, bool) {
+	return nil, false, false
+}
@@ -5,94 +5,474 @@ import (
 	"fmt"
 	"log/slog"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
 const SYSCALL_EXECVE = "execve"
 
+// ErrStraceNotInstalled is returned by Attach when strace can't be found.
+var ErrStraceNotInstalled = errors.New("strace is not installed")
+
+// How long to wait for strace to attach.
+const straceAttachTimeout = 5 * time.Second
+
 var (
 	errIgnoredMessage   = errors.New("ignored message")
 	errInvalidTimestamp = errors.New("invalid timestamp")
+	errInvalidArgs      = errors.New("invalid execve arguments")
+
+	// The [pid n] prefix is left off while strace is only tracing a single process.
+	syscallRx    = regexp.MustCompile(`^(?:\[pid\s+(\d+)\]\s+)?([\d\.]+)\s+(\w+)\((.*)\)\s+=\s+(-?\d+)(?:\s+(E\w+)\s+\(.+\))?`)
+	unfinishedRx = regexp.MustCompile(`^(?:\[pid\s+(\d+)\]\s+)?([\d\.]+)\s+(\w+)\((.*?),?\s*<unfinished \.\.\.>`)
+	resumedRx    = regexp.MustCompile(`^(?:\[pid\s+(\d+)\]\s+)?([\d\.]+)\s+<\.\.\. (\w+) resumed>.*\)\s+=\s+(-?\d+)(?:\s+(E\w+)\s+\(.+\))?`)
+	envCountRx   = regexp.MustCompile(`/\* (\d+) vars? \*/`)
+	exitRx       = regexp.MustCompile(`^(?:\[pid\s+(\d+)\]\s+)?([\d\.]+)\s+\+\+\+ (?:exited with (\d+)|killed by (SIG\w+))`)
 
-	execveRx = regexp.MustCompile(`^\[pid\s+(\d+)\]\s+([\d\.]+)\s+execve\((.+)\)\s+=\s+\d+`)
+	sockFamilyRx = regexp.MustCompile(`sa_family=(\w+)`)
+	portRx       = regexp.MustCompile(`sin6?_port=htons\((\d+)\)`)
+	inetAddrRx   = regexp.MustCompile(`sin_addr=inet_addr\("([^"]+)"\)`)
+	inet6AddrRx  = regexp.MustCompile(`inet_pton\(AF_INET6, "([^"]+)"`)
+	unixPathRx   = regexp.MustCompile(`sun_path=(@?)("(?:[^"\\]|\\.)*")`)
 )
 
-type StraceExecve struct {
+// When a syscall is interrupted by another process's output strace splits it
+// over two lines, an unfinished call followed later by its result.
+type syscallPart int
+
+const (
+	syscallComplete syscallPart = iota
+	syscallUnfinished
+	syscallResumed
+)
+
+// StraceSyscall is a single syscall as printed by strace.
+type StraceSyscall struct {
 	Pid       string
 	Timestamp time.Time
-	Cmd       string
+	Name      string
+	Cmd       string // The raw arguments
+	Result    int    // The return value, or the negated errno
+	Part      syscallPart
 }
 
+// Syscalls traced to find the processes started, a process is forked unless
+// it's cloned as a thread.
+var forkSyscalls = []string{"clone", "clone3", "fork", "vfork"}
+
 func filter(s string) bool {
 	return strings.Contains(s, SYSCALL_EXECVE)
 }
 
-func parse(s string) (StraceExecve, error) {
-	res := StraceExecve{}
-	m := execveRx.FindStringSubmatch(s)
+// Parses the line strace prints when a process exits, e.g.
+//
+//	[pid  1234] 1700000000.000000 +++ exited with 1 +++
+func parseExit(s string) (ExitEvent, bool) {
+	m := exitRx.FindStringSubmatch(s)
 	if m == nil {
+		return ExitEvent{}, false
+	}
+	ts, err := parseTimestamp(m[2])
+	if err != nil {
+		return ExitEvent{}, false
+	}
+
+	e := ExitEvent{Timestamp: ts, Signal: m[4]}
+	if m[3] != "" {
+		code, _ := strconv.Atoi(m[3])
+		e.ExitCode = &code
+	}
+	e.Pid, _ = strconv.Atoi(m[1])
+	return e, true
+}
+
+func parse(s string) (StraceSyscall, error) {
+	res := StraceSyscall{}
+
+	var pid, timestamp, result, errName string
+	if m := syscallRx.FindStringSubmatch(s); m != nil {
+		pid, timestamp, res.Name, res.Cmd, result, errName = m[1], m[2], m[3], m[4], m[5], m[6]
+	} else if m := unfinishedRx.FindStringSubmatch(s); m != nil {
+		pid, timestamp, res.Name, res.Cmd = m[1], m[2], m[3], m[4]
+		res.Part = syscallUnfinished
+	} else if m := resumedRx.FindStringSubmatch(s); m != nil {
+		pid, timestamp, res.Name, result, errName = m[1], m[2], m[3], m[4], m[5]
+		res.Part = syscallResumed
+	} else {
 		return res, errIgnoredMessage
 	}
 
-	// Extract the fields.
-	pid := m[1]
-	timestamp := m[2]
-	cmd := m[3]
+	ts, err := parseTimestamp(timestamp)
+	if err != nil {
+		return StraceSyscall{}, err
+	}
+
+	res.Pid = pid
+	res.Timestamp = ts
+	if result != "" {
+		// Failures are always printed as -1 followed by the errno.
+		if res.Result, _ = strconv.Atoi(result); res.Result < 0 {
+			res.Result = -errnoFromName(errName)
+		}
+	}
+
+	return res, nil
+}
 
-	// Parse the UNIX timestamp
-	bSecs, bNs, found := strings.Cut(timestamp, ".")
-	if !found {
-		return res, errInvalidTimestamp
+// Parses the UNIX timestamp printed by strace -ttt, seconds with a microsecond fraction.
+func parseTimestamp(timestamp string) (time.Time, error) {
+	bSecs, bFrac, found := strings.Cut(timestamp, ".")
+	if !found || len(bFrac) > 9 {
+		return time.Time{}, errInvalidTimestamp
 	}
-	secs, errSec := strconv.Atoi(string(bSecs))
-	ns, errNs := strconv.Atoi(string(bNs))
+	secs, errSec := strconv.Atoi(bSecs)
+	ns, errNs := strconv.Atoi(bFrac + strings.Repeat("0", 9-len(bFrac)))
 	if errSec != nil || errNs != nil {
-		return StraceExecve{}, errInvalidTimestamp
+		return time.Time{}, errInvalidTimestamp
+	}
+	return time.Unix(int64(secs), int64(ns)), nil
+}
+
+// strace prints the errno's name, e.g. ENOENT, before its description.
+// Unknown names are reported as EPERM.
+func errnoFromName(name string) int {
+	if errno, ok := errnoNames[name]; ok {
+		return int(errno)
+	}
+	return int(syscall.EPERM)
+}
+
+// Event converts the raw execve into an ExecEvent, filling in what strace
+// doesn't report from /proc while the process is still running.
+func (e StraceSyscall) Event() (ExecEvent, error) {
+	path, argv, envCount, err := parseExecveArgs(e.Cmd)
+	if err != nil {
+		return ExecEvent{}, err
+	}
+
+	pid, _ := strconv.Atoi(e.Pid)
+	event := ExecEvent{
+		Pid:        pid,
+		Timestamp:  e.Timestamp,
+		Executable: path,
+		Argv:       argv,
+		EnvCount:   envCount,
+		Result:     e.Result,
+	}
+	event.readProcess()
+	if !filepath.IsAbs(event.Executable) && event.Cwd != "" {
+		event.Executable = filepath.Join(event.Cwd, event.Executable)
+	}
+	return event, nil
+}
+
+// ForkEvent converts a fork, vfork or clone into a ForkEvent. Returns false if
+// it failed or started a thread.
+func (e StraceSyscall) ForkEvent() (ForkEvent, bool) {
+	if e.Result <= 0 || strings.Contains(e.Cmd, "CLONE_THREAD") {
+		return ForkEvent{}, false
 	}
+	ppid, _ := strconv.Atoi(e.Pid)
+	return ForkEvent{Pid: e.Result, PPid: ppid, Timestamp: e.Timestamp}, true
+}
 
-	p := StraceExecve{
+// SyscallEvent converts a file or network syscall into a SyscallEvent. Returns
+// false if it isn't audited, opens that can't change the file.
+func (e StraceSyscall) SyscallEvent() (SyscallEvent, bool, error) {
+	pid, _ := strconv.Atoi(e.Pid)
+	event := SyscallEvent{
 		Pid:       pid,
-		Timestamp: time.Unix(int64(secs), int64(ns)),
-		Cmd:       cmd,
+		Timestamp: e.Timestamp,
+		Syscall:   e.Name,
+		Result:    e.Result,
+	}
+
+	args := splitArgs(e.Cmd)
+	var err error
+	switch e.Name {
+	case "openat", "unlinkat":
+		if len(args) < 3 {
+			return event, false, errInvalidArgs
+		}
+		event.Path, err = e.path(args[0], args[1])
+		event.Flags = args[2]
+		if e.Name == "openat" && !opensForWrite(event.Flags) {
+			return event, false, err
+		}
+		if e.Name == "unlinkat" && event.Flags == "0" {
+			event.Flags = ""
+		}
+
+	case "renameat", "renameat2":
+		if len(args) < 4 {
+			return event, false, errInvalidArgs
+		}
+		if event.Path, err = e.path(args[0], args[1]); err == nil {
+			event.TargetPath, err = e.path(args[2], args[3])
+		}
+
+	case "connect", "bind":
+		if len(args) < 2 {
+			return event, false, errInvalidArgs
+		}
+		event.Addr = parseSockaddr(args[1])
+
+	default:
+		return event, false, nil
+	}
+
+	return event, err == nil, err
+}
+
+// Parses a dirfd and path pair of arguments into an absolute path.
+func (e StraceSyscall) path(dirfd string, quoted string) (string, error) {
+	path, _, err := unquote(quoted)
+	if err != nil {
+		return "", err
 	}
 
-	return p, nil
+	fd := atFdcwd
+	if dirfd != "AT_FDCWD" {
+		if fd, err = strconv.Atoi(dirfd); err != nil {
+			return "", errInvalidArgs
+		}
+	}
+	pid, _ := strconv.Atoi(e.Pid)
+	return resolvePath(pid, fd, path), nil
+}
+
+// Splits the arguments strace prints for a syscall, ignoring commas inside
+// strings, structs, arrays and function like macros such as htons(80).
+func splitArgs(s string) []string {
+	args := []string{}
+	depth, start := 0, 0
+	inString := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case inString && c == '\\':
+			i++
+		case c == '"':
+			inString = !inString
+		case inString:
+		case c == '{' || c == '[' || c == '(':
+			depth++
+		case c == '}' || c == ']' || c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			args = append(args, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	if rest := strings.TrimSpace(s[start:]); rest != "" {
+		args = append(args, rest)
+	}
+	return args
+}
+
+// Parses a socket address as strace prints it, e.g.
+//
+//	{sa_family=AF_INET, sin_port=htons(80), sin_addr=inet_addr("127.0.0.1")}
+func parseSockaddr(s string) *SockAddr {
+	m := sockFamilyRx.FindStringSubmatch(s)
+	if m == nil {
+		return nil
+	}
+
+	addr := &SockAddr{Family: m[1]}
+	switch m[1] {
+	case "AF_INET":
+		addr.Family = "inet"
+		if m := inetAddrRx.FindStringSubmatch(s); m != nil {
+			addr.Address = m[1]
+		}
+	case "AF_INET6":
+		addr.Family = "inet6"
+		if m := inet6AddrRx.FindStringSubmatch(s); m != nil {
+			addr.Address = m[1]
+		}
+	case "AF_UNIX":
+		addr.Family = "unix"
+		if m := unixPathRx.FindStringSubmatch(s); m != nil {
+			path, _, _ := unquote(m[2])
+			addr.Address = m[1] + path
+		}
+	}
+	if m := portRx.FindStringSubmatch(s); m != nil {
+		addr.Port, _ = strconv.Atoi(m[1])
+	}
+	return addr
+}
+
+// Parses the arguments strace prints for execve, e.g.
+//
+//	"/usr/bin/ls", ["ls", "-la"], 0x557237896740 /* 7 vars */
+func parseExecveArgs(s string) (string, []string, int, error) {
+	path, rest, err := unquote(s)
+	if err != nil {
+		return "", nil, 0, err
+	}
+
+	rest, ok := strings.CutPrefix(rest, ", ")
+	if !ok {
+		return "", nil, 0, errInvalidArgs
+	}
+
+	argv := []string{}
+	if strings.HasPrefix(rest, "[") {
+		rest = rest[1:]
+		for !strings.HasPrefix(rest, "]") {
+			var arg string
+			// Arrays longer than strace's limit end with ...
+			if strings.HasPrefix(rest, "...") {
+				rest = rest[3:]
+				continue
+			}
+			if arg, rest, err = unquote(rest); err != nil {
+				return "", nil, 0, err
+			}
+			argv = append(argv, arg)
+			rest = strings.TrimPrefix(rest, ", ")
+		}
+	}
+
+	envCount := 0
+	if m := envCountRx.FindStringSubmatch(rest); m != nil {
+		envCount, _ = strconv.Atoi(m[1])
+	}
+
+	return path, argv, envCount, nil
+}
+
+// Reads a C style quoted string from the start of s, returning it and the rest of s.
+// Strings strace truncated are followed by ..., which is skipped.
+func unquote(s string) (string, string, error) {
+	if !strings.HasPrefix(s, `"`) {
+		return "", s, errInvalidArgs
+	}
+
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '"':
+			return b.String(), strings.TrimPrefix(s[i+1:], "..."), nil
+		case '\\':
+			if i+1 >= len(s) {
+				return "", s, errInvalidArgs
+			}
+			i++
+			switch e := s[i]; e {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case 'v':
+				b.WriteByte('\v')
+			case 'f':
+				b.WriteByte('\f')
+			case 'x':
+				// Hex, always two digits.
+				if i+2 >= len(s) {
+					return "", s, errInvalidArgs
+				}
+				v, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+				if err != nil {
+					return "", s, errInvalidArgs
+				}
+				b.WriteByte(byte(v))
+				i += 2
+			case '0', '1', '2', '3', '4', '5', '6', '7':
+				// Octal, up to three digits.
+				j := i
+				for j < len(s) && j < i+3 && s[j] >= '0' && s[j] <= '7' {
+					j++
+				}
+				v, err := strconv.ParseUint(s[i:j], 8, 8)
+				if err != nil {
+					return "", s, errInvalidArgs
+				}
+				b.WriteByte(byte(v))
+				i = j - 1
+			default:
+				// \" \\ and anything else stand for themselves.
+				b.WriteByte(e)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", s, errInvalidArgs
 }
 
 type StraceLogger struct {
-	buf    strings.Builder
-	logger *slog.Logger
-	pid    int
-	cmd    *exec.Cmd
+	*tracerProcess
+	execQueue
+	buf      strings.Builder
+	logger   *slog.Logger
+	opts     Options
+	syscalls *syscallLogger
+	tree     *ProcessTree
+	pid      int
+	pending  map[string]StraceSyscall // unfinished calls by pid
 }
 
-func NewStraceLogger(logger *slog.Logger) *StraceLogger {
+func NewStraceLogger(logger *slog.Logger, opts Options) *StraceLogger {
 	return &StraceLogger{
-		logger: logger,
+		logger:   logger,
+		opts:     opts,
+		syscalls: newSyscallLogger(logger, "strace", opts.RateLimit),
+		tree:     NewProcessTree(),
+		pending:  map[string]StraceSyscall{},
+
+		execQueue: newExecQueue(),
 	}
 }
 
+func (s *StraceLogger) Tree() *ProcessTree {
+	return s.tree
+}
+
 func (s *StraceLogger) Attach(pid int) error {
 
 	pathToStrace, err := exec.LookPath("strace")
 	if err != nil {
-		s.logger.Warn("strace is not installed. Command auditing will be is disabled!")
-		return nil
+		return ErrStraceNotInstalled
 	}
 
-	cmd := exec.Command(pathToStrace, "-fttt", "-qqq", "-s", "2048", "-e", "trace=execve", "-p", fmt.Sprintf("%d", pid))
+	traced := slices.Concat([]string{SYSCALL_EXECVE}, forkSyscalls, s.opts.syscalls())
+	// Only -q, so process exits are still printed.
+	cmd := exec.Command(pathToStrace, "-fttt", "-q", "-s", "2048", "-e", "trace="+strings.Join(traced, ","), "-p", fmt.Sprintf("%d", pid))
 	cmd.Stderr = s
-	s.cmd = cmd
 	s.pid = pid
 
 	if err := cmd.Start(); err != nil {
 		return err
 	}
+	s.tracerProcess = newTracerProcess(cmd)
+	go s.wait(s.syscalls.flush)
+
+	// strace is quiet about attaching, so check the kernel agrees it's tracing pid.
+	deadline := time.After(straceAttachTimeout)
+	for tracerPid(pid) != cmd.Process.Pid {
+		select {
+		case <-s.Done():
+			return fmt.Errorf("strace failed to attach: %w", s.Err())
+		case <-deadline:
+			s.Close()
+			return errors.New("strace failed to attach: timed out")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
 
 	s.logger.Info(fmt.Sprintf("Attached to PID %d", pid))
+	s.tree.SetRoot(pid)
 
 	return nil
 }
@@ -102,10 +482,8 @@ func (s *StraceLogger) Write(p []byte) (int, error) {
 		s.buf.WriteByte(b)
 		if b == '\n' {
 			line := s.buf.String()
-			if filter(line) {
-				if execve, err := parse(line); err == nil {
-					s.logger.Info(fmt.Sprintf("Audit: [PID %s] %s", execve.Pid, execve.Cmd))
-				}
+			if s.traced(line) {
+				s.handle(line)
 			}
 			s.buf.Reset()
 		}
@@ -113,3 +491,84 @@ func (s *StraceLogger) Write(p []byte) (int, error) {
 
 	return len(p), nil
 }
+
+// Cheaply skips lines that can't be for a traced syscall.
+func (s *StraceLogger) traced(line string) bool {
+	if filter(line) || strings.Contains(line, "+++") {
+		return true
+	}
+	for _, name := range slices.Concat(forkSyscalls, s.opts.syscalls()) {
+		if strings.Contains(line, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *StraceLogger) handle(line string) {
+	if exit, ok := parseExit(line); ok {
+		if exit.Pid == 0 {
+			exit.Pid = s.pid
+		}
+		s.tree.Exit(exit)
+		return
+	}
+
+	call, err := parse(line)
+	if err != nil {
+		return
+	}
+	if call.Pid == "" {
+		call.Pid = strconv.Itoa(s.pid)
+	}
+
+	switch call.Part {
+	case syscallUnfinished:
+		s.pending[call.Pid] = call
+		return
+	case syscallResumed:
+		started, ok := s.pending[call.Pid]
+		if !ok || started.Name != call.Name {
+			return
+		}
+		delete(s.pending, call.Pid)
+		started.Result = call.Result
+		call = started
+	}
+
+	if slices.Contains(forkSyscalls, call.Name) {
+		if fork, ok := call.ForkEvent(); ok {
+			s.tree.Fork(fork)
+		}
+		return
+	}
+
+	if call.Name != SYSCALL_EXECVE {
+		s.handleSyscall(call)
+		return
+	}
+
+	event, err := call.Event()
+	if err != nil {
+		s.logger.Warn(fmt.Sprintf("Failed to parse execve of PID %s: %s", call.Pid, call.Cmd))
+		return
+	}
+	logExec(s.logger, event, "strace")
+	s.tree.Exec(event)
+	s.send(event)
+}
+
+func (s *StraceLogger) handleSyscall(call StraceSyscall) {
+	if !slices.Contains(s.opts.syscalls(), call.Name) {
+		return
+	}
+
+	event, ok, err := call.SyscallEvent()
+	if err != nil {
+		s.logger.Warn(fmt.Sprintf("Failed to parse %s of PID %s: %s", call.Name, call.Pid, call.Cmd))
+		return
+	}
+	if ok {
+		s.syscalls.log(event)
+	}
+}
@@ -1,7 +1,14 @@
 package strace
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"syscall"
 	"testing"
+	"time"
 )
 
 var valid = []string{
@@ -56,3 +63,236 @@ func TestParseMany(t *testing.T) {
 
 	}
 }
+
+func TestParseTimestamp(t *testing.T) {
+	ts, err := parseTimestamp("1730503723.010946")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts.Unix() != 1730503723 || ts.Nanosecond() != 10946000 {
+		t.Errorf("unexpected timestamp %s", ts)
+	}
+}
+
+// The errno is taken from its name, whatever the description says.
+func TestParseFailed(t *testing.T) {
+	tests := []struct {
+		line  string
+		errno syscall.Errno
+	}{
+		{`[pid 17] 1730823571.031830 execve("/usr/local/bin/ls", ["ls"], 0x557237896740 /* 7 vars */) = -1 ENOENT (No such file or directory)`, syscall.ENOENT},
+		{`[pid 17] 1730823571.031830 execve("/usr/local/bin/ls", ["ls"], 0x557237896740 /* 7 vars */) = -1 EACCES (Permission non accordée)`, syscall.EACCES},
+		{`[pid 17] 1730823571.031830 <... execve resumed>) = -1 E2BIG (Argument list too long)`, syscall.E2BIG},
+		{`[pid 17] 1730823571.031830 execve("/usr/local/bin/ls", ["ls"], 0x557237896740 /* 7 vars */) = -1 ENOTSUP (Operation not supported)`, syscall.EOPNOTSUPP},
+		{`[pid 17] 1730823571.031830 execve("/usr/local/bin/ls", ["ls"], 0x557237896740 /* 7 vars */) = -1 EUNKNOWN (Something new)`, syscall.EPERM},
+	}
+	for _, test := range tests {
+		res, err := parse(test.line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Result != -int(test.errno) {
+			t.Errorf("%s: want result %d got %d", test.line, -int(test.errno), res.Result)
+		}
+	}
+}
+
+func TestParseWithoutPid(t *testing.T) {
+	res, err := parse(`1730823571.031830 execve("/usr/bin/ls", ["ls"], 0x557237896740 /* 7 vars */) = 0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Pid != "" || res.Part != syscallComplete {
+		t.Errorf("unexpected execve %+v", res)
+	}
+}
+
+func TestUnquote(t *testing.T) {
+	tests := []struct {
+		in, want, rest string
+	}{
+		{`"plain", x`, "plain", ", x"},
+		{`"caf\303\251"`, "café", ""},
+		{`"\x41\x42"`, "AB", ""},
+		{`"say \"hi\" \\o/"`, `say "hi" \o/`, ""},
+		{`"a\tb\n"`, "a\tb\n", ""},
+		{`"\0"`, "\x00", ""},
+		{`"trunc"..., x`, "trunc", ", x"},
+	}
+	for _, test := range tests {
+		got, rest, err := unquote(test.in)
+		if err != nil {
+			t.Errorf("unquote(%s): %s", test.in, err)
+			continue
+		}
+		if got != test.want || rest != test.rest {
+			t.Errorf("unquote(%s): want %q, %q got %q, %q", test.in, test.want, test.rest, got, rest)
+		}
+	}
+
+	for _, in := range []string{`plain`, `"unterminated`, `"\x4"`} {
+		if _, _, err := unquote(in); err == nil {
+			t.Errorf("unquote(%s) should fail", in)
+		}
+	}
+}
+
+func TestParseExecveArgs(t *testing.T) {
+	path, argv, envCount, err := parseExecveArgs(`"/usr/bin/grep", ["grep", "a, b", "\"x\"", ...], 0x557bf130cb90 /* 53 vars */`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "/usr/bin/grep" {
+		t.Errorf("unexpected path %s", path)
+	}
+	if !slices.Equal(argv, []string{"grep", "a, b", `"x"`}) {
+		t.Errorf("unexpected argv %q", argv)
+	}
+	if envCount != 53 {
+		t.Errorf("want 53 vars got %d", envCount)
+	}
+}
+
+func TestStraceLoggerResumed(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewStraceLogger(slog.New(slog.NewJSONHandler(&buf, nil)), Options{})
+
+	lines := "[pid 9999991] 1730709070.467006 execve(\"/usr/bin/ls\", [\"ls\", \"-l\"], 0x557bf130cb90 /* 5 vars */ <unfinished ...>\n" +
+		"[pid 9999992] 1730709070.467100 +++ exited with 0 +++\n" +
+		"[pid 9999991] 1730709070.467200 <... execve resumed>) = 0\n"
+	if _, err := s.Write([]byte(lines)); err != nil {
+		t.Fatal(err)
+	}
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("expected a single record, got %s", buf.String())
+	}
+	if record["process.pid"] != float64(9999991) || record["process.command_line"] != "ls -l" {
+		t.Errorf("unexpected record %v", record)
+	}
+	if record["event.outcome"] != "success" || record["event.provider"] != "strace" {
+		t.Errorf("unexpected record %v", record)
+	}
+	if len(s.pending) != 0 {
+		t.Errorf("pending execve left behind %v", s.pending)
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	args := splitArgs(`3, {sa_family=AF_INET, sin_port=htons(80), sin_addr=inet_addr("1.2.3.4")}, 16`)
+	if len(args) != 3 || args[0] != "3" || args[2] != "16" {
+		t.Errorf("unexpected args %q", args)
+	}
+
+	args = splitArgs(`AT_FDCWD, "a, \"b\"", O_WRONLY|O_CREAT, 0666`)
+	if !slices.Equal(args, []string{"AT_FDCWD", `"a, \"b\""`, "O_WRONLY|O_CREAT", "0666"}) {
+		t.Errorf("unexpected args %q", args)
+	}
+}
+
+func TestParseSockaddr(t *testing.T) {
+	tests := map[string]string{
+		`{sa_family=AF_INET, sin_port=htons(80), sin_addr=inet_addr("1.2.3.4")}`:                                                      "inet 1.2.3.4:80",
+		`{sa_family=AF_INET6, sin6_port=htons(443), sin6_flowinfo=htonl(0), inet_pton(AF_INET6, "::1", &sin6_addr), sin6_scope_id=0}`: "inet6 [::1]:443",
+		`{sa_family=AF_UNIX, sun_path="/var/run/nscd/socket"}`:                                                                        "unix /var/run/nscd/socket",
+		`{sa_family=AF_UNIX, sun_path=@"abstract"}`:                                                                                   "unix @abstract",
+		`{sa_family=AF_NETLINK, nl_pid=0, nl_groups=00000000}`:                                                                        "AF_NETLINK AF_NETLINK",
+	}
+	for in, want := range tests {
+		addr := parseSockaddr(in)
+		if addr == nil {
+			t.Errorf("%s not parsed", in)
+			continue
+		}
+		if got := addr.Family + " " + addr.String(); got != want {
+			t.Errorf("want %s got %s", want, got)
+		}
+	}
+}
+
+func TestStraceSyscallEvent(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{`[pid 10] 1.5 openat(AT_FDCWD, "/tmp/out", O_WRONLY|O_CREAT|O_TRUNC, 0666) = 3`, "openat /tmp/out  O_WRONLY|O_CREAT|O_TRUNC 3"},
+		{`[pid 10] 1.5 openat(AT_FDCWD, "/etc/passwd", O_RDONLY|O_CLOEXEC) = 3`, ""},
+		{`[pid 10] 1.5 unlinkat(AT_FDCWD, "/tmp/d", AT_REMOVEDIR) = -1 ENOTEMPTY (Directory not empty)`, "unlinkat /tmp/d  AT_REMOVEDIR -39"},
+		{`[pid 10] 1.5 renameat2(AT_FDCWD, "/tmp/a", AT_FDCWD, "/tmp/b", RENAME_NOREPLACE) = 0`, "renameat2 /tmp/a /tmp/b  0"},
+		{`[pid 10] 1.5 connect(3, {sa_family=AF_INET, sin_port=htons(22), sin_addr=inet_addr("10.0.0.1")}, 16) = -1 EINPROGRESS (Operation now in progress)`, "connect 10.0.0.1:22   -115"},
+	}
+	for _, test := range tests {
+		call, err := parse(test.line)
+		if err != nil {
+			t.Fatalf("%s: %s", test.line, err)
+		}
+		e, ok, err := call.SyscallEvent()
+		if err != nil {
+			t.Fatalf("%s: %s", test.line, err)
+		}
+
+		got := ""
+		if ok {
+			target := e.Path
+			if e.Addr != nil {
+				target = e.Addr.String()
+			}
+			got = fmt.Sprintf("%s %s %s %s %d", e.Syscall, target, e.TargetPath, e.Flags, e.Result)
+		}
+		if got != test.want {
+			t.Errorf("want %q got %q", test.want, got)
+		}
+	}
+}
+
+func TestStraceLoggerSyscalls(t *testing.T) {
+	var buf syncBuffer
+	s := NewStraceLogger(slog.New(slog.NewJSONHandler(&buf, nil)), Options{Classes: []string{ClassConnect}})
+
+	lines := "[pid 9999991] 1730709070.467006 connect(3, {sa_family=AF_UNIX, sun_path=\"/run/x\"}, 110 <unfinished ...>\n" +
+		"[pid 9999991] 1730709070.467200 <... connect resumed>) = 0\n" +
+		"[pid 9999991] 1730709070.467300 bind(3, {sa_family=AF_INET, sin_port=htons(80), sin_addr=inet_addr(\"0.0.0.0\")}, 16) = 0\n"
+	if _, err := s.Write([]byte(lines)); err != nil {
+		t.Fatal(err)
+	}
+
+	records := buf.records(t)
+	if len(records) != 1 || records[0]["destination.address"] != "/run/x" {
+		t.Errorf("only the connect should be logged, got %v", records)
+	}
+}
+
+func TestStraceLoggerTree(t *testing.T) {
+	var buf syncBuffer
+	s := NewStraceLogger(slog.New(slog.NewJSONHandler(&buf, nil)), Options{})
+	s.pid = 9999990
+	s.tree.SetRoot(s.pid)
+
+	lines := "1730709070.400000 clone(child_stack=NULL, flags=CLONE_CHILD_CLEARTID|CLONE_CHILD_SETTID|SIGCHLD <unfinished ...>\n" +
+		"[pid 9999991] 1730709070.400100 execve(\"/bin/true\", [\"true\", \"x\"], 0x5637 /* 3 vars */ <unfinished ...>\n" +
+		"[pid 9999990] 1730709070.400200 <... clone resumed>, child_tidptr=0x7f) = 9999991\n" +
+		"[pid 9999991] 1730709070.400300 <... execve resumed>) = 0\n" +
+		"[pid 9999991] 1730709070.400400 clone3({flags=CLONE_VM|CLONE_THREAD|CLONE_SIGHAND, exit_signal=0}, 88) = 9999992\n" +
+		"[pid 9999992] 1730709070.400500 +++ exited with 0 +++\n" +
+		"[pid 9999991] 1730709070.400600 +++ killed by SIGTERM +++\n" +
+		"1730709070.500000 +++ exited with 3 +++\n"
+	if _, err := s.Write([]byte(lines)); err != nil {
+		t.Fatal(err)
+	}
+
+	roots := s.Tree().Roots()
+	if len(roots) != 1 || roots[0].ExitCode == nil || *roots[0].ExitCode != 3 {
+		t.Fatalf("unexpected tree %+v", roots)
+	}
+	if len(roots[0].Children) != 1 {
+		t.Fatalf("threads shouldn't be in the tree %+v", roots[0].Children)
+	}
+	child := roots[0].Children[0]
+	if child.Pid != 9999991 || child.Executable != "/bin/true" || child.Signal != "SIGTERM" {
+		t.Errorf("unexpected child %+v", child)
+	}
+	if !child.Started.Equal(time.Unix(1730709070, 400000000)) {
+		t.Errorf("unexpected start %s", child.Started)
+	}
+}
@@ -0,0 +1,462 @@
+package strace
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"webshell/policy"
+)
+
+// Classes of syscalls that can be audited as well as execve, each is enabled on its own.
+const (
+	ClassOpen    = "open"    // openat, only when opening for writing
+	ClassUnlink  = "unlink"  // unlinkat
+	ClassRename  = "rename"  // renameat and renameat2
+	ClassConnect = "connect" // connect
+	ClassBind    = "bind"    // bind
+)
+
+// The syscalls in each class.
+var syscallClasses = map[string][]string{
+	ClassOpen:    {"openat"},
+	ClassUnlink:  {"unlinkat"},
+	ClassRename:  {"renameat", "renameat2"},
+	ClassConnect: {"connect"},
+	ClassBind:    {"bind"},
+}
+
+// The 32-bit syscalls in each class, which the ptrace tracer logs without
+// reading their arguments from memory.
+var compatClasses = map[string][]string{
+	ClassOpen:    {"open", "creat", "openat"},
+	ClassUnlink:  {"unlink", "unlinkat"},
+	ClassRename:  {"rename", "renameat", "renameat2"},
+	ClassConnect: {"connect"},
+	ClassBind:    {"bind"},
+}
+
+// The calls socketcall, the 32-bit x86 syscall for every socket call, makes
+// in the audited classes, by its first argument.
+var socketcalls = map[uint64]string{
+	2: "bind",
+	3: "connect",
+}
+
+// Options configures what a tracer audits besides execve.
+type Options struct {
+	Classes   []string       // Syscall classes to audit
+	RateLimit int            // Max events per second of each class, 0 is unlimited
+	Policy    *policy.Policy // Commands to block, only the ptrace tracer enforces it
+}
+
+// ValidateClasses checks every class is one that can be audited.
+func ValidateClasses(classes []string) error {
+	for _, c := range classes {
+		if _, ok := syscallClasses[c]; !ok {
+			return fmt.Errorf("unknown syscall class %q", c)
+		}
+	}
+	return nil
+}
+
+// Returns the names of the syscalls in the enabled classes.
+func (o Options) syscalls() []string {
+	names := []string{}
+	for _, c := range o.Classes {
+		names = append(names, syscallClasses[c]...)
+	}
+	return names
+}
+
+// Returns the names of the 32-bit syscalls in the enabled classes.
+func (o Options) compatSyscalls() []string {
+	names := []string{}
+	for _, c := range o.Classes {
+		names = append(names, compatClasses[c]...)
+	}
+	return names
+}
+
+// Returns the class a syscall belongs to.
+func classOf(name string) string {
+	for class, names := range syscallClasses {
+		if slices.Contains(names, name) {
+			return class
+		}
+	}
+	for class, names := range compatClasses {
+		if slices.Contains(names, name) {
+			return class
+		}
+	}
+	return ""
+}
+
+// Makes a path relative to dirfd absolute, looking up the directory in /proc.
+func resolvePath(pid int, dirfd int, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	link := fmt.Sprintf("/proc/%d/cwd", pid)
+	if dirfd != atFdcwd {
+		link = fmt.Sprintf("/proc/%d/fd/%d", pid, dirfd)
+	}
+	dir, err := os.Readlink(link)
+	if err != nil {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// SyscallEvent is a file or network syscall made by a traced process.
+type SyscallEvent struct {
+	Pid        int       `json:"pid"`
+	Timestamp  time.Time `json:"timestamp"`
+	Syscall    string    `json:"syscall"`
+	Path       string    `json:"path,omitempty"`
+	TargetPath string    `json:"target_path,omitempty"` // Where a file was renamed to
+	Flags      string    `json:"flags,omitempty"`
+	Addr       *SockAddr `json:"addr,omitempty"`
+	Result     int       `json:"result"`             // Negated errno on failure
+	Unparsed   bool      `json:"unparsed,omitempty"` // A 32-bit syscall, whose path or address wasn't read
+}
+
+// Failure returns why the syscall failed, or an empty string if it succeeded.
+func (e SyscallEvent) Failure() string {
+	if e.Result >= 0 {
+		return ""
+	}
+	return syscall.Errno(-e.Result).Error()
+}
+
+// SockAddr is a decoded socket address.
+type SockAddr struct {
+	Family  string `json:"family"`            // inet, inet6, unix, or the AF_ name or number of anything else
+	Address string `json:"address,omitempty"` // IP address, or socket path. Abstract unix sockets start with @
+	Port    int    `json:"port,omitempty"`
+}
+
+func (a SockAddr) String() string {
+	if a.isIP() {
+		if addr, err := netip.ParseAddr(a.Address); err == nil {
+			return netip.AddrPortFrom(addr, uint16(a.Port)).String()
+		}
+	}
+	if a.Address != "" {
+		return a.Address
+	}
+	return a.Family
+}
+
+func (a SockAddr) isIP() bool {
+	return a.Family == "inet" || a.Family == "inet6"
+}
+
+// The ECS network.type of the address.
+func (a SockAddr) networkType() string {
+	switch a.Family {
+	case "inet":
+		return "ipv4"
+	case "inet6":
+		return "ipv6"
+	}
+	return a.Family
+}
+
+// Decodes a struct sockaddr as read from the tracee's memory.
+func decodeSockaddr(b []byte) *SockAddr {
+	if len(b) < 2 {
+		return nil
+	}
+
+	family := binary.LittleEndian.Uint16(b)
+	switch family {
+	case syscall.AF_INET:
+		if len(b) < 8 {
+			break
+		}
+		return &SockAddr{
+			Family:  "inet",
+			Port:    int(binary.BigEndian.Uint16(b[2:])),
+			Address: netip.AddrFrom4([4]byte(b[4:8])).String(),
+		}
+	case syscall.AF_INET6:
+		if len(b) < 24 {
+			break
+		}
+		return &SockAddr{
+			Family:  "inet6",
+			Port:    int(binary.BigEndian.Uint16(b[2:])),
+			Address: netip.AddrFrom16([16]byte(b[8:24])).String(),
+		}
+	case syscall.AF_UNIX:
+		path := b[2:]
+		abstract := len(path) > 0 && path[0] == 0
+		if abstract {
+			return &SockAddr{Family: "unix", Address: "@" + string(path[1:])}
+		}
+		if i := slices.Index(path, 0); i >= 0 {
+			path = path[:i]
+		}
+		return &SockAddr{Family: "unix", Address: string(path)}
+	}
+	return &SockAddr{Family: "AF_" + strconv.Itoa(int(family))}
+}
+
+// Open flags that are logged, in the order strace prints them.
+var openFlags = []struct {
+	flag int
+	name string
+}{
+	{syscall.O_CREAT, "O_CREAT"},
+	{syscall.O_EXCL, "O_EXCL"},
+	{syscall.O_NOCTTY, "O_NOCTTY"},
+	{syscall.O_TRUNC, "O_TRUNC"},
+	{syscall.O_APPEND, "O_APPEND"},
+	{syscall.O_NONBLOCK, "O_NONBLOCK"},
+	{syscall.O_DIRECTORY, "O_DIRECTORY"},
+	{syscall.O_NOFOLLOW, "O_NOFOLLOW"},
+	{syscall.O_CLOEXEC, "O_CLOEXEC"},
+}
+
+// Formats open flags the same way strace does, e.g. O_WRONLY|O_CREAT|O_TRUNC.
+func openFlagNames(flags int) string {
+	names := []string{}
+	switch flags & syscall.O_ACCMODE {
+	case syscall.O_RDONLY:
+		names = append(names, "O_RDONLY")
+	case syscall.O_WRONLY:
+		names = append(names, "O_WRONLY")
+	case syscall.O_RDWR:
+		names = append(names, "O_RDWR")
+	}
+	for _, f := range openFlags {
+		if flags&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// Reports whether open flags, formatted by openFlagNames or strace, can change the file.
+func opensForWrite(flags string) bool {
+	for _, name := range strings.Split(flags, "|") {
+		switch name {
+		case "O_WRONLY", "O_RDWR", "O_CREAT", "O_TRUNC":
+			return true
+		}
+	}
+	return false
+}
+
+// Devices shells open for writing all the time, which would drown out everything else.
+var ignoredDevices = []string{"/dev/null", "/dev/zero", "/dev/tty", "/dev/ptmx", "/dev/pts/"}
+
+func ignoredDevice(path string) bool {
+	for _, dev := range ignoredDevices {
+		if path == dev || (strings.HasSuffix(dev, "/") && strings.HasPrefix(path, dev)) {
+			return true
+		}
+	}
+	return false
+}
+
+// syscallLogger writes syscall events to the audit log, rate limiting each
+// class separately so a busy session can't flood it.
+type syscallLogger struct {
+	logger   *slog.Logger
+	provider string
+	rate     int
+
+	mu       sync.Mutex
+	limiters map[string]*rateLimiter
+}
+
+func newSyscallLogger(logger *slog.Logger, provider string, rate int) *syscallLogger {
+	return &syscallLogger{
+		logger:   logger,
+		provider: provider,
+		rate:     rate,
+		limiters: map[string]*rateLimiter{},
+	}
+}
+
+func (l *syscallLogger) log(e SyscallEvent) {
+	class := classOf(e.Syscall)
+	if class == ClassOpen && ignoredDevice(e.Path) {
+		return
+	}
+
+	l.mu.Lock()
+	if l.rate > 0 {
+		limiter, ok := l.limiters[class]
+		if !ok {
+			limiter = newRateLimiter(l.rate)
+			l.limiters[class] = limiter
+		}
+		if !limiter.allow(time.Now()) {
+			l.mu.Unlock()
+			return
+		}
+		if limiter.dropped > 0 {
+			l.logDropped(class, limiter.dropped)
+			limiter.dropped = 0
+		}
+	}
+	l.mu.Unlock()
+
+	logSyscall(l.logger, e, l.provider)
+}
+
+// Logs how many events were dropped since the last one that was allowed.
+func (l *syscallLogger) flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for class, limiter := range l.limiters {
+		if limiter.dropped > 0 {
+			l.logDropped(class, limiter.dropped)
+			limiter.dropped = 0
+		}
+	}
+}
+
+func (l *syscallLogger) logDropped(class string, count int) {
+	l.logger.Warn(fmt.Sprintf("Audit: %d %s events dropped by the rate limit", count, class),
+		slog.String("event.kind", "event"),
+		slog.String("event.action", "rate-limited"),
+		slog.String("event.provider", l.provider),
+		slog.String("webshell.audit.class", class),
+		slog.Int("webshell.audit.dropped", count),
+	)
+}
+
+// A token bucket allowing rate events a second, with bursts of up to a second's worth.
+type rateLimiter struct {
+	rate    float64
+	tokens  float64
+	last    time.Time
+	dropped int
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate)}
+}
+
+func (r *rateLimiter) allow(now time.Time) bool {
+	if !r.last.IsZero() {
+		r.tokens = min(r.rate, r.tokens+now.Sub(r.last).Seconds()*r.rate)
+	}
+	r.last = now
+
+	if r.tokens < 1 {
+		r.dropped++
+		return false
+	}
+	r.tokens--
+	return true
+}
+
+// Logs a file or network syscall as an ECS event.
+func logSyscall(logger *slog.Logger, e SyscallEvent, provider string) {
+	class := classOf(e.Syscall)
+
+	outcome := "success"
+	if e.Result < 0 {
+		outcome = "failure"
+	}
+	// A non-blocking connect carries on in the background, whether it worked isn't known.
+	if e.Result == -int(syscall.EINPROGRESS) {
+		outcome = "unknown"
+	}
+
+	attrs := []slog.Attr{
+		slog.String("event.kind", "event"),
+		slog.String("event.action", e.Syscall),
+		slog.String("event.outcome", outcome),
+		slog.String("event.provider", provider),
+		slog.String("webshell.audit.class", class),
+		slog.Int("process.pid", e.Pid),
+	}
+	if e.Unparsed {
+		attrs = append(attrs, slog.Bool("webshell.audit.unparsed", true))
+	}
+
+	target := e.Path
+	if e.Unparsed {
+		target = "(32-bit, arguments not read)"
+	}
+	switch class {
+	case ClassOpen, ClassUnlink, ClassRename:
+		eventType := "change"
+		if class == ClassUnlink {
+			eventType = "deletion"
+		}
+		attrs = append(attrs,
+			slog.Any("event.category", []string{"file"}),
+			slog.Any("event.type", []string{eventType}),
+		)
+		if !e.Unparsed {
+			attrs = append(attrs, slog.String("file.path", e.Path))
+		}
+		if e.TargetPath != "" {
+			attrs = append(attrs, slog.String("webshell.file.new_path", e.TargetPath))
+			target += " -> " + e.TargetPath
+		}
+		if e.Flags != "" {
+			attrs = append(attrs, slog.String("webshell.file.flags", e.Flags))
+		}
+
+	case ClassConnect, ClassBind:
+		// Connections are to the destination, bound addresses are where they'll come from.
+		eventType, side := []string{"connection", "start"}, "destination"
+		if class == ClassBind {
+			eventType, side = []string{"start"}, "source"
+		}
+		attrs = append(attrs,
+			slog.Any("event.category", []string{"network"}),
+			slog.Any("event.type", eventType),
+		)
+		if e.Addr != nil {
+			target = e.Addr.String()
+			attrs = append(attrs,
+				slog.String("network.type", e.Addr.networkType()),
+				slog.String(side+".address", e.Addr.Address),
+			)
+			if e.Addr.isIP() {
+				attrs = append(attrs,
+					slog.String(side+".ip", e.Addr.Address),
+					slog.Int(side+".port", e.Addr.Port),
+				)
+			}
+		}
+	}
+
+	if e.Result < 0 {
+		attrs = append(attrs,
+			slog.String("error.code", strconv.Itoa(-e.Result)),
+			slog.String("error.message", e.Failure()),
+		)
+	}
+
+	msg := fmt.Sprintf("Audit: [PID %d] %s %s", e.Pid, e.Syscall, target)
+	if e.Result < 0 {
+		msg += " = " + e.Failure()
+	}
+
+	record := slog.NewRecord(e.Timestamp, slog.LevelInfo, msg, 0)
+	record.AddAttrs(attrs...)
+	if err := logger.Handler().Handle(context.Background(), record); err != nil {
+		logger.Error(fmt.Sprintf("Failed to log %s: %s", e.Syscall, err))
+	}
+}
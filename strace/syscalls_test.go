@@ -0,0 +1,125 @@
+package strace
+
+import (
+	"encoding/json"
+	"log/slog"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDecodeSockaddr(t *testing.T) {
+	tests := []struct {
+		in   []byte
+		want string
+	}{
+		{[]byte{2, 0, 0x1f, 0x90, 127, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0}, "inet 127.0.0.1:8080"},
+		{append([]byte{10, 0, 0x01, 0xbb, 0, 0, 0, 0}, append(make([]byte, 15), 1, 0, 0, 0, 0)...), "inet6 [::1]:443"},
+		{append([]byte{1, 0}, "/run/x.sock\x00junk"...), "unix /run/x.sock"},
+		{append([]byte{1, 0, 0}, "abstract"...), "unix @abstract"},
+		{[]byte{16, 0, 0, 0}, "AF_16 AF_16"},
+	}
+	for _, test := range tests {
+		addr := decodeSockaddr(test.in)
+		if addr == nil {
+			t.Errorf("%v not decoded", test.in)
+			continue
+		}
+		if got := addr.Family + " " + addr.String(); got != test.want {
+			t.Errorf("want %s got %s", test.want, got)
+		}
+	}
+
+	if decodeSockaddr([]byte{2}) != nil {
+		t.Error("truncated address should be rejected")
+	}
+}
+
+func TestOpenFlags(t *testing.T) {
+	tests := []struct {
+		flags int
+		names string
+		write bool
+	}{
+		{syscall.O_RDONLY | syscall.O_CLOEXEC, "O_RDONLY|O_CLOEXEC", false},
+		{syscall.O_WRONLY | syscall.O_CREAT | syscall.O_TRUNC, "O_WRONLY|O_CREAT|O_TRUNC", true},
+		{syscall.O_RDWR, "O_RDWR", true},
+		{syscall.O_RDONLY | syscall.O_CREAT, "O_RDONLY|O_CREAT", true},
+	}
+	for _, test := range tests {
+		names := openFlagNames(test.flags)
+		if names != test.names {
+			t.Errorf("want %s got %s", test.names, names)
+		}
+		if opensForWrite(names) != test.write {
+			t.Errorf("%s: want write %t", names, test.write)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	r := newRateLimiter(2)
+	now := time.Now()
+
+	if !r.allow(now) || !r.allow(now) || r.allow(now) {
+		t.Error("burst should be limited to the rate")
+	}
+	if r.dropped != 1 {
+		t.Errorf("want 1 dropped got %d", r.dropped)
+	}
+	if !r.allow(now.Add(500 * time.Millisecond)) {
+		t.Error("tokens should refill over time")
+	}
+}
+
+func TestSyscallLoggerRateLimit(t *testing.T) {
+	var buf syncBuffer
+	l := newSyscallLogger(slog.New(slog.NewJSONHandler(&buf, nil)), "ptrace", 5)
+
+	for i := 0; i < 10; i++ {
+		l.log(SyscallEvent{Syscall: "unlinkat", Path: "/tmp/x"})
+	}
+	// Each class has its own limit.
+	l.log(SyscallEvent{Syscall: "connect", Addr: &SockAddr{Family: "inet", Address: "10.0.0.1", Port: 22}})
+	l.flush()
+
+	counts := map[string]int{}
+	for _, r := range buf.records(t) {
+		counts[r["event.action"].(string)]++
+		if r["event.action"] == "rate-limited" && r["webshell.audit.dropped"] != float64(5) {
+			t.Errorf("unexpected drop count %v", r)
+		}
+	}
+	if counts["unlinkat"] != 5 || counts["connect"] != 1 || counts["rate-limited"] != 1 {
+		t.Errorf("unexpected events %v", counts)
+	}
+}
+
+func TestLogSyscall(t *testing.T) {
+	var buf syncBuffer
+	logSyscall(slog.New(slog.NewJSONHandler(&buf, nil)), SyscallEvent{
+		Pid:     10,
+		Syscall: "connect",
+		Addr:    &SockAddr{Family: "inet6", Address: "2001:db8::1", Port: 443},
+		Result:  -int(syscall.EINPROGRESS),
+	}, "strace")
+
+	records := buf.records(t)
+	if len(records) != 1 {
+		t.Fatalf("want 1 record got %d", len(records))
+	}
+	r := records[0]
+	want := map[string]any{
+		"event.outcome":        "unknown",
+		"network.type":         "ipv6",
+		"destination.ip":       "2001:db8::1",
+		"destination.port":     float64(443),
+		"webshell.audit.class": "connect",
+	}
+	for k, v := range want {
+		if r[k] != v {
+			got, _ := json.Marshal(r)
+			t.Errorf("%s: want %v in %s", k, v, got)
+		}
+	}
+}
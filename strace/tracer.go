@@ -0,0 +1,228 @@
+package strace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A Tracer audits the commands run by a process and everything it starts.
+type Tracer interface {
+	// Attach starts tracing pid, it returns once the tracer is attached.
+	Attach(pid int) error
+	// Done is closed when the tracer stops, either because everything it
+	// traced has exited, or because it died.
+	Done() <-chan struct{}
+	// Err is why the tracer stopped, once Done is closed.
+	Err() error
+	// Close detaches the tracer and waits for it to exit.
+	Close() error
+	// Tree is the processes seen so far.
+	Tree() *ProcessTree
+	// Execs receives the execs seen, including those the policy blocked.
+	Execs() <-chan ExecEvent
+}
+
+var errTracerExited = errors.New("tracer exited")
+
+// How long Close waits for a tracer to exit before killing it.
+const tracerCloseTimeout = 5 * time.Second
+
+// tracerProcess supervises the process doing the tracing, so its exit is
+// noticed and it's always reaped.
+type tracerProcess struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+	err  error
+}
+
+func newTracerProcess(cmd *exec.Cmd) *tracerProcess {
+	return &tracerProcess{cmd: cmd, done: make(chan struct{})}
+}
+
+// Reaps the tracer once it exits, then calls exited, if set, before Done is
+// closed. Only called once, after it's started.
+func (p *tracerProcess) wait(exited func()) {
+	p.err = p.cmd.Wait()
+	if exited != nil {
+		exited()
+	}
+	close(p.done)
+}
+
+func (p *tracerProcess) Done() <-chan struct{} {
+	return p.done
+}
+
+func (p *tracerProcess) Err() error {
+	select {
+	case <-p.done:
+		if p.err == nil {
+			return errTracerExited
+		}
+		return p.err
+	default:
+		return nil
+	}
+}
+
+// Close stops the tracer with SIGTERM, which detaches it from everything it's
+// tracing, then SIGKILL if it doesn't exit in time.
+func (p *tracerProcess) Close() error {
+	select {
+	case <-p.done:
+		return nil
+	default:
+	}
+
+	if err := p.cmd.Process.Signal(syscall.SIGTERM); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return err
+	}
+	select {
+	case <-p.done:
+		return nil
+	case <-time.After(tracerCloseTimeout):
+	}
+
+	if err := p.cmd.Process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return err
+	}
+	<-p.done
+	return nil
+}
+
+// Returns the pid of the process tracing pid, or 0 if it isn't being traced.
+func tracerPid(pid int) int {
+	status, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if value, ok := strings.CutPrefix(line, "TracerPid:"); ok {
+			tracer, _ := strconv.Atoi(strings.TrimSpace(value))
+			return tracer
+		}
+	}
+	return 0
+}
+
+// How many execs are queued for Execs before more are dropped, they're
+// audited either way.
+const execQueueSize = 256
+
+// execQueue passes the execs a tracer sees on to the server.
+type execQueue struct {
+	execs chan ExecEvent
+}
+
+func newExecQueue() execQueue {
+	return execQueue{execs: make(chan ExecEvent, execQueueSize)}
+}
+
+func (q execQueue) Execs() <-chan ExecEvent {
+	return q.execs
+}
+
+// Never blocks the tracer, execs are dropped when nothing is receiving them.
+func (q execQueue) send(e ExecEvent) {
+	select {
+	case q.execs <- e:
+	default:
+	}
+}
+
+// ExecEvent is a single execve made by a traced process.
+type ExecEvent struct {
+	Pid        int       `json:"pid"`
+	PPid       int       `json:"ppid"`
+	Timestamp  time.Time `json:"timestamp"`
+	Executable string    `json:"executable"`
+	Argv       []string  `json:"argv"`
+	EnvCount   int       `json:"env_count"`
+	Cwd        string    `json:"cwd"`
+	Uid        int       `json:"uid"`
+	Gid        int       `json:"gid"`
+	Result     int       `json:"result"`         // 0 on success, otherwise the negated errno
+	Rule       string    `json:"rule,omitempty"` // The policy rule that blocked it
+}
+
+// Failure returns why the execve failed, or an empty string if it succeeded.
+func (e ExecEvent) Failure() string {
+	if e.Result >= 0 {
+		return ""
+	}
+	return syscall.Errno(-e.Result).Error()
+}
+
+// Fills in the details of the process from /proc. Best effort, the process may already have exited.
+func (e *ExecEvent) readProcess() {
+	e.Cwd, _ = os.Readlink(fmt.Sprintf("/proc/%d/cwd", e.Pid))
+	e.PPid, e.Uid, e.Gid = readStatus(e.Pid)
+}
+
+// Logs an exec as an ECS process event. provider is the tracer that saw it.
+func logExec(logger *slog.Logger, e ExecEvent, provider string, extra ...slog.Attr) {
+	outcome := "success"
+	if e.Result < 0 {
+		outcome = "failure"
+	}
+	action, level := "exec", slog.LevelInfo
+	if e.Rule != "" {
+		action, level = "exec-blocked", slog.LevelWarn
+	}
+
+	attrs := []slog.Attr{
+		slog.String("event.kind", "event"),
+		slog.Any("event.category", []string{"process"}),
+		slog.Any("event.type", []string{"start"}),
+		slog.String("event.action", action),
+		slog.String("event.outcome", outcome),
+		slog.String("event.provider", provider),
+		slog.Int("process.pid", e.Pid),
+		slog.Int("process.parent.pid", e.PPid),
+		slog.String("process.executable", e.Executable),
+		slog.String("process.name", filepath.Base(e.Executable)),
+		slog.Any("process.args", e.Argv),
+		slog.Int("process.args_count", len(e.Argv)),
+		slog.String("process.command_line", strings.Join(e.Argv, " ")),
+		slog.String("process.working_directory", e.Cwd),
+		slog.Time("process.start", e.Timestamp),
+		slog.Int("webshell.exec.env_count", e.EnvCount),
+	}
+	if e.Uid >= 0 {
+		attrs = append(attrs, slog.String("process.user.id", strconv.Itoa(e.Uid)))
+	}
+	if e.Gid >= 0 {
+		attrs = append(attrs, slog.String("process.group.id", strconv.Itoa(e.Gid)))
+	}
+	if e.Result < 0 {
+		attrs = append(attrs,
+			slog.String("error.code", strconv.Itoa(-e.Result)),
+			slog.String("error.message", e.Failure()),
+		)
+	}
+
+	attrs = append(attrs, extra...)
+
+	msg := fmt.Sprintf("Audit: [PID %d] %s", e.Pid, strings.Join(e.Argv, " "))
+	if e.Rule != "" {
+		msg = fmt.Sprintf("Blocked: [PID %d] %s by rule %s", e.Pid, strings.Join(e.Argv, " "), e.Rule)
+	} else if e.Result < 0 {
+		msg += " = " + e.Failure()
+	}
+
+	// Logged with the time of the exec rather than when it was processed.
+	record := slog.NewRecord(e.Timestamp, level, msg, 0)
+	record.AddAttrs(attrs...)
+	if err := logger.Handler().Handle(context.Background(), record); err != nil {
+		logger.Error(fmt.Sprintf("Failed to log exec: %s", err))
+	}
+}
@@ -0,0 +1,60 @@
+package strace
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestTracerProcessClose(t *testing.T) {
+	cmd := exec.Command("sleep", "60")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	p := newTracerProcess(cmd)
+	go p.wait(nil)
+
+	if p.Err() != nil {
+		t.Errorf("running tracer has an error %s", p.Err())
+	}
+
+	start := time.Now()
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > tracerCloseTimeout {
+		t.Error("SIGTERM should have stopped the tracer")
+	}
+
+	select {
+	case <-p.Done():
+	default:
+		t.Error("Done should be closed once the tracer is closed")
+	}
+	if p.Err() == nil {
+		t.Error("stopped tracer should report why")
+	}
+
+	// Closing again is a no-op.
+	if err := p.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTracerProcessExited(t *testing.T) {
+	cmd := exec.Command("true")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	p := newTracerProcess(cmd)
+	go p.wait(nil)
+
+	select {
+	case <-p.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Done wasn't closed after the tracer exited")
+	}
+	if p.Err() != errTracerExited {
+		t.Errorf("want %s got %v", errTracerExited, p.Err())
+	}
+}
@@ -0,0 +1,262 @@
+package strace
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"webshell/procfs"
+)
+
+// ForkEvent is a traced process starting a new process, not a thread.
+type ForkEvent struct {
+	Pid       int       `json:"pid"` // The new process
+	PPid      int       `json:"ppid"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// ExitEvent is a traced process exiting. Tracers that can't see how a process
+// exited leave both ExitCode and Signal unset.
+type ExitEvent struct {
+	Pid       int       `json:"pid"`
+	Timestamp time.Time `json:"timestamp"`
+	ExitCode  *int      `json:"exit_code,omitempty"`
+	Signal    string    `json:"signal,omitempty"` // The signal that killed it, e.g. SIGKILL
+}
+
+// ProcessNode is a process in a ProcessTree. Processes that never exec'd keep
+// the executable and arguments of the parent they were forked from.
+type ProcessNode struct {
+	Pid        int            `json:"pid"`
+	PPid       int            `json:"ppid"`
+	Executable string         `json:"executable"`
+	Argv       []string       `json:"argv"`
+	Cwd        string         `json:"cwd,omitempty"`
+	Exec       bool           `json:"exec"` // Whether it exec'd, rather than only being forked
+	Started    time.Time      `json:"started"`
+	Ended      *time.Time     `json:"ended,omitempty"`
+	ExitCode   *int           `json:"exit_code,omitempty"`
+	Signal     string         `json:"signal,omitempty"`
+	Children   []*ProcessNode `json:"children,omitempty"`
+
+	command []string // What it first exec'd, later execs replace Argv
+}
+
+// Command is a command the user ran, a process the shell started directly.
+type Command struct {
+	Pid         int        `json:"pid"`
+	CommandLine string     `json:"command_line"`
+	Argv        []string   `json:"argv"`
+	Cwd         string     `json:"cwd,omitempty"`
+	Started     time.Time  `json:"started"`
+	Ended       *time.Time `json:"ended,omitempty"`
+	ExitCode    *int       `json:"exit_code,omitempty"`
+	Signal      string     `json:"signal,omitempty"`
+}
+
+// ProcessTree reconstructs which process started which from a tracer's
+// events. Events can arrive out of order, a child's exec can be seen before
+// its parent's fork returns, so processes are linked to their parent
+// whichever comes first.
+type ProcessTree struct {
+	mu      sync.Mutex
+	root    *ProcessNode
+	orphans []*ProcessNode       // Processes whose parent wasn't traced
+	running map[int]*ProcessNode // By pid, pids are reused once a process exits
+}
+
+func NewProcessTree() *ProcessTree {
+	return &ProcessTree{running: map[int]*ProcessNode{}}
+}
+
+// SetRoot adds the traced process, reading its details from /proc.
+func (t *ProcessTree) SetRoot(pid int) {
+	node := &ProcessNode{Pid: pid, Started: time.Now()}
+	node.Argv, _ = procfs.Argv(pid)
+	node.Executable, _ = os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	node.Cwd, _ = os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid))
+	node.PPid, _, _ = readStatus(pid)
+	if boot, err := procfs.BootTime(); err == nil {
+		if stat, err := procfs.ReadStat(pid); err == nil {
+			node.Started = stat.Started(boot)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.root = node
+	t.running[pid] = node
+}
+
+// Fork adds a new process.
+func (t *ProcessTree) Fork(e ForkEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	node, ok := t.running[e.Pid]
+	if !ok {
+		node = &ProcessNode{Pid: e.Pid, Started: e.Timestamp}
+		t.running[e.Pid] = node
+	} else if e.Timestamp.Before(node.Started) {
+		node.Started = e.Timestamp
+	}
+	if !node.Exec {
+		if parent, ok := t.running[e.PPid]; ok {
+			node.Executable, node.Argv, node.Cwd = parent.Executable, parent.Argv, parent.Cwd
+		}
+	}
+	t.link(node, e.PPid)
+}
+
+// Exec records a process replacing its image. Failed execs are ignored.
+func (t *ProcessTree) Exec(e ExecEvent) {
+	if e.Result < 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	node, ok := t.running[e.Pid]
+	if !ok {
+		node = &ProcessNode{Pid: e.Pid, Started: e.Timestamp}
+		t.running[e.Pid] = node
+	}
+	if !node.Exec {
+		node.command = e.Argv
+	}
+	node.Exec = true
+	node.Executable, node.Argv = e.Executable, e.Argv
+	if e.Cwd != "" {
+		node.Cwd = e.Cwd
+	}
+	t.link(node, e.PPid)
+}
+
+// Exit records a process exiting. Exits of processes that weren't seen starting are ignored.
+func (t *ProcessTree) Exit(e ExitEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	node, ok := t.running[e.Pid]
+	if !ok {
+		return
+	}
+	delete(t.running, e.Pid)
+
+	ended := e.Timestamp
+	node.Ended = &ended
+	node.ExitCode = e.ExitCode
+	node.Signal = e.Signal
+}
+
+// Adds node to its parent's children, if it hasn't been already. Called with t.mu held.
+func (t *ProcessTree) link(node *ProcessNode, ppid int) {
+	if node == t.root || node.PPid != 0 || ppid == 0 {
+		return
+	}
+	node.PPid = ppid
+
+	if parent, ok := t.running[ppid]; ok {
+		parent.Children = append(parent.Children, node)
+	} else {
+		t.orphans = append(t.orphans, node)
+	}
+}
+
+// Roots returns a copy of the tree, the traced process followed by any
+// processes whose parent wasn't seen.
+func (t *ProcessTree) Roots() []*ProcessNode {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	roots := []*ProcessNode{}
+	if t.root != nil {
+		roots = append(roots, t.root.copy())
+	}
+	for _, node := range t.orphans {
+		roots = append(roots, node.copy())
+	}
+	return roots
+}
+
+func (n *ProcessNode) copy() *ProcessNode {
+	c := *n
+	c.Children = nil
+	for _, child := range n.Children {
+		c.Children = append(c.Children, child.copy())
+	}
+	return &c
+}
+
+// Commands returns the commands the shell ran directly, in the order they
+// started. Subshells the shell forked without exec'ing are looked through,
+// so the commands in a pipeline or ( ... ) are all included.
+func (t *ProcessTree) Commands() []Command {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	commands := []Command{}
+	if t.root == nil {
+		return commands
+	}
+
+	var walk func(children []*ProcessNode)
+	walk = func(children []*ProcessNode) {
+		for _, node := range children {
+			if !node.Exec {
+				walk(node.Children)
+				continue
+			}
+			commands = append(commands, Command{
+				Pid:         node.Pid,
+				CommandLine: strings.Join(node.command, " "),
+				Argv:        node.command,
+				Cwd:         node.Cwd,
+				Started:     node.Started,
+				Ended:       node.Ended,
+				ExitCode:    node.ExitCode,
+				Signal:      node.Signal,
+			})
+		}
+	}
+	walk(t.root.Children)
+
+	slices.SortStableFunc(commands, func(a, b Command) int {
+		return a.Started.Compare(b.Started)
+	})
+	return commands
+}
+
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGHUP:  "SIGHUP",
+	syscall.SIGINT:  "SIGINT",
+	syscall.SIGQUIT: "SIGQUIT",
+	syscall.SIGILL:  "SIGILL",
+	syscall.SIGTRAP: "SIGTRAP",
+	syscall.SIGABRT: "SIGABRT",
+	syscall.SIGBUS:  "SIGBUS",
+	syscall.SIGFPE:  "SIGFPE",
+	syscall.SIGKILL: "SIGKILL",
+	syscall.SIGUSR1: "SIGUSR1",
+	syscall.SIGSEGV: "SIGSEGV",
+	syscall.SIGUSR2: "SIGUSR2",
+	syscall.SIGPIPE: "SIGPIPE",
+	syscall.SIGALRM: "SIGALRM",
+	syscall.SIGTERM: "SIGTERM",
+	syscall.SIGXCPU: "SIGXCPU",
+	syscall.SIGXFSZ: "SIGXFSZ",
+	syscall.SIGSYS:  "SIGSYS",
+}
+
+// Returns the name of a signal as strace prints it, e.g. SIGKILL.
+func signalName(sig syscall.Signal) string {
+	if name, ok := signalNames[sig]; ok {
+		return name
+	}
+	return fmt.Sprintf("SIG%d", int(sig))
+}
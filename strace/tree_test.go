@@ -0,0 +1,79 @@
+package strace
+
+import (
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestProcessTree(t *testing.T) {
+	tree := NewProcessTree()
+	shell := os.Getpid()
+	tree.SetRoot(shell)
+
+	start := time.Now()
+	at := func(ms int) time.Time { return start.Add(time.Duration(ms) * time.Millisecond) }
+	code := func(c int) *int { return &c }
+
+	// ls, with the exec seen before the fork returns.
+	tree.Exec(ExecEvent{Pid: 100, PPid: shell, Timestamp: at(2), Executable: "/bin/ls", Argv: []string{"ls", "-l"}})
+	tree.Fork(ForkEvent{Pid: 100, PPid: shell, Timestamp: at(1)})
+	tree.Exit(ExitEvent{Pid: 100, Timestamp: at(3), ExitCode: code(0)})
+
+	// A subshell running two commands, one of which re-execs.
+	tree.Fork(ForkEvent{Pid: 101, PPid: shell, Timestamp: at(4)})
+	tree.Fork(ForkEvent{Pid: 102, PPid: 101, Timestamp: at(5)})
+	tree.Exec(ExecEvent{Pid: 102, PPid: 101, Timestamp: at(5), Executable: "/usr/bin/env", Argv: []string{"env", "make"}})
+	tree.Exec(ExecEvent{Pid: 102, PPid: 101, Timestamp: at(6), Executable: "/usr/bin/make", Argv: []string{"make"}})
+	tree.Exec(ExecEvent{Pid: 101, PPid: shell, Timestamp: at(7), Executable: "/bin/nope", Result: -2})
+	tree.Exit(ExitEvent{Pid: 102, Timestamp: at(8), Signal: "SIGKILL"})
+
+	// The pid is reused once the first process exits.
+	tree.Fork(ForkEvent{Pid: 100, PPid: shell, Timestamp: at(9)})
+	tree.Exec(ExecEvent{Pid: 100, PPid: shell, Timestamp: at(9), Executable: "/bin/false", Argv: []string{"false"}})
+	tree.Exit(ExitEvent{Pid: 100, Timestamp: at(10), ExitCode: code(1)})
+
+	// A process whose parent wasn't traced.
+	tree.Exec(ExecEvent{Pid: 200, PPid: 1, Timestamp: at(11), Executable: "/bin/sleep", Argv: []string{"sleep", "1"}})
+
+	roots := tree.Roots()
+	if len(roots) != 2 || roots[0].Pid != shell || roots[1].Pid != 200 {
+		t.Fatalf("unexpected roots %+v", roots)
+	}
+	children := roots[0].Children
+	if len(children) != 3 {
+		t.Fatalf("expected 3 children of the shell, got %+v", children)
+	}
+
+	ls := children[0]
+	if !ls.Started.Equal(at(1)) || !ls.Ended.Equal(at(3)) || *ls.ExitCode != 0 || ls.Executable != "/bin/ls" {
+		t.Errorf("unexpected ls %+v", ls)
+	}
+
+	subshell := children[1]
+	if subshell.Exec || subshell.Executable != roots[0].Executable || subshell.Ended != nil {
+		t.Errorf("subshell should be a copy of the shell %+v", subshell)
+	}
+	if len(subshell.Children) != 1 || subshell.Children[0].Executable != "/usr/bin/make" || subshell.Children[0].Signal != "SIGKILL" {
+		t.Errorf("unexpected subshell children %+v", subshell.Children)
+	}
+
+	commands := tree.Commands()
+	lines := []string{}
+	for _, c := range commands {
+		lines = append(lines, c.CommandLine)
+	}
+	if !slices.Equal(lines, []string{"ls -l", "env make", "false"}) {
+		t.Errorf("unexpected commands %q", lines)
+	}
+	if commands[1].Signal != "SIGKILL" || commands[2].ExitCode == nil || *commands[2].ExitCode != 1 {
+		t.Errorf("unexpected command results %+v", commands)
+	}
+
+	// Roots is a copy, so it doesn't change with the tree.
+	tree.Exit(ExitEvent{Pid: 101, Timestamp: at(12), ExitCode: code(0)})
+	if subshell.Ended != nil {
+		t.Error("copy of the tree was modified")
+	}
+}
@@ -10,8 +10,12 @@ var templateFS embed.FS
 
 // As with assets, templates are embedded in the binary.
 var (
-	errorTemplate  = template.Must(template.ParseFS(templateFS, "templates/error.html"))
-	fileTemplate   = template.Must(template.ParseFS(templateFS, "templates/files.html"))
-	replayTemplate = template.Must(template.ParseFS(templateFS, "templates/replay.html"))
-	termTemplate   = template.Must(template.ParseFS(templateFS, "templates/index.html"))
+	adminTemplate   = template.Must(template.ParseFS(templateFS, "templates/admin.html"))
+	shadowTemplate  = template.Must(template.ParseFS(templateFS, "templates/shadow.html"))
+	errorTemplate   = template.Must(template.ParseFS(templateFS, "templates/error.html"))
+	fileTemplate    = template.Must(template.ParseFS(templateFS, "templates/files.html"))
+	replayTemplate  = template.Must(template.ParseFS(templateFS, "templates/replay.html"))
+	libraryTemplate = template.Must(template.ParseFS(templateFS, "templates/library.html"))
+	reportTemplate  = template.Must(template.New("report.html").Funcs(reportFuncs).ParseFS(templateFS, "templates/report.html"))
+	termTemplate    = template.Must(template.ParseFS(templateFS, "templates/index.html"))
 )
@@ -32,7 +32,7 @@ func NewInactivityTimeout(ctx context.Context, ttl time.Duration) *InactivityTim
 	return &InactivityTimeout{
 		C:          make(chan time.Time, 2),
 		ticker:     time.NewTicker(10 * time.Second), // 2x the client's ping interval
-		shutdown:   func() { os.Exit(0) },
+		shutdown:   func() { idleShutdown(ttl) },
 		ttl:        ttl,
 		lastActive: time.Now(),
 		ctx:        ctx,
@@ -67,3 +67,18 @@ func (ka *InactivityTimeout) Start() {
 func (ka *InactivityTimeout) Ping() {
 	ka.C <- time.Now()
 }
+
+// Ends every session, so they're audited as having timed out, then exits.
+func idleShutdown(idle time.Duration) {
+	wg := sync.WaitGroup{}
+	for _, s := range sessions.List("") {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.IdleTimeout(idle)
+		}()
+	}
+	wg.Wait()
+	closeLogs()
+	os.Exit(0)
+}
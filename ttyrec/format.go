@@ -5,15 +5,19 @@ import (
 )
 
 import (
+	"bytes"
 	"encoding/binary"
 	"io"
 )
 
 const (
 	MAGIC   uint32 = 0xDC3443CD
-	VERSION byte   = 0x01
+	VERSION byte   = 0x02
 )
 
+// Version 1 headers end before the metadata fields.
+const headerSizeV1 = 40
+
 type Header struct {
 	Magic             uint32
 	Version           byte
@@ -24,6 +28,8 @@ type Header struct {
 	AuditLength       int64
 	TimingOffset      int64
 	TimingLength      int64
+	MetadataOffset    int64
+	MetadataLength    int64
 }
 
 type Timing struct {
@@ -32,9 +38,10 @@ type Timing struct {
 }
 
 type TTYRecording struct {
-	Header  Header
-	Audit   *io.SectionReader
-	Timings []Timing
+	Header   Header
+	Audit    *io.SectionReader
+	Timings  []Timing
+	Metadata []byte // JSON describing the session, empty if there is none
 	// TODO: keep ref to underlying file
 }
 
@@ -49,10 +56,22 @@ func Load(r ReaderAtCloser) (*TTYRecording, error) {
 
 	rec := &TTYRecording{}
 	header := Header{}
-	err := binary.Read(r, binary.LittleEndian, &header)
-	if err != nil {
+
+	// Reads enough for the largest header, version 1 headers are checked once the version is known.
+	b := make([]byte, binary.Size(header))
+	n, err := r.ReadAt(b, 0)
+	if n < headerSizeV1 {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 		return nil, err
 	}
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &header); err != nil {
+		return nil, err
+	}
+	if header.Version == 1 {
+		header.MetadataOffset, header.MetadataLength = 0, 0
+	}
 
 	rec.Header = header
 
@@ -60,7 +79,7 @@ func Load(r ReaderAtCloser) (*TTYRecording, error) {
 		return nil, fmt.Errorf("invalid file, invalid header ID %d", rec.Header.Magic)
 	}
 
-	if rec.Header.Version != VERSION {
+	if rec.Header.Version != 1 && rec.Header.Version != VERSION {
 		return nil, fmt.Errorf("unsupport recording version %d", rec.Header.Version)
 	}
 
@@ -84,10 +103,17 @@ func Load(r ReaderAtCloser) (*TTYRecording, error) {
 		})
 	}
 
+	if rec.Header.MetadataOffset > 0 && rec.Header.MetadataLength > 0 {
+		rec.Metadata = make([]byte, rec.Header.MetadataLength)
+		if _, err := r.ReadAt(rec.Metadata, rec.Header.MetadataOffset); err != nil {
+			return nil, err
+		}
+	}
+
 	return rec, nil
 }
 
-func Save(dest io.WriteSeeker, audit io.Reader, timings io.Reader) error {
+func Save(dest io.WriteSeeker, audit io.Reader, timings io.Reader, metadata []byte) error {
 
 	header := Header{
 		Magic:   MAGIC,
@@ -118,6 +144,15 @@ func Save(dest io.WriteSeeker, audit io.Reader, timings io.Reader) error {
 	header.TimingOffset = int64(header.AuditOffset + header.AuditLength)
 	header.TimingLength = w
 
+	// Write the metadata
+	if len(metadata) > 0 {
+		if _, err := dest.Write(metadata); err != nil {
+			return err
+		}
+		header.MetadataOffset = header.TimingOffset + header.TimingLength
+		header.MetadataLength = int64(len(metadata))
+	}
+
 	// Update the header
 	dest.Seek(0, 0)
 	err = binary.Write(dest, binary.LittleEndian, header)
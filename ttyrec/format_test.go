@@ -38,8 +38,10 @@ func TestSaveAndLoad(t *testing.T) {
 
 	timings := bytes.NewReader(bb.Bytes())
 
+	metadata := []byte(`{"id":"abc"}`)
+
 	// Save the tty recording.
-	err = Save(out, audit, timings)
+	err = Save(out, audit, timings, metadata)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -88,4 +90,51 @@ func TestSaveAndLoad(t *testing.T) {
 			)
 		}
 	}
+
+	// Check the metadata matches.
+	if !bytes.Equal(rec.Metadata, metadata) {
+		t.Errorf("metadata want %s got %s", metadata, rec.Metadata)
+	}
+}
+
+func TestLoadVersion1(t *testing.T) {
+	out, err := os.CreateTemp("", "ttyrec.out")
+	if err != nil {
+		t.Fatal("failed to create tmp file")
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	// A version 1 recording has a shorter header, without the metadata fields.
+	auditData := []byte("foo\r\n")
+	timing := Timing{Time: 1, Offset: 0}
+	header := Header{
+		Magic:        MAGIC,
+		Version:      1,
+		AuditOffset:  headerSizeV1,
+		AuditLength:  int64(len(auditData)),
+		TimingOffset: headerSizeV1 + int64(len(auditData)),
+		TimingLength: int64(binary.Size(timing)),
+	}
+	b := &bytes.Buffer{}
+	binary.Write(b, binary.LittleEndian, header)
+	b.Truncate(headerSizeV1)
+	b.Write(auditData)
+	binary.Write(b, binary.LittleEndian, timing)
+	if _, err := out.Write(b.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	rec, err := Load(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recordingFromFile, err := io.ReadAll(rec.Audit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(recordingFromFile, auditData) || len(rec.Timings) != 2 || rec.Metadata != nil {
+		t.Errorf("version 1 recording loaded incorrectly %+v", rec)
+	}
 }
@@ -22,6 +22,7 @@ type Recorder struct {
 	enabled   bool
 	auditDir  string
 	auditFile string
+	metadata  []byte
 }
 
 func NewRecorder(auditDir, auditFile string) (*Recorder, error) {
@@ -53,6 +54,11 @@ func NewRecorder(auditDir, auditFile string) (*Recorder, error) {
 	return rec, nil
 }
 
+// SetMetadata sets the JSON saved with the recording, describing the session.
+func (r *Recorder) SetMetadata(metadata []byte) {
+	r.metadata = metadata
+}
+
 func (r *Recorder) Save() error {
 
 	outfile, err := os.Create(filepath.Join(r.auditDir, r.auditFile))
@@ -74,7 +80,7 @@ func (r *Recorder) Save() error {
 	}
 	defer timeFile.Close()
 
-	return Save(outfile, ttyFile, timeFile)
+	return Save(outfile, ttyFile, timeFile, r.metadata)
 }
 
 func (r Recorder) Close() error {
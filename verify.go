@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"webshell/logging"
+)
+
+// AuditVerify is the subcommand that checks a chained audit log hasn't been tampered with.
+const AuditVerify = "audit-verify"
+
+// Runs the audit-verify subcommand, returning the exit code.
+func runAuditVerify(args []string) int {
+	flags := flag.NewFlagSet(AuditVerify, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s %s [-strict] PUBLIC_KEY [AUDIT_LOG...]\n", filepath.Base(os.Args[0]), AuditVerify)
+		flags.PrintDefaults()
+	}
+	strict := flags.Bool("strict", false, "Report records that aren't part of a chain as problems, for logs with only audit records")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	args = flags.Args()
+	if len(args) < 1 {
+		flags.Usage()
+		return 2
+	}
+	key, err := logging.LoadVerifyingKey(args[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid key: %s\n", err)
+		return 1
+	}
+
+	// Rotated logs are read in the order given, as if they were one file.
+	in := io.Reader(os.Stdin)
+	if len(args) > 1 {
+		readers := []io.Reader{}
+		for _, name := range args[1:] {
+			f, err := os.Open(name)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			defer f.Close()
+			readers = append(readers, f)
+		}
+		in = io.MultiReader(readers...)
+	}
+
+	ok, err := verifyLog(in, key, *strict, os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if !ok {
+		return 1
+	}
+	return 0
+}
+
+// Writes a line to out for each problem with the chained log, returning whether there were none.
+func verifyLog(log io.Reader, key ed25519.PublicKey, strict bool, out io.Writer) (bool, error) {
+	v, err := logging.VerifyChain(log, key, strict)
+	if err != nil {
+		return false, err
+	}
+
+	for _, p := range v.Problems {
+		if p.Chain == "" {
+			fmt.Fprintf(out, "line %d: %s\n", p.Line, p.Message)
+		} else {
+			fmt.Fprintf(out, "line %d: chain %s: %s\n", p.Line, p.Chain, p.Message)
+		}
+	}
+	fmt.Fprintf(out, "%d records in %d chains, %d unchained records, %d signed checkpoints, %d problems\n", v.Records, v.Chains, v.Unchained, v.Checkpoints, len(v.Problems))
+	if v.Records == 0 {
+		fmt.Fprintln(out, "No chained records found, was the log written with -audit-chain-key?")
+		return false, nil
+	}
+	return len(v.Problems) == 0, nil
+}